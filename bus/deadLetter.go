@@ -0,0 +1,63 @@
+package bus
+
+import "github.com/nnset/iot-cloud-connector/events"
+
+// DeadLetterReason Why a message could not be delivered.
+type DeadLetterReason string
+
+const (
+	NoSubscribers DeadLetterReason = "no_subscribers"
+	QueueOverflow DeadLetterReason = "queue_overflow"
+	Expired       DeadLetterReason = "expired"
+	Rejected      DeadLetterReason = "rejected"
+	// Compacted Stored messages removed by retention before a durable subscriber read them,
+	// see DurableSkippedTopic.
+	Compacted DeadLetterReason = "compacted"
+)
+
+// Dead letters are published on the bus dead letter topic, with the original topic and
+// the reason in these headers.
+const (
+	DefaultDeadLetterTopic string = "bus::dead_letters"
+	DeadLetterTopicHeader  string = "dead_letter_topic"
+	DeadLetterReasonHeader string = "dead_letter_reason"
+)
+
+// NewDeadLetter Copies message, adding the dead letter headers. Dead letters never expire,
+// even when the original message did.
+func NewDeadLetter(topic string, message events.Message, reason DeadLetterReason) events.Message {
+	headers := make(map[string]string, len(message.Headers)+2)
+
+	for key, value := range message.Headers {
+		headers[key] = value
+	}
+
+	headers[DeadLetterTopicHeader] = topic
+	headers[DeadLetterReasonHeader] = string(reason)
+	message.Headers = headers
+	message.ExpiresAt = 0
+
+	return message
+}
+
+// ReplayDeadLetter Publishes a dead letter back on its original topic, without the dead
+// letter headers.
+func ReplayDeadLetter(publisher BusPublisher, deadLetter events.Message) error {
+	topic := deadLetter.Header(DeadLetterTopicHeader)
+
+	if err := ValidateTopic(topic); err != nil {
+		return err
+	}
+
+	headers := make(map[string]string, len(deadLetter.Headers))
+
+	for key, value := range deadLetter.Headers {
+		if key != DeadLetterTopicHeader && key != DeadLetterReasonHeader {
+			headers[key] = value
+		}
+	}
+
+	deadLetter.Headers = headers
+
+	return publisher.Publish(topic, deadLetter)
+}
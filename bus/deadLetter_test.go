@@ -0,0 +1,117 @@
+package bus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+func TestUndeliverableMessagesShouldBeDeadLettered(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	deadLetters := make(chan events.Message, 1)
+	eventBus.Subscribe(DefaultDeadLetterTopic, &deadLetters)
+
+	message := events.NewMessage([]byte("4"), "localhost", events.Default)
+	message.SetHeader("origin", "metrics")
+
+	assert.Assert(t, eventBus.Publish("system_metrics::allocated_memory", message) != nil)
+
+	select {
+	case deadLetter := <-deadLetters:
+		assert.Assert(t, deadLetter.ID == message.ID)
+		assert.Assert(t, deadLetter.Header(DeadLetterTopicHeader) == "system_metrics::allocated_memory")
+		assert.Assert(t, deadLetter.Header(DeadLetterReasonHeader) == string(NoSubscribers))
+		assert.Assert(t, deadLetter.Header("origin") == "metrics")
+	case <-time.After(time.Second):
+		t.Fatal("dead letter was not received")
+	}
+
+	assert.Assert(t, eventBus.DeadLettersCount() == 1)
+	assert.Assert(t, message.Header(DeadLetterReasonHeader) == "")
+}
+
+func TestOverflowedMessagesShouldBeDeadLettered(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	deadLetters := make(chan events.Message, 2)
+	eventBus.Subscribe(DefaultDeadLetterTopic, &deadLetters)
+
+	slow := make(chan events.Message)
+	eventBus.SubscribeWithOptions("topic", &slow, SubscriptionOptions{QueueSize: 1, OverflowPolicy: OverflowDropOldest})
+
+	for i := 0; i < 3; i++ {
+		eventBus.Publish("topic", events.NewMessage([]byte{byte(i)}, "", events.Default))
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// First message is waiting on the slow channel, second one was dropped
+	deadLetter := <-deadLetters
+	assert.Assert(t, deadLetter.Payload[0] == 1)
+	assert.Assert(t, deadLetter.Header(DeadLetterReasonHeader) == string(QueueOverflow))
+}
+
+func TestDeadLettersShouldBeReplayedOnTheirTopic(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	eventBus.DeadLetterTopic = ""
+
+	eventBus.Publish("connections::closed", events.NewMessage([]byte("bye"), "", events.Default))
+	assert.Assert(t, eventBus.DeadLettersCount() == 1)
+
+	channel := make(chan events.Message, 1)
+	eventBus.Subscribe("connections::closed", &channel)
+
+	deadLetter := NewDeadLetter("connections::closed", events.NewMessage([]byte("bye"), "", events.Default), NoSubscribers)
+	assert.NilError(t, ReplayDeadLetter(eventBus, deadLetter))
+
+	select {
+	case message := <-channel:
+		assert.Assert(t, string(message.Payload) == "bye")
+		assert.Assert(t, message.Header(DeadLetterTopicHeader) == "")
+	case <-time.After(time.Second):
+		t.Fatal("dead letter was not replayed")
+	}
+
+	assert.Assert(t, ReplayDeadLetter(eventBus, events.NewMessage(nil, "", events.Default)) != nil)
+}
+
+func TestExpiredMessagesShouldBeDeadLettered(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	deadLetters := make(chan events.Message, 2)
+	eventBus.Subscribe(DefaultDeadLetterTopic, &deadLetters)
+
+	slow := make(chan events.Message)
+	eventBus.Subscribe("devices::abc-123::send", &slow)
+
+	expired := events.NewMessage([]byte("valve off"), "", events.Command)
+	expired.SetTTL(-time.Second)
+
+	assert.Assert(t, eventBus.Publish("devices::abc-123::send", expired) == ErrMessageExpired)
+
+	// Expires while waiting in the subscription queue
+	first := events.NewMessage([]byte("valve on"), "", events.Command)
+	late := events.NewMessage([]byte("valve off"), "", events.Command)
+	late.SetTTL(20 * time.Millisecond)
+
+	eventBus.Publish("devices::abc-123::send", first)
+	eventBus.Publish("devices::abc-123::send", late)
+	time.Sleep(40 * time.Millisecond)
+
+	assert.Assert(t, (<-slow).ID == first.ID)
+
+	for _, id := range []string{expired.ID, late.ID} {
+		select {
+		case deadLetter := <-deadLetters:
+			assert.Assert(t, deadLetter.ID == id)
+			assert.Assert(t, deadLetter.Header(DeadLetterReasonHeader) == string(Expired))
+		case <-time.After(time.Second):
+			t.Fatal("dead letter was not received")
+		}
+	}
+
+	select {
+	case <-slow:
+		t.Fatal("expired message must not be delivered")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
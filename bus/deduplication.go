@@ -0,0 +1,181 @@
+package bus
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/events"
+)
+
+const (
+	DefaultDeduplicationWindow     time.Duration = time.Minute
+	DefaultDeduplicationMaxEntries int           = 100000
+
+	// DeduplicationOtherDevices Duplicates key counting the devices beyond MaxEntries, it
+	// is not a valid device ID.
+	DeduplicationOtherDevices string = "*"
+)
+
+// DeduplicationInterceptor Drops published messages already seen within Window on the
+// same topic. Messages are identified by their device and events.SequenceHeader when both
+// are present, by their ID otherwise. Duplicates are not delivered, nor dead lettered, and
+// Publish returns nil as the message was already published. Identifiers are reserved before
+// publishing, so concurrent publishes of the same message deliver it once, and forgotten
+// when publishing fails, so it can be retried.
+//
+// At most MaxEntries identifiers are remembered, the oldest ones are forgotten first. At
+// most MaxEntries devices get their own duplicates count, the rest are counted together
+// under DeduplicationOtherDevices.
+type DeduplicationInterceptor struct {
+	PassThroughInterceptor
+	Window     time.Duration
+	MaxEntries int
+	seen       map[string]*list.Element
+	order      *list.List // Oldest first, elements are *deduplicationEntry
+	duplicates map[string]uint64
+	lock       sync.Mutex
+}
+
+type deduplicationEntry struct {
+	key    string
+	seenAt time.Time
+}
+
+// NewDeduplicationInterceptor Creates a new instance of DeduplicationInterceptor
+func NewDeduplicationInterceptor(window time.Duration, maxEntries int) *DeduplicationInterceptor {
+	if window <= 0 {
+		window = DefaultDeduplicationWindow
+	}
+
+	if maxEntries <= 0 {
+		maxEntries = DefaultDeduplicationMaxEntries
+	}
+
+	return &DeduplicationInterceptor{
+		Window:     window,
+		MaxEntries: maxEntries,
+		seen:       make(map[string]*list.Element),
+		order:      list.New(),
+		duplicates: make(map[string]uint64),
+	}
+}
+
+func (interceptor *DeduplicationInterceptor) InterceptPublish(topic string, message events.Message, next PublishFunc) error {
+	key := deduplicationKey(topic, message)
+
+	if key == "" {
+		return next(topic, message)
+	}
+
+	if !interceptor.reserve(key, message.DeviceID) {
+		return nil
+	}
+
+	if err := next(topic, message); err != nil {
+		interceptor.release(key)
+		return err
+	}
+
+	return nil
+}
+
+// Duplicates Returns a copy of the dropped duplicates count per device, messages not
+// sent by a device are counted under an empty device ID.
+func (interceptor *DeduplicationInterceptor) Duplicates() map[string]uint64 {
+	interceptor.lock.Lock()
+	defer interceptor.lock.Unlock()
+
+	cloned := make(map[string]uint64, len(interceptor.duplicates))
+
+	for k, v := range interceptor.duplicates {
+		cloned[k] = v
+	}
+
+	return cloned
+}
+
+// Remembered Returns how many identifiers are currently remembered.
+func (interceptor *DeduplicationInterceptor) Remembered() int {
+	interceptor.lock.Lock()
+	defer interceptor.lock.Unlock()
+
+	return interceptor.order.Len()
+}
+
+// reserve Records key as seen now unless it was seen within the window, in which case
+// it counts a duplicate for deviceID and returns false. The oldest keys beyond MaxEntries
+// are forgotten.
+func (interceptor *DeduplicationInterceptor) reserve(key string, deviceID string) bool {
+	now := time.Now()
+
+	interceptor.lock.Lock()
+	defer interceptor.lock.Unlock()
+
+	interceptor.forgetExpired(now)
+
+	if _, exists := interceptor.seen[key]; exists {
+		interceptor.countDuplicate(deviceID)
+		return false
+	}
+
+	for interceptor.order.Len() >= interceptor.MaxEntries {
+		interceptor.forget(interceptor.order.Front())
+	}
+
+	interceptor.seen[key] = interceptor.order.PushBack(&deduplicationEntry{key: key, seenAt: now})
+
+	return true
+}
+
+// release Forgets a key reserved for a publish that failed.
+func (interceptor *DeduplicationInterceptor) release(key string) {
+	interceptor.lock.Lock()
+	defer interceptor.lock.Unlock()
+
+	if element, exists := interceptor.seen[key]; exists {
+		interceptor.forget(element)
+	}
+}
+
+// countDuplicate lock must be held by the caller.
+func (interceptor *DeduplicationInterceptor) countDuplicate(deviceID string) {
+	if _, counted := interceptor.duplicates[deviceID]; !counted && len(interceptor.duplicates) >= interceptor.MaxEntries {
+		deviceID = DeduplicationOtherDevices
+	}
+
+	interceptor.duplicates[deviceID]++
+}
+
+// forgetExpired Removes the identifiers seen before the window, as they are stored in
+// order it stops at the first one still inside the window.
+func (interceptor *DeduplicationInterceptor) forgetExpired(now time.Time) {
+	for oldest := interceptor.order.Front(); oldest != nil; oldest = interceptor.order.Front() {
+		if now.Sub(oldest.Value.(*deduplicationEntry).seenAt) < interceptor.Window {
+			return
+		}
+
+		interceptor.forget(oldest)
+	}
+}
+
+func (interceptor *DeduplicationInterceptor) forget(element *list.Element) {
+	delete(interceptor.seen, element.Value.(*deduplicationEntry).key)
+	interceptor.order.Remove(element)
+}
+
+// deduplicationKey Includes topic, the same message may be published on several topics,
+// i.e. forwarded to a device and then on events.MessageSentTopic.
+func deduplicationKey(topic string, message events.Message) string {
+	sequence := message.Header(events.SequenceHeader)
+
+	if message.DeviceID != "" && sequence != "" {
+		return "sequence:" + topic + ":" + message.DeviceID + ":" + sequence
+	}
+
+	if message.ID == "" {
+		return ""
+	}
+
+	return "id:" + topic + ":" + message.ID
+}
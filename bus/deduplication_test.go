@@ -0,0 +1,131 @@
+package bus
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+func TestDeduplicationInterceptorShouldDropRepeatedMessages(t *testing.T) {
+	deduplication := NewDeduplicationInterceptor(time.Minute, 10)
+	inMemory, _ := NewInMemoryEventBus()
+	eventBus := NewInterceptedBus(inMemory, deduplication)
+
+	channel := make(chan events.Message, 10)
+	eventBus.Subscribe("devices::#", &channel)
+
+	message := events.NewDeviceMessage("abc-123", []byte("21"), "", events.Default)
+	assert.NilError(t, eventBus.Publish("devices::abc-123", message))
+	assert.NilError(t, eventBus.Publish("devices::abc-123", message))
+
+	// Retransmissions get a new ID but keep their sequence
+	first := events.NewDeviceMessage("abc-123", []byte("22"), "", events.Default)
+	first.SetHeader(events.SequenceHeader, "7")
+	retransmission := events.NewDeviceMessage("abc-123", []byte("22"), "", events.Default)
+	retransmission.SetHeader(events.SequenceHeader, "7")
+	otherDevice := events.NewDeviceMessage("def-456", []byte("22"), "", events.Default)
+	otherDevice.SetHeader(events.SequenceHeader, "7")
+
+	eventBus.Publish("devices::abc-123", first)
+	eventBus.Publish("devices::abc-123", retransmission)
+	eventBus.Publish("devices::def-456", otherDevice)
+
+	time.Sleep(20 * time.Millisecond)
+
+	assert.Assert(t, len(channel) == 3)
+	assert.DeepEqual(t, deduplication.Duplicates(), map[string]uint64{"abc-123": 2})
+	assert.Assert(t, inMemory.DeadLettersCount() == 0)
+}
+
+func TestDeduplicationInterceptorShouldOnlyDropRepeatedMessagesOnTheSameTopic(t *testing.T) {
+	deduplication := NewDeduplicationInterceptor(time.Minute, 10)
+	inMemory, _ := NewInMemoryEventBus()
+	eventBus := NewInterceptedBus(inMemory, deduplication)
+
+	message := events.NewDeviceMessage("abc-123", []byte("21"), "", events.Default)
+
+	// Nobody subscribed yet, the retry must not be taken for a duplicate
+	assert.Assert(t, eventBus.Publish("devices::abc-123::send", message) != nil)
+
+	sent := make(chan events.Message, 10)
+	eventBus.Subscribe("devices::abc-123::send", &sent)
+	assert.NilError(t, eventBus.Publish("devices::abc-123::send", message))
+
+	// Forwarded messages are published again, with the same ID, on another topic
+	forwarded := make(chan events.Message, 10)
+	eventBus.Subscribe(events.MessageSentTopic, &forwarded)
+	assert.NilError(t, eventBus.Publish(events.MessageSentTopic, message))
+
+	time.Sleep(20 * time.Millisecond)
+
+	assert.Assert(t, len(sent) == 1)
+	assert.Assert(t, len(forwarded) == 1)
+	assert.Assert(t, len(deduplication.Duplicates()) == 0)
+}
+
+func TestDeduplicationInterceptorShouldDeliverConcurrentRepeatedMessagesOnce(t *testing.T) {
+	inMemory, _ := NewInMemoryEventBus()
+	eventBus := NewInterceptedBus(inMemory, NewDeduplicationInterceptor(time.Minute, 10))
+
+	channel := make(chan events.Message, 100)
+	eventBus.Subscribe("devices::#", &channel)
+
+	// A device retransmitting over several connections at once
+	message := events.NewDeviceMessage("abc-123", []byte("21"), "", events.Default)
+	published := sync.WaitGroup{}
+
+	for i := 0; i < 50; i++ {
+		published.Add(1)
+
+		go func() {
+			defer published.Done()
+			eventBus.Publish("devices::abc-123", message)
+		}()
+	}
+
+	published.Wait()
+	time.Sleep(20 * time.Millisecond)
+
+	assert.Assert(t, len(channel) == 1)
+}
+
+func TestDeduplicationInterceptorShouldForgetMessagesOutsideTheWindow(t *testing.T) {
+	deduplication := NewDeduplicationInterceptor(20*time.Millisecond, 10)
+	key := deduplicationKey("topic", events.NewMessage(nil, "", events.Default))
+
+	assert.Assert(t, deduplication.reserve(key, ""))
+	assert.Assert(t, !deduplication.reserve(key, ""))
+
+	time.Sleep(30 * time.Millisecond)
+
+	assert.Assert(t, deduplication.reserve(key, ""))
+	deduplication.release(key)
+	assert.Assert(t, deduplication.Remembered() == 0)
+}
+
+func TestDeduplicationInterceptorMemoryShouldBeBounded(t *testing.T) {
+	deduplication := NewDeduplicationInterceptor(time.Minute, 3)
+	oldest := deduplicationKey("topic", events.NewMessage(nil, "", events.Default))
+	deduplication.reserve(oldest, "")
+
+	for i := 0; i < 5; i++ {
+		key := deduplicationKey("topic", events.NewMessage(nil, "", events.Default))
+		deduplication.reserve(key, "")
+
+		// Every device counts a duplicate
+		deduplication.reserve(key, fmt.Sprintf("device-%d", i))
+	}
+
+	assert.Assert(t, deduplication.Remembered() == 3)
+	assert.Assert(t, deduplication.reserve(oldest, ""))
+	assert.DeepEqual(t, deduplication.Duplicates(), map[string]uint64{
+		"device-0":                1,
+		"device-1":                1,
+		"device-2":                1,
+		DeduplicationOtherDevices: 2,
+	})
+}
@@ -0,0 +1,421 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/nnset/iot-cloud-connector/events"
+)
+
+// DurableOffsetHeader Message header holding the write ahead log offset of the message,
+// durable subscribers acknowledge it once processed, see DurableEventBus.Acknowledge.
+const DurableOffsetHeader string = "bus_offset"
+
+// DurableSkippedTopic Original topic of the Compacted dead letters, see DurableEventBus.
+const DurableSkippedTopic string = "bus::durable_skipped"
+
+const durableOffsetsFile string = "offsets.json"
+
+// DurableEventBus Message bus that appends every published message to a write ahead log
+// before delivering it.
+//   - Subscribe works like InMemoryEventBus, subscribers only receive messages published
+//     while they are subscribed.
+//   - SubscribeDurable subscribers are identified by name and receive every message stored
+//     after the last offset they acknowledged, across restarts.
+//
+// Log retention (see WriteAheadLogOptions) does not wait for durable subscribers. When
+// the messages a durable subscriber was about to read were removed, it goes on with the
+// oldest stored one, and the skipped offsets are dead lettered as a single Compacted
+// message on DurableSkippedTopic, whose JSON payload is a DurableSkippedRange.
+type DurableEventBus struct {
+	log         *writeAheadLog
+	live        *InMemoryEventBus
+	lock        sync.Mutex
+	consumers   map[string]*durableConsumer
+	offsets     map[string]uint64 // offsets[name] => last acknowledged offset
+	offsetsPath string
+}
+
+// DurableSkippedRange Offsets a durable subscriber never received, both included.
+type DurableSkippedRange struct {
+	Subscriber  string `json:"subscriber"`
+	FirstOffset uint64 `json:"first_offset"`
+	LastOffset  uint64 `json:"last_offset"`
+}
+
+// durableConsumer Delivers the log records to a durable subscriber, starting at cursor.
+type durableConsumer struct {
+	name      string
+	pattern   string
+	channel   *chan events.Message
+	cursor    uint64
+	wakeUp    chan struct{}
+	isClosing chan struct{}
+}
+
+// NewDurableEventBus Opens, or creates, the log at options.Directory.
+func NewDurableEventBus(options WriteAheadLogOptions) (*DurableEventBus, error) {
+	log, err := openWriteAheadLog(options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	live, _ := NewInMemoryEventBus()
+
+	bus := &DurableEventBus{
+		log:         log,
+		live:        live,
+		consumers:   make(map[string]*durableConsumer),
+		offsets:     make(map[string]uint64),
+		offsetsPath: filepath.Join(options.Directory, durableOffsetsFile),
+	}
+
+	if err := bus.loadOffsets(); err != nil {
+		log.close()
+		return nil, err
+	}
+
+	return bus, nil
+}
+
+// DurableOffset Returns the offset of a message delivered by a DurableEventBus.
+func DurableOffset(message events.Message) (uint64, error) {
+	offset, err := strconv.ParseUint(message.Header(DurableOffsetHeader), 10, 64)
+
+	if err != nil {
+		return 0, fmt.Errorf("message %s has no durable offset", message.ID)
+	}
+
+	return offset, nil
+}
+
+// SubscribeContext See BusContextSubscriber, subscriptions are not durable.
+func (bus *DurableEventBus) SubscribeContext(ctx context.Context, pattern string, opts ...SubscriptionOption) (*Subscription, error) {
+	return bus.live.SubscribeContext(ctx, pattern, opts...)
+}
+
+// Subscribe See InMemoryEventBus.Subscribe
+func (bus *DurableEventBus) Subscribe(pattern string, channel *chan events.Message) error {
+	return bus.live.Subscribe(pattern, channel)
+}
+
+// SubscribeWithOptions See InMemoryEventBus.SubscribeWithOptions
+func (bus *DurableEventBus) SubscribeWithOptions(pattern string, channel *chan events.Message, options SubscriptionOptions) error {
+	return bus.live.SubscribeWithOptions(pattern, channel, options)
+}
+
+// SubscribeDurable Delivers to channel the stored messages matching pattern, starting
+// after the last offset acknowledged by name, or at the oldest stored message.
+// Messages are delivered in order, one at a time.
+func (bus *DurableEventBus) SubscribeDurable(name string, pattern string, channel *chan events.Message) error {
+	if err := ValidateTopicPattern(pattern); err != nil {
+		return err
+	}
+
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	if _, exists := bus.consumers[name]; exists {
+		return fmt.Errorf("durable subscriber %s is already subscribed", name)
+	}
+
+	cursor := bus.log.firstOffset()
+
+	// Resumes after its acknowledged offset even if it was removed, so it is reported
+	if acknowledged, ok := bus.offsets[name]; ok {
+		cursor = acknowledged + 1
+	}
+
+	consumer := &durableConsumer{
+		name:      name,
+		pattern:   pattern,
+		channel:   channel,
+		cursor:    cursor,
+		wakeUp:    make(chan struct{}, 1),
+		isClosing: make(chan struct{}),
+	}
+
+	bus.consumers[name] = consumer
+	go bus.consume(consumer)
+
+	return nil
+}
+
+// UnsubscribeDurable Stops delivering messages to name, its acknowledged offset is kept.
+func (bus *DurableEventBus) UnsubscribeDurable(name string) error {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	consumer, exists := bus.consumers[name]
+
+	if !exists {
+		return fmt.Errorf("durable subscriber %s doesn't exist", name)
+	}
+
+	close(consumer.isClosing)
+	delete(bus.consumers, name)
+
+	return nil
+}
+
+// Unsubscribe Removes a subscription made with Subscribe or SubscribeDurable.
+func (bus *DurableEventBus) Unsubscribe(pattern string, channel *chan events.Message) error {
+	bus.lock.Lock()
+
+	for name, consumer := range bus.consumers {
+		if consumer.pattern == pattern && consumer.channel == channel {
+			bus.lock.Unlock()
+			return bus.UnsubscribeDurable(name)
+		}
+	}
+
+	bus.lock.Unlock()
+
+	return bus.live.Unsubscribe(pattern, channel)
+}
+
+// Publish Stores message in the log, then delivers it. Unlike InMemoryEventBus it is
+// not an error to publish to a topic without subscribers, durable ones may come later.
+func (bus *DurableEventBus) Publish(topic string, message events.Message) error {
+	// Stored messages are never dead letters, durable subscribers may come later
+	return bus.publish(topic, message, func(topic string, message events.Message) {
+		bus.live.deliver(topic, message)
+	})
+}
+
+// PublishRetained See BusRetainer, retained values are not restored after restarting,
+// durable subscribers replay the log instead.
+func (bus *DurableEventBus) PublishRetained(topic string, message events.Message) error {
+	return bus.publish(topic, message, func(topic string, message events.Message) {
+		bus.live.PublishRetained(topic, message)
+	})
+}
+
+// ClearRetained See BusRetainer
+func (bus *DurableEventBus) ClearRetained(topic string) error {
+	return bus.live.ClearRetained(topic)
+}
+
+// publish Stores message and delivers it to live subscribers with deliver.
+func (bus *DurableEventBus) publish(topic string, message events.Message, deliver func(string, events.Message)) error {
+	if err := ValidateTopic(topic); err != nil {
+		return err
+	}
+
+	if message.Expired() {
+		bus.live.DeadLetter(topic, message, Expired)
+		return ErrMessageExpired
+	}
+
+	offset, err := bus.log.append(topic, message)
+
+	if err != nil {
+		return err
+	}
+
+	// Headers are copied, the publisher may still be using them
+	headers := make(map[string]string, len(message.Headers)+1)
+
+	for key, value := range message.Headers {
+		headers[key] = value
+	}
+
+	headers[DurableOffsetHeader] = strconv.FormatUint(offset, 10)
+	message.Headers = headers
+
+	deliver(topic, message)
+
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	for _, consumer := range bus.consumers {
+		select {
+		case consumer.wakeUp <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Request See BusRequester
+func (bus *DurableEventBus) Request(ctx context.Context, topic string, message events.Message) (events.Message, error) {
+	return subscribeAndRequest(ctx, bus, topic, message)
+}
+
+// Acknowledge Stores offset as the last message processed by the durable subscriber name.
+func (bus *DurableEventBus) Acknowledge(name string, offset uint64) error {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	bus.offsets[name] = offset
+
+	return bus.saveOffsets()
+}
+
+// SubscriptionStats See InMemoryEventBus.SubscriptionStats
+func (bus *DurableEventBus) SubscriptionStats(pattern string, channel *chan events.Message) (SubscriptionStats, error) {
+	return bus.live.SubscriptionStats(pattern, channel)
+}
+
+// QueuedByPriority See BusQueueInspector, durable subscribers are not queued, they read
+// the log in order.
+func (bus *DurableEventBus) QueuedByPriority() map[events.MessagePriority]int {
+	return bus.live.QueuedByPriority()
+}
+
+// Inspect See BusInspector, durable subscribers are not included.
+func (bus *DurableEventBus) Inspect() BusSnapshot {
+	return bus.live.Inspect()
+}
+
+// DeadLettersCount See InMemoryEventBus.DeadLettersCount
+func (bus *DurableEventBus) DeadLettersCount() uint64 {
+	return bus.live.DeadLettersCount()
+}
+
+// Close Stops durable subscribers and flushes the log.
+func (bus *DurableEventBus) Close() error {
+	bus.lock.Lock()
+
+	for name, consumer := range bus.consumers {
+		close(consumer.isClosing)
+		delete(bus.consumers, name)
+	}
+
+	bus.lock.Unlock()
+
+	return bus.log.close()
+}
+
+func (bus *DurableEventBus) consume(consumer *durableConsumer) {
+	for {
+		bus.deliverStored(consumer)
+
+		select {
+		case <-consumer.wakeUp:
+		case <-consumer.isClosing:
+			return
+		}
+	}
+}
+
+// deliverStored Delivers records until reaching the end of the log.
+func (bus *DurableEventBus) deliverStored(consumer *durableConsumer) {
+	for {
+		record, err := bus.log.read(consumer.cursor)
+
+		switch err {
+		case nil:
+		case errWALOffsetCompacted:
+			select {
+			case <-consumer.isClosing:
+				// Unsubscribed, it resumes from its acknowledged offset next time
+				return
+			default:
+			}
+
+			bus.skipCompacted(consumer)
+			continue
+		case io.EOF:
+			return
+		default:
+			// Wait for the next publish before trying again
+			return
+		}
+
+		offset := consumer.cursor
+		consumer.cursor++
+
+		if !TopicMatches(consumer.pattern, record.Topic) {
+			continue
+		}
+
+		if record.Message.Expired() {
+			bus.live.DeadLetter(record.Topic, record.Message, Expired)
+			continue
+		}
+
+		record.Message.SetHeader(DurableOffsetHeader, strconv.FormatUint(offset, 10))
+
+		select {
+		case *consumer.channel <- record.Message:
+		case <-consumer.isClosing:
+			return
+		}
+	}
+}
+
+// skipCompacted Moves the consumer cursor to the oldest stored offset, dead lettering the
+// offsets it skips.
+func (bus *DurableEventBus) skipCompacted(consumer *durableConsumer) {
+	first := bus.log.firstOffset()
+
+	skipped := DurableSkippedRange{
+		Subscriber:  consumer.name,
+		FirstOffset: consumer.cursor,
+		LastOffset:  first - 1,
+	}
+
+	consumer.cursor = first
+	payload, _ := json.Marshal(skipped)
+
+	notice := events.NewMessage(payload, "", events.Default)
+	notice.ContentType = events.JSONContentType
+
+	bus.live.DeadLetter(DurableSkippedTopic, notice, Compacted)
+}
+
+func (bus *DurableEventBus) loadOffsets() error {
+	data, err := ioutil.ReadFile(bus.offsetsPath)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, &bus.offsets)
+}
+
+// saveOffsets Writes a temporary file and renames it, so a crash never leaves a partial file.
+func (bus *DurableEventBus) saveOffsets() error {
+	data, err := json.Marshal(bus.offsets)
+
+	if err != nil {
+		return err
+	}
+
+	temporary := bus.offsetsPath + ".tmp"
+	file, err := os.Create(temporary)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temporary, bus.offsetsPath)
+}
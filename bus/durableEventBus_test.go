@@ -0,0 +1,127 @@
+package bus
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+func waitForDurableMessage(t *testing.T, channel chan events.Message) events.Message {
+	select {
+	case message := <-channel:
+		return message
+	case <-time.After(time.Second):
+		t.Fatal("message was not received")
+	}
+
+	return events.Message{}
+}
+
+func TestDurableSubscribersShouldResumeAfterRestarting(t *testing.T) {
+	directory := newTestWriteAheadLogDirectory(t)
+	defer os.RemoveAll(directory)
+
+	eventBus, err := NewDurableEventBus(WriteAheadLogOptions{Directory: directory})
+	assert.NilError(t, err)
+
+	// Published before anyone subscribed
+	assert.NilError(t, eventBus.Publish("connections::established", events.NewMessage([]byte("1"), "", events.Default)))
+	eventBus.Publish("system_metrics::allocated_memory", events.NewMessage([]byte("ignored"), "", events.Default))
+
+	channel := make(chan events.Message)
+	assert.NilError(t, eventBus.SubscribeDurable("storage", "connections::*", &channel))
+
+	eventBus.Publish("connections::closed", events.NewMessage([]byte("2"), "", events.Default))
+
+	first := waitForDurableMessage(t, channel)
+	assert.Assert(t, string(first.Payload) == "1")
+
+	offset, err := DurableOffset(first)
+	assert.NilError(t, err)
+	assert.NilError(t, eventBus.Acknowledge("storage", offset))
+
+	second := waitForDurableMessage(t, channel)
+	assert.Assert(t, string(second.Payload) == "2")
+	assert.NilError(t, eventBus.Close())
+
+	// Second message was not acknowledged, so it is delivered again
+	eventBus, err = NewDurableEventBus(WriteAheadLogOptions{Directory: directory})
+	assert.NilError(t, err)
+	defer eventBus.Close()
+
+	assert.NilError(t, eventBus.SubscribeDurable("storage", "connections::*", &channel))
+	assert.Assert(t, eventBus.SubscribeDurable("storage", "connections::*", &channel) != nil)
+
+	again := waitForDurableMessage(t, channel)
+	assert.Assert(t, string(again.Payload) == "2")
+
+	assert.NilError(t, eventBus.Unsubscribe("connections::*", &channel))
+}
+
+func TestDurableBusShouldDeliverToLiveSubscribers(t *testing.T) {
+	directory := newTestWriteAheadLogDirectory(t)
+	defer os.RemoveAll(directory)
+
+	eventBus, _ := NewDurableEventBus(WriteAheadLogOptions{Directory: directory, SyncPolicy: SyncPeriodically})
+	defer eventBus.Close()
+
+	channel := make(chan events.Message)
+	eventBus.Subscribe("topic", &channel)
+
+	message := events.NewMessage([]byte("live"), "", events.Default)
+	eventBus.Publish("topic", message)
+
+	received := waitForDurableMessage(t, channel)
+	offset, _ := DurableOffset(received)
+
+	assert.Assert(t, string(received.Payload) == "live")
+	assert.Assert(t, offset == 0)
+	assert.Assert(t, message.Header(DurableOffsetHeader) == "")
+}
+
+func TestDurableSubscribersShouldBeToldAboutMessagesRemovedBeforeTheyReadThem(t *testing.T) {
+	directory := newTestWriteAheadLogDirectory(t)
+	defer os.RemoveAll(directory)
+
+	eventBus, err := NewDurableEventBus(WriteAheadLogOptions{
+		Directory:         directory,
+		SyncPolicy:        SyncNever,
+		SegmentMaxBytes:   1,
+		RetentionMaxBytes: 1,
+	})
+	assert.NilError(t, err)
+	defer eventBus.Close()
+
+	deadLetters := make(chan events.Message, 10)
+	eventBus.Subscribe(DefaultDeadLetterTopic, &deadLetters)
+
+	channel := make(chan events.Message)
+	assert.NilError(t, eventBus.SubscribeDurable("storage", "connections::*", &channel))
+
+	eventBus.Publish("connections::closed", events.NewMessage([]byte("0"), "", events.Default))
+	assert.NilError(t, eventBus.Acknowledge("storage", 0))
+	assert.Assert(t, string(waitForDurableMessage(t, channel).Payload) == "0")
+	assert.NilError(t, eventBus.UnsubscribeDurable("storage"))
+
+	// Every record takes a segment and retention only keeps the last one
+	for i := 1; i < 4; i++ {
+		eventBus.Publish("connections::closed", events.NewMessage([]byte(strconv.Itoa(i)), "", events.Default))
+	}
+
+	assert.NilError(t, eventBus.SubscribeDurable("storage", "connections::*", &channel))
+	assert.Assert(t, string(waitForDurableMessage(t, channel).Payload) == "3")
+
+	deadLetter := waitForDurableMessage(t, deadLetters)
+	assert.Assert(t, deadLetter.Header(DeadLetterReasonHeader) == string(Compacted))
+	assert.Assert(t, deadLetter.Header(DeadLetterTopicHeader) == DurableSkippedTopic)
+
+	skipped := DurableSkippedRange{}
+	assert.NilError(t, json.Unmarshal(deadLetter.Payload, &skipped))
+	assert.DeepEqual(t, skipped, DurableSkippedRange{Subscriber: "storage", FirstOffset: 1, LastOffset: 2})
+	assert.Assert(t, eventBus.DeadLettersCount() == 1)
+}
@@ -1,96 +1,408 @@
 package bus
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"reflect"
 	"sync"
+	"sync/atomic"
 
 	"github.com/nnset/iot-cloud-connector/events"
 )
 
+var ErrMessageExpired = errors.New("message expired")
+
+// InMemoryEventBus Message bus for a single process. Subscriptions accept wildcard
+// patterns (see TopicLevelSeparator), matched against published topics using a trie.
+// Every subscription has its own bounded queue, so publishing never waits for slow
+// subscribers while holding the bus lock (see SubscriptionOptions), and higher priority
+// messages are delivered first (see events.MessagePriority).
+// Subscriptions may also join a group to share the load of its topics with other members.
+//
+// Messages that can not be delivered, because nobody is subscribed to their topic, a
+// subscription queue overflowed or they expired (see events.Message.ExpiresAt), are
+// published on DeadLetterTopic (see NewDeadLetter), unless it is empty.
 type InMemoryEventBus struct {
-	subscriptions      map[string][]*chan events.Message // subscriptions[topic] => [chan events.Message]
+	deadLetters        uint64 // First field to keep 64 bit alignment for atomic operations
+	DeadLetterTopic    string
+	subscriptions      *topicTrie
+	groups             map[string]*subscriptionGroup
+	retained           map[string]events.Message // retained[topic] => last value
 	lock               sync.Mutex
+	activity           map[string]*topicActivity // activity[topic] => counters, see Inspect
+	activityLock       sync.Mutex
 	TotalSubscriptions int
 }
 
 // NewInMemoryEventBus
 func NewInMemoryEventBus() (*InMemoryEventBus, error) {
 	return &InMemoryEventBus{
-		subscriptions:      make(map[string][]*chan events.Message),
+		DeadLetterTopic:    DefaultDeadLetterTopic,
+		subscriptions:      newTopicTrie(),
+		groups:             make(map[string]*subscriptionGroup),
+		retained:           make(map[string]events.Message),
 		lock:               sync.Mutex{},
+		activity:           make(map[string]*topicActivity),
 		TotalSubscriptions: 0,
 	}, nil
 }
 
-func (bus *InMemoryEventBus) Subscribe(topic string, channel *chan events.Message) error {
+// SubscribeContext See BusContextSubscriber, every subscription is made through it.
+func (bus *InMemoryEventBus) SubscribeContext(ctx context.Context, pattern string, opts ...SubscriptionOption) (*Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	channel := make(chan events.Message)
+	handle, err := bus.subscribe(pattern, &channel, newSubscriptionOptions(opts...))
+
+	if err != nil {
+		return nil, err
+	}
+
+	handle.endWith(ctx)
+
+	return handle, nil
+}
+
+// Subscribe Subscribes channel to every topic matching pattern, including topics
+// first published after subscribing, using the default SubscriptionOptions.
+func (bus *InMemoryEventBus) Subscribe(pattern string, channel *chan events.Message) error {
+	return bus.SubscribeWithOptions(pattern, channel, SubscriptionOptions{})
+}
+
+// SubscribeWithOptions Same as Subscribe, options configure the subscription queue
+// and filter. Subscribing a channel twice to the same pattern is an error,
+// ErrDuplicateSubscription.
+func (bus *InMemoryEventBus) SubscribeWithOptions(pattern string, channel *chan events.Message, options SubscriptionOptions) error {
+	_, err := bus.subscribe(pattern, channel, options)
+
+	return err
+}
+
+// subscribe Adds a subscription delivering to channel and returns its handle.
+func (bus *InMemoryEventBus) subscribe(pattern string, channel *chan events.Message, options SubscriptionOptions) (*Subscription, error) {
+	if err := ValidateTopicPattern(pattern); err != nil {
+		return nil, err
+	}
+
+	var filter *MessageFilter
+
+	if options.Filter != "" {
+		var err error
+
+		if filter, err = ParseMessageFilter(options.Filter); err != nil {
+			return nil, err
+		}
+	}
+
 	bus.lock.Lock()
-	defer bus.lock.Unlock()
 
-	// TODO check for repeated subscriptions
-	bus.subscriptions[topic] = append(bus.subscriptions[topic], channel)
+	for _, existing := range bus.subscriptions.find(pattern) {
+		if existing.channel == channel {
+			bus.lock.Unlock()
+			return nil, ErrDuplicateSubscription
+		}
+	}
+
+	s := newSubscription(pattern, channel, options)
+	s.filter = filter
+	s.onExpired = func(expired queuedMessage) {
+		bus.DeadLetter(expired.topic, expired.message, Expired)
+	}
+	s.onDelivered = func(delivered queuedMessage) {
+		bus.recordDelivered(delivered.topic)
+	}
+	s.handle = newSubscriptionHandle(bus, pattern, channel, func() (bool, error) {
+		return bus.remove(s), nil
+	})
+	bus.subscriptions.add(s)
+	bus.joinGroup(s)
+	s.start()
+
+	retained := []queuedMessage{}
+	expired := []queuedMessage{}
+
+	for topic, message := range bus.retained {
+		if message.Expired() {
+			delete(bus.retained, topic)
+			expired = append(expired, queuedMessage{topic, message})
+		} else if TopicMatches(pattern, topic) && s.accepts(&filterContext{message: message}) {
+			retained = append(retained, queuedMessage{topic, message})
+		}
+	}
 
 	bus.TotalSubscriptions++
+	bus.lock.Unlock()
 
-	return nil
+	for _, queued := range expired {
+		bus.DeadLetter(queued.topic, queued.message, Expired)
+	}
+
+	for _, queued := range retained {
+		bus.enqueue(s, queued)
+	}
+
+	return s.handle, nil
 }
 
+// Publish Queues message for every channel subscribed to a pattern matching topic, once
+// per channel even when several of its patterns match, and for one member of every
+// subscriptions group. Subscriptions whose filter rejects message are skipped, it is
+// not a dead letter when all of them do.
 func (bus *InMemoryEventBus) Publish(topic string, message events.Message) error {
-	bus.lock.Lock()
-	defer bus.lock.Unlock()
+	if err := ValidateTopic(topic); err != nil {
+		return err
+	}
+
+	if message.Expired() {
+		bus.DeadLetter(topic, message, Expired)
+		return ErrMessageExpired
+	}
 
-	if _, ok := bus.subscriptions[topic]; !ok {
+	if bus.deliver(topic, message) == 0 {
+		bus.DeadLetter(topic, message, NoSubscribers)
 		return fmt.Errorf("topic %s doesn't exist", topic)
 	}
 
-	for _, subs := range bus.subscriptions[topic] {
-		*subs <- message
+	return nil
+}
+
+// DeadLetter Counts message as undeliverable and publishes it on DeadLetterTopic.
+// Dead letters that can not be delivered themselves are discarded.
+func (bus *InMemoryEventBus) DeadLetter(topic string, message events.Message, reason DeadLetterReason) {
+	if topic == bus.DeadLetterTopic {
+		return
+	}
+
+	atomic.AddUint64(&bus.deadLetters, 1)
+
+	if bus.DeadLetterTopic != "" {
+		bus.deliver(bus.DeadLetterTopic, NewDeadLetter(topic, message, reason))
+	}
+}
+
+// DeadLettersCount Messages that could not be delivered since the bus was created.
+func (bus *InMemoryEventBus) DeadLettersCount() uint64 {
+	return atomic.LoadUint64(&bus.deadLetters)
+}
+
+// deliver Queues message for its recipients, returns how many subscriptions matched
+// topic, including those whose filter rejected message.
+func (bus *InMemoryEventBus) deliver(topic string, message events.Message) int {
+	bus.lock.Lock()
+	matches := bus.subscriptions.match(topic)
+	_, retained := bus.retained[topic]
+	bus.lock.Unlock()
+
+	// Filters are evaluated without holding the lock, decoding payloads may take a while
+	context := &filterContext{message: message}
+	accepted := make([]*subscription, 0, len(matches))
+
+	for _, s := range matches {
+		if s.accepts(context) {
+			accepted = append(accepted, s)
+		}
+	}
+
+	bus.lock.Lock()
+	selected := recipients(accepted, bus.groups)
+	bus.lock.Unlock()
+
+	bus.recordPublished(topic, len(matches) > 0 || retained)
+
+	for _, s := range selected {
+		bus.enqueue(s, queuedMessage{topic, message})
+	}
+
+	return len(matches)
+}
+
+func (bus *InMemoryEventBus) enqueue(s *subscription, queued queuedMessage) {
+	dropped, keep := s.enqueue(queued)
+
+	if !keep {
+		bus.disconnect(s)
+	}
+
+	for _, overflowed := range dropped {
+		bus.DeadLetter(overflowed.topic, overflowed.message, QueueOverflow)
 	}
+}
+
+// PublishRetained See BusRetainer
+func (bus *InMemoryEventBus) PublishRetained(topic string, message events.Message) error {
+	if err := ValidateTopic(topic); err != nil {
+		return err
+	}
+
+	if message.Expired() {
+		bus.DeadLetter(topic, message, Expired)
+		return ErrMessageExpired
+	}
+
+	bus.lock.Lock()
+	bus.retained[topic] = message
+	bus.lock.Unlock()
+
+	// Not a dead letter when nobody is subscribed, it is retained for later subscribers
+	bus.deliver(topic, message)
 
 	return nil
 }
 
-func (bus *InMemoryEventBus) Unsubscribe(topic string, channel *chan events.Message) error {
+// ClearRetained See BusRetainer
+func (bus *InMemoryEventBus) ClearRetained(topic string) error {
 	bus.lock.Lock()
 	defer bus.lock.Unlock()
 
-	if _, ok := bus.subscriptions[topic]; ok && len(bus.subscriptions[topic]) > 0 {
-		bus.unsubscribeChannel(topic, bus.findChannelIdx(topic, reflect.ValueOf(channel)))
+	delete(bus.retained, topic)
+	bus.forgetInactiveTopics(topic)
+
+	return nil
+}
+
+// Unsubscribe Removes channel's subscription to pattern, which must be the same pattern
+// used when subscribing. Messages still queued for channel are discarded.
+func (bus *InMemoryEventBus) Unsubscribe(pattern string, channel *chan events.Message) error {
+	_, err := bus.unsubscribe(pattern, channel)
+
+	return err
+}
+
+// unsubscribe Same as Unsubscribe, returns true when this call removed the subscription,
+// false when channel was not subscribed to pattern or someone else removed it first.
+func (bus *InMemoryEventBus) unsubscribe(pattern string, channel *chan events.Message) (bool, error) {
+	bus.lock.Lock()
+
+	if !bus.subscriptions.exists(pattern) {
+		bus.lock.Unlock()
+		return false, fmt.Errorf("topic %s doesn't exist", pattern)
+	}
+
+	var handle *Subscription
+
+	for _, s := range bus.subscriptions.find(pattern) {
+		if s.channel == channel {
+			handle = s.handle
+		}
+	}
+
+	bus.lock.Unlock()
+
+	if handle == nil {
+		return false, nil
+	}
+
+	return handle.unsubscribe(ErrUnsubscribed)
+}
+
+// remove Removes target from the bus, returns false when it was already removed.
+func (bus *InMemoryEventBus) remove(target *subscription) bool {
+	bus.lock.Lock()
+	removed := bus.subscriptions.remove(target.pattern, func(s *subscription) bool {
+		return s == target
+	})
+
+	if removed != nil {
+		bus.leaveGroup(removed)
+		bus.TotalSubscriptions--
+		bus.forgetInactiveTopics(removed.pattern)
+	}
+	bus.lock.Unlock()
 
-		return nil
+	if removed == nil {
+		return false
 	}
 
-	return fmt.Errorf("topic %s doesn't exist", topic)
+	removed.close()
+
+	return true
 }
 
-func (bus *InMemoryEventBus) findChannelIdx(topic string, channel reflect.Value) int {
+// SubscriptionStats Returns the queue stats of channel's subscription to pattern.
+func (bus *InMemoryEventBus) SubscriptionStats(pattern string, channel *chan events.Message) (SubscriptionStats, error) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
 
-	if _, ok := bus.subscriptions[topic]; ok {
-		for idx, subs := range bus.subscriptions[topic] {
-			if reflect.ValueOf(subs).Type() == channel.Type() &&
-				reflect.ValueOf(subs).Pointer() == channel.Pointer() {
+	for _, s := range bus.subscriptions.find(pattern) {
+		if s.channel == channel {
+			return s.stats(), nil
+		}
+	}
+
+	return SubscriptionStats{}, fmt.Errorf("subscription to topic %s doesn't exist", pattern)
+}
 
-				return idx
-			}
+// QueuedByPriority See BusQueueInspector
+func (bus *InMemoryEventBus) QueuedByPriority() map[events.MessagePriority]int {
+	bus.lock.Lock()
+	subscriptions := bus.subscriptions.all()
+	bus.lock.Unlock()
+
+	queued := make(map[events.MessagePriority]int, priorityLanes)
+
+	for _, priority := range events.Priorities {
+		queued[priority] = 0
+
+		for _, s := range subscriptions {
+			queued[priority] += len(s.lanes[laneOf(priority)])
 		}
 	}
 
-	return -1
+	return queued
+}
+
+// HasSubscribers See BusTopicMatcher
+func (bus *InMemoryEventBus) HasSubscribers(topic string) bool {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	return len(bus.subscriptions.match(topic)) > 0
 }
 
-func (bus *InMemoryEventBus) unsubscribeChannel(topic string, channelIndex int) {
-	if _, ok := bus.subscriptions[topic]; !ok {
+// disconnect Removes a subscription that overflowed with OverflowDisconnect policy.
+func (bus *InMemoryEventBus) disconnect(target *subscription) {
+	if !bus.remove(target) {
 		return
 	}
 
-	l := len(bus.subscriptions[topic])
+	target.handle.disconnected()
 
-	if channelIndex < 0 || channelIndex >= l {
+	if target.options.OnDisconnect != nil {
+		target.options.OnDisconnect(target.pattern, target.channel)
+	}
+}
+
+func (bus *InMemoryEventBus) joinGroup(s *subscription) {
+	name := s.options.Group
+
+	if name == "" {
+		return
+	}
+
+	if _, ok := bus.groups[name]; !ok {
+		bus.groups[name] = &subscriptionGroup{balancing: s.options.GroupBalancing}
+	}
+
+	bus.groups[name].members++
+}
+
+func (bus *InMemoryEventBus) leaveGroup(s *subscription) {
+	group, ok := bus.groups[s.options.Group]
+
+	if !ok {
 		return
 	}
 
-	copy(bus.subscriptions[topic][channelIndex:], bus.subscriptions[topic][channelIndex+1:])
-	bus.subscriptions[topic][l-1] = nil // or the zero value of T
-	bus.subscriptions[topic] = bus.subscriptions[topic][:l-1]
-	bus.TotalSubscriptions--
+	group.members--
+
+	if group.members == 0 {
+		delete(bus.groups, s.options.Group)
+	}
+}
+
+// Request See BusRequester
+func (bus *InMemoryEventBus) Request(ctx context.Context, topic string, message events.Message) (events.Message, error) {
+	return subscribeAndRequest(ctx, bus, topic, message)
 }
@@ -70,12 +70,12 @@ func TestSubscribingToEventBusTopicShouldReceiveMessages(t *testing.T) {
 
 	go func() {
 		time.Sleep(50 * time.Millisecond)
-		eventBus.Publish("topic", events.NewMessage("payload", "address", events.Query)) // todo Query
+		eventBus.Publish("topic", events.NewMessage([]byte("payload"), "address", events.Query)) // todo Query
 	}()
 
 	select {
 	case event := <-ch:
-		assert.Assert(t, event.Payload == "payload")
+		assert.Assert(t, string(event.Payload) == "payload")
 	case <-time.After(1 * time.Second):
 		// Message was not received
 		assert.Assert(t, 1 == 0)
@@ -83,9 +83,199 @@ func TestSubscribingToEventBusTopicShouldReceiveMessages(t *testing.T) {
 
 	select {
 	case event := <-ch2:
-		assert.Assert(t, event.Payload == "payload")
+		assert.Assert(t, string(event.Payload) == "payload")
 	case <-time.After(1 * time.Second):
 		// Message was not received
 		assert.Assert(t, 1 == 0)
 	}
 }
+
+func TestWildcardSubscribersShouldReceiveMessagesFromNewTopics(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	ch := make(chan events.Message)
+
+	assert.NilError(t, eventBus.Subscribe("system_metrics::*", &ch))
+	assert.NilError(t, eventBus.Subscribe("system_metrics::#", &ch))
+
+	assert.NilError(t, eventBus.Publish("system_metrics::open_files", events.NewMessage([]byte("12"), "localhost", events.Default)))
+
+	// Both patterns match, the message must be received only once
+	select {
+	case event := <-ch:
+		assert.Assert(t, string(event.Payload) == "12")
+	case <-time.After(1 * time.Second):
+		assert.Assert(t, 1 == 0)
+	}
+
+	select {
+	case <-ch:
+		assert.Assert(t, 1 == 0)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Assert(t, eventBus.Publish("connections::closed", events.NewMessage([]byte(""), "", events.Default)) != nil)
+	assert.Assert(t, eventBus.Publish("system_metrics::*", events.NewMessage([]byte(""), "", events.Default)) != nil)
+
+	assert.NilError(t, eventBus.Unsubscribe("system_metrics::*", &ch))
+	assert.NilError(t, eventBus.Unsubscribe("system_metrics::#", &ch))
+	assert.Assert(t, eventBus.TotalSubscriptions == 0)
+}
+
+func TestPublishingShouldNotWaitForSlowSubscribers(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	slow := make(chan events.Message)
+	fast := make(chan events.Message)
+
+	eventBus.SubscribeWithOptions("topic", &slow, SubscriptionOptions{QueueSize: 1, OverflowPolicy: OverflowDropNewest})
+	eventBus.Subscribe("topic", &fast)
+
+	for i := 0; i < 3; i++ {
+		assert.NilError(t, eventBus.Publish("topic", events.NewMessage([]byte{byte(i)}, "address", events.Default)))
+		assert.Assert(t, (<-fast).Payload[0] == byte(i))
+
+		// Let the slow subscription take the first message out of its queue
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// First message is waiting on the slow channel, second one is queued, third one dropped
+	stats, err := eventBus.SubscriptionStats("topic", &slow)
+	assert.NilError(t, err)
+	assert.Assert(t, stats.Dropped == 1)
+	assert.Assert(t, stats.OverflowPolicy == "drop_newest")
+
+	assert.Assert(t, (<-slow).Payload[0] == 0)
+	assert.Assert(t, (<-slow).Payload[0] == 1)
+}
+
+func TestOverflowPoliciesShouldDropMessages(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	oldest := make(chan events.Message)
+	blocking := make(chan events.Message)
+	disconnected := make(chan events.Message)
+	disconnections := make(chan string, 1)
+
+	eventBus.SubscribeWithOptions("topic", &oldest, SubscriptionOptions{QueueSize: 1, OverflowPolicy: OverflowDropOldest})
+	eventBus.SubscribeWithOptions("topic", &blocking, SubscriptionOptions{QueueSize: 1, BlockTimeout: 10 * time.Millisecond})
+	eventBus.SubscribeWithOptions("topic", &disconnected, SubscriptionOptions{
+		QueueSize:      1,
+		OverflowPolicy: OverflowDisconnect,
+		OnDisconnect: func(pattern string, channel *chan events.Message) {
+			disconnections <- pattern
+		},
+	})
+
+	for i := 0; i < 4; i++ {
+		eventBus.Publish("topic", events.NewMessage([]byte{byte(i)}, "address", events.Default))
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	assert.Assert(t, <-disconnections == "topic")
+	assert.Assert(t, eventBus.TotalSubscriptions == 2)
+
+	oldestStats, _ := eventBus.SubscriptionStats("topic", &oldest)
+	blockingStats, _ := eventBus.SubscriptionStats("topic", &blocking)
+	assert.Assert(t, oldestStats.Dropped == 2)
+	assert.Assert(t, blockingStats.Dropped == 2)
+
+	// Newest messages were kept
+	<-oldest
+	assert.Assert(t, (<-oldest).Payload[0] == 3)
+}
+
+func TestGroupMembersShouldShareMessages(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	workers := []chan events.Message{make(chan events.Message, 10), make(chan events.Message, 10), make(chan events.Message, 10)}
+	audit := make(chan events.Message, 10)
+
+	for i := range workers {
+		eventBus.SubscribeWithOptions(events.MessageReceivedTopic, &workers[i], SubscriptionOptions{Group: "ingestion"})
+	}
+
+	eventBus.Subscribe(events.MessageReceivedTopic, &audit)
+
+	for i := 0; i < 6; i++ {
+		eventBus.Publish(events.MessageReceivedTopic, events.NewMessage([]byte{byte(i)}, "address", events.Default))
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	for i := range workers {
+		assert.Assert(t, len(workers[i]) == 2)
+	}
+
+	assert.Assert(t, len(audit) == 6)
+
+	// Last member leaving removes the group
+	for i := range workers {
+		eventBus.Unsubscribe(events.MessageReceivedTopic, &workers[i])
+	}
+
+	assert.Assert(t, len(eventBus.groups) == 0)
+}
+
+func TestFilteredSubscribersShouldOnlyReceiveMatchingMessages(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	alerts := make(chan events.Message, 10)
+	everything := make(chan events.Message, 10)
+
+	err := eventBus.SubscribeWithOptions(events.MessageReceivedTopic, &alerts, SubscriptionOptions{
+		Filter: `temperature > 80 || device_type == "pump"`,
+	})
+	assert.NilError(t, err)
+	eventBus.Subscribe(events.MessageReceivedTopic, &everything)
+
+	for _, payload := range []string{`{"temperature": 21}`, `{"temperature": 95}`, `{"device_type": "pump"}`, `not json`} {
+		eventBus.Publish(events.MessageReceivedTopic, events.NewMessage([]byte(payload), "", events.Default))
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	assert.Assert(t, len(alerts) == 2)
+	assert.Assert(t, string((<-alerts).Payload) == `{"temperature": 95}`)
+	assert.Assert(t, len(everything) == 4)
+
+	stats, _ := eventBus.SubscriptionStats(events.MessageReceivedTopic, &alerts)
+	assert.Assert(t, stats.Filter == `temperature > 80 || device_type == "pump"`)
+}
+
+func TestMessagesRejectedByEveryFilterShouldNotBeDeadLetters(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	channel := make(chan events.Message, 10)
+	eventBus.SubscribeWithOptions("topic", &channel, SubscriptionOptions{Filter: "message.device_id == \"abc-123\""})
+
+	assert.NilError(t, eventBus.Publish("topic", events.NewDeviceMessage("def-456", nil, "", events.Default)))
+	assert.NilError(t, eventBus.Publish("topic", events.NewDeviceMessage("abc-123", nil, "", events.Default)))
+
+	time.Sleep(20 * time.Millisecond)
+
+	assert.Assert(t, len(channel) == 1)
+	assert.Assert(t, eventBus.DeadLettersCount() == 0)
+}
+
+func TestGroupMembersFilteringAMessageOutShouldNotBeChosen(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	pumps := make(chan events.Message, 10)
+	valves := make(chan events.Message, 10)
+
+	eventBus.SubscribeWithOptions("topic", &pumps, SubscriptionOptions{Group: "workers", Filter: `device_type == "pump"`})
+	eventBus.SubscribeWithOptions("topic", &valves, SubscriptionOptions{Group: "workers", Filter: `device_type == "valve"`})
+
+	for i := 0; i < 4; i++ {
+		eventBus.Publish("topic", events.NewMessage([]byte(`{"device_type": "pump"}`), "", events.Default))
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	assert.Assert(t, len(pumps) == 4)
+	assert.Assert(t, len(valves) == 0)
+}
+
+func TestSubscribingWithAnInvalidFilterShouldReturnError(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	channel := make(chan events.Message)
+
+	err := eventBus.SubscribeWithOptions("topic", &channel, SubscriptionOptions{Filter: "temperature >"})
+
+	assert.Assert(t, err != nil)
+	assert.Assert(t, eventBus.TotalSubscriptions == 0)
+}
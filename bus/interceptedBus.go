@@ -0,0 +1,314 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/nnset/iot-cloud-connector/events"
+)
+
+// PublishFunc Publishes message on topic, the next step of a publish interceptors chain.
+type PublishFunc func(topic string, message events.Message) error
+
+// DeliverFunc Delivers message to a subscriber of pattern, the next step of a delivery
+// interceptors chain.
+type DeliverFunc func(pattern string, message events.Message) error
+
+// Interceptor Bus middleware. Interceptors observe messages, may call next with a
+// modified message, or reject it returning an error without calling next.
+//   - InterceptPublish runs once per Publish call.
+//   - InterceptDelivery runs once per subscriber receiving the message.
+//
+// Embed PassThroughInterceptor to implement only one of them.
+type Interceptor interface {
+	InterceptPublish(topic string, message events.Message, next PublishFunc) error
+	InterceptDelivery(pattern string, message events.Message, next DeliverFunc) error
+}
+
+// PassThroughInterceptor Interceptor that does nothing.
+type PassThroughInterceptor struct{}
+
+func (PassThroughInterceptor) InterceptPublish(topic string, message events.Message, next PublishFunc) error {
+	return next(topic, message)
+}
+
+func (PassThroughInterceptor) InterceptDelivery(pattern string, message events.Message, next DeliverFunc) error {
+	return next(pattern, message)
+}
+
+// DeadLetterer Optional MessageBus capability, see InMemoryEventBus.DeadLetter.
+type DeadLetterer interface {
+	DeadLetter(topic string, message events.Message, reason DeadLetterReason)
+}
+
+// InterceptedBus Wraps a MessageBus running interceptors around every publish and every
+// delivery, in the order they were given. Messages rejected when publishing are dead
+// lettered if the wrapped bus implements DeadLetterer, rejected deliveries are dropped.
+//
+// Optional capabilities (BusRetainer, BusOptionsSubscriber, BusStatsProvider,
+// BusInspector, BusQueueInspector and BusTopicMatcher) are forwarded to the wrapped bus,
+// retained messages run through the publish interceptors too.
+type InterceptedBus struct {
+	eventBus     MessageBus
+	interceptors []Interceptor
+	forwarders   map[interceptedSubscription]*deliveryForwarder
+	lock         sync.Mutex
+}
+
+type interceptedSubscription struct {
+	pattern string
+	channel *chan events.Message
+}
+
+// deliveryForwarder Receives the wrapped bus messages for a subscriber, and runs the
+// delivery chain before passing them to the subscriber channel.
+type deliveryForwarder struct {
+	channel   chan events.Message
+	isClosing chan struct{}
+}
+
+// NewInterceptedBus Creates a new instance of InterceptedBus
+func NewInterceptedBus(eventBus MessageBus, interceptors ...Interceptor) *InterceptedBus {
+	return &InterceptedBus{
+		eventBus:     eventBus,
+		interceptors: interceptors,
+		forwarders:   make(map[interceptedSubscription]*deliveryForwarder),
+	}
+}
+
+// Publish See MessageBus
+func (bus *InterceptedBus) Publish(topic string, message events.Message) error {
+	return bus.publish(topic, message, bus.eventBus.Publish)
+}
+
+// PublishRetained See BusRetainer, the message is published without being retained when
+// the wrapped bus does not implement it.
+func (bus *InterceptedBus) PublishRetained(topic string, message events.Message) error {
+	if retainer, ok := bus.eventBus.(BusRetainer); ok {
+		return bus.publish(topic, message, retainer.PublishRetained)
+	}
+
+	return bus.publish(topic, message, bus.eventBus.Publish)
+}
+
+// ClearRetained See BusRetainer
+func (bus *InterceptedBus) ClearRetained(topic string) error {
+	if retainer, ok := bus.eventBus.(BusRetainer); ok {
+		return retainer.ClearRetained(topic)
+	}
+
+	return nil
+}
+
+// publish Runs the publish interceptors chain, ending with publish.
+func (bus *InterceptedBus) publish(topic string, message events.Message, publish PublishFunc) error {
+	published := false
+
+	chain := PublishFunc(func(topic string, message events.Message) error {
+		published = true
+		return publish(topic, message)
+	})
+
+	for i := len(bus.interceptors) - 1; i >= 0; i-- {
+		interceptor, next := bus.interceptors[i], chain
+
+		chain = func(topic string, message events.Message) error {
+			return interceptor.InterceptPublish(topic, message, next)
+		}
+	}
+
+	err := chain(topic, message)
+
+	if err != nil && !published {
+		if deadLetterer, ok := bus.eventBus.(DeadLetterer); ok {
+			deadLetterer.DeadLetter(topic, message, Rejected)
+		}
+	}
+
+	return err
+}
+
+// Subscribe See MessageBus
+func (bus *InterceptedBus) Subscribe(pattern string, channel *chan events.Message) error {
+	return bus.subscribe(pattern, channel, func(forwarder *deliveryForwarder) error {
+		return bus.eventBus.Subscribe(pattern, &forwarder.channel)
+	})
+}
+
+// SubscribeWithOptions See BusOptionsSubscriber, the wrapped bus must implement it.
+func (bus *InterceptedBus) SubscribeWithOptions(pattern string, channel *chan events.Message, options SubscriptionOptions) error {
+	subscriber, ok := bus.eventBus.(BusOptionsSubscriber)
+
+	if !ok {
+		return ErrSubscriptionOptionsNotSupported
+	}
+
+	return bus.subscribe(pattern, channel, func(forwarder *deliveryForwarder) error {
+		onDisconnect := options.OnDisconnect
+
+		// The wrapped bus disconnects the forwarder, not channel
+		options.OnDisconnect = func(string, *chan events.Message) {
+			if bus.removeForwarder(pattern, channel, forwarder) && onDisconnect != nil {
+				onDisconnect(pattern, channel)
+			}
+		}
+
+		return subscriber.SubscribeWithOptions(pattern, &forwarder.channel, options)
+	})
+}
+
+// subscribe Creates the forwarder of channel, subscribed to the wrapped bus by subscribe.
+func (bus *InterceptedBus) subscribe(pattern string, channel *chan events.Message, subscribe func(*deliveryForwarder) error) error {
+	key := interceptedSubscription{pattern, channel}
+
+	forwarder := &deliveryForwarder{
+		channel:   make(chan events.Message),
+		isClosing: make(chan struct{}),
+	}
+
+	bus.lock.Lock()
+
+	if _, exists := bus.forwarders[key]; exists {
+		bus.lock.Unlock()
+		return ErrDuplicateSubscription
+	}
+
+	bus.forwarders[key] = forwarder
+	bus.lock.Unlock()
+
+	// Not holding the lock, the wrapped bus may disconnect the forwarder while subscribing
+	if err := subscribe(forwarder); err != nil {
+		bus.removeForwarder(pattern, channel, forwarder)
+		return err
+	}
+
+	go bus.forward(pattern, channel, forwarder)
+
+	return nil
+}
+
+// Unsubscribe See MessageBus
+func (bus *InterceptedBus) Unsubscribe(pattern string, channel *chan events.Message) error {
+	key := interceptedSubscription{pattern, channel}
+
+	bus.lock.Lock()
+	forwarder, exists := bus.forwarders[key]
+	bus.lock.Unlock()
+
+	if !exists {
+		return fmt.Errorf("topic %s doesn't exist", pattern)
+	}
+
+	// The forwarder keeps reading while unsubscribing, publishers may be sending to it
+	err := bus.eventBus.Unsubscribe(pattern, &forwarder.channel)
+	bus.removeForwarder(pattern, channel, forwarder)
+
+	return err
+}
+
+// removeForwarder Stops forwarder, returns false when it was already removed.
+func (bus *InterceptedBus) removeForwarder(pattern string, channel *chan events.Message, forwarder *deliveryForwarder) bool {
+	key := interceptedSubscription{pattern, channel}
+
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	if bus.forwarders[key] != forwarder {
+		return false
+	}
+
+	delete(bus.forwarders, key)
+	close(forwarder.isClosing)
+
+	return true
+}
+
+// SubscriptionStats See BusStatsProvider, the wrapped bus must implement it.
+func (bus *InterceptedBus) SubscriptionStats(pattern string, channel *chan events.Message) (SubscriptionStats, error) {
+	provider, ok := bus.eventBus.(BusStatsProvider)
+
+	if !ok {
+		return SubscriptionStats{}, ErrSubscriptionStatsNotSupported
+	}
+
+	bus.lock.Lock()
+	forwarder, exists := bus.forwarders[interceptedSubscription{pattern, channel}]
+	bus.lock.Unlock()
+
+	if !exists {
+		return SubscriptionStats{}, fmt.Errorf("subscription to topic %s doesn't exist", pattern)
+	}
+
+	return provider.SubscriptionStats(pattern, &forwarder.channel)
+}
+
+// Inspect See BusInspector, the snapshot is empty when the wrapped bus does not
+// implement it.
+func (bus *InterceptedBus) Inspect() BusSnapshot {
+	if inspector, ok := bus.eventBus.(BusInspector); ok {
+		return inspector.Inspect()
+	}
+
+	return BusSnapshot{}
+}
+
+// HasSubscribers See BusTopicMatcher, topics are taken as subscribed when the wrapped bus
+// does not implement it.
+func (bus *InterceptedBus) HasSubscribers(topic string) bool {
+	if matcher, ok := bus.eventBus.(BusTopicMatcher); ok {
+		return matcher.HasSubscribers(topic)
+	}
+
+	return true
+}
+
+// QueuedByPriority See BusQueueInspector, nothing is queued when the wrapped bus does
+// not implement it.
+func (bus *InterceptedBus) QueuedByPriority() map[events.MessagePriority]int {
+	if inspector, ok := bus.eventBus.(BusQueueInspector); ok {
+		return inspector.QueuedByPriority()
+	}
+
+	queued := make(map[events.MessagePriority]int, len(events.Priorities))
+
+	for _, priority := range events.Priorities {
+		queued[priority] = 0
+	}
+
+	return queued
+}
+
+// Request See BusRequester
+func (bus *InterceptedBus) Request(ctx context.Context, topic string, message events.Message) (events.Message, error) {
+	return subscribeAndRequest(ctx, bus, topic, message)
+}
+
+func (bus *InterceptedBus) forward(pattern string, channel *chan events.Message, forwarder *deliveryForwarder) {
+	chain := DeliverFunc(func(pattern string, message events.Message) error {
+		select {
+		case *channel <- message:
+		case <-forwarder.isClosing:
+		}
+
+		return nil
+	})
+
+	for i := len(bus.interceptors) - 1; i >= 0; i-- {
+		interceptor, next := bus.interceptors[i], chain
+
+		chain = func(pattern string, message events.Message) error {
+			return interceptor.InterceptDelivery(pattern, message, next)
+		}
+	}
+
+	for {
+		select {
+		case message := <-forwarder.channel:
+			chain(pattern, message)
+
+		case <-forwarder.isClosing:
+			return
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+// upperCaseInterceptor Mutates payloads when publishing
+type upperCaseInterceptor struct {
+	PassThroughInterceptor
+}
+
+func (upperCaseInterceptor) InterceptPublish(topic string, message events.Message, next PublishFunc) error {
+	message.Payload = []byte(strings.ToUpper(string(message.Payload)))
+	return next(topic, message)
+}
+
+// quietInterceptor Rejects deliveries to a pattern
+type quietInterceptor struct {
+	PassThroughInterceptor
+	pattern string
+}
+
+func (interceptor quietInterceptor) InterceptDelivery(pattern string, message events.Message, next DeliverFunc) error {
+	if pattern == interceptor.pattern {
+		return errors.New("rejected")
+	}
+
+	return next(pattern, message)
+}
+
+func TestInterceptorsShouldMutateMessages(t *testing.T) {
+	inMemory, _ := NewInMemoryEventBus()
+	eventBus := NewInterceptedBus(inMemory, upperCaseInterceptor{})
+
+	channel := make(chan events.Message)
+	assert.NilError(t, eventBus.Subscribe("connections::*", &channel))
+	assert.NilError(t, eventBus.Publish("connections::closed", events.NewMessage([]byte("bye"), "", events.Default)))
+
+	select {
+	case message := <-channel:
+		assert.Assert(t, string(message.Payload) == "BYE")
+	case <-time.After(time.Second):
+		t.Fatal("message was not received")
+	}
+
+	assert.NilError(t, eventBus.Unsubscribe("connections::*", &channel))
+	assert.Assert(t, inMemory.TotalSubscriptions == 0)
+	assert.Assert(t, eventBus.Unsubscribe("connections::*", &channel) != nil)
+}
+
+func TestInterceptorsShouldRejectDeliveriesPerSubscriber(t *testing.T) {
+	inMemory, _ := NewInMemoryEventBus()
+	eventBus := NewInterceptedBus(inMemory, quietInterceptor{pattern: "connections::#"})
+
+	rejected := make(chan events.Message)
+	accepted := make(chan events.Message)
+	eventBus.Subscribe("connections::#", &rejected)
+	eventBus.Subscribe("connections::closed", &accepted)
+
+	eventBus.Publish("connections::closed", events.NewMessage([]byte("bye"), "", events.Default))
+
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("message was not received")
+	}
+
+	select {
+	case <-rejected:
+		t.Fatal("message delivery must be rejected")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRejectedPublishesShouldBeDeadLettered(t *testing.T) {
+	inMemory, _ := NewInMemoryEventBus()
+	eventBus := NewInterceptedBus(inMemory, NewPayloadSizeLimitInterceptor(2))
+
+	deadLetters := make(chan events.Message, 1)
+	inMemory.Subscribe(DefaultDeadLetterTopic, &deadLetters)
+
+	channel := make(chan events.Message, 1)
+	eventBus.Subscribe("topic", &channel)
+
+	assert.Assert(t, eventBus.Publish("topic", events.NewMessage([]byte("too big"), "", events.Default)) != nil)
+
+	select {
+	case deadLetter := <-deadLetters:
+		assert.Assert(t, deadLetter.Header(DeadLetterReasonHeader) == string(Rejected))
+	case <-time.After(time.Second):
+		t.Fatal("dead letter was not received")
+	}
+
+	assert.NilError(t, eventBus.Publish("topic", events.NewMessage([]byte("ok"), "", events.Default)))
+}
+
+func TestInterceptedBusShouldRetainMessagesThroughTheInterceptors(t *testing.T) {
+	inMemory, _ := NewInMemoryEventBus()
+	eventBus := NewInterceptedBus(inMemory, upperCaseInterceptor{}, NewPayloadSizeLimitInterceptor(4))
+
+	assert.NilError(t, eventBus.PublishRetained("system_metrics::uptime", events.NewMessage([]byte("up"), "", events.Default)))
+	assert.Assert(t, eventBus.PublishRetained("system_metrics::load", events.NewMessage([]byte("too big"), "", events.Default)) != nil)
+
+	channel := make(chan events.Message, 2)
+	assert.NilError(t, eventBus.Subscribe("system_metrics::*", &channel))
+
+	select {
+	case message := <-channel:
+		assert.Assert(t, string(message.Payload) == "UP")
+	case <-time.After(time.Second):
+		t.Fatal("retained message was not received")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Assert(t, len(channel) == 0)
+	assert.Assert(t, inMemory.DeadLettersCount() == 1)
+
+	assert.NilError(t, eventBus.ClearRetained("system_metrics::uptime"))
+
+	late := make(chan events.Message, 1)
+	assert.NilError(t, eventBus.Subscribe("system_metrics::uptime", &late))
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Assert(t, len(late) == 0)
+}
+
+func TestInterceptedBusShouldForwardSubscriptionOptionsAndStats(t *testing.T) {
+	inMemory, _ := NewInMemoryEventBus()
+	eventBus := NewInterceptedBus(inMemory, upperCaseInterceptor{})
+
+	subscription, err := Subscribe(context.Background(), eventBus, "devices::#", WithQueueSize(8), WithFilter(`message.device_id == "abc-123"`))
+	assert.NilError(t, err)
+
+	eventBus.Publish("devices::def-456", events.NewDeviceMessage("def-456", []byte("no"), "", events.Default))
+	eventBus.Publish("devices::abc-123", events.NewDeviceMessage("abc-123", []byte("yes"), "", events.Default))
+
+	select {
+	case message := <-subscription.C():
+		assert.Assert(t, string(message.Payload) == "YES")
+	case <-time.After(time.Second):
+		t.Fatal("message was not received")
+	}
+
+	stats, err := subscription.Stats()
+	assert.NilError(t, err)
+	assert.Assert(t, stats.QueueSize == 8)
+
+	assert.Assert(t, len(eventBus.Inspect().Subscriptions) == 1)
+	assert.Assert(t, len(eventBus.QueuedByPriority()) == len(events.Priorities))
+
+	assert.NilError(t, subscription.Unsubscribe())
+	assert.Assert(t, inMemory.TotalSubscriptions == 0)
+}
+
+func TestInterceptedBusShouldForgetDisconnectedSubscribers(t *testing.T) {
+	inMemory, _ := NewInMemoryEventBus()
+	eventBus := NewInterceptedBus(inMemory)
+
+	subscription, _ := Subscribe(context.Background(), eventBus, "topic", WithQueueSize(1), WithOverflowPolicy(OverflowDisconnect, 0))
+
+	for i := 0; i < 4; i++ {
+		eventBus.Publish("topic", events.NewMessage(nil, "", events.Default))
+	}
+
+	select {
+	case <-subscription.Done():
+	case <-time.After(time.Second):
+		t.Fatal("subscription was not disconnected")
+	}
+
+	assert.Assert(t, subscription.Err() == ErrSubscriptionDisconnected)
+	assert.Assert(t, eventBus.Unsubscribe("topic", subscription.channel) != nil)
+}
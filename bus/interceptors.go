@@ -0,0 +1,122 @@
+package bus
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/nnset/iot-cloud-connector/events"
+	"github.com/sirupsen/logrus"
+)
+
+// LoggingInterceptor Logs every publish and delivery at debug level, and failed
+// publishes at warning level.
+type LoggingInterceptor struct {
+	logger logrus.FieldLogger
+}
+
+// NewLoggingInterceptor Creates a new instance of LoggingInterceptor
+func NewLoggingInterceptor(logger logrus.FieldLogger) *LoggingInterceptor {
+	return &LoggingInterceptor{logger: logger}
+}
+
+func (interceptor *LoggingInterceptor) InterceptPublish(topic string, message events.Message, next PublishFunc) error {
+	fields := logrus.Fields{"topic": topic, "message_id": message.ID, "payload_size": len(message.Payload)}
+
+	if err := next(topic, message); err != nil {
+		interceptor.logger.WithFields(fields).WithError(err).Warn("Bus publish failed")
+		return err
+	}
+
+	interceptor.logger.WithFields(fields).Debug("Bus message published")
+
+	return nil
+}
+
+func (interceptor *LoggingInterceptor) InterceptDelivery(pattern string, message events.Message, next DeliverFunc) error {
+	interceptor.logger.WithFields(logrus.Fields{"pattern": pattern, "message_id": message.ID}).Debug("Bus message delivered")
+
+	return next(pattern, message)
+}
+
+// TopicCountersInterceptor Counts messages published per topic, and delivered per
+// subscription pattern.
+type TopicCountersInterceptor struct {
+	published map[string]uint64
+	delivered map[string]uint64
+	lock      sync.Mutex
+}
+
+// NewTopicCountersInterceptor Creates a new instance of TopicCountersInterceptor
+func NewTopicCountersInterceptor() *TopicCountersInterceptor {
+	return &TopicCountersInterceptor{
+		published: make(map[string]uint64),
+		delivered: make(map[string]uint64),
+	}
+}
+
+func (interceptor *TopicCountersInterceptor) InterceptPublish(topic string, message events.Message, next PublishFunc) error {
+	err := next(topic, message)
+
+	if err == nil {
+		interceptor.lock.Lock()
+		interceptor.published[topic]++
+		interceptor.lock.Unlock()
+	}
+
+	return err
+}
+
+func (interceptor *TopicCountersInterceptor) InterceptDelivery(pattern string, message events.Message, next DeliverFunc) error {
+	err := next(pattern, message)
+
+	if err == nil {
+		interceptor.lock.Lock()
+		interceptor.delivered[pattern]++
+		interceptor.lock.Unlock()
+	}
+
+	return err
+}
+
+// Published Returns a copy of the published messages count per topic.
+func (interceptor *TopicCountersInterceptor) Published() map[string]uint64 {
+	return interceptor.copy(interceptor.published)
+}
+
+// Delivered Returns a copy of the delivered messages count per subscription pattern.
+func (interceptor *TopicCountersInterceptor) Delivered() map[string]uint64 {
+	return interceptor.copy(interceptor.delivered)
+}
+
+func (interceptor *TopicCountersInterceptor) copy(counters map[string]uint64) map[string]uint64 {
+	interceptor.lock.Lock()
+	defer interceptor.lock.Unlock()
+
+	cloned := make(map[string]uint64, len(counters))
+
+	for k, v := range counters {
+		cloned[k] = v
+	}
+
+	return cloned
+}
+
+// PayloadSizeLimitInterceptor Rejects publishing messages with payloads bigger than
+// MaxPayloadSize bytes.
+type PayloadSizeLimitInterceptor struct {
+	PassThroughInterceptor
+	MaxPayloadSize int
+}
+
+// NewPayloadSizeLimitInterceptor Creates a new instance of PayloadSizeLimitInterceptor
+func NewPayloadSizeLimitInterceptor(maxPayloadSize int) *PayloadSizeLimitInterceptor {
+	return &PayloadSizeLimitInterceptor{MaxPayloadSize: maxPayloadSize}
+}
+
+func (interceptor *PayloadSizeLimitInterceptor) InterceptPublish(topic string, message events.Message, next PublishFunc) error {
+	if len(message.Payload) > interceptor.MaxPayloadSize {
+		return fmt.Errorf("message %s payload is %d bytes, limit is %d", message.ID, len(message.Payload), interceptor.MaxPayloadSize)
+	}
+
+	return next(topic, message)
+}
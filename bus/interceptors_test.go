@@ -0,0 +1,53 @@
+package bus
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/events"
+	"github.com/sirupsen/logrus"
+	"gotest.tools/assert"
+)
+
+func TestLoggingInterceptorShouldLogPublishesAndDeliveries(t *testing.T) {
+	output := &bytes.Buffer{}
+	logger := logrus.New()
+	logger.Out = output
+	logger.SetLevel(logrus.DebugLevel)
+
+	inMemory, _ := NewInMemoryEventBus()
+	eventBus := NewInterceptedBus(inMemory, NewLoggingInterceptor(logger))
+
+	channel := make(chan events.Message)
+	eventBus.Subscribe("topic", &channel)
+	eventBus.Publish("topic", events.NewMessage([]byte("payload"), "", events.Default))
+	<-channel
+
+	eventBus.Publish("nobody::listens", events.NewMessage(nil, "", events.Default))
+
+	logs := output.String()
+	assert.Assert(t, strings.Contains(logs, "Bus message published"))
+	assert.Assert(t, strings.Contains(logs, "Bus message delivered"))
+	assert.Assert(t, strings.Contains(logs, "Bus publish failed"))
+}
+
+func TestTopicCountersInterceptorShouldCountMessages(t *testing.T) {
+	counters := NewTopicCountersInterceptor()
+	inMemory, _ := NewInMemoryEventBus()
+	eventBus := NewInterceptedBus(inMemory, counters)
+
+	channel := make(chan events.Message)
+	eventBus.Subscribe("system_metrics::*", &channel)
+
+	for i := 0; i < 2; i++ {
+		eventBus.Publish("system_metrics::allocated_memory", events.NewMessage(nil, "", events.Default))
+		<-channel
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	assert.DeepEqual(t, counters.Published(), map[string]uint64{"system_metrics::allocated_memory": 2})
+	assert.DeepEqual(t, counters.Delivered(), map[string]uint64{"system_metrics::*": 2})
+}
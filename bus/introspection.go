@@ -0,0 +1,146 @@
+package bus
+
+import (
+	"sort"
+	"time"
+)
+
+// BusInspector Optional MessageBus capability, a snapshot of the bus state and activity
+// to diagnose stuck or slow pipelines.
+type BusInspector interface {
+	Inspect() BusSnapshot
+}
+
+// BusSnapshot
+//   - Topics Every published topic that still has subscribers or a retained message,
+//     sorted by name.
+//   - Subscriptions Every subscription queue, sorted by pattern.
+//   - QueuedByPriority Messages waiting in every subscription queue, by priority name.
+//   - DeadLetters See InMemoryEventBus.DeadLettersCount.
+type BusSnapshot struct {
+	Topics             []TopicStats        `json:"topics"`
+	Subscriptions      []SubscriptionStats `json:"subscriptions"`
+	TotalSubscriptions int                 `json:"total_subscriptions"`
+	QueuedByPriority   map[string]int      `json:"queued_by_priority"`
+	DeadLetters        uint64              `json:"dead_letters"`
+}
+
+// TopicStats Activity of a topic.
+//   - Subscribers Subscriptions whose pattern currently matches the topic.
+//   - Published Messages published on the topic, delivered or not.
+//   - Delivered Messages handed to subscriber channels.
+//   - LastPublishedAt Unix time in nanoseconds.
+type TopicStats struct {
+	Topic           string `json:"topic"`
+	Subscribers     int    `json:"subscribers"`
+	Published       uint64 `json:"published"`
+	Delivered       uint64 `json:"delivered"`
+	LastPublishedAt int64  `json:"last_published_at"`
+}
+
+type topicActivity struct {
+	published       uint64
+	delivered       uint64
+	lastPublishedAt int64
+}
+
+// recordPublished Counts a message published on topic, topics without subscribers nor a
+// retained message are forgotten, i.e. request reply topics.
+func (bus *InMemoryEventBus) recordPublished(topic string, active bool) {
+	bus.activityLock.Lock()
+	defer bus.activityLock.Unlock()
+
+	if !active {
+		delete(bus.activity, topic)
+		return
+	}
+
+	activity, exists := bus.activity[topic]
+
+	if !exists {
+		activity = &topicActivity{}
+		bus.activity[topic] = activity
+	}
+
+	activity.published++
+	activity.lastPublishedAt = time.Now().UnixNano()
+}
+
+func (bus *InMemoryEventBus) recordDelivered(topic string) {
+	bus.activityLock.Lock()
+	defer bus.activityLock.Unlock()
+
+	if activity, exists := bus.activity[topic]; exists {
+		activity.delivered++
+	}
+}
+
+// forgetInactiveTopics Forgets the activity of the topics matching pattern left without
+// subscribers nor a retained message. Must be called holding the bus lock.
+func (bus *InMemoryEventBus) forgetInactiveTopics(pattern string) {
+	bus.activityLock.Lock()
+	defer bus.activityLock.Unlock()
+
+	for topic := range bus.activity {
+		if !TopicMatches(pattern, topic) {
+			continue
+		}
+
+		if _, retained := bus.retained[topic]; !retained && len(bus.subscriptions.match(topic)) == 0 {
+			delete(bus.activity, topic)
+		}
+	}
+}
+
+// Inspect See BusInspector
+func (bus *InMemoryEventBus) Inspect() BusSnapshot {
+	bus.activityLock.Lock()
+	topics := make([]TopicStats, 0, len(bus.activity))
+
+	for topic, activity := range bus.activity {
+		topics = append(topics, TopicStats{
+			Topic:           topic,
+			Published:       activity.published,
+			Delivered:       activity.delivered,
+			LastPublishedAt: activity.lastPublishedAt,
+		})
+	}
+
+	bus.activityLock.Unlock()
+
+	bus.lock.Lock()
+
+	for i := range topics {
+		topics[i].Subscribers = len(bus.subscriptions.match(topics[i].Topic))
+	}
+
+	subscriptions := bus.subscriptions.all()
+	totalSubscriptions := bus.TotalSubscriptions
+	bus.lock.Unlock()
+
+	snapshot := BusSnapshot{
+		Topics:             topics,
+		Subscriptions:      make([]SubscriptionStats, 0, len(subscriptions)),
+		TotalSubscriptions: totalSubscriptions,
+		QueuedByPriority:   make(map[string]int, priorityLanes),
+		DeadLetters:        bus.DeadLettersCount(),
+	}
+
+	for _, s := range subscriptions {
+		snapshot.Subscriptions = append(snapshot.Subscriptions, s.stats())
+	}
+
+	for priority, queued := range bus.QueuedByPriority() {
+		snapshot.QueuedByPriority[priority.String()] = queued
+	}
+
+	sort.Slice(snapshot.Topics, func(i, j int) bool {
+		return snapshot.Topics[i].Topic < snapshot.Topics[j].Topic
+	})
+
+	sort.SliceStable(snapshot.Subscriptions, func(i, j int) bool {
+		return snapshot.Subscriptions[i].Pattern < snapshot.Subscriptions[j].Pattern
+	})
+
+	return snapshot
+}
@@ -0,0 +1,84 @@
+package bus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+func TestInspectShouldReportTopicsActivity(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	received := make(chan events.Message, 10)
+	metrics := make(chan events.Message)
+
+	eventBus.Subscribe(events.MessageReceivedTopic, &received)
+	eventBus.Subscribe("system_metrics::*", &metrics)
+	eventBus.Subscribe("connections::*", &received)
+
+	before := time.Now().UnixNano()
+
+	for i := 0; i < 3; i++ {
+		eventBus.Publish(events.MessageReceivedTopic, events.NewMessage(nil, "", events.Default))
+	}
+
+	// Nobody reads metrics, the first message waits in the delivery goroutine
+	eventBus.Publish(events.SystemMetricsAllocatedMemoryTopic, events.NewMessage(nil, "", events.Default))
+	eventBus.Publish(events.SystemMetricsAllocatedMemoryTopic, events.NewMessage(nil, "", events.Default))
+	eventBus.Publish("nobody::listens", events.NewMessage(nil, "", events.Default))
+
+	time.Sleep(20 * time.Millisecond)
+
+	snapshot := eventBus.Inspect()
+
+	// Neither nobody::listens nor the dead letters topic have subscribers
+	assert.Assert(t, len(snapshot.Topics) == 2)
+
+	assert.Assert(t, snapshot.Topics[0].Topic == events.MessageReceivedTopic)
+	assert.Assert(t, snapshot.Topics[0].Subscribers == 1)
+	assert.Assert(t, snapshot.Topics[0].Published == 3)
+	assert.Assert(t, snapshot.Topics[0].Delivered == 3)
+	assert.Assert(t, snapshot.Topics[0].LastPublishedAt >= before)
+
+	assert.Assert(t, snapshot.Topics[1].Topic == events.SystemMetricsAllocatedMemoryTopic)
+	assert.Assert(t, snapshot.Topics[1].Published == 2)
+	assert.Assert(t, snapshot.Topics[1].Delivered == 0)
+
+	assert.Assert(t, snapshot.TotalSubscriptions == 3)
+	assert.Assert(t, len(snapshot.Subscriptions) == 3)
+	assert.Assert(t, snapshot.Subscriptions[2].Pattern == "system_metrics::*")
+	assert.Assert(t, snapshot.Subscriptions[2].Queued == 1)
+	assert.DeepEqual(t, snapshot.QueuedByPriority, map[string]int{"high": 0, "normal": 1, "low": 0})
+	assert.Assert(t, snapshot.DeadLetters == 1)
+}
+
+func TestInspectShouldForgetTopicsWithoutSubscribersNorRetainedMessages(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	responder := make(chan events.Message)
+	eventBus.Subscribe("devices::abc-123::send", &responder)
+
+	go func() {
+		for request := range responder {
+			eventBus.Publish(request.ReplyTo, events.NewReplyMessage(request, nil, ""))
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		_, err := eventBus.Request(context.Background(), "devices::abc-123::send", events.NewMessage(nil, "", events.Command))
+		assert.NilError(t, err)
+	}
+
+	assert.NilError(t, eventBus.PublishRetained("system_metrics::uptime", events.NewMessage(nil, "", events.Default)))
+
+	topics := eventBus.Inspect().Topics
+	assert.Assert(t, len(topics) == 2)
+	assert.Assert(t, topics[0].Topic == "devices::abc-123::send")
+	assert.Assert(t, topics[1].Topic == "system_metrics::uptime")
+
+	assert.NilError(t, eventBus.Unsubscribe("devices::abc-123::send", &responder))
+	assert.NilError(t, eventBus.ClearRetained("system_metrics::uptime"))
+
+	assert.Assert(t, len(eventBus.Inspect().Topics) == 0)
+}
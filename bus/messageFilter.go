@@ -0,0 +1,564 @@
+package bus
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/nnset/iot-cloud-connector/events"
+)
+
+// MessageFilterFieldsPrefix Paths starting with this prefix refer to message fields,
+// named as in the message JSON, instead of to its payload, e.g. message.device_id or
+// message.headers.mqtt_topic
+const MessageFilterFieldsPrefix string = "message"
+
+// MessageFilter Compiled filter expression, see ParseMessageFilter.
+type MessageFilter struct {
+	expression string
+	root       filterNode
+}
+
+// ParseMessageFilter Compiles a filter expression, e.g.
+// temperature > 80 && (device_type == "pump" || message.device_id == "abc-123")
+//   - Paths select a value of the payload, decoded with the codec of the message content
+//     type or as JSON when it has none. Levels are separated by dots and list items are
+//     selected by their index, e.g. sensors.0.temperature. Paths starting with
+//     MessageFilterFieldsPrefix select message fields instead, message.priority is the
+//     priority name, e.g. message.priority == "high".
+//   - Literals are double quoted strings, numbers, true, false and null.
+//   - Comparisons are ==, !=, <, <=, > and >=. Numbers compare with numbers and strings
+//     with strings, any other ordering comparison is false. Missing values equal null.
+//   - Conditions are combined with &&, || and !, and grouped with parentheses. A path
+//     alone is true when its value is not false, null, zero or empty.
+func ParseMessageFilter(expression string) (*MessageFilter, error) {
+	tokens, err := tokenizeFilter(expression)
+
+	if err != nil {
+		return nil, fmt.Errorf("filter %q, %s", expression, err)
+	}
+
+	parser := &filterParser{tokens: tokens}
+	root, err := parser.parseOr()
+
+	if err == nil && parser.peek().kind != filterTokenEnd {
+		err = fmt.Errorf("unexpected %s", parser.peek())
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("filter %q, %s", expression, err)
+	}
+
+	return &MessageFilter{expression: expression, root: root}, nil
+}
+
+// String Returns the filter expression.
+func (filter *MessageFilter) String() string {
+	return filter.expression
+}
+
+// Matches Evaluates the filter for message.
+func (filter *MessageFilter) Matches(message events.Message) bool {
+	return filter.matches(&filterContext{message: message})
+}
+
+func (filter *MessageFilter) matches(context *filterContext) bool {
+	return filter.root.matches(context)
+}
+
+// filterContext Message being evaluated, its payload is decoded once, when a path first
+// needs it, and shared by every filter evaluated for the message.
+type filterContext struct {
+	message events.Message
+	payload interface{}
+	decoded bool
+}
+
+func (context *filterContext) decodedPayload() interface{} {
+	if context.decoded {
+		return context.payload
+	}
+
+	context.decoded = true
+	contentType := context.message.ContentType
+
+	if contentType == "" {
+		contentType = events.JSONContentType
+	}
+
+	codec, exists := events.CodecFor(contentType)
+
+	if !exists || codec.Unmarshal(context.message.Payload, &context.payload) != nil {
+		context.payload = nil
+	}
+
+	return context.payload
+}
+
+type filterNode interface {
+	matches(context *filterContext) bool
+}
+
+type filterOperand interface {
+	// value Returns the operand value, false when it is missing.
+	value(context *filterContext) (interface{}, bool)
+}
+
+type filterAnd struct{ left, right filterNode }
+
+func (node filterAnd) matches(context *filterContext) bool {
+	return node.left.matches(context) && node.right.matches(context)
+}
+
+type filterOr struct{ left, right filterNode }
+
+func (node filterOr) matches(context *filterContext) bool {
+	return node.left.matches(context) || node.right.matches(context)
+}
+
+type filterNot struct{ node filterNode }
+
+func (node filterNot) matches(context *filterContext) bool {
+	return !node.node.matches(context)
+}
+
+type filterTruthy struct{ operand filterOperand }
+
+func (node filterTruthy) matches(context *filterContext) bool {
+	value, exists := node.operand.value(context)
+
+	if !exists {
+		return false
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	}
+
+	if number, isNumber := filterNumber(value); isNumber {
+		return number != 0
+	}
+
+	return true
+}
+
+type filterComparison struct {
+	left     filterOperand
+	operator string
+	right    filterOperand
+}
+
+func (node filterComparison) matches(context *filterContext) bool {
+	left, _ := node.left.value(context)
+	right, _ := node.right.value(context)
+
+	switch node.operator {
+	case "==":
+		return filterEqual(left, right)
+	case "!=":
+		return !filterEqual(left, right)
+	}
+
+	var order int
+
+	leftNumber, leftIsNumber := filterNumber(left)
+	rightNumber, rightIsNumber := filterNumber(right)
+	leftString, leftIsString := left.(string)
+	rightString, rightIsString := right.(string)
+
+	switch {
+	case leftIsNumber && rightIsNumber:
+		if leftNumber < rightNumber {
+			order = -1
+		} else if leftNumber > rightNumber {
+			order = 1
+		}
+	case leftIsString && rightIsString:
+		order = strings.Compare(leftString, rightString)
+	default:
+		return false
+	}
+
+	switch node.operator {
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	default:
+		return order >= 0
+	}
+}
+
+type filterLiteral struct{ literal interface{} }
+
+func (operand filterLiteral) value(context *filterContext) (interface{}, bool) {
+	return operand.literal, true
+}
+
+type filterPath struct {
+	messageField bool
+	levels       []string
+}
+
+func (operand filterPath) value(context *filterContext) (interface{}, bool) {
+	if !operand.messageField {
+		return filterSelect(context.decodedPayload(), operand.levels)
+	}
+
+	message := context.message
+	var field interface{}
+
+	switch operand.levels[0] {
+	case "id":
+		field = message.ID
+	case "origin_remote_address":
+		field = message.OriginRemoteAddress
+	case "message_type":
+		field = string(message.MessagType)
+	case "timestamp":
+		field = message.Timestamp
+	case "device_id":
+		field = message.DeviceID
+	case "correlation_id":
+		field = message.CorrelationID
+	case "reply_to":
+		field = message.ReplyTo
+	case "content_type":
+		field = message.ContentType
+	case "expires_at":
+		field = message.ExpiresAt
+	case "priority":
+		field = message.Priority.String()
+	case "schema_version":
+		field = message.SchemaVersion
+	case "headers":
+		if len(operand.levels) != 2 {
+			return nil, false
+		}
+
+		header, exists := message.Headers[operand.levels[1]]
+
+		return header, exists
+	default:
+		return nil, false
+	}
+
+	if len(operand.levels) > 1 {
+		return nil, false
+	}
+
+	return field, true
+}
+
+// filterSelect Walks value down levels, through objects keys and lists indexes.
+func filterSelect(value interface{}, levels []string) (interface{}, bool) {
+	for _, level := range levels {
+		switch container := value.(type) {
+		case map[string]interface{}:
+			child, exists := container[level]
+
+			if !exists {
+				return nil, false
+			}
+
+			value = child
+
+		case []interface{}:
+			idx, err := strconv.Atoi(level)
+
+			if err != nil || idx < 0 || idx >= len(container) {
+				return nil, false
+			}
+
+			value = container[idx]
+
+		default:
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// filterNumber Decoded payloads hold float64 numbers when JSON, int64 or uint64 otherwise.
+func filterNumber(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case float64:
+		return number, true
+	case int64:
+		return float64(number), true
+	case uint64:
+		return float64(number), true
+	case int:
+		return float64(number), true
+	}
+
+	return 0, false
+}
+
+// filterEqual Compares scalars, objects and lists are never equal.
+func filterEqual(left, right interface{}) bool {
+	leftNumber, leftIsNumber := filterNumber(left)
+	rightNumber, rightIsNumber := filterNumber(right)
+
+	if leftIsNumber || rightIsNumber {
+		return leftIsNumber && rightIsNumber && leftNumber == rightNumber
+	}
+
+	switch left.(type) {
+	case nil, bool, string:
+		return left == right
+	}
+
+	return false
+}
+
+type filterTokenKind int
+
+const (
+	filterTokenEnd filterTokenKind = iota
+	filterTokenPath
+	filterTokenString
+	filterTokenNumber
+	filterTokenOperator
+)
+
+type filterToken struct {
+	kind     filterTokenKind
+	text     string
+	position int
+}
+
+func (token filterToken) String() string {
+	if token.kind == filterTokenEnd {
+		return "end of expression"
+	}
+
+	return fmt.Sprintf("%q at %d", token.text, token.position)
+}
+
+func tokenizeFilter(expression string) ([]filterToken, error) {
+	tokens := []filterToken{}
+	runes := []rune(expression)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+
+		case r == '"':
+			i++
+
+			for i < len(runes) && runes[i] != '"' {
+				if runes[i] == '\\' {
+					i++
+				}
+
+				i++
+			}
+
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at %d", start)
+			}
+
+			i++
+			tokens = append(tokens, filterToken{filterTokenString, string(runes[start:i]), start})
+
+		case r == '-' || unicode.IsDigit(r):
+			i++
+
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || strings.ContainsRune(".eE+-", runes[i])) {
+				i++
+			}
+
+			tokens = append(tokens, filterToken{filterTokenNumber, string(runes[start:i]), start})
+
+		case r == '_' || unicode.IsLetter(r):
+			for i < len(runes) && (runes[i] == '_' || runes[i] == '.' || unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				i++
+			}
+
+			tokens = append(tokens, filterToken{filterTokenPath, string(runes[start:i]), start})
+
+		default:
+			operator := ""
+
+			for _, candidate := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")"} {
+				if strings.HasPrefix(string(runes[i:]), candidate) {
+					operator = candidate
+					break
+				}
+			}
+
+			if operator == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", r, start)
+			}
+
+			i += len(operator)
+			tokens = append(tokens, filterToken{filterTokenOperator, operator, start})
+		}
+	}
+
+	return append(tokens, filterToken{kind: filterTokenEnd, position: len(runes)}), nil
+}
+
+// filterParser Recursive descent parser, from lowest to highest precedence: ||, &&, !,
+// comparisons.
+type filterParser struct {
+	tokens []filterToken
+	next   int
+}
+
+func (parser *filterParser) peek() filterToken {
+	return parser.tokens[parser.next]
+}
+
+func (parser *filterParser) accept(operator string) bool {
+	token := parser.peek()
+
+	if token.kind == filterTokenOperator && token.text == operator {
+		parser.next++
+		return true
+	}
+
+	return false
+}
+
+func (parser *filterParser) parseOr() (filterNode, error) {
+	left, err := parser.parseAnd()
+
+	for err == nil && parser.accept("||") {
+		var right filterNode
+
+		if right, err = parser.parseAnd(); err == nil {
+			left = filterOr{left, right}
+		}
+	}
+
+	return left, err
+}
+
+func (parser *filterParser) parseAnd() (filterNode, error) {
+	left, err := parser.parseNot()
+
+	for err == nil && parser.accept("&&") {
+		var right filterNode
+
+		if right, err = parser.parseNot(); err == nil {
+			left = filterAnd{left, right}
+		}
+	}
+
+	return left, err
+}
+
+func (parser *filterParser) parseNot() (filterNode, error) {
+	if parser.accept("!") {
+		node, err := parser.parseNot()
+
+		return filterNot{node}, err
+	}
+
+	if parser.accept("(") {
+		node, err := parser.parseOr()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !parser.accept(")") {
+			return nil, fmt.Errorf("expected ) instead of %s", parser.peek())
+		}
+
+		return node, nil
+	}
+
+	return parser.parseComparison()
+}
+
+func (parser *filterParser) parseComparison() (filterNode, error) {
+	left, err := parser.parseOperand()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, operator := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if parser.accept(operator) {
+			right, err := parser.parseOperand()
+
+			if err != nil {
+				return nil, err
+			}
+
+			return filterComparison{left, operator, right}, nil
+		}
+	}
+
+	return filterTruthy{left}, nil
+}
+
+func (parser *filterParser) parseOperand() (filterOperand, error) {
+	token := parser.peek()
+	parser.next++
+
+	switch token.kind {
+	case filterTokenString:
+		text, err := strconv.Unquote(token.text)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s", token)
+		}
+
+		return filterLiteral{text}, nil
+
+	case filterTokenNumber:
+		number, err := strconv.ParseFloat(token.text, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", token)
+		}
+
+		return filterLiteral{number}, nil
+
+	case filterTokenPath:
+		switch token.text {
+		case "true":
+			return filterLiteral{true}, nil
+		case "false":
+			return filterLiteral{false}, nil
+		case "null":
+			return filterLiteral{nil}, nil
+		}
+
+		levels := strings.Split(token.text, ".")
+
+		for _, level := range levels {
+			if level == "" {
+				return nil, fmt.Errorf("invalid path %s", token)
+			}
+		}
+
+		if levels[0] == MessageFilterFieldsPrefix && len(levels) > 1 {
+			return filterPath{messageField: true, levels: levels[1:]}, nil
+		}
+
+		return filterPath{levels: levels}, nil
+	}
+
+	parser.next--
+
+	return nil, fmt.Errorf("expected a value instead of %s", token)
+}
@@ -0,0 +1,73 @@
+package bus
+
+import (
+	"testing"
+
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+func TestMessageFiltersShouldEvaluatePayloadPaths(t *testing.T) {
+	message := events.NewDeviceMessage("abc-123", []byte(`{
+		"temperature": 85.5,
+		"device_type": "pump",
+		"online": true,
+		"sensors": [{"name": "inlet", "pressure": 2}],
+		"location": {"room": "basement"}
+	}`), "", events.Default)
+	message.SetHeader("mqtt_topic", "sensors/abc-123")
+	message.Priority = events.PriorityHigh
+
+	examples := map[string]bool{
+		`temperature > 80`:               true,
+		`temperature <= 80`:              false,
+		`temperature == 85.5`:            true,
+		`device_type == "pump"`:          true,
+		`device_type != "pump"`:          false,
+		`device_type < "valve"`:          true,
+		`online`:                         true,
+		`!online`:                        false,
+		`sensors.0.pressure >= 2`:        true,
+		`sensors.1.pressure >= 2`:        false,
+		`location.room == "basement"`:    true,
+		`missing == null`:                true,
+		`missing`:                        false,
+		`temperature > "80"`:             false,
+		`sensors == sensors`:             false,
+		`message.device_id == "abc-123"`: true,
+		`message.headers.mqtt_topic == "sensors/abc-123"`: true,
+		`message.message_type == "default"`:               true,
+		`message.unknown == null`:                         true,
+		`message.priority == "high"`:                      true,
+		`message.priority == "normal"`:                    false,
+		`message.schema_version >= 4`:                     true,
+		`temperature > 90 || device_type == "pump"`:       true,
+		`temperature > 80 && device_type == "valve"`:      false,
+		`!(temperature > 90) && (online || missing)`:      true,
+	}
+
+	for expression, expected := range examples {
+		filter, err := ParseMessageFilter(expression)
+
+		assert.NilError(t, err, expression)
+		assert.Assert(t, filter.Matches(message) == expected, expression)
+	}
+}
+
+func TestMessageFiltersShouldDecodePayloadsWithTheirContentType(t *testing.T) {
+	payload, _ := events.CBORCodec{}.Marshal(map[string]interface{}{"temperature": 95})
+	message := events.NewMessage(payload, "", events.Default)
+	message.ContentType = events.CBORContentType
+
+	filter, _ := ParseMessageFilter("temperature > 80")
+
+	assert.Assert(t, filter.Matches(message))
+}
+
+func TestInvalidMessageFiltersShouldNotBeParsed(t *testing.T) {
+	for _, expression := range []string{"", "temperature >", "(online", "online)", `"unterminated`, "a..b", "temperature = 1", "1 2"} {
+		_, err := ParseMessageFilter(expression)
+
+		assert.Assert(t, err != nil, expression)
+	}
+}
@@ -0,0 +1,168 @@
+package bus
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// PlaybackMode How a Player spaces the messages it publishes.
+type PlaybackMode int
+
+const (
+	// PlaybackOriginalTiming Messages are published as far apart as they were recorded.
+	PlaybackOriginalTiming PlaybackMode = iota
+	// PlaybackAccelerated Same as PlaybackOriginalTiming, Speed times faster.
+	PlaybackAccelerated
+	// PlaybackInstant Messages are published one after another, without waiting.
+	PlaybackInstant
+)
+
+const DefaultPlaybackSpeed float64 = 10
+
+// PlayerOptions
+//   - Mode See PlaybackMode.
+//   - Speed How many times faster PlaybackAccelerated plays.
+//   - DeviceIDs Only messages from, or to, these devices are played, empty plays all of them.
+//   - Topics Only messages recorded on topics matching these patterns are played, empty
+//     plays all of them.
+type PlayerOptions struct {
+	Mode      PlaybackMode
+	Speed     float64
+	DeviceIDs []string
+	Topics    []string
+}
+
+// PlaybackStats
+//   - Played Messages published.
+//   - Skipped Messages left out by the PlayerOptions filters.
+//   - Failed Messages the bus refused, i.e. because nobody is subscribed to their topic.
+type PlaybackStats struct {
+	Played  int `json:"played"`
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+}
+
+// Player Publishes the messages captured by a Recorder again, on the topics they were
+// recorded on. Messages keep their ID and timestamps, expiry times are moved forward
+// so they keep the TTL they had when recorded.
+type Player struct {
+	reader  io.Reader
+	options PlayerOptions
+}
+
+// NewPlayer Creates a new instance of Player reading the recording from reader.
+func NewPlayer(reader io.Reader, options PlayerOptions) (*Player, error) {
+	for _, pattern := range options.Topics {
+		if err := ValidateTopicPattern(pattern); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.Speed <= 0 {
+		options.Speed = DefaultPlaybackSpeed
+	}
+
+	return &Player{reader: reader, options: options}, nil
+}
+
+// Play Publishes the recording through publisher until it ends or ctx is done.
+func (player *Player) Play(ctx context.Context, publisher BusPublisher) (PlaybackStats, error) {
+	stats := PlaybackStats{}
+	recording, err := newRecordingReader(player.reader)
+
+	if err != nil {
+		return stats, err
+	}
+
+	// Time between records is measured from the first one played
+	var firstRecordedAt int64
+	var started time.Time
+
+	for {
+		record, err := recording.next()
+
+		if err == io.EOF {
+			return stats, nil
+		}
+
+		if err != nil {
+			return stats, err
+		}
+
+		if !player.plays(record) {
+			stats.Skipped++
+			continue
+		}
+
+		if started.IsZero() {
+			firstRecordedAt = record.RecordedAt
+			started = time.Now()
+		}
+
+		if err := player.wait(ctx, started, time.Duration(record.RecordedAt-firstRecordedAt)); err != nil {
+			return stats, err
+		}
+
+		message := record.Message
+
+		if message.ExpiresAt != 0 {
+			message.ExpiresAt += time.Now().UnixNano() - record.RecordedAt
+		}
+
+		if err := publisher.Publish(record.Topic, message); err != nil {
+			stats.Failed++
+			continue
+		}
+
+		stats.Played++
+	}
+}
+
+func (player *Player) plays(record recordedMessage) bool {
+	if len(player.options.DeviceIDs) > 0 && !containsString(player.options.DeviceIDs, record.Message.DeviceID) {
+		return false
+	}
+
+	if len(player.options.Topics) == 0 {
+		return true
+	}
+
+	for _, pattern := range player.options.Topics {
+		if TopicMatches(pattern, record.Topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wait Waits until elapsed, scaled by the playback mode, has passed since started.
+func (player *Player) wait(ctx context.Context, started time.Time, elapsed time.Duration) error {
+	switch player.options.Mode {
+	case PlaybackInstant:
+		return ctx.Err()
+	case PlaybackAccelerated:
+		elapsed = time.Duration(float64(elapsed) / player.options.Speed)
+	}
+
+	timer := time.NewTimer(time.Until(started.Add(elapsed)))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,99 @@
+package bus
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+// newTestRecording Records three device messages, 50ms apart, and a metric.
+func newTestRecording(t *testing.T) []byte {
+	recording := &bytes.Buffer{}
+	recorder, err := NewRecorder(recording)
+	assert.NilError(t, err)
+
+	next := PublishFunc(func(topic string, message events.Message) error { return nil })
+
+	for i, deviceID := range []string{"abc-123", "def-456", "abc-123"} {
+		if i > 0 {
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		recorder.InterceptPublish(events.MessageReceivedTopic, events.NewDeviceMessage(deviceID, []byte{byte(i)}, "", events.Default), next)
+	}
+
+	recorder.InterceptPublish(events.SystemMetricsAllocatedMemoryTopic, events.NewMessage([]byte("4"), "", events.Default), next)
+
+	return recording.Bytes()
+}
+
+func TestPlayerShouldFilterByDeviceAndTopic(t *testing.T) {
+	recording := newTestRecording(t)
+	eventBus, _ := NewInMemoryEventBus()
+	received := make(chan events.Message, 10)
+	eventBus.Subscribe("#", &received)
+
+	player, err := NewPlayer(bytes.NewReader(recording), PlayerOptions{
+		Mode:      PlaybackInstant,
+		DeviceIDs: []string{"abc-123"},
+		Topics:    []string{"connections::*"},
+	})
+	assert.NilError(t, err)
+
+	stats, err := player.Play(context.Background(), eventBus)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, stats, PlaybackStats{Played: 2, Skipped: 2})
+
+	time.Sleep(20 * time.Millisecond)
+
+	assert.Assert(t, len(received) == 2)
+	assert.DeepEqual(t, (<-received).Payload, []byte{0})
+	assert.DeepEqual(t, (<-received).Payload, []byte{2})
+}
+
+func TestPlayerShouldKeepTheOriginalTimingUnlessAccelerated(t *testing.T) {
+	recording := newTestRecording(t)
+	eventBus, _ := NewInMemoryEventBus()
+	received := make(chan events.Message, 10)
+	eventBus.Subscribe("#", &received)
+
+	examples := []struct {
+		options  PlayerOptions
+		min, max time.Duration
+	}{
+		{PlayerOptions{Mode: PlaybackOriginalTiming}, 100 * time.Millisecond, time.Second},
+		{PlayerOptions{Mode: PlaybackAccelerated, Speed: 10}, 10 * time.Millisecond, 90 * time.Millisecond},
+		{PlayerOptions{Mode: PlaybackInstant}, 0, 10 * time.Millisecond},
+	}
+
+	for _, example := range examples {
+		player, _ := NewPlayer(bytes.NewReader(recording), example.options)
+		start := time.Now()
+
+		stats, err := player.Play(context.Background(), eventBus)
+		elapsed := time.Since(start)
+
+		assert.NilError(t, err)
+		assert.Assert(t, stats.Played == 4)
+		assert.Assert(t, elapsed >= example.min && elapsed < example.max, elapsed)
+	}
+}
+
+func TestPlayerShouldStopWhenTheContextIsDone(t *testing.T) {
+	recording := newTestRecording(t)
+	eventBus, _ := NewInMemoryEventBus()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	// Nobody is subscribed, the first message fails while the second one is waiting
+	player, _ := NewPlayer(bytes.NewReader(recording), PlayerOptions{})
+	stats, err := player.Play(ctx, eventBus)
+
+	assert.Assert(t, err == context.DeadlineExceeded)
+	assert.DeepEqual(t, stats, PlaybackStats{Failed: 1})
+}
@@ -0,0 +1,30 @@
+package bus
+
+import "github.com/nnset/iot-cloud-connector/events"
+
+// Every subscription has a queue, or lane, per message priority. Lanes take turns to
+// deliver their messages, a lane delivers up to its weight messages per turn, so higher
+// priorities go first while lower ones keep moving, e.g. a low priority message every
+// 7 while higher priority ones are waiting.
+const priorityLanes = 3
+
+var priorityLaneWeights = [priorityLanes]int{4, 2, 1} // high, normal, low
+
+// laneOf Lane index of priority, priorities above PriorityHigh or below PriorityLow
+// share the high and low lanes.
+func laneOf(priority events.MessagePriority) int {
+	switch {
+	case priority >= events.PriorityHigh:
+		return 0
+	case priority <= events.PriorityLow:
+		return 2
+	}
+
+	return 1
+}
+
+// BusQueueInspector Optional MessageBus capability, reports how many messages of every
+// priority are waiting in subscription queues.
+type BusQueueInspector interface {
+	QueuedByPriority() map[events.MessagePriority]int
+}
@@ -0,0 +1,71 @@
+package bus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+func publishWithPriority(eventBus *InMemoryEventBus, topic string, priority events.MessagePriority, count int) {
+	for i := 0; i < count; i++ {
+		m := events.NewMessage([]byte(priority.String()), "", events.Default)
+		m.Priority = priority
+		eventBus.Publish(topic, m)
+	}
+}
+
+func TestHigherPriorityMessagesShouldSkipAheadOfQueuedOnes(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	channel := make(chan events.Message)
+	eventBus.Subscribe("motors", &channel)
+
+	publishWithPriority(eventBus, "motors", events.PriorityLow, 1)
+	time.Sleep(20 * time.Millisecond)
+
+	publishWithPriority(eventBus, "motors", events.PriorityLow, 10)
+	publishWithPriority(eventBus, "motors", events.PriorityNormal, 10)
+	publishWithPriority(eventBus, "motors", events.PriorityHigh, 1)
+
+	time.Sleep(20 * time.Millisecond)
+
+	// The delivery goroutine already took the first low priority message
+	assert.Assert(t, string((<-channel).Payload) == "low")
+	assert.Assert(t, string((<-channel).Payload) == "high")
+	assert.Assert(t, string((<-channel).Payload) == "normal")
+}
+
+func TestLowerPriorityMessagesShouldNotStarve(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	channel := make(chan events.Message)
+	eventBus.SubscribeWithOptions("motors", &channel, SubscriptionOptions{QueueSize: 100})
+
+	publishWithPriority(eventBus, "motors", events.PriorityHigh, 1)
+	time.Sleep(20 * time.Millisecond)
+
+	publishWithPriority(eventBus, "motors", events.PriorityLow, 20)
+	publishWithPriority(eventBus, "motors", events.PriorityNormal, 20)
+	publishWithPriority(eventBus, "motors", events.PriorityHigh, 40)
+
+	time.Sleep(20 * time.Millisecond)
+
+	received := make(map[string]int)
+
+	for i := 0; i < 15; i++ {
+		received[string((<-channel).Payload)]++
+	}
+
+	assert.DeepEqual(t, received, map[string]int{"high": 9, "normal": 4, "low": 2})
+
+	// Let the delivery goroutine take the next message
+	time.Sleep(20 * time.Millisecond)
+
+	stats, _ := eventBus.SubscriptionStats("motors", &channel)
+	assert.DeepEqual(t, stats.QueuedByPriority, map[string]int{"high": 31, "normal": 16, "low": 18})
+	assert.DeepEqual(t, eventBus.QueuedByPriority(), map[events.MessagePriority]int{
+		events.PriorityHigh:   31,
+		events.PriorityNormal: 16,
+		events.PriorityLow:    18,
+	})
+}
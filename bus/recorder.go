@@ -0,0 +1,176 @@
+package bus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/events"
+)
+
+// Recordings start with recordingMagic, followed by one record per captured message: its
+// length as an unsigned varint and the MessagePack encoded recordedMessage.
+const (
+	recordingMagic         string = "IOTBUSREC1\n"
+	recordingMaxRecordSize uint64 = 64 * 1024 * 1024
+)
+
+var ErrNotARecording = errors.New("data is not a bus recording")
+
+// recordedMessage A message captured by Recorder, RecordedAt is Unix time in nanoseconds.
+type recordedMessage struct {
+	Topic      string         `json:"topic"`
+	RecordedAt int64          `json:"recorded_at"`
+	Message    events.Message `json:"message"`
+}
+
+// Recorder Interceptor capturing the messages published on topics matching its patterns,
+// to be replayed later with a Player. Messages are captured before being published, so
+// those that could not be delivered are captured too.
+//
+//	recorder, _ := NewRecorder(file, "connections::message_received", "devices::#")
+//	eventBus := NewInterceptedBus(inMemoryBus, recorder)
+//
+// Recording failures never make publishing fail, see Err.
+type Recorder struct {
+	PassThroughInterceptor
+	patterns []string
+	writer   io.Writer
+	recorded uint64
+	err      error
+	lock     sync.Mutex
+}
+
+// NewRecorder Creates a new instance of Recorder writing to writer, an empty patterns
+// list captures every topic.
+func NewRecorder(writer io.Writer, patterns ...string) (*Recorder, error) {
+	for _, pattern := range patterns {
+		if err := ValidateTopicPattern(pattern); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := io.WriteString(writer, recordingMagic); err != nil {
+		return nil, err
+	}
+
+	return &Recorder{patterns: patterns, writer: writer}, nil
+}
+
+func (recorder *Recorder) InterceptPublish(topic string, message events.Message, next PublishFunc) error {
+	if recorder.captures(topic) {
+		recorder.record(recordedMessage{Topic: topic, RecordedAt: time.Now().UnixNano(), Message: message})
+	}
+
+	return next(topic, message)
+}
+
+// Recorded Returns how many messages were captured.
+func (recorder *Recorder) Recorded() uint64 {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	return recorder.recorded
+}
+
+// Err Returns the first error writing the recording, messages are no longer captured
+// after it.
+func (recorder *Recorder) Err() error {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	return recorder.err
+}
+
+func (recorder *Recorder) captures(topic string) bool {
+	if len(recorder.patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range recorder.patterns {
+		if TopicMatches(pattern, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (recorder *Recorder) record(record recordedMessage) {
+	encoded, err := events.MessagePackCodec{}.Marshal(record)
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	if recorder.err != nil {
+		return
+	}
+
+	if err != nil {
+		recorder.err = err
+		return
+	}
+
+	data := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(encoded))
+	data = append(data[:binary.PutUvarint(data, uint64(len(encoded)))], encoded...)
+
+	// A single write per record, so a recording being written can be played up to its
+	// last complete record
+	if _, err := recorder.writer.Write(data); err != nil {
+		recorder.err = err
+		return
+	}
+
+	recorder.recorded++
+}
+
+// recordingReader Reads the records written by a Recorder.
+type recordingReader struct {
+	reader *bufio.Reader
+}
+
+func newRecordingReader(reader io.Reader) (*recordingReader, error) {
+	buffered := bufio.NewReader(reader)
+	magic := make([]byte, len(recordingMagic))
+
+	if _, err := io.ReadFull(buffered, magic); err != nil || string(magic) != recordingMagic {
+		return nil, ErrNotARecording
+	}
+
+	return &recordingReader{reader: buffered}, nil
+}
+
+// next Returns the next record, io.EOF after the last complete one.
+func (recording *recordingReader) next() (recordedMessage, error) {
+	record := recordedMessage{}
+	length, err := binary.ReadUvarint(recording.reader)
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return record, io.EOF
+	}
+
+	if err != nil {
+		return record, err
+	}
+
+	if length > recordingMaxRecordSize {
+		return record, fmt.Errorf("recording record of %d bytes is too big", length)
+	}
+
+	data := make([]byte, length)
+
+	if _, err := io.ReadFull(recording.reader, data); err != nil {
+		// A torn last record, the recording was still being written
+		return record, io.EOF
+	}
+
+	if err := (events.MessagePackCodec{}).Unmarshal(data, &record); err != nil {
+		return record, err
+	}
+
+	return record, nil
+}
@@ -0,0 +1,62 @@
+package bus
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+func TestRecorderShouldCaptureSelectedTopics(t *testing.T) {
+	recording := &bytes.Buffer{}
+	recorder, err := NewRecorder(recording, "devices::#")
+	assert.NilError(t, err)
+
+	inMemory, _ := NewInMemoryEventBus()
+	eventBus := NewInterceptedBus(inMemory, recorder)
+
+	// Nobody is subscribed, messages are captured anyway
+	command := events.NewDeviceMessage("abc-123", []byte{0x01, 0xFF}, "", events.Command)
+	command.SetHeader("mqtt_topic", "devices/abc-123")
+	eventBus.Publish("devices::abc-123::send", command)
+	eventBus.Publish(events.SystemMetricsAllocatedMemoryTopic, events.NewMessage([]byte("4"), "", events.Default))
+
+	assert.Assert(t, recorder.Recorded() == 1)
+	assert.NilError(t, recorder.Err())
+
+	reader, err := newRecordingReader(recording)
+	assert.NilError(t, err)
+
+	record, err := reader.next()
+	assert.NilError(t, err)
+	assert.Assert(t, record.Topic == "devices::abc-123::send")
+	assert.Assert(t, record.RecordedAt >= command.Timestamp)
+	assert.DeepEqual(t, record.Message, command)
+
+	_, err = reader.next()
+	assert.Assert(t, err == io.EOF)
+}
+
+func TestRecordingsShouldToleratePartialLastRecords(t *testing.T) {
+	recording := &bytes.Buffer{}
+	recorder, _ := NewRecorder(recording)
+	eventBus, _ := NewInMemoryEventBus()
+
+	for i := 0; i < 2; i++ {
+		recorder.InterceptPublish("topic", events.NewMessage([]byte("payload"), "", events.Default), eventBus.Publish)
+	}
+
+	torn := recording.Bytes()[:recording.Len()-3]
+	reader, _ := newRecordingReader(bytes.NewReader(torn))
+
+	_, err := reader.next()
+	assert.NilError(t, err)
+
+	_, err = reader.next()
+	assert.Assert(t, err == io.EOF)
+
+	_, err = newRecordingReader(bytes.NewReader([]byte("not a recording")))
+	assert.Assert(t, err == ErrNotARecording)
+}
@@ -0,0 +1,73 @@
+package bus
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/nnset/iot-cloud-connector/events"
+)
+
+// BusRequester Optional MessageBus capability, synchronous request/reply exchanges.
+// Request publishes message on topic and waits for the first message correlated with it
+// (see events.NewReplyMessage) published on message.ReplyTo, until ctx is done.
+type BusRequester interface {
+	Request(ctx context.Context, topic string, message events.Message) (events.Message, error)
+}
+
+// RepliesTopicPrefix Request waits for replies on an ephemeral topic with this prefix.
+const RepliesTopicPrefix string = "_replies"
+
+var (
+	ErrRequestNotSupported = errors.New("message bus does not support requests")
+	ErrMessageHasNoReplyTo = errors.New("message has no reply to topic")
+)
+
+// Request Sends a request through eventBus if it implements BusRequester.
+func Request(ctx context.Context, eventBus MessageBus, topic string, message events.Message) (events.Message, error) {
+	requester, ok := eventBus.(BusRequester)
+
+	if !ok {
+		return events.Message{}, ErrRequestNotSupported
+	}
+
+	return requester.Request(ctx, topic, message)
+}
+
+// Reply Publishes payload as the reply to request, on the topic request asked for.
+func Reply(publisher BusPublisher, request events.Message, payload []byte) error {
+	if request.ReplyTo == "" {
+		return ErrMessageHasNoReplyTo
+	}
+
+	return publisher.Publish(request.ReplyTo, events.NewReplyMessage(request, payload, ""))
+}
+
+// subscribeAndRequest Request implementation on top of MessageBus, the reply subscription
+// is removed once a reply arrives or ctx is done.
+func subscribeAndRequest(ctx context.Context, eventBus MessageBus, topic string, message events.Message) (events.Message, error) {
+	message.ReplyTo = RepliesTopicPrefix + TopicLevelSeparator + uuid.New().String()
+	replies, err := Subscribe(ctx, eventBus, message.ReplyTo)
+
+	if err != nil {
+		return events.Message{}, err
+	}
+
+	defer replies.Unsubscribe()
+
+	if err := eventBus.Publish(topic, message); err != nil {
+		return events.Message{}, err
+	}
+
+	for {
+		select {
+		case reply := <-replies.C():
+			if reply.CorrelationID == message.ID {
+				return reply, nil
+			}
+
+		case <-ctx.Done():
+			return events.Message{}, ctx.Err()
+		}
+	}
+}
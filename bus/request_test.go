@@ -0,0 +1,63 @@
+package bus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+type publishOnlyBus struct {
+	MessageBus
+}
+
+func TestRequestsShouldReturnTheCorrelatedReply(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	requests := make(chan events.Message)
+	eventBus.Subscribe("devices::abc-123::send", &requests)
+
+	go func() {
+		request := <-requests
+
+		// Messages not correlated with the request must be ignored
+		eventBus.Publish(request.ReplyTo, events.NewMessage([]byte("not a reply"), "", events.Query))
+		Reply(eventBus, request, []byte("21"))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	reply, err := Request(ctx, eventBus, "devices::abc-123::send", events.NewMessage([]byte("temperature"), "", events.Query))
+
+	assert.NilError(t, err)
+	assert.Assert(t, string(reply.Payload) == "21")
+	assert.Assert(t, eventBus.TotalSubscriptions == 1)
+}
+
+func TestRequestsShouldCleanUpWhenContextIsDone(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	requests := make(chan events.Message, 1)
+	eventBus.Subscribe("devices::abc-123::send", &requests)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := eventBus.Request(ctx, "devices::abc-123::send", events.NewMessage([]byte("on"), "", events.Command))
+
+	assert.Assert(t, err == context.DeadlineExceeded)
+	assert.Assert(t, eventBus.TotalSubscriptions == 1)
+
+	request := <-requests
+	assert.Assert(t, Reply(eventBus, request, []byte("late")) != nil)
+}
+
+func TestRequestsShouldRequireBusSupport(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+
+	_, err := Request(context.Background(), publishOnlyBus{eventBus}, "topic", events.NewMessage(nil, "", events.Query))
+	assert.Assert(t, err == ErrRequestNotSupported)
+
+	assert.Assert(t, Reply(eventBus, events.NewMessage(nil, "", events.Query), nil) == ErrMessageHasNoReplyTo)
+}
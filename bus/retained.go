@@ -0,0 +1,22 @@
+package bus
+
+import "github.com/nnset/iot-cloud-connector/events"
+
+// BusRetainer Optional MessageBus capability, retained messages. A retained message is
+// stored as the last value of its topic, and delivered to every new subscription with a
+// pattern matching the topic as soon as it subscribes. Publishing a retained message when
+// nobody is subscribed is not an error.
+type BusRetainer interface {
+	PublishRetained(topic string, message events.Message) error
+	ClearRetained(topic string) error
+}
+
+// PublishRetained Publishes a retained message if eventBus implements BusRetainer,
+// otherwise a regular one.
+func PublishRetained(eventBus BusPublisher, topic string, message events.Message) error {
+	if retainer, ok := eventBus.(BusRetainer); ok {
+		return retainer.PublishRetained(topic, message)
+	}
+
+	return eventBus.Publish(topic, message)
+}
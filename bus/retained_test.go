@@ -0,0 +1,58 @@
+package bus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+func TestRetainedMessagesShouldBeDeliveredToNewSubscribers(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+
+	assert.NilError(t, PublishRetained(eventBus, "system_metrics::allocated_memory", events.NewMessage([]byte("3"), "", events.Default)))
+	assert.NilError(t, PublishRetained(eventBus, "system_metrics::allocated_memory", events.NewMessage([]byte("4"), "", events.Default)))
+	assert.NilError(t, PublishRetained(eventBus, "connections::closed", events.NewMessage([]byte("ignored"), "", events.Default)))
+
+	channel := make(chan events.Message)
+	eventBus.Subscribe("system_metrics::*", &channel)
+
+	select {
+	case message := <-channel:
+		assert.Assert(t, string(message.Payload) == "4")
+	case <-time.After(time.Second):
+		t.Fatal("retained message was not received")
+	}
+
+	select {
+	case <-channel:
+		t.Fatal("only the last value must be retained")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestClearedRetainedMessagesShouldNotBeDelivered(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+
+	PublishRetained(eventBus, "system_metrics::allocated_memory", events.NewMessage([]byte("4"), "", events.Default))
+	assert.NilError(t, eventBus.ClearRetained("system_metrics::allocated_memory"))
+
+	channel := make(chan events.Message)
+	eventBus.Subscribe("system_metrics::#", &channel)
+
+	select {
+	case <-channel:
+		t.Fatal("retained message was cleared")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPublishRetainedShouldFallBackToPublish(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+
+	err := PublishRetained(publishOnlyBus{eventBus}, "connections::closed", events.NewMessage(nil, "", events.Default))
+
+	// A regular publish without subscribers
+	assert.Assert(t, err != nil)
+}
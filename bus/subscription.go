@@ -0,0 +1,305 @@
+package bus
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/events"
+)
+
+// OverflowPolicy What a subscription does with a published message when its queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock Publisher waits up to BlockTimeout for room in the queue, then drops the message.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest Oldest queued message is dropped to make room for the new one.
+	OverflowDropOldest
+	// OverflowDropNewest New message is dropped.
+	OverflowDropNewest
+	// OverflowDisconnect New message is dropped and the subscription removed from the bus.
+	OverflowDisconnect
+)
+
+// GroupBalancing How a message is assigned to one of the members of a subscriptions group.
+type GroupBalancing int
+
+const (
+	// GroupRoundRobin Members take turns.
+	GroupRoundRobin GroupBalancing = iota
+	// GroupLeastLoaded Member with fewer queued messages, ties are resolved in turns.
+	GroupLeastLoaded
+)
+
+const (
+	DefaultSubscriptionQueueSize    int           = 64
+	DefaultSubscriptionBlockTimeout time.Duration = 5 * time.Second
+)
+
+func (policy OverflowPolicy) String() string {
+	switch policy {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropOldest:
+		return "drop_oldest"
+	case OverflowDropNewest:
+		return "drop_newest"
+	case OverflowDisconnect:
+		return "disconnect"
+	}
+
+	return "unknown"
+}
+
+// SubscriptionOptions Configures how messages are queued for a subscriber, zero values
+// are replaced with defaults.
+//   - QueueSize Messages of each priority waiting to be delivered to the subscriber channel.
+//   - OverflowPolicy What to do when the queue is full.
+//   - BlockTimeout How long OverflowBlock waits for room in the queue.
+//   - OnDisconnect Called once the subscription was removed by OverflowDisconnect.
+//   - Group Subscriptions sharing a group name share the load: each message is delivered
+//     to only one of the group members whose pattern matches the topic. Every group, and
+//     every subscription without group, still gets its own copy.
+//   - GroupBalancing How members are chosen, set by the first member of the group.
+//   - Filter Expression messages must match to be queued, see ParseMessageFilter. Messages
+//     not matching are skipped before reaching the queue, and a group member filtering
+//     a message out is never chosen for it.
+type SubscriptionOptions struct {
+	QueueSize      int
+	OverflowPolicy OverflowPolicy
+	BlockTimeout   time.Duration
+	OnDisconnect   func(pattern string, channel *chan events.Message)
+	Group          string
+	GroupBalancing GroupBalancing
+	Filter         string
+}
+
+// SubscriptionStats Snapshot of a subscription queue.
+type SubscriptionStats struct {
+	Pattern          string         `json:"pattern"`
+	Group            string         `json:"group,omitempty"`
+	Filter           string         `json:"filter,omitempty"`
+	OverflowPolicy   string         `json:"overflow_policy"`
+	QueueSize        int            `json:"queue_size"`
+	Queued           int            `json:"queued"`
+	QueuedByPriority map[string]int `json:"queued_by_priority"`
+	Dropped          uint64         `json:"dropped"`
+}
+
+// queuedMessage A message waiting in a subscription queue, and the topic it was published on.
+type queuedMessage struct {
+	topic   string
+	message events.Message
+}
+
+// subscription Messages matching pattern are queued by publishers and delivered to
+// channel by the subscription own goroutine, so a slow subscriber never blocks the bus.
+type subscription struct {
+	dropped     uint64 // First field to keep 64 bit alignment for atomic operations
+	pattern     string
+	channel     *chan events.Message
+	options     SubscriptionOptions
+	lanes       [priorityLanes]chan queuedMessage
+	queueLock   sync.Mutex
+	isClosing   chan struct{}
+	closeOnce   sync.Once
+	onExpired   func(queuedMessage)
+	onDelivered func(queuedMessage)
+	filter      *MessageFilter
+	handle      *Subscription
+}
+
+func newSubscription(pattern string, channel *chan events.Message, options SubscriptionOptions) *subscription {
+	if options.QueueSize <= 0 {
+		options.QueueSize = DefaultSubscriptionQueueSize
+	}
+
+	if options.BlockTimeout <= 0 {
+		options.BlockTimeout = DefaultSubscriptionBlockTimeout
+	}
+
+	var lanes [priorityLanes]chan queuedMessage
+
+	for lane := range lanes {
+		lanes[lane] = make(chan queuedMessage, options.QueueSize)
+	}
+
+	return &subscription{
+		pattern:   pattern,
+		channel:   channel,
+		options:   options,
+		lanes:     lanes,
+		isClosing: make(chan struct{}),
+	}
+}
+
+func (s *subscription) start() {
+	go s.deliver()
+}
+
+func (s *subscription) deliver() {
+	credits := priorityLaneWeights
+
+	for {
+		queued, ok := s.next(&credits)
+
+		if !ok {
+			// Every lane is empty, wait for the next message
+			select {
+			case queued = <-s.lanes[0]:
+			case queued = <-s.lanes[1]:
+			case queued = <-s.lanes[2]:
+			case <-s.isClosing:
+				return
+			}
+		}
+
+		// Messages may expire while waiting in the queue
+		if queued.message.Expired() {
+			if s.onExpired != nil {
+				s.onExpired(queued)
+			}
+
+			continue
+		}
+
+		select {
+		case *s.channel <- queued.message:
+			if s.onDelivered != nil {
+				s.onDelivered(queued)
+			}
+
+		case <-s.isClosing:
+			return
+		}
+	}
+}
+
+// next Takes a message from the highest priority lane with messages and credits left,
+// see priorityLaneWeights. Returns false when every lane is empty.
+func (s *subscription) next(credits *[priorityLanes]int) (queuedMessage, bool) {
+	for round := 0; round < 2; round++ {
+		for lane := range s.lanes {
+			if credits[lane] == 0 {
+				continue
+			}
+
+			select {
+			case queued := <-s.lanes[lane]:
+				credits[lane]--
+				return queued, true
+			default:
+			}
+		}
+
+		// Lanes with messages ran out of credits
+		*credits = priorityLaneWeights
+	}
+
+	return queuedMessage{}, false
+}
+
+// enqueue Queues message applying the overflow policy. Returns the messages dropped,
+// and false when the subscription must be disconnected.
+func (s *subscription) enqueue(message queuedMessage) ([]queuedMessage, bool) {
+	queue := s.lanes[laneOf(message.message.Priority)]
+
+	select {
+	case <-s.isClosing:
+		return nil, true
+	case queue <- message:
+		return nil, true
+	default:
+	}
+
+	dropped := []queuedMessage{}
+
+	switch s.options.OverflowPolicy {
+	case OverflowDropOldest:
+		s.queueLock.Lock()
+		defer s.queueLock.Unlock()
+
+		for {
+			select {
+			case queue <- message:
+				atomic.AddUint64(&s.dropped, uint64(len(dropped)))
+				return dropped, true
+			default:
+			}
+
+			select {
+			case oldest := <-queue:
+				dropped = append(dropped, oldest)
+			default:
+			}
+		}
+
+	case OverflowDropNewest:
+		dropped = append(dropped, message)
+
+	case OverflowDisconnect:
+		atomic.AddUint64(&s.dropped, 1)
+		return append(dropped, message), false
+
+	default:
+		timeout := time.NewTimer(s.options.BlockTimeout)
+		defer timeout.Stop()
+
+		select {
+		case queue <- message:
+		case <-s.isClosing:
+		case <-timeout.C:
+			dropped = append(dropped, message)
+		}
+	}
+
+	atomic.AddUint64(&s.dropped, uint64(len(dropped)))
+
+	return dropped, true
+}
+
+// accepts Checks message against the subscription filter, if any.
+func (s *subscription) accepts(context *filterContext) bool {
+	return s.filter == nil || s.filter.matches(context)
+}
+
+func (s *subscription) queued() int {
+	queued := 0
+
+	for _, queue := range s.lanes {
+		queued += len(queue)
+	}
+
+	return queued
+}
+
+// queuedByPriority Messages waiting in every lane, indexed by priority name.
+func (s *subscription) queuedByPriority() map[string]int {
+	queued := make(map[string]int, priorityLanes)
+
+	for _, priority := range events.Priorities {
+		queued[priority.String()] = len(s.lanes[laneOf(priority)])
+	}
+
+	return queued
+}
+
+func (s *subscription) close() {
+	s.closeOnce.Do(func() {
+		close(s.isClosing)
+	})
+}
+
+func (s *subscription) stats() SubscriptionStats {
+	return SubscriptionStats{
+		Pattern:          s.pattern,
+		Group:            s.options.Group,
+		Filter:           s.options.Filter,
+		OverflowPolicy:   s.options.OverflowPolicy.String(),
+		QueueSize:        s.options.QueueSize,
+		Queued:           s.queued(),
+		QueuedByPriority: s.queuedByPriority(),
+		Dropped:          atomic.LoadUint64(&s.dropped),
+	}
+}
@@ -0,0 +1,60 @@
+package bus
+
+// subscriptionGroup Balancing state of a group of subscriptions, see SubscriptionOptions.Group
+type subscriptionGroup struct {
+	balancing GroupBalancing
+	members   int
+	turn      uint64
+}
+
+// pick Chooses which one of the matching group members gets the message.
+func (group *subscriptionGroup) pick(candidates []*subscription) *subscription {
+	group.turn++
+	chosen := candidates[group.turn%uint64(len(candidates))]
+
+	if group.balancing != GroupLeastLoaded {
+		return chosen
+	}
+
+	for i := range candidates {
+		// Starting at the current turn, so ties are resolved in turns too
+		candidate := candidates[(group.turn+uint64(i))%uint64(len(candidates))]
+
+		if candidate.queued() < chosen.queued() {
+			chosen = candidate
+		}
+	}
+
+	return chosen
+}
+
+// recipients Keeps every ungrouped subscription and one member of every group.
+func recipients(matches []*subscription, groups map[string]*subscriptionGroup) []*subscription {
+	selected := []*subscription{}
+	candidates := make(map[string][]*subscription)
+	order := []string{}
+
+	for _, s := range matches {
+		name := s.options.Group
+
+		if name == "" {
+			selected = append(selected, s)
+			continue
+		}
+
+		if _, ok := candidates[name]; !ok {
+			order = append(order, name)
+		}
+
+		candidates[name] = append(candidates[name], s)
+	}
+
+	for _, name := range order {
+		// The group may be gone if its members unsubscribed since matching
+		if group, ok := groups[name]; ok {
+			selected = append(selected, group.pick(candidates[name]))
+		}
+	}
+
+	return selected
+}
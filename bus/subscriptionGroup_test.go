@@ -0,0 +1,48 @@
+package bus
+
+import (
+	"testing"
+
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+func TestGroupsShouldPickMembersInTurns(t *testing.T) {
+	group := &subscriptionGroup{balancing: GroupRoundRobin}
+	a := newSubscription("topic", nil, SubscriptionOptions{Group: "workers"})
+	b := newSubscription("topic", nil, SubscriptionOptions{Group: "workers"})
+
+	first := group.pick([]*subscription{a, b})
+	second := group.pick([]*subscription{a, b})
+
+	assert.Assert(t, first != second)
+	assert.Assert(t, group.pick([]*subscription{a, b}) == first)
+}
+
+func TestLeastLoadedGroupsShouldPickMembersWithFewerQueuedMessages(t *testing.T) {
+	group := &subscriptionGroup{balancing: GroupLeastLoaded}
+	busy := newSubscription("topic", nil, SubscriptionOptions{Group: "workers"})
+	idle := newSubscription("topic", nil, SubscriptionOptions{Group: "workers"})
+
+	busy.enqueue(queuedMessage{"topic", events.NewMessage(nil, "", events.Default)})
+
+	for i := 0; i < 3; i++ {
+		assert.Assert(t, group.pick([]*subscription{busy, idle}) == idle)
+	}
+}
+
+func TestRecipientsShouldIncludeOneMemberPerGroup(t *testing.T) {
+	groups := map[string]*subscriptionGroup{
+		"storage": {},
+		"metrics": {},
+	}
+
+	matches := []*subscription{
+		newSubscription("topic", nil, SubscriptionOptions{}),
+		newSubscription("topic", nil, SubscriptionOptions{Group: "storage"}),
+		newSubscription("topic", nil, SubscriptionOptions{Group: "storage"}),
+		newSubscription("#", nil, SubscriptionOptions{Group: "metrics"}),
+	}
+
+	assert.Assert(t, len(recipients(matches, groups)) == 3)
+}
@@ -0,0 +1,238 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/events"
+)
+
+var (
+	ErrDuplicateSubscription           = errors.New("channel is already subscribed to this pattern")
+	ErrSubscriptionOptionsNotSupported = errors.New("message bus does not support subscription options")
+	ErrSubscriptionStatsNotSupported   = errors.New("message bus does not support subscription stats")
+	ErrUnsubscribed                    = errors.New("subscription was unsubscribed")
+	ErrSubscriptionDisconnected        = errors.New("subscription was disconnected, its queue overflowed")
+)
+
+// BusContextSubscriber Optional MessageBus capability, subscriptions owning their channel
+// and ending with a context, see Subscribe.
+type BusContextSubscriber interface {
+	SubscribeContext(ctx context.Context, pattern string, opts ...SubscriptionOption) (*Subscription, error)
+}
+
+// BusOptionsSubscriber Optional MessageBus capability, subscriptions configured with
+// SubscriptionOptions.
+type BusOptionsSubscriber interface {
+	SubscribeWithOptions(pattern string, channel *chan events.Message, options SubscriptionOptions) error
+}
+
+// BusStatsProvider Optional MessageBus capability, see SubscriptionStats.
+type BusStatsProvider interface {
+	SubscriptionStats(pattern string, channel *chan events.Message) (SubscriptionStats, error)
+}
+
+// SubscriptionOption Sets one of the SubscriptionOptions, see Subscribe.
+type SubscriptionOption func(options *SubscriptionOptions)
+
+// WithQueueSize See SubscriptionOptions.QueueSize
+func WithQueueSize(size int) SubscriptionOption {
+	return func(options *SubscriptionOptions) {
+		options.QueueSize = size
+	}
+}
+
+// WithOverflowPolicy See SubscriptionOptions.OverflowPolicy and BlockTimeout, which is
+// only used by OverflowBlock.
+func WithOverflowPolicy(policy OverflowPolicy, blockTimeout time.Duration) SubscriptionOption {
+	return func(options *SubscriptionOptions) {
+		options.OverflowPolicy = policy
+		options.BlockTimeout = blockTimeout
+	}
+}
+
+// WithGroup See SubscriptionOptions.Group and GroupBalancing
+func WithGroup(name string, balancing GroupBalancing) SubscriptionOption {
+	return func(options *SubscriptionOptions) {
+		options.Group = name
+		options.GroupBalancing = balancing
+	}
+}
+
+// WithFilter See SubscriptionOptions.Filter
+func WithFilter(expression string) SubscriptionOption {
+	return func(options *SubscriptionOptions) {
+		options.Filter = expression
+	}
+}
+
+// newSubscriptionOptions Returns the SubscriptionOptions set by opts.
+func newSubscriptionOptions(opts ...SubscriptionOption) SubscriptionOptions {
+	options := SubscriptionOptions{}
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return options
+}
+
+// Subscription Handle of a subscription, see Subscribe. Buses implementing
+// BusContextSubscriber keep one for every subscription, their Subscribe and Unsubscribe
+// methods work through it.
+type Subscription struct {
+	eventBus BusSubscriber
+	pattern  string
+	channel  *chan events.Message
+	remove   func() (bool, error) // Removes the subscription from eventBus, false if it already was
+	done     chan struct{}
+	err      error
+	lock     sync.Mutex // Held while removing, so every caller returns once it is removed
+}
+
+func newSubscriptionHandle(eventBus BusSubscriber, pattern string, channel *chan events.Message, remove func() (bool, error)) *Subscription {
+	return &Subscription{
+		eventBus: eventBus,
+		pattern:  pattern,
+		channel:  channel,
+		remove:   remove,
+		done:     make(chan struct{}),
+	}
+}
+
+// Subscribe Subscribes to pattern through eventBus and returns the subscription handle,
+// which owns the channel messages are delivered to.
+// The subscription ends when ctx is done, when Unsubscribe is called or when the bus
+// disconnects it (see OverflowDisconnect), whatever happens first.
+// Buses not implementing BusContextSubscriber are adapted through their channel based
+// methods, options then require eventBus to implement BusOptionsSubscriber.
+func Subscribe(ctx context.Context, eventBus BusSubscriber, pattern string, opts ...SubscriptionOption) (*Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if subscriber, ok := eventBus.(BusContextSubscriber); ok {
+		return subscriber.SubscribeContext(ctx, pattern, opts...)
+	}
+
+	channel := make(chan events.Message)
+	subscription := newSubscriptionHandle(eventBus, pattern, &channel, func() (bool, error) {
+		err := eventBus.Unsubscribe(pattern, &channel)
+		return err == nil, err
+	})
+
+	var err error
+
+	if subscriber, ok := eventBus.(BusOptionsSubscriber); ok {
+		options := newSubscriptionOptions(opts...)
+		options.OnDisconnect = func(pattern string, channel *chan events.Message) {
+			subscription.disconnected()
+		}
+
+		err = subscriber.SubscribeWithOptions(pattern, &channel, options)
+	} else if len(opts) > 0 {
+		err = ErrSubscriptionOptionsNotSupported
+	} else {
+		err = eventBus.Subscribe(pattern, &channel)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	subscription.endWith(ctx)
+
+	return subscription, nil
+}
+
+// C Channel messages are delivered to. It is not closed when the subscription ends,
+// select on Done too.
+func (subscription *Subscription) C() <-chan events.Message {
+	return *subscription.channel
+}
+
+// Done Closed when the subscription ends, once it was removed from the bus, see Err.
+func (subscription *Subscription) Done() <-chan struct{} {
+	return subscription.done
+}
+
+// Err Why the subscription ended: ErrUnsubscribed, ErrSubscriptionDisconnected or the
+// context error. Nil while it is active.
+func (subscription *Subscription) Err() error {
+	subscription.lock.Lock()
+	defer subscription.lock.Unlock()
+
+	return subscription.err
+}
+
+// Pattern Topic pattern the subscription was made to.
+func (subscription *Subscription) Pattern() string {
+	return subscription.pattern
+}
+
+// Unsubscribe Ends the subscription, it returns once the subscription was removed from
+// the bus, even when another goroutine is ending it. Calling it again does nothing.
+func (subscription *Subscription) Unsubscribe() error {
+	_, err := subscription.unsubscribe(ErrUnsubscribed)
+	return err
+}
+
+// Stats Returns the subscription queue stats if the bus implements BusStatsProvider.
+func (subscription *Subscription) Stats() (SubscriptionStats, error) {
+	provider, ok := subscription.eventBus.(BusStatsProvider)
+
+	if !ok {
+		return SubscriptionStats{}, ErrSubscriptionStatsNotSupported
+	}
+
+	return provider.SubscriptionStats(subscription.pattern, subscription.channel)
+}
+
+// endWith Unsubscribes when ctx is done, unless the subscription ended before.
+func (subscription *Subscription) endWith(ctx context.Context) {
+	if ctx.Done() == nil {
+		return
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			subscription.unsubscribe(ctx.Err())
+		case <-subscription.done:
+		}
+	}()
+}
+
+// unsubscribe Ends the subscription with reason, returns true when this call removed it
+// from the bus.
+func (subscription *Subscription) unsubscribe(reason error) (bool, error) {
+	subscription.lock.Lock()
+	defer subscription.lock.Unlock()
+
+	if subscription.err != nil {
+		return false, nil
+	}
+
+	removed, err := subscription.remove()
+	subscription.end(reason)
+
+	return removed, err
+}
+
+// disconnected Ends a subscription the bus already removed.
+func (subscription *Subscription) disconnected() {
+	subscription.lock.Lock()
+	defer subscription.lock.Unlock()
+
+	if subscription.err == nil {
+		subscription.end(ErrSubscriptionDisconnected)
+	}
+}
+
+// end Records reason and closes done, the lock must be held.
+func (subscription *Subscription) end(reason error) {
+	subscription.err = reason
+	close(subscription.done)
+}
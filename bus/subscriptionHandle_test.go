@@ -0,0 +1,134 @@
+package bus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+func TestSubscriptionHandlesShouldReceiveMessages(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+
+	subscription, err := Subscribe(context.Background(), eventBus, "devices::*::send", WithQueueSize(8), WithFilter(`valve == "off"`))
+	assert.NilError(t, err)
+
+	eventBus.Publish("devices::abc-123::send", events.NewMessage([]byte(`{"valve": "on"}`), "", events.Command))
+	eventBus.Publish("devices::abc-123::send", events.NewMessage([]byte(`{"valve": "off"}`), "", events.Command))
+
+	select {
+	case m := <-subscription.C():
+		assert.Assert(t, string(m.Payload) == `{"valve": "off"}`)
+	case <-time.After(time.Second):
+		assert.Assert(t, false)
+	}
+
+	stats, err := subscription.Stats()
+	assert.NilError(t, err)
+	assert.Assert(t, stats.QueueSize == 8)
+	assert.Assert(t, stats.Filter == `valve == "off"`)
+
+	assert.NilError(t, subscription.Unsubscribe())
+	assert.NilError(t, subscription.Unsubscribe())
+	assert.Assert(t, subscription.Err() == ErrUnsubscribed)
+	assert.Assert(t, eventBus.TotalSubscriptions == 0)
+}
+
+func TestSubscriptionHandlesShouldEndWithTheirContext(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	subscription, _ := Subscribe(ctx, eventBus, "topic")
+	assert.Assert(t, subscription.Err() == nil)
+
+	cancel()
+
+	select {
+	case <-subscription.Done():
+	case <-time.After(time.Second):
+		assert.Assert(t, false)
+	}
+
+	assert.Assert(t, subscription.Err() == context.Canceled)
+	assert.Assert(t, eventBus.TotalSubscriptions == 0)
+
+	_, err := Subscribe(ctx, eventBus, "topic")
+	assert.Assert(t, err == context.Canceled)
+}
+
+func TestSubscriptionHandlesShouldEndWhenDisconnected(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	subscription, _ := Subscribe(context.Background(), eventBus, "topic", WithQueueSize(1), WithOverflowPolicy(OverflowDisconnect, 0))
+
+	for i := 0; i < 3; i++ {
+		eventBus.Publish("topic", events.NewMessage(nil, "", events.Default))
+	}
+
+	select {
+	case <-subscription.Done():
+	case <-time.After(time.Second):
+		assert.Assert(t, false)
+	}
+
+	assert.Assert(t, subscription.Err() == ErrSubscriptionDisconnected)
+}
+
+// channelsOnlyBus Hides the optional capabilities of the bus it wraps
+type channelsOnlyBus struct {
+	MessageBus
+}
+
+func TestSubscriptionOptionsShouldRequireABusSupportingThem(t *testing.T) {
+	inMemory, _ := NewInMemoryEventBus()
+	eventBus := channelsOnlyBus{inMemory}
+
+	_, err := Subscribe(context.Background(), eventBus, "topic", WithQueueSize(8))
+	assert.Assert(t, err == ErrSubscriptionOptionsNotSupported)
+
+	subscription, err := Subscribe(context.Background(), eventBus, "topic")
+	assert.NilError(t, err)
+
+	_, err = subscription.Stats()
+	assert.Assert(t, err == ErrSubscriptionStatsNotSupported)
+}
+
+func TestDuplicateSubscriptionsShouldBeRejected(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	channel := make(chan events.Message)
+
+	assert.NilError(t, eventBus.Subscribe("topic", &channel))
+	assert.Assert(t, eventBus.Subscribe("topic", &channel) == ErrDuplicateSubscription)
+	assert.NilError(t, eventBus.Subscribe("topic::#", &channel))
+	assert.Assert(t, eventBus.TotalSubscriptions == 2)
+}
+
+func TestUnsubscribeShouldReturnOnceTheSubscriptionIsRemoved(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	subscription, _ := Subscribe(ctx, eventBus, "topic")
+
+	// Races the context goroutine, both must return after removing the subscription
+	cancel()
+	assert.NilError(t, subscription.Unsubscribe())
+	assert.Assert(t, eventBus.TotalSubscriptions == 0)
+}
+
+func TestChannelSubscriptionsShouldWorkThroughTheirHandle(t *testing.T) {
+	eventBus, _ := NewInMemoryEventBus()
+	subscription, _ := Subscribe(context.Background(), eventBus, "topic")
+
+	assert.Assert(t, eventBus.Subscribe("topic", subscription.channel) == ErrDuplicateSubscription)
+	assert.NilError(t, eventBus.Unsubscribe("topic", subscription.channel))
+
+	select {
+	case <-subscription.Done():
+	case <-time.After(time.Second):
+		assert.Assert(t, false)
+	}
+
+	assert.Assert(t, subscription.Err() == ErrUnsubscribed)
+	assert.Assert(t, eventBus.TotalSubscriptions == 0)
+}
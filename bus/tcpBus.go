@@ -0,0 +1,98 @@
+package bus
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/events"
+)
+
+// Networked bus wire protocol, shared by TCPBusServer and TCPBusClient. Every frame is a
+// JSON encoded tcpBusFrame followed by a new line:
+//   - subscribe, unsubscribe From clients, Topic is a subscription pattern.
+//   - publish From clients, Message is published on Topic. When ID is set the server
+//     answers with a published frame.
+//   - published From the server, the publish frame with the same ID was published, Error
+//     tells why it failed, i.e. nobody is subscribed to its topic.
+//   - message From the server, Message was published on Topic, which matches at least one
+//     of the client patterns.
+const (
+	tcpBusSubscribe   string = "subscribe"
+	tcpBusUnsubscribe string = "unsubscribe"
+	tcpBusPublish     string = "publish"
+	tcpBusPublished   string = "published"
+	tcpBusMessage     string = "message"
+
+	DefaultTCPBusMaxFrameSize   int           = 1024 * 1024
+	DefaultTCPBusWriteTimeout   time.Duration = 5 * time.Second
+	DefaultTCPBusPublishTimeout time.Duration = 5 * time.Second
+)
+
+var (
+	ErrBusIsDisconnected  = errors.New("networked bus is disconnected from its server")
+	ErrBusPublishTimedOut = errors.New("networked bus server did not answer the publish in time")
+)
+
+type tcpBusFrame struct {
+	Operation string          `json:"op"`
+	Topic     string          `json:"topic,omitempty"`
+	ID        uint64          `json:"id,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Message   *events.Message `json:"message,omitempty"`
+}
+
+// tcpBusConnection Frames reader and writer, writes are safe for concurrent use.
+type tcpBusConnection struct {
+	conn         net.Conn
+	scanner      *bufio.Scanner
+	writeTimeout time.Duration
+	writeMutex   sync.Mutex
+}
+
+func newTCPBusConnection(conn net.Conn, maxFrameSize int, writeTimeout time.Duration) *tcpBusConnection {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), maxFrameSize)
+
+	return &tcpBusConnection{
+		conn:         conn,
+		scanner:      scanner,
+		writeTimeout: writeTimeout,
+	}
+}
+
+func (connection *tcpBusConnection) read() (tcpBusFrame, error) {
+	frame := tcpBusFrame{}
+
+	if !connection.scanner.Scan() {
+		if err := connection.scanner.Err(); err != nil {
+			return frame, err
+		}
+
+		return frame, errors.New("networked bus connection closed")
+	}
+
+	err := json.Unmarshal(connection.scanner.Bytes(), &frame)
+
+	return frame, err
+}
+
+func (connection *tcpBusConnection) write(frame tcpBusFrame) error {
+	encoded, err := json.Marshal(frame)
+
+	if err != nil {
+		return err
+	}
+
+	connection.writeMutex.Lock()
+	defer connection.writeMutex.Unlock()
+
+	connection.conn.SetWriteDeadline(time.Now().Add(connection.writeTimeout))
+
+	_, err = connection.conn.Write(append(encoded, '\n'))
+
+	return err
+}
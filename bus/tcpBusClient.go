@@ -0,0 +1,322 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/events"
+)
+
+// TCPBusClient MessageBus shared with other processes through a TCPBusServer.
+//
+// Subscriptions are made on a local InMemoryEventBus, and their patterns registered on
+// the server, which forwards the matching messages. Publishing sends the message to the
+// server, so it is delivered to local subscribers too once it comes back, and waits up to
+// PublishTimeout for the server to publish it: like any MessageBus, Publish fails when
+// nobody, in any process, is subscribed to the topic. When the connection is lost the
+// client reconnects every ReconnectInterval and registers its patterns again, messages
+// published meanwhile fail with ErrBusIsDisconnected.
+type TCPBusClient struct {
+	ServerAddress     string
+	ReconnectInterval time.Duration
+	PublishTimeout    time.Duration
+	MaxFrameSize      int // Bytes
+	local             *InMemoryEventBus
+	connection        *tcpBusConnection
+	interests         map[string]int        // interests[pattern] => local subscriptions
+	published         map[uint64]chan error // published[publish frame ID] => server answer
+	lastPublishID     uint64
+	lock              sync.Mutex
+	closeOnce         sync.Once
+	isClosing         chan struct{}
+}
+
+// NewTCPBusClient Connects to the TCPBusServer at serverAddress.
+func NewTCPBusClient(serverAddress string) (*TCPBusClient, error) {
+	local, _ := NewInMemoryEventBus()
+
+	client := &TCPBusClient{
+		ServerAddress:     serverAddress,
+		ReconnectInterval: time.Second,
+		PublishTimeout:    DefaultTCPBusPublishTimeout,
+		MaxFrameSize:      DefaultTCPBusMaxFrameSize,
+		local:             local,
+		interests:         make(map[string]int),
+		published:         make(map[uint64]chan error),
+		isClosing:         make(chan struct{}),
+	}
+
+	connection, err := client.connect()
+
+	if err != nil {
+		return nil, err
+	}
+
+	go client.readFrames(connection)
+
+	return client, nil
+}
+
+// Connected Checks if the client is currently connected to the server.
+func (client *TCPBusClient) Connected() bool {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	return client.connection != nil
+}
+
+// Subscribe See MessageBus
+func (client *TCPBusClient) Subscribe(pattern string, channel *chan events.Message) error {
+	return client.SubscribeWithOptions(pattern, channel, SubscriptionOptions{})
+}
+
+// SubscribeWithOptions See InMemoryEventBus.SubscribeWithOptions
+func (client *TCPBusClient) SubscribeWithOptions(pattern string, channel *chan events.Message, options SubscriptionOptions) error {
+	onDisconnect := options.OnDisconnect
+
+	options.OnDisconnect = func(pattern string, channel *chan events.Message) {
+		client.loseInterest(pattern)
+
+		if onDisconnect != nil {
+			onDisconnect(pattern, channel)
+		}
+	}
+
+	if err := ValidateTopicPattern(pattern); err != nil {
+		return err
+	}
+
+	// Counted first, the local bus may disconnect the subscription while subscribing
+	client.addInterest(pattern)
+
+	if err := client.local.SubscribeWithOptions(pattern, channel, options); err != nil {
+		client.loseInterest(pattern)
+		return err
+	}
+
+	return nil
+}
+
+// Unsubscribe See MessageBus
+func (client *TCPBusClient) Unsubscribe(pattern string, channel *chan events.Message) error {
+	removed, err := client.local.unsubscribe(pattern, channel)
+
+	if removed {
+		client.loseInterest(pattern)
+	}
+
+	return err
+}
+
+// addInterest Counts a local subscription to pattern, the server is asked to send its
+// messages on the first one.
+func (client *TCPBusClient) addInterest(pattern string) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	client.interests[pattern]++
+
+	if client.interests[pattern] == 1 && client.connection != nil {
+		// On failure the pattern is registered again once reconnected
+		client.connection.write(tcpBusFrame{Operation: tcpBusSubscribe, Topic: pattern})
+	}
+}
+
+// loseInterest Counts a local subscription to pattern removed, the server stops sending
+// its messages after the last one.
+func (client *TCPBusClient) loseInterest(pattern string) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	if client.interests[pattern] == 0 {
+		return
+	}
+
+	client.interests[pattern]--
+
+	if client.interests[pattern] > 0 {
+		return
+	}
+
+	delete(client.interests, pattern)
+
+	if client.connection != nil {
+		client.connection.write(tcpBusFrame{Operation: tcpBusUnsubscribe, Topic: pattern})
+	}
+}
+
+// Publish Sends message to the server, see TCPBusClient.
+func (client *TCPBusClient) Publish(topic string, message events.Message) error {
+	if err := ValidateTopic(topic); err != nil {
+		return err
+	}
+
+	client.lock.Lock()
+	connection := client.connection
+
+	if connection == nil {
+		client.lock.Unlock()
+		return ErrBusIsDisconnected
+	}
+
+	client.lastPublishID++
+	id := client.lastPublishID
+	answer := make(chan error, 1)
+	client.published[id] = answer
+	client.lock.Unlock()
+
+	defer func() {
+		client.lock.Lock()
+		delete(client.published, id)
+		client.lock.Unlock()
+	}()
+
+	if err := connection.write(tcpBusFrame{Operation: tcpBusPublish, Topic: topic, ID: id, Message: &message}); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-answer:
+		return err
+	case <-time.After(client.PublishTimeout):
+		return ErrBusPublishTimedOut
+	}
+}
+
+// Request See BusRequester
+func (client *TCPBusClient) Request(ctx context.Context, topic string, message events.Message) (events.Message, error) {
+	return subscribeAndRequest(ctx, client, topic, message)
+}
+
+// Close Disconnects from the server, the client can not be used anymore.
+func (client *TCPBusClient) Close() error {
+	client.closeOnce.Do(func() {
+		close(client.isClosing)
+	})
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	if client.connection == nil {
+		return nil
+	}
+
+	err := client.connection.conn.Close()
+	client.connection = nil
+
+	return err
+}
+
+// connect Dials the server and registers the subscribed patterns.
+func (client *TCPBusClient) connect() (*tcpBusConnection, error) {
+	conn, err := net.Dial("tcp", client.ServerAddress)
+
+	if err != nil {
+		return nil, err
+	}
+
+	connection := newTCPBusConnection(conn, client.MaxFrameSize, DefaultTCPBusWriteTimeout)
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	select {
+	case <-client.isClosing:
+		conn.Close()
+		return nil, ErrBusIsDisconnected
+	default:
+	}
+
+	for pattern := range client.interests {
+		if err := connection.write(tcpBusFrame{Operation: tcpBusSubscribe, Topic: pattern}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	client.connection = connection
+
+	return connection, nil
+}
+
+// readFrames Delivers forwarded messages to local subscribers until the connection is
+// lost, then reconnects.
+func (client *TCPBusClient) readFrames(connection *tcpBusConnection) {
+	for {
+		frame, err := connection.read()
+
+		if err != nil {
+			break
+		}
+
+		switch frame.Operation {
+		case tcpBusMessage:
+			if frame.Message != nil {
+				client.local.Publish(frame.Topic, *frame.Message)
+			}
+
+		case tcpBusPublished:
+			client.answerPublish(frame)
+		}
+	}
+
+	client.lock.Lock()
+
+	if client.connection == connection {
+		client.connection = nil
+	}
+
+	// Their answers, if any, were lost with the connection
+	for id, answer := range client.published {
+		answer <- ErrBusIsDisconnected
+		delete(client.published, id)
+	}
+
+	client.lock.Unlock()
+	connection.conn.Close()
+
+	client.reconnect()
+}
+
+// answerPublish Wakes up the Publish waiting for frame.
+func (client *TCPBusClient) answerPublish(frame tcpBusFrame) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	answer, waiting := client.published[frame.ID]
+
+	if !waiting {
+		return
+	}
+
+	delete(client.published, frame.ID)
+
+	if frame.Error != "" {
+		answer <- errors.New(frame.Error)
+	} else {
+		answer <- nil
+	}
+}
+
+func (client *TCPBusClient) reconnect() {
+	for {
+		select {
+		case <-client.isClosing:
+			return
+		case <-time.After(client.ReconnectInterval):
+		}
+
+		connection, err := client.connect()
+
+		if err != nil {
+			continue
+		}
+
+		go client.readFrames(connection)
+
+		return
+	}
+}
@@ -0,0 +1,148 @@
+package bus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+func TestTCPBusClientsShouldShareTopics(t *testing.T) {
+	server, _ := newTestTCPBusServer(t)
+	defer server.Close()
+
+	publisher, err := NewTCPBusClient(server.Addr().String())
+	assert.NilError(t, err)
+	defer publisher.Close()
+
+	subscriber, _ := NewTCPBusClient(server.Addr().String())
+	defer subscriber.Close()
+
+	channel := make(chan events.Message)
+	assert.NilError(t, subscriber.Subscribe("devices::#", &channel))
+	time.Sleep(20 * time.Millisecond)
+
+	assert.NilError(t, publisher.Publish("devices::abc-123::send", events.NewMessage([]byte{0xFF}, "", events.Command)))
+
+	select {
+	case message := <-channel:
+		assert.DeepEqual(t, message.Payload, []byte{0xFF})
+	case <-time.After(time.Second):
+		t.Fatal("message was not received")
+	}
+}
+
+func TestTCPBusClientsShouldSupportRequests(t *testing.T) {
+	server, local := newTestTCPBusServer(t)
+	defer server.Close()
+
+	client, _ := NewTCPBusClient(server.Addr().String())
+	defer client.Close()
+
+	requests := make(chan events.Message)
+	local.Subscribe("devices::abc-123::send", &requests)
+
+	go func() {
+		request := <-requests
+		Reply(server, request, []byte("21"))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	time.Sleep(20 * time.Millisecond)
+
+	reply, err := client.Request(ctx, "devices::abc-123::send", events.NewMessage([]byte("temperature"), "", events.Query))
+
+	assert.NilError(t, err)
+	assert.Assert(t, string(reply.Payload) == "21")
+}
+
+func TestTCPBusClientsShouldReconnectAndSubscribeAgain(t *testing.T) {
+	server, _ := newTestTCPBusServer(t)
+	address := server.Addr().String()
+
+	client, _ := NewTCPBusClient(address)
+	client.ReconnectInterval = 20 * time.Millisecond
+	defer client.Close()
+
+	channel := make(chan events.Message)
+	client.Subscribe("connections::*", &channel)
+
+	server.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	assert.Assert(t, !client.Connected())
+	assert.Assert(t, client.Publish("connections::closed", events.NewMessage(nil, "", events.Default)) == ErrBusIsDisconnected)
+
+	local, _ := NewInMemoryEventBus()
+	server = NewTCPBusServer(local, address)
+	assert.NilError(t, server.Start())
+	defer server.Close()
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Assert(t, client.Connected())
+
+	server.Publish("connections::established", events.NewMessage([]byte("again"), "", events.Default))
+
+	select {
+	case message := <-channel:
+		assert.Assert(t, string(message.Payload) == "again")
+	case <-time.After(time.Second):
+		t.Fatal("message was not received")
+	}
+}
+
+func TestTCPBusClientsShouldOnlyForgetPatternsWithoutLocalSubscriptions(t *testing.T) {
+	server, _ := newTestTCPBusServer(t)
+	defer server.Close()
+
+	publisher, _ := NewTCPBusClient(server.Addr().String())
+	defer publisher.Close()
+
+	subscriber, _ := NewTCPBusClient(server.Addr().String())
+	defer subscriber.Close()
+
+	channel := make(chan events.Message)
+	neverSubscribed := make(chan events.Message)
+
+	assert.NilError(t, subscriber.Subscribe("devices::#", &channel))
+	assert.Assert(t, subscriber.Subscribe("devices::#", &channel) == ErrDuplicateSubscription)
+	assert.NilError(t, subscriber.Unsubscribe("devices::#", &neverSubscribed))
+	time.Sleep(20 * time.Millisecond)
+
+	assert.NilError(t, publisher.Publish("devices::abc-123::send", events.NewMessage([]byte("on"), "", events.Command)))
+
+	select {
+	case message := <-channel:
+		assert.Assert(t, string(message.Payload) == "on")
+	case <-time.After(time.Second):
+		t.Fatal("message was not received")
+	}
+
+	assert.NilError(t, subscriber.Unsubscribe("devices::#", &channel))
+	subscriber.Unsubscribe("devices::#", &channel)
+
+	subscriber.lock.Lock()
+	_, interested := subscriber.interests["devices::#"]
+	subscriber.lock.Unlock()
+
+	assert.Assert(t, !interested)
+}
+
+func TestTCPBusClientsShouldFailToPublishWhenNobodyIsSubscribed(t *testing.T) {
+	server, _ := newTestTCPBusServer(t)
+	defer server.Close()
+
+	client, _ := NewTCPBusClient(server.Addr().String())
+	defer client.Close()
+
+	assert.Assert(t, client.Publish("devices::abc-123::send", events.NewMessage(nil, "", events.Command)) != nil)
+
+	channel := make(chan events.Message, 1)
+	client.Subscribe("devices::#", &channel)
+
+	assert.NilError(t, client.Publish("devices::abc-123::send", events.NewMessage(nil, "", events.Command)))
+}
@@ -0,0 +1,271 @@
+package bus
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/nnset/iot-cloud-connector/events"
+)
+
+// BusTopicMatcher Optional MessageBus capability, checks if publishing on topic would
+// reach at least one subscription.
+type BusTopicMatcher interface {
+	HasSubscribers(topic string) bool
+}
+
+// TCPBusServer Shares a local MessageBus with other processes connected through
+// TCPBusClient. It is a MessageBus itself: messages published through the server, by
+// local code or by clients, are published on the local bus and forwarded to every client
+// subscribed to a matching pattern. Messages published directly on the local bus stay local.
+//
+// Clients that can not keep up, and fill their SessionQueueSize, are disconnected and
+// expected to reconnect.
+type TCPBusServer struct {
+	ListenAddress    string
+	MaxFrameSize     int // Bytes
+	SessionQueueSize int // Frames
+	eventBus         MessageBus
+	listener         net.Listener
+	sessions         map[*tcpBusSession]bool
+	sessionsMutex    sync.Mutex
+}
+
+// tcpBusSession A connected client, frames are written by its own goroutine from queue.
+type tcpBusSession struct {
+	connection *tcpBusConnection
+	patterns   map[string]bool
+	queue      chan tcpBusFrame
+	closeOnce  sync.Once
+	isClosing  chan struct{}
+}
+
+// NewTCPBusServer Creates a new instance of TCPBusServer sharing eventBus.
+func NewTCPBusServer(eventBus MessageBus, listenAddress string) *TCPBusServer {
+	return &TCPBusServer{
+		ListenAddress:    listenAddress,
+		MaxFrameSize:     DefaultTCPBusMaxFrameSize,
+		SessionQueueSize: 256,
+		eventBus:         eventBus,
+		sessions:         make(map[*tcpBusSession]bool),
+	}
+}
+
+// Start Listens on ListenAddress and accepts clients in the background.
+func (server *TCPBusServer) Start() error {
+	listener, err := net.Listen("tcp", server.ListenAddress)
+
+	if err != nil {
+		return err
+	}
+
+	server.listener = listener
+
+	go server.acceptClients()
+
+	return nil
+}
+
+// Addr Address the server is listening on, useful when ListenAddress port is 0.
+func (server *TCPBusServer) Addr() net.Addr {
+	return server.listener.Addr()
+}
+
+// Close Stops accepting clients and disconnects the connected ones.
+func (server *TCPBusServer) Close() error {
+	err := server.listener.Close()
+
+	server.sessionsMutex.Lock()
+	defer server.sessionsMutex.Unlock()
+
+	for session := range server.sessions {
+		session.close()
+	}
+
+	return err
+}
+
+// ConnectedClients
+func (server *TCPBusServer) ConnectedClients() int {
+	server.sessionsMutex.Lock()
+	defer server.sessionsMutex.Unlock()
+
+	return len(server.sessions)
+}
+
+// Subscribe Subscribes to the local bus.
+func (server *TCPBusServer) Subscribe(pattern string, channel *chan events.Message) error {
+	return server.eventBus.Subscribe(pattern, channel)
+}
+
+// Unsubscribe Unsubscribes from the local bus.
+func (server *TCPBusServer) Unsubscribe(pattern string, channel *chan events.Message) error {
+	return server.eventBus.Unsubscribe(pattern, channel)
+}
+
+// Publish Publishes message on the local bus and forwards it to subscribed clients.
+// It only fails if nobody, local or remote, is subscribed to topic. Messages only
+// forwarded are not published locally when the local bus implements BusTopicMatcher,
+// so they are not dead lettered there.
+func (server *TCPBusServer) Publish(topic string, message events.Message) error {
+	if err := ValidateTopic(topic); err != nil {
+		return err
+	}
+
+	forwarded := server.forward(topic, message)
+
+	if matcher, ok := server.eventBus.(BusTopicMatcher); ok && forwarded && !matcher.HasSubscribers(topic) {
+		return nil
+	}
+
+	err := server.eventBus.Publish(topic, message)
+
+	if forwarded {
+		return nil
+	}
+
+	return err
+}
+
+// Request See BusRequester
+func (server *TCPBusServer) Request(ctx context.Context, topic string, message events.Message) (events.Message, error) {
+	return subscribeAndRequest(ctx, server, topic, message)
+}
+
+// forward Queues message for every client with a pattern matching topic, returns false
+// when there was none.
+func (server *TCPBusServer) forward(topic string, message events.Message) bool {
+	server.sessionsMutex.Lock()
+	defer server.sessionsMutex.Unlock()
+
+	forwarded := false
+	frame := tcpBusFrame{Operation: tcpBusMessage, Topic: topic, Message: &message}
+
+	for session := range server.sessions {
+		if !session.matches(topic) {
+			continue
+		}
+
+		forwarded = true
+		session.send(frame)
+	}
+
+	return forwarded
+}
+
+func (server *TCPBusServer) acceptClients() {
+	for {
+		conn, err := server.listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		session := &tcpBusSession{
+			connection: newTCPBusConnection(conn, server.MaxFrameSize, DefaultTCPBusWriteTimeout),
+			patterns:   make(map[string]bool),
+			queue:      make(chan tcpBusFrame, server.SessionQueueSize),
+			isClosing:  make(chan struct{}),
+		}
+
+		server.sessionsMutex.Lock()
+		server.sessions[session] = true
+		server.sessionsMutex.Unlock()
+
+		go server.writeFrames(session)
+		go server.readFrames(session)
+	}
+}
+
+func (server *TCPBusServer) readFrames(session *tcpBusSession) {
+	defer func() {
+		server.sessionsMutex.Lock()
+		delete(server.sessions, session)
+		server.sessionsMutex.Unlock()
+
+		session.close()
+	}()
+
+	for {
+		frame, err := session.connection.read()
+
+		if err != nil {
+			return
+		}
+
+		switch frame.Operation {
+		case tcpBusSubscribe:
+			if ValidateTopicPattern(frame.Topic) == nil {
+				server.sessionsMutex.Lock()
+				session.patterns[frame.Topic] = true
+				server.sessionsMutex.Unlock()
+			}
+
+		case tcpBusUnsubscribe:
+			server.sessionsMutex.Lock()
+			delete(session.patterns, frame.Topic)
+			server.sessionsMutex.Unlock()
+
+		case tcpBusPublish:
+			if frame.Message == nil {
+				continue
+			}
+
+			err := server.Publish(frame.Topic, *frame.Message)
+
+			if frame.ID == 0 {
+				continue
+			}
+
+			published := tcpBusFrame{Operation: tcpBusPublished, ID: frame.ID}
+
+			if err != nil {
+				published.Error = err.Error()
+			}
+
+			session.send(published)
+		}
+	}
+}
+
+func (server *TCPBusServer) writeFrames(session *tcpBusSession) {
+	for {
+		select {
+		case frame := <-session.queue:
+			if session.connection.write(frame) != nil {
+				session.close()
+				return
+			}
+
+		case <-session.isClosing:
+			return
+		}
+	}
+}
+
+// matches Checks if any of the session patterns matches topic, sessionsMutex must be held.
+func (session *tcpBusSession) matches(topic string) bool {
+	for pattern := range session.patterns {
+		if TopicMatches(pattern, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// send Queues frame, a session whose queue is full is closed.
+func (session *tcpBusSession) send(frame tcpBusFrame) {
+	select {
+	case session.queue <- frame:
+	default:
+		session.close()
+	}
+}
+
+func (session *tcpBusSession) close() {
+	session.closeOnce.Do(func() {
+		close(session.isClosing)
+		session.connection.conn.Close()
+	})
+}
@@ -0,0 +1,95 @@
+package bus
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+func newTestTCPBusServer(t *testing.T) (*TCPBusServer, *InMemoryEventBus) {
+	local, _ := NewInMemoryEventBus()
+	server := NewTCPBusServer(local, "127.0.0.1:0")
+	assert.NilError(t, server.Start())
+
+	return server, local
+}
+
+func TestTCPBusServerShouldForwardMessagesToSubscribedClients(t *testing.T) {
+	server, _ := newTestTCPBusServer(t)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.NilError(t, err)
+	defer conn.Close()
+
+	conn.Write([]byte("{\"op\":\"subscribe\",\"topic\":\"system_metrics::*\"}\n"))
+	time.Sleep(20 * time.Millisecond)
+
+	assert.Assert(t, server.ConnectedClients() == 1)
+	assert.NilError(t, server.Publish("system_metrics::allocated_memory", events.NewMessage([]byte("4"), "", events.Default)))
+
+	// Nobody is subscribed, locally or remotely
+	assert.Assert(t, server.Publish("connections::closed", events.NewMessage(nil, "", events.Default)) != nil)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.NilError(t, err)
+
+	frame := tcpBusFrame{}
+	assert.NilError(t, json.Unmarshal([]byte(strings.TrimSpace(line)), &frame))
+	assert.Assert(t, frame.Operation == tcpBusMessage)
+	assert.Assert(t, frame.Topic == "system_metrics::allocated_memory")
+	assert.Assert(t, string(frame.Message.Payload) == "4")
+}
+
+func TestTCPBusServerShouldPublishClientMessagesLocally(t *testing.T) {
+	server, local := newTestTCPBusServer(t)
+	defer server.Close()
+
+	channel := make(chan events.Message)
+	local.Subscribe("connections::closed", &channel)
+
+	conn, _ := net.Dial("tcp", server.Addr().String())
+	defer conn.Close()
+
+	conn.Write([]byte("{\"op\":\"publish\",\"topic\":\"connections::closed\",\"message\":{\"id\":\"1\",\"payload\":\"bye\"}}\n"))
+
+	select {
+	case message := <-channel:
+		assert.Assert(t, string(message.Payload) == "bye")
+	case <-time.After(time.Second):
+		t.Fatal("message was not received")
+	}
+}
+
+func TestTCPBusServerShouldNotDeadLetterMessagesOnlyDeliveredToClients(t *testing.T) {
+	server, local := newTestTCPBusServer(t)
+	defer server.Close()
+
+	deadLetters := make(chan events.Message, 1)
+	local.Subscribe(local.DeadLetterTopic, &deadLetters)
+
+	client, _ := NewTCPBusClient(server.Addr().String())
+	defer client.Close()
+
+	channel := make(chan events.Message, 1)
+	client.Subscribe("system_metrics::*", &channel)
+	time.Sleep(20 * time.Millisecond)
+
+	assert.NilError(t, server.Publish("system_metrics::allocated_memory", events.NewMessage([]byte("4"), "", events.Default)))
+
+	select {
+	case <-channel:
+	case <-time.After(time.Second):
+		t.Fatal("message was not received")
+	}
+
+	assert.Assert(t, local.DeadLettersCount() == 0)
+	assert.Assert(t, len(deadLetters) == 0)
+}
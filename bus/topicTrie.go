@@ -0,0 +1,241 @@
+package bus
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nnset/iot-cloud-connector/events"
+)
+
+// Topics are hierarchical, levels are separated by TopicLevelSeparator, e.g. connections::message_received.
+// Subscriptions may use wildcard levels:
+//   - SingleLevelWildcard matches exactly one level: system_metrics::* matches system_metrics::allocated_memory
+//   - MultiLevelWildcard matches any number of levels, including none, and must be the last level:
+//     devices::# matches devices, devices::abc-123 and devices::abc-123::send
+const (
+	TopicLevelSeparator string = "::"
+	SingleLevelWildcard string = "*"
+	MultiLevelWildcard  string = "#"
+)
+
+// ValidateTopicPattern Checks that pattern is a valid subscription pattern.
+func ValidateTopicPattern(pattern string) error {
+	if pattern == "" {
+		return fmt.Errorf("topic pattern can not be empty")
+	}
+
+	levels := strings.Split(pattern, TopicLevelSeparator)
+
+	for i, level := range levels {
+		if level == MultiLevelWildcard && i != len(levels)-1 {
+			return fmt.Errorf("topic pattern %s, %s wildcard must be the last level", pattern, MultiLevelWildcard)
+		}
+
+		if level != MultiLevelWildcard && level != SingleLevelWildcard &&
+			strings.ContainsAny(level, SingleLevelWildcard+MultiLevelWildcard) {
+			return fmt.Errorf("topic pattern %s, wildcards must take a whole level", pattern)
+		}
+	}
+
+	return nil
+}
+
+// ValidateTopic Checks that topic is a valid topic to publish to, wildcards are not allowed.
+func ValidateTopic(topic string) error {
+	if topic == "" {
+		return fmt.Errorf("topic can not be empty")
+	}
+
+	if strings.ContainsAny(topic, SingleLevelWildcard+MultiLevelWildcard) {
+		return fmt.Errorf("topic %s, wildcards are not allowed when publishing", topic)
+	}
+
+	return nil
+}
+
+// TopicMatches Checks topic against a subscription pattern.
+func TopicMatches(pattern, topic string) bool {
+	patternLevels := strings.Split(pattern, TopicLevelSeparator)
+	topicLevels := strings.Split(topic, TopicLevelSeparator)
+
+	for i, level := range patternLevels {
+		if level == MultiLevelWildcard {
+			return true
+		}
+
+		if i >= len(topicLevels) {
+			return false
+		}
+
+		if level != SingleLevelWildcard && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(patternLevels) == len(topicLevels)
+}
+
+// topicNode A level of the subscriptions trie, children are indexed by level name,
+// wildcards included.
+type topicNode struct {
+	children      map[string]*topicNode
+	subscriptions []*subscription
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children: make(map[string]*topicNode),
+	}
+}
+
+// topicTrie Subscriptions indexed by pattern levels, so matching a topic costs
+// proportionally to its number of levels instead of to the number of subscriptions.
+type topicTrie struct {
+	root *topicNode
+}
+
+func newTopicTrie() *topicTrie {
+	return &topicTrie{
+		root: newTopicNode(),
+	}
+}
+
+func (trie *topicTrie) add(s *subscription) {
+	node := trie.root
+
+	for _, level := range strings.Split(s.pattern, TopicLevelSeparator) {
+		child, ok := node.children[level]
+
+		if !ok {
+			child = newTopicNode()
+			node.children[level] = child
+		}
+
+		node = child
+	}
+
+	node.subscriptions = append(node.subscriptions, s)
+}
+
+// remove Removes the first subscription to pattern accepted by selector, pruning the
+// nodes left empty. Returns the removed subscription, nil when none was accepted.
+func (trie *topicTrie) remove(pattern string, selector func(*subscription) bool) *subscription {
+	levels := strings.Split(pattern, TopicLevelSeparator)
+	path := []*topicNode{trie.root}
+
+	for _, level := range levels {
+		child, ok := path[len(path)-1].children[level]
+
+		if !ok {
+			return nil
+		}
+
+		path = append(path, child)
+	}
+
+	node := path[len(path)-1]
+	var removed *subscription
+
+	for idx, s := range node.subscriptions {
+		if selector(s) {
+			removed = s
+			l := len(node.subscriptions)
+			copy(node.subscriptions[idx:], node.subscriptions[idx+1:])
+			node.subscriptions[l-1] = nil
+			node.subscriptions = node.subscriptions[:l-1]
+			break
+		}
+	}
+
+	for i := len(levels); i > 0; i-- {
+		if len(path[i].subscriptions) > 0 || len(path[i].children) > 0 {
+			break
+		}
+
+		delete(path[i-1].children, levels[i-1])
+	}
+
+	return removed
+}
+
+// exists Checks if there is at least one subscription to exactly pattern.
+func (trie *topicTrie) exists(pattern string) bool {
+	return len(trie.find(pattern)) > 0
+}
+
+// find Returns the subscriptions to exactly pattern.
+func (trie *topicTrie) find(pattern string) []*subscription {
+	node := trie.root
+
+	for _, level := range strings.Split(pattern, TopicLevelSeparator) {
+		child, ok := node.children[level]
+
+		if !ok {
+			return nil
+		}
+
+		node = child
+	}
+
+	return node.subscriptions
+}
+
+// all Returns every subscription.
+func (trie *topicTrie) all() []*subscription {
+	subscriptions := []*subscription{}
+
+	var walk func(node *topicNode)
+
+	walk = func(node *topicNode) {
+		subscriptions = append(subscriptions, node.subscriptions...)
+
+		for _, child := range node.children {
+			walk(child)
+		}
+	}
+
+	walk(trie.root)
+
+	return subscriptions
+}
+
+// match Returns the subscriptions whose pattern matches topic, a channel subscribed
+// through several matching patterns is returned only once.
+func (trie *topicTrie) match(topic string) []*subscription {
+	matches := []*subscription{}
+	seen := make(map[*chan events.Message]bool)
+
+	collect := func(node *topicNode) {
+		for _, s := range node.subscriptions {
+			if !seen[s.channel] {
+				seen[s.channel] = true
+				matches = append(matches, s)
+			}
+		}
+	}
+
+	var walk func(node *topicNode, levels []string)
+
+	walk = func(node *topicNode, levels []string) {
+		if multi, ok := node.children[MultiLevelWildcard]; ok {
+			collect(multi)
+		}
+
+		if len(levels) == 0 {
+			collect(node)
+			return
+		}
+
+		if child, ok := node.children[levels[0]]; ok {
+			walk(child, levels[1:])
+		}
+
+		if single, ok := node.children[SingleLevelWildcard]; ok {
+			walk(single, levels[1:])
+		}
+	}
+
+	walk(trie.root, strings.Split(topic, TopicLevelSeparator))
+
+	return matches
+}
@@ -0,0 +1,63 @@
+package bus
+
+import (
+	"testing"
+
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+func TestTopicPatternsShouldBeValidated(t *testing.T) {
+	assert.NilError(t, ValidateTopicPattern("system_metrics::*"))
+	assert.NilError(t, ValidateTopicPattern("devices::*::send"))
+	assert.NilError(t, ValidateTopicPattern("#"))
+
+	assert.Assert(t, ValidateTopicPattern("") != nil)
+	assert.Assert(t, ValidateTopicPattern("devices::#::send") != nil)
+	assert.Assert(t, ValidateTopicPattern("system_metrics::alloc*") != nil)
+
+	assert.NilError(t, ValidateTopic("connections::closed"))
+	assert.Assert(t, ValidateTopic("connections::*") != nil)
+}
+
+func TestTopicsShouldMatchWildcardPatterns(t *testing.T) {
+	examples := []struct {
+		pattern string
+		topic   string
+		matches bool
+	}{
+		{"connections::closed", "connections::closed", true},
+		{"connections::closed", "connections::established", false},
+		{"system_metrics::*", "system_metrics::allocated_memory", true},
+		{"system_metrics::*", "system_metrics", false},
+		{"system_metrics::*", "system_metrics::memory::allocated", false},
+		{"devices::*::send", "devices::abc-123::send", true},
+		{"devices::#", "devices", true},
+		{"devices::#", "devices::abc-123::send", true},
+		{"#", "connections::closed", true},
+	}
+
+	for _, example := range examples {
+		trie := newTopicTrie()
+		channel := make(chan events.Message)
+		trie.add(&subscription{pattern: example.pattern, channel: &channel})
+
+		assert.Assert(t, TopicMatches(example.pattern, example.topic) == example.matches, example.pattern)
+		assert.Assert(t, (len(trie.match(example.topic)) == 1) == example.matches, example.pattern)
+	}
+}
+
+func TestRemovingSubscriptionsShouldPruneTheTrie(t *testing.T) {
+	trie := newTopicTrie()
+	channel := make(chan events.Message)
+	isChannel := func(s *subscription) bool { return s.channel == &channel }
+
+	trie.add(&subscription{pattern: "devices::*::send", channel: &channel})
+	assert.Assert(t, trie.exists("devices::*::send"))
+
+	assert.Assert(t, trie.remove("devices::*::send", isChannel) != nil)
+	assert.Assert(t, !trie.exists("devices::*::send"))
+	assert.Assert(t, len(trie.root.children) == 0)
+
+	assert.Assert(t, trie.remove("devices::*::send", isChannel) == nil)
+}
@@ -0,0 +1,500 @@
+package bus
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/events"
+)
+
+// SyncPolicy When appended records are flushed to disk with fsync.
+type SyncPolicy int
+
+const (
+	// SyncEveryAppend Every record is flushed before Publish returns, the safest and slowest.
+	SyncEveryAppend SyncPolicy = iota
+	// SyncPeriodically Records are flushed every SyncInterval, a crash may lose the last interval.
+	SyncPeriodically
+	// SyncNever Flushing is left to the operating system.
+	SyncNever
+)
+
+const (
+	DefaultWriteAheadLogSyncInterval    time.Duration = time.Second
+	DefaultWriteAheadLogSegmentMaxBytes int64         = 16 * 1024 * 1024
+	DefaultWriteAheadLogRetentionCheck  time.Duration = time.Minute
+
+	walSegmentExtension string = ".wal"
+	walRecordHeaderSize int    = 8
+)
+
+var (
+	errWALOffsetCompacted = errors.New("write ahead log offset was removed by retention")
+	errWALCorrupted       = errors.New("write ahead log record is corrupted")
+
+	walChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// WriteAheadLogOptions
+//   - Directory Where segment files are stored, it is created if missing.
+//   - SyncPolicy See SyncPolicy.
+//   - SyncInterval Flush interval for SyncPeriodically.
+//   - SegmentMaxBytes A new segment file is started once the current one reaches this size.
+//   - RetentionMaxBytes Oldest segments are removed while the log is bigger, 0 means no limit.
+//   - RetentionMaxAge Segments not written for longer are removed, 0 means no limit.
+//
+// Retention is applied on every rotation and, when RetentionMaxAge is set, periodically so
+// an idle log also expires its segments. Retention never removes the segment being written,
+// but does not wait for durable subscribers either, see DurableEventBus.
+type WriteAheadLogOptions struct {
+	Directory         string
+	SyncPolicy        SyncPolicy
+	SyncInterval      time.Duration
+	SegmentMaxBytes   int64
+	RetentionMaxBytes int64
+	RetentionMaxAge   time.Duration
+}
+
+// walRecord What is stored for every published message.
+type walRecord struct {
+	Topic   string         `json:"topic"`
+	Message events.Message `json:"message"`
+}
+
+// walSegment A log file holding consecutive records, starting at baseOffset. Every record
+// is its data length and CRC-32C, both 4 bytes big endian, followed by its JSON data.
+type walSegment struct {
+	baseOffset uint64
+	path       string
+	file       *os.File
+	size       int64
+	positions  []int64
+	modified   time.Time
+}
+
+// writeAheadLog Append only log of published messages, split in segment files.
+type writeAheadLog struct {
+	options    WriteAheadLogOptions
+	lock       sync.RWMutex
+	segments   []*walSegment
+	nextOffset uint64
+	unsynced   bool
+	isClosing  chan struct{}
+	closeOnce  sync.Once
+}
+
+func openWriteAheadLog(options WriteAheadLogOptions) (*writeAheadLog, error) {
+	if options.Directory == "" {
+		return nil, errors.New("write ahead log directory can not be empty")
+	}
+
+	if options.SyncInterval <= 0 {
+		options.SyncInterval = DefaultWriteAheadLogSyncInterval
+	}
+
+	if options.SegmentMaxBytes <= 0 {
+		options.SegmentMaxBytes = DefaultWriteAheadLogSegmentMaxBytes
+	}
+
+	if err := os.MkdirAll(options.Directory, 0755); err != nil {
+		return nil, err
+	}
+
+	log := &writeAheadLog{
+		options:   options,
+		segments:  []*walSegment{},
+		isClosing: make(chan struct{}),
+	}
+
+	if err := log.recover(); err != nil {
+		log.closeSegments()
+		return nil, err
+	}
+
+	if options.SyncPolicy == SyncPeriodically {
+		go log.syncPeriodically()
+	}
+
+	if options.RetentionMaxAge > 0 {
+		go log.applyRetentionPeriodically()
+	}
+
+	return log, nil
+}
+
+// recover Opens the existing segments. A torn record at the end of the last segment,
+// left by a crash while appending, is truncated. Anywhere else it is an error.
+func (log *writeAheadLog) recover() error {
+	paths, err := filepath.Glob(filepath.Join(log.options.Directory, "*"+walSegmentExtension))
+
+	if err != nil {
+		return err
+	}
+
+	baseOffsets := []uint64{}
+
+	for _, path := range paths {
+		baseOffset, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), walSegmentExtension), 10, 64)
+
+		if err != nil {
+			return fmt.Errorf("unexpected write ahead log file %s", path)
+		}
+
+		baseOffsets = append(baseOffsets, baseOffset)
+	}
+
+	sort.Slice(baseOffsets, func(i, j int) bool { return baseOffsets[i] < baseOffsets[j] })
+
+	for i, baseOffset := range baseOffsets {
+		segment, err := log.openSegment(baseOffset)
+
+		if err != nil {
+			return err
+		}
+
+		log.segments = append(log.segments, segment)
+
+		if err := segment.scan(i == len(baseOffsets)-1); err != nil {
+			return err
+		}
+
+		log.nextOffset = segment.baseOffset + uint64(len(segment.positions))
+	}
+
+	if len(log.segments) == 0 {
+		segment, err := log.openSegment(0)
+
+		if err != nil {
+			return err
+		}
+
+		log.segments = append(log.segments, segment)
+	}
+
+	return log.applyRetention()
+}
+
+func (log *writeAheadLog) openSegment(baseOffset uint64) (*walSegment, error) {
+	path := filepath.Join(log.options.Directory, fmt.Sprintf("%020d%s", baseOffset, walSegmentExtension))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &walSegment{
+		baseOffset: baseOffset,
+		path:       path,
+		file:       file,
+		positions:  []int64{},
+		modified:   info.ModTime(),
+	}, nil
+}
+
+// scan Indexes the segment records, truncating a torn tail when isLast.
+func (segment *walSegment) scan(isLast bool) error {
+	data, err := ioutil.ReadFile(segment.path)
+
+	if err != nil {
+		return err
+	}
+
+	position := int64(0)
+
+	for position < int64(len(data)) {
+		if _, err := decodeWALRecord(data[position:]); err != nil {
+			if !isLast {
+				return fmt.Errorf("%s at %s:%d", err, segment.path, position)
+			}
+
+			if err := segment.file.Truncate(position); err != nil {
+				return err
+			}
+
+			break
+		}
+
+		segment.positions = append(segment.positions, position)
+		position += int64(walRecordHeaderSize) + int64(binary.BigEndian.Uint32(data[position:]))
+	}
+
+	segment.size = position
+
+	return nil
+}
+
+func encodeWALRecord(topic string, message events.Message) ([]byte, error) {
+	data, err := json.Marshal(walRecord{Topic: topic, Message: message})
+
+	if err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, walRecordHeaderSize, walRecordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record[0:], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:], crc32.Checksum(data, walChecksumTable))
+
+	return append(record, data...), nil
+}
+
+// decodeWALRecord Decodes the record at the beginning of data.
+func decodeWALRecord(data []byte) (walRecord, error) {
+	record := walRecord{}
+
+	if len(data) < walRecordHeaderSize {
+		return record, errWALCorrupted
+	}
+
+	length := int64(binary.BigEndian.Uint32(data[0:]))
+
+	if length > int64(len(data)-walRecordHeaderSize) {
+		return record, errWALCorrupted
+	}
+
+	body := data[walRecordHeaderSize : int64(walRecordHeaderSize)+length]
+
+	if crc32.Checksum(body, walChecksumTable) != binary.BigEndian.Uint32(data[4:]) {
+		return record, errWALCorrupted
+	}
+
+	if err := json.Unmarshal(body, &record); err != nil {
+		return record, errWALCorrupted
+	}
+
+	return record, nil
+}
+
+// append Stores a record and returns its offset.
+func (log *writeAheadLog) append(topic string, message events.Message) (uint64, error) {
+	record, err := encodeWALRecord(topic, message)
+
+	if err != nil {
+		return 0, err
+	}
+
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	active := log.segments[len(log.segments)-1]
+
+	if len(active.positions) > 0 && active.size+int64(len(record)) > log.options.SegmentMaxBytes {
+		if active, err = log.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := active.file.WriteAt(record, active.size); err != nil {
+		// Leave the segment as it was, a partial write is overwritten by the next append
+		return 0, err
+	}
+
+	if log.options.SyncPolicy == SyncEveryAppend {
+		if err := active.file.Sync(); err != nil {
+			return 0, err
+		}
+	} else {
+		log.unsynced = true
+	}
+
+	offset := log.nextOffset
+	active.positions = append(active.positions, active.size)
+	active.size += int64(len(record))
+	active.modified = time.Now()
+	log.nextOffset++
+
+	return offset, nil
+}
+
+func (log *writeAheadLog) rotate() (*walSegment, error) {
+	active := log.segments[len(log.segments)-1]
+
+	if err := active.file.Sync(); err != nil {
+		return nil, err
+	}
+
+	segment, err := log.openSegment(log.nextOffset)
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.segments = append(log.segments, segment)
+
+	return segment, log.applyRetention()
+}
+
+// applyRetention Removes the oldest segments exceeding the retention limits.
+func (log *writeAheadLog) applyRetention() error {
+	totalSize := int64(0)
+
+	for _, segment := range log.segments {
+		totalSize += segment.size
+	}
+
+	for len(log.segments) > 1 {
+		oldest := log.segments[0]
+		tooBig := log.options.RetentionMaxBytes > 0 && totalSize > log.options.RetentionMaxBytes
+		tooOld := log.options.RetentionMaxAge > 0 && time.Since(oldest.modified) > log.options.RetentionMaxAge
+
+		if !tooBig && !tooOld {
+			break
+		}
+
+		oldest.file.Close()
+
+		if err := os.Remove(oldest.path); err != nil {
+			return err
+		}
+
+		totalSize -= oldest.size
+		log.segments = log.segments[1:]
+	}
+
+	return nil
+}
+
+// read Returns the record stored at offset, io.EOF when offset was not written yet.
+func (log *writeAheadLog) read(offset uint64) (walRecord, error) {
+	log.lock.RLock()
+	defer log.lock.RUnlock()
+
+	if offset >= log.nextOffset {
+		return walRecord{}, io.EOF
+	}
+
+	if offset < log.segments[0].baseOffset {
+		return walRecord{}, errWALOffsetCompacted
+	}
+
+	idx := sort.Search(len(log.segments), func(i int) bool {
+		return log.segments[i].baseOffset > offset
+	}) - 1
+
+	segment := log.segments[idx]
+	position := segment.positions[offset-segment.baseOffset]
+	end := segment.size
+
+	if next := offset - segment.baseOffset + 1; next < uint64(len(segment.positions)) {
+		end = segment.positions[next]
+	}
+
+	data := make([]byte, end-position)
+
+	if _, err := segment.file.ReadAt(data, position); err != nil {
+		return walRecord{}, err
+	}
+
+	return decodeWALRecord(data)
+}
+
+// firstOffset Oldest offset not removed by retention.
+func (log *writeAheadLog) firstOffset() uint64 {
+	log.lock.RLock()
+	defer log.lock.RUnlock()
+
+	return log.segments[0].baseOffset
+}
+
+func (log *writeAheadLog) sync() error {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	if !log.unsynced {
+		return nil
+	}
+
+	log.unsynced = false
+
+	return log.segments[len(log.segments)-1].file.Sync()
+}
+
+func (log *writeAheadLog) syncPeriodically() {
+	ticker := time.NewTicker(log.options.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			log.sync()
+
+		case <-log.isClosing:
+			return
+		}
+	}
+}
+
+// applyRetentionPeriodically Expires segments while nothing is appended, checking every
+// RetentionMaxAge up to DefaultWriteAheadLogRetentionCheck.
+func (log *writeAheadLog) applyRetentionPeriodically() {
+	interval := log.options.RetentionMaxAge
+
+	if interval > DefaultWriteAheadLogRetentionCheck {
+		interval = DefaultWriteAheadLogRetentionCheck
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			log.lock.Lock()
+
+			select {
+			case <-log.isClosing:
+				// close may have won the lock, its segments are gone
+			default:
+				log.applyRetention()
+			}
+
+			log.lock.Unlock()
+
+		case <-log.isClosing:
+			return
+		}
+	}
+}
+
+func (log *writeAheadLog) close() error {
+	var err error
+
+	log.closeOnce.Do(func() {
+		close(log.isClosing)
+
+		if log.options.SyncPolicy != SyncNever {
+			err = log.sync()
+		}
+
+		log.lock.Lock()
+		defer log.lock.Unlock()
+
+		log.closeSegments()
+	})
+
+	return err
+}
+
+func (log *writeAheadLog) closeSegments() {
+	for _, segment := range log.segments {
+		segment.file.Close()
+	}
+}
@@ -0,0 +1,145 @@
+package bus
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+func newTestWriteAheadLogDirectory(t *testing.T) string {
+	directory, err := ioutil.TempDir("", "wal")
+	assert.NilError(t, err)
+
+	return directory
+}
+
+func TestWriteAheadLogShouldReadAppendedRecords(t *testing.T) {
+	directory := newTestWriteAheadLogDirectory(t)
+	defer os.RemoveAll(directory)
+
+	log, err := openWriteAheadLog(WriteAheadLogOptions{Directory: directory})
+	assert.NilError(t, err)
+
+	for i := 0; i < 3; i++ {
+		offset, err := log.append("connections::closed", events.NewMessage([]byte{byte(i), 0xFF}, "", events.Default))
+
+		assert.NilError(t, err)
+		assert.Assert(t, offset == uint64(i))
+	}
+
+	record, err := log.read(1)
+	assert.NilError(t, err)
+	assert.Assert(t, record.Topic == "connections::closed")
+	assert.DeepEqual(t, record.Message.Payload, []byte{1, 0xFF})
+
+	_, err = log.read(3)
+	assert.Assert(t, err == io.EOF)
+
+	assert.NilError(t, log.close())
+}
+
+func TestWriteAheadLogShouldRotateAndRemoveOldSegments(t *testing.T) {
+	directory := newTestWriteAheadLogDirectory(t)
+	defer os.RemoveAll(directory)
+
+	log, _ := openWriteAheadLog(WriteAheadLogOptions{
+		Directory:         directory,
+		SyncPolicy:        SyncNever,
+		SegmentMaxBytes:   1,
+		RetentionMaxBytes: 1,
+	})
+
+	for i := 0; i < 5; i++ {
+		log.append("topic", events.NewMessage([]byte("payload"), "", events.Default))
+	}
+
+	// Every record takes a segment, retention only keeps the one being written
+	segments, _ := filepath.Glob(filepath.Join(directory, "*"+walSegmentExtension))
+	assert.Assert(t, len(segments) == 1)
+	assert.Assert(t, log.firstOffset() == 4)
+
+	_, err := log.read(0)
+	assert.Assert(t, err == errWALOffsetCompacted)
+
+	log.close()
+}
+
+func TestWriteAheadLogShouldRemoveExpiredSegments(t *testing.T) {
+	directory := newTestWriteAheadLogDirectory(t)
+	defer os.RemoveAll(directory)
+
+	log, _ := openWriteAheadLog(WriteAheadLogOptions{
+		Directory:       directory,
+		SegmentMaxBytes: 1,
+		RetentionMaxAge: 10 * time.Millisecond,
+	})
+
+	log.append("topic", events.NewMessage([]byte("old"), "", events.Default))
+	time.Sleep(20 * time.Millisecond)
+	log.append("topic", events.NewMessage([]byte("new"), "", events.Default))
+
+	assert.Assert(t, log.firstOffset() == 1)
+
+	log.close()
+}
+
+func TestIdleWriteAheadLogsShouldRemoveExpiredSegments(t *testing.T) {
+	directory := newTestWriteAheadLogDirectory(t)
+	defer os.RemoveAll(directory)
+
+	log, _ := openWriteAheadLog(WriteAheadLogOptions{
+		Directory:       directory,
+		SegmentMaxBytes: 1,
+		RetentionMaxAge: 50 * time.Millisecond,
+	})
+
+	log.append("topic", events.NewMessage([]byte("old"), "", events.Default))
+	log.append("topic", events.NewMessage([]byte("new"), "", events.Default))
+	assert.Assert(t, log.firstOffset() == 0)
+
+	// Nothing else is appended, the first segment must expire anyway
+	time.Sleep(200 * time.Millisecond)
+	assert.Assert(t, log.firstOffset() == 1)
+
+	log.close()
+}
+
+func TestWriteAheadLogShouldRecoverFromTornRecords(t *testing.T) {
+	directory := newTestWriteAheadLogDirectory(t)
+	defer os.RemoveAll(directory)
+
+	log, _ := openWriteAheadLog(WriteAheadLogOptions{Directory: directory})
+	log.append("topic", events.NewMessage([]byte("complete"), "", events.Default))
+	log.append("topic", events.NewMessage([]byte("torn"), "", events.Default))
+	log.close()
+
+	// Simulate a crash in the middle of the last append
+	path := filepath.Join(directory, "00000000000000000000"+walSegmentExtension)
+	info, _ := os.Stat(path)
+	assert.NilError(t, os.Truncate(path, info.Size()-3))
+
+	log, err := openWriteAheadLog(WriteAheadLogOptions{Directory: directory})
+	assert.NilError(t, err)
+
+	record, err := log.read(0)
+	assert.NilError(t, err)
+	assert.Assert(t, string(record.Message.Payload) == "complete")
+
+	_, err = log.read(1)
+	assert.Assert(t, err == io.EOF)
+
+	// New records take the place of the torn one
+	offset, _ := log.append("topic", events.NewMessage([]byte("after recovery"), "", events.Default))
+	assert.Assert(t, offset == 1)
+
+	record, _ = log.read(1)
+	assert.Assert(t, string(record.Message.Payload) == "after recovery")
+
+	log.close()
+}
@@ -1,11 +1,12 @@
 package entities
 
 import (
-	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/nnset/iot-cloud-connector/events"
 )
 
 type Connection struct {
@@ -25,15 +26,39 @@ type Connection struct {
 // NewConnectionFromDefaultPayload Parse a payload and try to find device_id field
 // and return a new connection instance.
 func NewConnectionFromDefaultPayload(payload, remoteAddress string) (*Connection, error) {
-	// See https://blog.golang.org/json
+	return newConnectionFromPayload(events.JSONCodec{}, []byte(payload), "", remoteAddress)
+}
+
+// NewConnectionFromMessage Like NewConnectionFromDefaultPayload, but the payload is decoded
+// with the codec registered for message.ContentType (JSON if empty), and message.DeviceID,
+// when set, takes precedence over the payload device_id field.
+func NewConnectionFromMessage(message events.Message) (*Connection, error) {
+	var codec events.Codec = events.JSONCodec{}
+
+	if message.ContentType != "" {
+		var exists bool
+
+		if codec, exists = events.CodecFor(message.ContentType); !exists {
+			return nil, fmt.Errorf("can not create a new connection: unsupported content type %s", message.ContentType)
+		}
+	}
+
+	return newConnectionFromPayload(codec, message.Payload, message.DeviceID, message.OriginRemoteAddress)
+}
+
+func newConnectionFromPayload(codec events.Codec, payload []byte, deviceID, remoteAddress string) (*Connection, error) {
 	var c Connection
 
-	err := json.Unmarshal([]byte(payload), &c)
+	err := codec.Unmarshal(payload, &c)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if deviceID != "" {
+		c.DeviceID = deviceID
+	}
+
 	return NewConnection(c.DeviceID, c.DeviceName, c.DeviceType, c.UserAgent, remoteAddress)
 }
 
@@ -44,6 +69,10 @@ func NewConnection(deviceID, deviceName, deviceType, userAgent, remoteAddress st
 		return nil, errors.New("can not create a new connection: empty deviceID")
 	}
 
+	if err := events.ValidateDeviceID(deviceID); err != nil {
+		return nil, fmt.Errorf("can not create a new connection: %s", err)
+	}
+
 	if remoteAddress == "" {
 		return nil, errors.New("can not create a new connection: empty remoteAddress")
 	}
@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/nnset/iot-cloud-connector/events"
 	"gotest.tools/assert"
 )
 
@@ -20,6 +21,14 @@ func TestConnectionNamedConstructorShouldReturnErrorIfDeviceIdIsEmpty(t *testing
 	assert.Error(t, err, "can not create a new connection: empty deviceID")
 }
 
+func TestConnectionNamedConstructorShouldRejectDeviceIDsMatchingOtherDevicesTopics(t *testing.T) {
+	for _, deviceID := range []string{"*", "#", "abc::123", "abc-*"} {
+		_, err := NewConnection(deviceID, "device_name", "device_type", "agent", "192.168.1.100")
+
+		assert.ErrorContains(t, err, "can not create a new connection: device ID")
+	}
+}
+
 func TestConnectionNamedConstructorShouldReturnErrorIfRemoteAddressIsEmpty(t *testing.T) {
 	_, err := NewConnection("device_id", "device_name", "device_type", "agent", "")
 
@@ -77,3 +86,14 @@ func TestWhenAMessageIsReceivedStatsAreUpdated(t *testing.T) {
 	assert.Assert(t, deviceConnection.ReceivedMessages == 1)
 	assert.Assert(t, deviceConnection.LastReceivedMessageTimeStamp == time.Now().Unix())
 }
+
+func TestCreatingAConnectionFromMessageShouldPreferMessageDeviceID(t *testing.T) {
+	message := events.NewDeviceMessage("abc-123", []byte("{\"device_name\": \"Thermostat\"}"), "192.168.1.100", events.Default)
+
+	connection, err := NewConnectionFromMessage(message)
+
+	assert.NilError(t, err)
+	assert.Assert(t, connection.DeviceID == "abc-123")
+	assert.Assert(t, connection.DeviceName == "Thermostat")
+	assert.Assert(t, connection.RemoteAddress == "192.168.1.100")
+}
@@ -0,0 +1,401 @@
+package events
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"unicode/utf8"
+)
+
+// CBOR (RFC 8949) encoding of the codecs generic values tree. Decoding supports
+// indefinite lengths, half and single precision floats, and skips tags.
+
+const (
+	cborUnsignedInteger byte = 0
+	cborNegativeInteger byte = 1
+	cborByteString      byte = 2
+	cborTextString      byte = 3
+	cborArray           byte = 4
+	cborMap             byte = 5
+	cborTag             byte = 6
+	cborSimple          byte = 7
+
+	cborFalse      byte = 20
+	cborTrue       byte = 21
+	cborNull       byte = 22
+	cborUndefined  byte = 23
+	cborFloat16    byte = 25
+	cborFloat32    byte = 26
+	cborFloat64    byte = 27
+	cborIndefinite byte = 31
+	cborBreak      byte = 0xFF
+)
+
+var errCBORMalformed = errors.New("cbor: malformed data")
+
+func appendCBORHead(data []byte, majorType byte, argument uint64) []byte {
+	head := majorType << 5
+
+	switch {
+	case argument < 24:
+		return append(data, head|byte(argument))
+	case argument <= math.MaxUint8:
+		return append(data, head|24, byte(argument))
+	case argument <= math.MaxUint16:
+		return append(data, head|25, byte(argument>>8), byte(argument))
+	case argument <= math.MaxUint32:
+		data = append(data, head|26)
+		return append(data, byte(argument>>24), byte(argument>>16), byte(argument>>8), byte(argument))
+	}
+
+	data = append(data, head|27)
+	encoded := make([]byte, 8)
+	binary.BigEndian.PutUint64(encoded, argument)
+
+	return append(data, encoded...)
+}
+
+func appendCBOR(data []byte, generic interface{}) []byte {
+	switch value := generic.(type) {
+	case nil:
+		return append(data, cborSimple<<5|cborNull)
+
+	case bool:
+		if value {
+			return append(data, cborSimple<<5|cborTrue)
+		}
+
+		return append(data, cborSimple<<5|cborFalse)
+
+	case int64:
+		if value < 0 {
+			return appendCBORHead(data, cborNegativeInteger, uint64(-(value + 1)))
+		}
+
+		return appendCBORHead(data, cborUnsignedInteger, uint64(value))
+
+	case uint64:
+		return appendCBORHead(data, cborUnsignedInteger, value)
+
+	case float64:
+		data = append(data, cborSimple<<5|cborFloat64)
+		encoded := make([]byte, 8)
+		binary.BigEndian.PutUint64(encoded, math.Float64bits(value))
+
+		return append(data, encoded...)
+
+	case string:
+		// CBOR text strings must be valid UTF-8
+		if !utf8.ValidString(value) {
+			return append(appendCBORHead(data, cborByteString, uint64(len(value))), value...)
+		}
+
+		return append(appendCBORHead(data, cborTextString, uint64(len(value))), value...)
+
+	case []byte:
+		return append(appendCBORHead(data, cborByteString, uint64(len(value))), value...)
+
+	case []interface{}:
+		data = appendCBORHead(data, cborArray, uint64(len(value)))
+
+		for _, item := range value {
+			data = appendCBOR(data, item)
+		}
+
+		return data
+
+	case codecMap:
+		data = appendCBORHead(data, cborMap, uint64(len(value)))
+
+		for _, entry := range value {
+			data = appendCBOR(data, entry.key)
+			data = appendCBOR(data, entry.value)
+		}
+
+		return data
+	}
+
+	return append(data, cborSimple<<5|cborUndefined)
+}
+
+type cborDecoder struct {
+	data   []byte
+	offset int
+}
+
+func (decoder *cborDecoder) readByte() (byte, error) {
+	if decoder.offset >= len(decoder.data) {
+		return 0, errCodecTruncated
+	}
+
+	decoder.offset++
+
+	return decoder.data[decoder.offset-1], nil
+}
+
+func (decoder *cborDecoder) read(n uint64) ([]byte, error) {
+	if n > uint64(len(decoder.data)-decoder.offset) {
+		return nil, errCodecTruncated
+	}
+
+	decoder.offset += int(n)
+
+	return decoder.data[decoder.offset-int(n) : decoder.offset], nil
+}
+
+func (decoder *cborDecoder) argument(additional byte) (uint64, error) {
+	switch {
+	case additional < 24:
+		return uint64(additional), nil
+	case additional <= 27:
+		encoded, err := decoder.read(1 << (additional - 24))
+
+		if err != nil {
+			return 0, err
+		}
+
+		var argument uint64
+
+		for _, b := range encoded {
+			argument = argument<<8 | uint64(b)
+		}
+
+		return argument, nil
+	}
+
+	return 0, errCBORMalformed
+}
+
+func (decoder *cborDecoder) decode(depth int) (interface{}, error) {
+	if depth > codecMaxDepth {
+		return nil, errCodecTooDeep
+	}
+
+	head, err := decoder.readByte()
+
+	if err != nil {
+		return nil, err
+	}
+
+	majorType := head >> 5
+	additional := head & 0x1F
+
+	if majorType == cborSimple {
+		return decoder.decodeSimple(additional)
+	}
+
+	if additional == cborIndefinite {
+		return decoder.decodeIndefinite(majorType, depth)
+	}
+
+	argument, err := decoder.argument(additional)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch majorType {
+	case cborUnsignedInteger:
+		if argument > math.MaxInt64 {
+			return argument, nil
+		}
+
+		return int64(argument), nil
+
+	case cborNegativeInteger:
+		if argument > math.MaxInt64 {
+			return nil, errors.New("cbor: negative integer overflows int64")
+		}
+
+		return -int64(argument) - 1, nil
+
+	case cborByteString:
+		bytes, err := decoder.read(argument)
+
+		return append([]byte{}, bytes...), err
+
+	case cborTextString:
+		text, err := decoder.read(argument)
+
+		return string(text), err
+
+	case cborArray:
+		if argument > uint64(len(decoder.data)) {
+			return nil, errCodecTruncated
+		}
+
+		list := make([]interface{}, argument)
+
+		for i := range list {
+			if list[i], err = decoder.decode(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+
+		return list, nil
+
+	case cborMap:
+		if argument > uint64(len(decoder.data)) {
+			return nil, errCodecTruncated
+		}
+
+		entries := make(codecMap, argument)
+
+		for i := range entries {
+			if entries[i].key, err = decoder.decode(depth + 1); err != nil {
+				return nil, err
+			}
+
+			if entries[i].value, err = decoder.decode(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+
+		return entries, nil
+
+	case cborTag:
+		// Tags semantics are not supported, only their content is kept
+		return decoder.decode(depth + 1)
+	}
+
+	return nil, errCBORMalformed
+}
+
+func (decoder *cborDecoder) decodeSimple(additional byte) (interface{}, error) {
+	switch additional {
+	case cborFalse:
+		return false, nil
+	case cborTrue:
+		return true, nil
+	case cborNull, cborUndefined:
+		return nil, nil
+	case cborFloat16:
+		encoded, err := decoder.read(2)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return float16ToFloat64(binary.BigEndian.Uint16(encoded)), nil
+	case cborFloat32:
+		encoded, err := decoder.read(4)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(encoded))), nil
+	case cborFloat64:
+		encoded, err := decoder.read(8)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return math.Float64frombits(binary.BigEndian.Uint64(encoded)), nil
+	}
+
+	return nil, errCBORMalformed
+}
+
+func (decoder *cborDecoder) decodeIndefinite(majorType byte, depth int) (interface{}, error) {
+	isBreak := func() bool {
+		if decoder.offset < len(decoder.data) && decoder.data[decoder.offset] == cborBreak {
+			decoder.offset++
+			return true
+		}
+
+		return false
+	}
+
+	switch majorType {
+	case cborByteString, cborTextString:
+		chunks := []byte{}
+
+		for !isBreak() {
+			chunk, err := decoder.decode(depth + 1)
+
+			if err != nil {
+				return nil, err
+			}
+
+			switch value := chunk.(type) {
+			case []byte:
+				chunks = append(chunks, value...)
+			case string:
+				chunks = append(chunks, value...)
+			default:
+				return nil, errCBORMalformed
+			}
+		}
+
+		if majorType == cborTextString {
+			return string(chunks), nil
+		}
+
+		return chunks, nil
+
+	case cborArray:
+		list := []interface{}{}
+
+		for !isBreak() {
+			item, err := decoder.decode(depth + 1)
+
+			if err != nil {
+				return nil, err
+			}
+
+			list = append(list, item)
+		}
+
+		return list, nil
+
+	case cborMap:
+		entries := codecMap{}
+
+		for !isBreak() {
+			key, err := decoder.decode(depth + 1)
+
+			if err != nil {
+				return nil, err
+			}
+
+			value, err := decoder.decode(depth + 1)
+
+			if err != nil {
+				return nil, err
+			}
+
+			entries = append(entries, codecMapEntry{key, value})
+		}
+
+		return entries, nil
+	}
+
+	return nil, errCBORMalformed
+}
+
+func float16ToFloat64(half uint16) float64 {
+	exponent := int(half>>10) & 0x1F
+	mantissa := float64(half & 0x3FF)
+	var value float64
+
+	switch exponent {
+	case 0:
+		value = math.Ldexp(mantissa, -24)
+	case 31:
+		if mantissa == 0 {
+			value = math.Inf(1)
+		} else {
+			value = math.NaN()
+		}
+	default:
+		value = math.Ldexp(mantissa+1024, exponent-25)
+	}
+
+	if half&0x8000 != 0 {
+		return -value
+	}
+
+	return value
+}
@@ -0,0 +1,211 @@
+package events
+
+import (
+	"encoding/json"
+	"mime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Codec Encodes and decodes Go values, and message payloads, for a given content type.
+// Besides JSON, codecs map structs using their json field tags.
+type Codec interface {
+	// Name Short name, i.e. json, used where a content type does not fit, like
+	// WebSocket subprotocols
+	Name() string
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+const (
+	JSONContentType        = "application/json"
+	CBORContentType        = "application/cbor"
+	MessagePackContentType = "application/msgpack"
+)
+
+var (
+	codecs      = make(map[string]Codec) // By content type
+	codecsMutex sync.RWMutex
+)
+
+func init() {
+	RegisterCodec(JSONCodec{})
+	RegisterCodec(CBORCodec{})
+	RegisterCodec(MessagePackCodec{})
+}
+
+// RegisterCodec Adds codec to the registry, replacing any codec registered for the same
+// content type.
+func RegisterCodec(codec Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+
+	codecs[codec.ContentType()] = codec
+}
+
+// CodecFor Finds the codec for contentType, parameters like charset are ignored.
+func CodecFor(contentType string) (Codec, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+
+	if err != nil {
+		return nil, false
+	}
+
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+
+	codec, exists := codecs[mediaType]
+
+	return codec, exists
+}
+
+// CodecByName Finds a codec by its Name.
+func CodecByName(name string) (Codec, bool) {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+
+	for _, codec := range codecs {
+		if codec.Name() == name {
+			return codec, true
+		}
+	}
+
+	return nil, false
+}
+
+// ContentTypes Content types of all registered codecs, sorted.
+func ContentTypes() []string {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+
+	contentTypes := []string{}
+
+	for contentType := range codecs {
+		contentTypes = append(contentTypes, contentType)
+	}
+
+	sort.Strings(contentTypes)
+
+	return contentTypes
+}
+
+// NegotiateCodec Picks the codec for an HTTP like Accept header, respecting the order
+// of its media ranges. q values are ignored, except q=0 which excludes a media range.
+// An empty header, or */*, gets JSONCodec.
+func NegotiateCodec(accept string) (Codec, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return JSONCodec{}, true
+	}
+
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+
+		switch mediaType {
+		case "*/*", "application/*":
+			return JSONCodec{}, true
+		}
+
+		if codec, exists := CodecFor(mediaType); exists {
+			return codec, true
+		}
+	}
+
+	return nil, false
+}
+
+// JSONCodec encoding/json
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) ContentType() string {
+	return JSONContentType
+}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// CBORCodec Concise Binary Object Representation, RFC 8949.
+type CBORCodec struct{}
+
+func (CBORCodec) Name() string {
+	return "cbor"
+}
+
+func (CBORCodec) ContentType() string {
+	return CBORContentType
+}
+
+func (CBORCodec) Marshal(v interface{}) ([]byte, error) {
+	generic, err := toGeneric(v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return appendCBOR(nil, generic), nil
+}
+
+func (CBORCodec) Unmarshal(data []byte, v interface{}) error {
+	decoder := &cborDecoder{data: data}
+	generic, err := decoder.decode(0)
+
+	if err != nil {
+		return err
+	}
+
+	if decoder.offset != len(data) {
+		return errCodecTrailingData
+	}
+
+	return fromGeneric(generic, v)
+}
+
+// MessagePackCodec https://github.com/msgpack/msgpack/blob/master/spec.md
+type MessagePackCodec struct{}
+
+func (MessagePackCodec) Name() string {
+	return "msgpack"
+}
+
+func (MessagePackCodec) ContentType() string {
+	return MessagePackContentType
+}
+
+func (MessagePackCodec) Marshal(v interface{}) ([]byte, error) {
+	generic, err := toGeneric(v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return appendMessagePack(nil, generic), nil
+}
+
+func (MessagePackCodec) Unmarshal(data []byte, v interface{}) error {
+	decoder := &messagePackDecoder{data: data}
+	generic, err := decoder.decode(0)
+
+	if err != nil {
+		return err
+	}
+
+	if decoder.offset != len(data) {
+		return errCodecTrailingData
+	}
+
+	return fromGeneric(generic, v)
+}
@@ -0,0 +1,584 @@
+package events
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Binary codecs (CBOR, MessagePack) translate Go values to and from a generic tree of
+// nil, bool, int64, uint64 (only above math.MaxInt64), float64, string, []byte,
+// []interface{} and codecMap values, so each codec only deals with its wire format.
+
+const codecMaxDepth = 100
+
+var (
+	errCodecTrailingData = errors.New("codec: trailing data after value")
+	errCodecTooDeep      = errors.New("codec: maximum nesting depth exceeded")
+	errCodecTruncated    = errors.New("codec: unexpected end of data")
+)
+
+type codecMapEntry struct {
+	key   interface{}
+	value interface{}
+}
+
+// codecMap Keeps entries order, so encoding the same value always produces the same bytes.
+type codecMap []codecMapEntry
+
+type codecField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+func toGeneric(v interface{}) (interface{}, error) {
+	return toGenericValue(reflect.ValueOf(v), 0)
+}
+
+func toGenericValue(value reflect.Value, depth int) (interface{}, error) {
+	if depth > codecMaxDepth {
+		return nil, errCodecTooDeep
+	}
+
+	if !value.IsValid() {
+		return nil, nil
+	}
+
+	isNil := (value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface) && value.IsNil()
+
+	if value.Type().Implements(textMarshalerType) && !isNil {
+		text, err := value.Interface().(encoding.TextMarshaler).MarshalText()
+
+		return string(text), err
+	}
+
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			return nil, nil
+		}
+
+		return toGenericValue(value.Elem(), depth+1)
+
+	case reflect.Bool:
+		return value.Bool(), nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int(), nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if value.Uint() > math.MaxInt64 {
+			return value.Uint(), nil
+		}
+
+		return int64(value.Uint()), nil
+
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), nil
+
+	case reflect.String:
+		return value.String(), nil
+
+	case reflect.Slice:
+		if value.IsNil() {
+			return nil, nil
+		}
+
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			return append([]byte{}, value.Bytes()...), nil
+		}
+
+		return toGenericList(value, depth)
+
+	case reflect.Array:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			bytes := make([]byte, value.Len())
+			reflect.Copy(reflect.ValueOf(bytes), value)
+
+			return bytes, nil
+		}
+
+		return toGenericList(value, depth)
+
+	case reflect.Map:
+		if value.IsNil() {
+			return nil, nil
+		}
+
+		entries := codecMap{}
+
+		for _, key := range value.MapKeys() {
+			genericKey, err := toGenericValue(key, depth+1)
+
+			if err != nil {
+				return nil, err
+			}
+
+			genericValue, err := toGenericValue(value.MapIndex(key), depth+1)
+
+			if err != nil {
+				return nil, err
+			}
+
+			entries = append(entries, codecMapEntry{genericKey, genericValue})
+		}
+
+		sort.Slice(entries, func(i, j int) bool {
+			return fmt.Sprint(entries[i].key) < fmt.Sprint(entries[j].key)
+		})
+
+		return entries, nil
+
+	case reflect.Struct:
+		entries := codecMap{}
+
+		for _, field := range codecFieldsOf(value.Type()) {
+			fieldValue, exists := fieldByIndex(value, field.index, false)
+
+			if !exists || (field.omitEmpty && isEmptyValue(fieldValue)) {
+				continue
+			}
+
+			genericValue, err := toGenericValue(fieldValue, depth+1)
+
+			if err != nil {
+				return nil, err
+			}
+
+			entries = append(entries, codecMapEntry{field.name, genericValue})
+		}
+
+		return entries, nil
+	}
+
+	return nil, fmt.Errorf("codec: unsupported type %s", value.Type())
+}
+
+func toGenericList(value reflect.Value, depth int) (interface{}, error) {
+	list := make([]interface{}, value.Len())
+
+	for i := range list {
+		item, err := toGenericValue(value.Index(i), depth+1)
+
+		if err != nil {
+			return nil, err
+		}
+
+		list[i] = item
+	}
+
+	return list, nil
+}
+
+func fromGeneric(generic interface{}, v interface{}) error {
+	target := reflect.ValueOf(v)
+
+	if target.Kind() != reflect.Ptr || target.IsNil() {
+		return errors.New("codec: Unmarshal needs a non nil pointer")
+	}
+
+	return assignGeneric(generic, target.Elem())
+}
+
+func assignGeneric(generic interface{}, target reflect.Value) error {
+	if target.Kind() == reflect.Ptr {
+		if generic == nil {
+			target.Set(reflect.Zero(target.Type()))
+			return nil
+		}
+
+		if target.IsNil() {
+			target.Set(reflect.New(target.Type().Elem()))
+		}
+
+		return assignGeneric(generic, target.Elem())
+	}
+
+	if text, isString := generic.(string); isString && target.CanAddr() &&
+		target.Addr().Type().Implements(textUnmarshalerType) {
+		return target.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(text))
+	}
+
+	if target.Kind() == reflect.Interface && target.NumMethod() == 0 {
+		if generic == nil {
+			target.Set(reflect.Zero(target.Type()))
+		} else {
+			target.Set(reflect.ValueOf(toInterface(generic)))
+		}
+
+		return nil
+	}
+
+	if generic == nil {
+		target.Set(reflect.Zero(target.Type()))
+		return nil
+	}
+
+	mismatch := fmt.Errorf("codec: can not decode %T into %s", generic, target.Type())
+
+	switch target.Kind() {
+	case reflect.Bool:
+		value, isBool := generic.(bool)
+
+		if !isBool {
+			return mismatch
+		}
+
+		target.SetBool(value)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var value int64
+
+		switch number := generic.(type) {
+		case int64:
+			value = number
+		case uint64:
+			return mismatch
+		case float64:
+			if number != math.Trunc(number) {
+				return mismatch
+			}
+
+			value = int64(number)
+		default:
+			return mismatch
+		}
+
+		if target.OverflowInt(value) {
+			return mismatch
+		}
+
+		target.SetInt(value)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var value uint64
+
+		switch number := generic.(type) {
+		case int64:
+			if number < 0 {
+				return mismatch
+			}
+
+			value = uint64(number)
+		case uint64:
+			value = number
+		case float64:
+			if number < 0 || number != math.Trunc(number) {
+				return mismatch
+			}
+
+			value = uint64(number)
+		default:
+			return mismatch
+		}
+
+		if target.OverflowUint(value) {
+			return mismatch
+		}
+
+		target.SetUint(value)
+
+	case reflect.Float32, reflect.Float64:
+		switch number := generic.(type) {
+		case int64:
+			target.SetFloat(float64(number))
+		case uint64:
+			target.SetFloat(float64(number))
+		case float64:
+			target.SetFloat(number)
+		default:
+			return mismatch
+		}
+
+	case reflect.String:
+		switch text := generic.(type) {
+		case string:
+			target.SetString(text)
+		case []byte:
+			target.SetString(string(text))
+		default:
+			return mismatch
+		}
+
+	case reflect.Slice:
+		if target.Type().Elem().Kind() == reflect.Uint8 {
+			switch bytes := generic.(type) {
+			case []byte:
+				target.SetBytes(append([]byte{}, bytes...))
+				return nil
+			case string:
+				target.SetBytes([]byte(bytes))
+				return nil
+			}
+		}
+
+		list, isList := generic.([]interface{})
+
+		if !isList {
+			return mismatch
+		}
+
+		slice := reflect.MakeSlice(target.Type(), len(list), len(list))
+
+		for i, item := range list {
+			if err := assignGeneric(item, slice.Index(i)); err != nil {
+				return err
+			}
+		}
+
+		target.Set(slice)
+
+	case reflect.Array:
+		if bytes, isBytes := generic.([]byte); isBytes && target.Type().Elem().Kind() == reflect.Uint8 {
+			reflect.Copy(target, reflect.ValueOf(bytes))
+			return nil
+		}
+
+		list, isList := generic.([]interface{})
+
+		if !isList {
+			return mismatch
+		}
+
+		for i := 0; i < target.Len() && i < len(list); i++ {
+			if err := assignGeneric(list[i], target.Index(i)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		entries, isMap := generic.(codecMap)
+
+		if !isMap {
+			return mismatch
+		}
+
+		if target.IsNil() {
+			target.Set(reflect.MakeMap(target.Type()))
+		}
+
+		for _, entry := range entries {
+			key := reflect.New(target.Type().Key()).Elem()
+			value := reflect.New(target.Type().Elem()).Elem()
+
+			if err := assignGeneric(entry.key, key); err != nil {
+				return err
+			}
+
+			if err := assignGeneric(entry.value, value); err != nil {
+				return err
+			}
+
+			target.SetMapIndex(key, value)
+		}
+
+	case reflect.Struct:
+		entries, isMap := generic.(codecMap)
+
+		if !isMap {
+			return mismatch
+		}
+
+		fields := codecFieldsOf(target.Type())
+
+		for _, entry := range entries {
+			name, isString := entry.key.(string)
+
+			if !isString {
+				continue
+			}
+
+			field, exists := findCodecField(fields, name)
+
+			if !exists {
+				continue
+			}
+
+			fieldValue, _ := fieldByIndex(target, field.index, true)
+
+			if err := assignGeneric(entry.value, fieldValue); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return mismatch
+	}
+
+	return nil
+}
+
+// toInterface Generic tree as the values encoding/json would produce for an interface{},
+// except numbers which keep being int64 or uint64.
+func toInterface(generic interface{}) interface{} {
+	switch value := generic.(type) {
+	case []interface{}:
+		list := make([]interface{}, len(value))
+
+		for i, item := range value {
+			list[i] = toInterface(item)
+		}
+
+		return list
+
+	case codecMap:
+		allKeysAreStrings := true
+
+		for _, entry := range value {
+			if _, isString := entry.key.(string); !isString {
+				allKeysAreStrings = false
+			}
+		}
+
+		if allKeysAreStrings {
+			object := make(map[string]interface{}, len(value))
+
+			for _, entry := range value {
+				object[entry.key.(string)] = toInterface(entry.value)
+			}
+
+			return object
+		}
+
+		object := make(map[interface{}]interface{}, len(value))
+
+		for _, entry := range value {
+			key := toInterface(entry.key)
+
+			if key != nil && !reflect.TypeOf(key).Comparable() {
+				key = fmt.Sprint(key)
+			}
+
+			object[key] = toInterface(entry.value)
+		}
+
+		return object
+	}
+
+	return generic
+}
+
+// codecFieldsOf Exported struct fields, named and filtered by their json tags. Fields of
+// embedded structs are promoted unless shadowed.
+func codecFieldsOf(structType reflect.Type) []codecField {
+	fields := []codecField{}
+	embedded := []codecField{}
+	names := make(map[string]bool)
+
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		tag := field.Tag.Get("json")
+
+		if tag == "-" {
+			continue
+		}
+
+		options := strings.Split(tag, ",")
+		name := options[0]
+		omitEmpty := false
+
+		for _, option := range options[1:] {
+			omitEmpty = omitEmpty || option == "omitempty"
+		}
+
+		fieldType := field.Type
+
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+
+		if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+			for _, promoted := range codecFieldsOf(fieldType) {
+				promoted.index = append([]int{i}, promoted.index...)
+				embedded = append(embedded, promoted)
+			}
+
+			continue
+		}
+
+		if field.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+
+		fields = append(fields, codecField{name, []int{i}, omitEmpty})
+		names[name] = true
+	}
+
+	for _, field := range embedded {
+		if !names[field.name] {
+			fields = append(fields, field)
+			names[field.name] = true
+		}
+	}
+
+	return fields
+}
+
+func findCodecField(fields []codecField, name string) (codecField, bool) {
+	for _, field := range fields {
+		if field.name == name {
+			return field, true
+		}
+	}
+
+	for _, field := range fields {
+		if strings.EqualFold(field.name, name) {
+			return field, true
+		}
+	}
+
+	return codecField{}, false
+}
+
+// fieldByIndex Like reflect.Value.FieldByIndex, allocating nil embedded pointers if
+// allocate is true, otherwise reporting the field does not exist.
+func fieldByIndex(value reflect.Value, index []int, allocate bool) (reflect.Value, bool) {
+	for i, fieldIndex := range index {
+		if i > 0 && value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				if !allocate {
+					return reflect.Value{}, false
+				}
+
+				value.Set(reflect.New(value.Type().Elem()))
+			}
+
+			value = value.Elem()
+		}
+
+		value = value.Field(fieldIndex)
+	}
+
+	return value, true
+}
+
+func isEmptyValue(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return value.Len() == 0
+	case reflect.Bool:
+		return !value.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return value.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return value.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return value.IsNil()
+	}
+
+	return false
+}
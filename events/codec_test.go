@@ -0,0 +1,167 @@
+package events
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+type codecTestSensor struct {
+	Name        string            `json:"name"`
+	Temperature float64           `json:"temperature"`
+	Readings    []int             `json:"readings"`
+	Raw         []byte            `json:"raw"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Ignored     string            `json:"-"`
+	Online      *bool             `json:"online"`
+}
+
+func TestCodecsShouldBeRegisteredByContentType(t *testing.T) {
+	codec, exists := CodecFor("application/json; charset=utf-8")
+	assert.Assert(t, exists)
+	assert.Assert(t, codec.Name() == "json")
+
+	codec, exists = CodecByName("msgpack")
+	assert.Assert(t, exists)
+	assert.Assert(t, codec.ContentType() == MessagePackContentType)
+
+	_, exists = CodecFor("text/plain")
+	assert.Assert(t, !exists)
+
+	assert.DeepEqual(t, ContentTypes(), []string{CBORContentType, JSONContentType, MessagePackContentType})
+}
+
+func TestCodecsShouldBeNegotiatedFromAcceptHeaders(t *testing.T) {
+	codec, _ := NegotiateCodec("")
+	assert.Assert(t, codec.Name() == "json")
+
+	codec, _ = NegotiateCodec("text/html, application/cbor;q=0.9, application/json;q=0.5")
+	assert.Assert(t, codec.Name() == "cbor")
+
+	codec, _ = NegotiateCodec("application/cbor;q=0, */*")
+	assert.Assert(t, codec.Name() == "json")
+
+	_, acceptable := NegotiateCodec("text/html")
+	assert.Assert(t, !acceptable)
+}
+
+func TestCBORShouldMatchRFC8949Examples(t *testing.T) {
+	examples := []struct {
+		value   interface{}
+		encoded []byte
+	}{
+		{0, []byte{0x00}},
+		{23, []byte{0x17}},
+		{24, []byte{0x18, 0x18}},
+		{1000, []byte{0x19, 0x03, 0xE8}},
+		{-1000, []byte{0x39, 0x03, 0xE7}},
+		{uint64(math.MaxUint64), []byte{0x1B, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{"IETF", []byte{0x64, 0x49, 0x45, 0x54, 0x46}},
+		{[]byte{1, 2, 3, 4}, []byte{0x44, 0x01, 0x02, 0x03, 0x04}},
+		{[]int{1, 2, 3}, []byte{0x83, 0x01, 0x02, 0x03}},
+		{map[string]int{"a": 1}, []byte{0xA1, 0x61, 0x61, 0x01}},
+		{true, []byte{0xF5}},
+		{nil, []byte{0xF6}},
+	}
+
+	for _, example := range examples {
+		encoded, err := CBORCodec{}.Marshal(example.value)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, encoded, example.encoded)
+	}
+
+	var decoded interface{}
+
+	// Indefinite length array, half precision float and a tagged value
+	assert.NilError(t, CBORCodec{}.Unmarshal([]byte{0x9F, 0xF9, 0x3C, 0x00, 0xC1, 0x01, 0xFF}, &decoded))
+	assert.DeepEqual(t, decoded, []interface{}{1.0, int64(1)})
+}
+
+func TestMessagePackShouldMatchTheSpec(t *testing.T) {
+	examples := []struct {
+		value   interface{}
+		encoded []byte
+	}{
+		{127, []byte{0x7F}},
+		{-32, []byte{0xE0}},
+		{-33, []byte{0xD0, 0xDF}},
+		{256, []byte{0xCD, 0x01, 0x00}},
+		{"hi", []byte{0xA2, 0x68, 0x69}},
+		{[]byte{1}, []byte{0xC4, 0x01, 0x01}},
+		{[]bool{true, false}, []byte{0x92, 0xC3, 0xC2}},
+		{map[string]interface{}{"a": nil}, []byte{0x81, 0xA1, 0x61, 0xC0}},
+	}
+
+	for _, example := range examples {
+		encoded, err := MessagePackCodec{}.Marshal(example.value)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, encoded, example.encoded)
+	}
+}
+
+func TestCodecsShouldRoundTripStructs(t *testing.T) {
+	online := true
+	sensor := codecTestSensor{
+		Name:        "thermostat",
+		Temperature: -21.5,
+		Readings:    []int{1, -2, 300000},
+		Raw:         []byte{0x00, 0xFF},
+		Labels:      map[string]string{"room": "kitchen"},
+		Ignored:     "not encoded",
+		Online:      &online,
+	}
+
+	for _, codec := range []Codec{JSONCodec{}, CBORCodec{}, MessagePackCodec{}} {
+		encoded, err := codec.Marshal(sensor)
+		assert.NilError(t, err)
+
+		var decoded codecTestSensor
+		assert.NilError(t, codec.Unmarshal(encoded, &decoded))
+
+		sensor.Ignored = ""
+		assert.DeepEqual(t, decoded, sensor)
+	}
+}
+
+func TestCodecsShouldRoundTripMessages(t *testing.T) {
+	m := NewDeviceMessage("abc-123", []byte{0x01, 0xFE, 0x00}, "192.168.1.100", Command)
+	m.ContentType = "application/octet-stream"
+	m.SetHeader("mqtt_topic", "sensors/abc-123")
+
+	for _, codec := range []Codec{JSONCodec{}, CBORCodec{}, MessagePackCodec{}} {
+		encoded, err := codec.Marshal(m)
+		assert.NilError(t, err)
+
+		var decoded Message
+		assert.NilError(t, codec.Unmarshal(encoded, &decoded))
+		assert.DeepEqual(t, decoded, m)
+	}
+}
+
+func TestBinaryPayloadsShouldBeBase64EncodedInJSON(t *testing.T) {
+	encoded, _ := json.Marshal(NewMessage([]byte{0xFF, 0x00}, "", Default))
+
+	var fields map[string]interface{}
+	json.Unmarshal(encoded, &fields)
+
+	assert.Assert(t, fields["payload"] == "/wA=")
+	assert.Assert(t, fields["payload_encoding"] == "base64")
+
+	encoded, _ = json.Marshal(NewMessage([]byte("on"), "", Default))
+	json.Unmarshal(encoded, &fields)
+
+	assert.Assert(t, fields["payload"] == "on")
+}
+
+func TestMalformedBinaryDataShouldNotBeDecoded(t *testing.T) {
+	var decoded interface{}
+
+	assert.Assert(t, CBORCodec{}.Unmarshal([]byte{0x9B, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, &decoded) != nil)
+	assert.Assert(t, CBORCodec{}.Unmarshal([]byte{0x01, 0x02}, &decoded) == errCodecTrailingData)
+	assert.Assert(t, MessagePackCodec{}.Unmarshal([]byte{0xDD, 0xFF, 0xFF, 0xFF, 0xFF}, &decoded) != nil)
+	assert.Assert(t, MessagePackCodec{}.Unmarshal([]byte{0xC1}, &decoded) != nil)
+}
@@ -1,7 +1,11 @@
 package events
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 )
@@ -15,20 +19,185 @@ const (
 	Default MessageType = "default"
 )
 
+// MessagePriority Subscribers get higher priority messages first, see bus.SubscriptionOptions.
+type MessagePriority int
+
+const (
+	PriorityLow    MessagePriority = -1
+	PriorityNormal MessagePriority = 0
+	PriorityHigh   MessagePriority = 1
+)
+
+// Priorities Every priority, from highest to lowest.
+var Priorities = []MessagePriority{PriorityHigh, PriorityNormal, PriorityLow}
+
+func (priority MessagePriority) String() string {
+	switch {
+	case priority >= PriorityHigh:
+		return "high"
+	case priority <= PriorityLow:
+		return "low"
+	}
+
+	return "normal"
+}
+
+// ParseMessagePriority Parses a priority name, see MessagePriority.String. Empty is PriorityNormal.
+func ParseMessagePriority(name string) (MessagePriority, error) {
+	switch name {
+	case "high":
+		return PriorityHigh, nil
+	case "", "normal":
+		return PriorityNormal, nil
+	case "low":
+		return PriorityLow, nil
+	}
+
+	return PriorityNormal, fmt.Errorf("unknown message priority %s", name)
+}
+
+// SequenceHeader Message header holding the sequence number a device gave to the message,
+// retransmissions of a message keep its sequence number.
+const SequenceHeader = "sequence"
+
+// MessageSchemaVersion Current Message JSON schema version:
+//   - 1 (or missing) Timestamp in seconds, no metadata fields.
+//   - 2 Timestamp in nanoseconds, DeviceID, CorrelationID, ReplyTo, ContentType and Headers.
+//   - 3 ExpiresAt.
+//   - 4 Priority.
+const MessageSchemaVersion = 4
+
+// Message
+//   - Payload Raw bytes, see ContentType and CodecFor to decode them.
+//   - DeviceID The IoT device the message comes from, or is addressed to.
+//   - CorrelationID Only set on replies, it is the ID of the query or command being answered.
+//   - ReplyTo Topic where the sender expects replies to be published.
+//   - ContentType MIME type of Payload, i.e. application/json.
+//   - Headers Free form metadata, i.e. the MQTT topic a message was published on.
+//   - Timestamp Unix time in nanoseconds.
+//   - ExpiresAt Unix time in nanoseconds after which the message must not be delivered, 0 never expires.
+//   - Priority Messages with a higher priority skip ahead of queued ones, see MessagePriority.
 type Message struct {
-	ID                  string      `json:"id"`
-	Payload             string      `json:"payload"`
-	OriginRemoteAddress string      `json:"origin_remote_address"`
-	MessagType          MessageType `json:"message_type"`
-	Timestamp           int64       `json:"timestamp"`
+	ID                  string            `json:"id"`
+	Payload             []byte            `json:"payload"`
+	OriginRemoteAddress string            `json:"origin_remote_address"`
+	MessagType          MessageType       `json:"message_type"`
+	Timestamp           int64             `json:"timestamp"`
+	DeviceID            string            `json:"device_id,omitempty"`
+	CorrelationID       string            `json:"correlation_id,omitempty"`
+	ReplyTo             string            `json:"reply_to,omitempty"`
+	ContentType         string            `json:"content_type,omitempty"`
+	Headers             map[string]string `json:"headers,omitempty"`
+	ExpiresAt           int64             `json:"expires_at,omitempty"`
+	Priority            MessagePriority   `json:"priority,omitempty"`
+	SchemaVersion       int               `json:"schema_version"`
 }
 
-func NewMessage(payload, remoteAddress string, messagType MessageType) Message {
+func NewMessage(payload []byte, remoteAddress string, messagType MessageType) Message {
 	return Message{
-		uuid.New().String(),
-		payload,
-		remoteAddress,
-		messagType,
-		time.Now().Unix(),
+		ID:                  uuid.New().String(),
+		Payload:             payload,
+		OriginRemoteAddress: remoteAddress,
+		MessagType:          messagType,
+		Timestamp:           time.Now().UnixNano(),
+		Headers:             make(map[string]string),
+		SchemaVersion:       MessageSchemaVersion,
 	}
 }
+
+// NewDeviceMessage Creates a new message coming from, or addressed to, deviceID.
+func NewDeviceMessage(deviceID string, payload []byte, remoteAddress string, messagType MessageType) Message {
+	message := NewMessage(payload, remoteAddress, messagType)
+	message.DeviceID = deviceID
+
+	return message
+}
+
+// NewReplyMessage Creates the reply to a query or command, correlated with it.
+func NewReplyMessage(request Message, payload []byte, remoteAddress string) Message {
+	reply := NewDeviceMessage(request.DeviceID, payload, remoteAddress, request.MessagType)
+	reply.CorrelationID = request.ID
+
+	return reply
+}
+
+// Time Timestamp as time.Time
+func (m Message) Time() time.Time {
+	return time.Unix(0, m.Timestamp)
+}
+
+// SetTTL Message expires ttl from now.
+func (m *Message) SetTTL(ttl time.Duration) {
+	m.ExpiresAt = time.Now().Add(ttl).UnixNano()
+}
+
+// Expired Checks if the message expiry time has passed.
+func (m Message) Expired() bool {
+	return m.ExpiresAt != 0 && time.Now().UnixNano() >= m.ExpiresAt
+}
+
+// Header Returns the header value, or an empty string if missing.
+func (m Message) Header(key string) string {
+	return m.Headers[key]
+}
+
+// SetHeader Sets a header value, Headers is created if needed.
+func (m *Message) SetHeader(key, value string) {
+	if m.Headers == nil {
+		m.Headers = make(map[string]string)
+	}
+
+	m.Headers[key] = value
+}
+
+// jsonMessage JSON representation of Message. Payload is a JSON string, payloads which
+// are not valid UTF-8 are base64 encoded and flagged with payload_encoding.
+type jsonMessage struct {
+	*message
+	Payload         string `json:"payload"`
+	PayloadEncoding string `json:"payload_encoding,omitempty"`
+}
+
+// message Message without its JSON methods, avoids calling them recursively
+type message Message
+
+// MarshalJSON See jsonMessage
+func (m Message) MarshalJSON() ([]byte, error) {
+	encoded := jsonMessage{message: (*message)(&m), Payload: string(m.Payload)}
+
+	if !utf8.Valid(m.Payload) {
+		encoded.Payload = base64.StdEncoding.EncodeToString(m.Payload)
+		encoded.PayloadEncoding = "base64"
+	}
+
+	return json.Marshal(encoded)
+}
+
+// UnmarshalJSON Messages encoded with an older schema are upgraded to MessageSchemaVersion.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	decoded := jsonMessage{message: &message{}}
+
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	payload := []byte(decoded.Payload)
+
+	if decoded.PayloadEncoding == "base64" {
+		var err error
+
+		if payload, err = base64.StdEncoding.DecodeString(decoded.Payload); err != nil {
+			return err
+		}
+	}
+
+	if decoded.SchemaVersion < 2 {
+		decoded.Timestamp = decoded.Timestamp * int64(time.Second)
+	}
+
+	*m = Message(*decoded.message)
+	m.Payload = payload
+	m.SchemaVersion = MessageSchemaVersion
+
+	return nil
+}
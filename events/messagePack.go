@@ -0,0 +1,306 @@
+package events
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"unicode/utf8"
+)
+
+// MessagePack encoding of the codecs generic values tree. Extension types are not supported.
+
+var errMessagePackMalformed = errors.New("msgpack: malformed data")
+
+func appendMessagePackLength(data []byte, length int, fix byte, fixMax int, eight, sixteen, thirtyTwo byte) []byte {
+	switch {
+	case fix != 0 && length <= fixMax:
+		return append(data, fix|byte(length))
+	case eight != 0 && length <= math.MaxUint8:
+		return append(data, eight, byte(length))
+	case length <= math.MaxUint16:
+		return append(data, sixteen, byte(length>>8), byte(length))
+	}
+
+	return append(data, thirtyTwo, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+}
+
+func appendMessagePack(data []byte, generic interface{}) []byte {
+	switch value := generic.(type) {
+	case nil:
+		return append(data, 0xC0)
+
+	case bool:
+		if value {
+			return append(data, 0xC3)
+		}
+
+		return append(data, 0xC2)
+
+	case int64:
+		switch {
+		case value >= 0 && value <= 0x7F, value < 0 && value >= -32:
+			return append(data, byte(value))
+		case value >= 0:
+			return appendMessagePackUint(data, uint64(value))
+		case value >= math.MinInt8:
+			return append(data, 0xD0, byte(value))
+		case value >= math.MinInt16:
+			return append(data, 0xD1, byte(value>>8), byte(value))
+		case value >= math.MinInt32:
+			return append(data, 0xD2, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+		}
+
+		encoded := make([]byte, 8)
+		binary.BigEndian.PutUint64(encoded, uint64(value))
+
+		return append(append(data, 0xD3), encoded...)
+
+	case uint64:
+		return appendMessagePackUint(data, value)
+
+	case float64:
+		encoded := make([]byte, 8)
+		binary.BigEndian.PutUint64(encoded, math.Float64bits(value))
+
+		return append(append(data, 0xCB), encoded...)
+
+	case string:
+		// str must be valid UTF-8
+		if !utf8.ValidString(value) {
+			return append(appendMessagePackLength(data, len(value), 0, 0, 0xC4, 0xC5, 0xC6), value...)
+		}
+
+		return append(appendMessagePackLength(data, len(value), 0xA0, 31, 0xD9, 0xDA, 0xDB), value...)
+
+	case []byte:
+		return append(appendMessagePackLength(data, len(value), 0, 0, 0xC4, 0xC5, 0xC6), value...)
+
+	case []interface{}:
+		data = appendMessagePackLength(data, len(value), 0x90, 15, 0, 0xDC, 0xDD)
+
+		for _, item := range value {
+			data = appendMessagePack(data, item)
+		}
+
+		return data
+
+	case codecMap:
+		data = appendMessagePackLength(data, len(value), 0x80, 15, 0, 0xDE, 0xDF)
+
+		for _, entry := range value {
+			data = appendMessagePack(data, entry.key)
+			data = appendMessagePack(data, entry.value)
+		}
+
+		return data
+	}
+
+	return append(data, 0xC0)
+}
+
+func appendMessagePackUint(data []byte, value uint64) []byte {
+	switch {
+	case value <= 0x7F:
+		return append(data, byte(value))
+	case value <= math.MaxUint8:
+		return append(data, 0xCC, byte(value))
+	case value <= math.MaxUint16:
+		return append(data, 0xCD, byte(value>>8), byte(value))
+	case value <= math.MaxUint32:
+		return append(data, 0xCE, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+	}
+
+	encoded := make([]byte, 8)
+	binary.BigEndian.PutUint64(encoded, value)
+
+	return append(append(data, 0xCF), encoded...)
+}
+
+type messagePackDecoder struct {
+	data   []byte
+	offset int
+}
+
+func (decoder *messagePackDecoder) read(n int) ([]byte, error) {
+	if n < 0 || n > len(decoder.data)-decoder.offset {
+		return nil, errCodecTruncated
+	}
+
+	decoder.offset += n
+
+	return decoder.data[decoder.offset-n : decoder.offset], nil
+}
+
+// readUint Reads a big endian unsigned integer of size bytes
+func (decoder *messagePackDecoder) readUint(size int) (uint64, error) {
+	encoded, err := decoder.read(size)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var value uint64
+
+	for _, b := range encoded {
+		value = value<<8 | uint64(b)
+	}
+
+	return value, nil
+}
+
+func (decoder *messagePackDecoder) decode(depth int) (interface{}, error) {
+	if depth > codecMaxDepth {
+		return nil, errCodecTooDeep
+	}
+
+	head, err := decoder.read(1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	b := head[0]
+
+	switch {
+	case b <= 0x7F:
+		return int64(b), nil
+	case b >= 0xE0:
+		return int64(int8(b)), nil
+	case b&0xF0 == 0x80:
+		return decoder.decodeMap(int(b&0x0F), depth)
+	case b&0xF0 == 0x90:
+		return decoder.decodeArray(int(b&0x0F), depth)
+	case b&0xE0 == 0xA0:
+		return decoder.decodeString(int(b & 0x1F))
+	}
+
+	switch b {
+	case 0xC0:
+		return nil, nil
+	case 0xC2:
+		return false, nil
+	case 0xC3:
+		return true, nil
+
+	case 0xC4, 0xC5, 0xC6:
+		length, err := decoder.readUint(1 << (b - 0xC4))
+
+		if err != nil {
+			return nil, err
+		}
+
+		bytes, err := decoder.read(int(length))
+
+		return append([]byte{}, bytes...), err
+
+	case 0xCA:
+		bits, err := decoder.readUint(4)
+
+		return float64(math.Float32frombits(uint32(bits))), err
+
+	case 0xCB:
+		bits, err := decoder.readUint(8)
+
+		return math.Float64frombits(bits), err
+
+	case 0xCC, 0xCD, 0xCE, 0xCF:
+		value, err := decoder.readUint(1 << (b - 0xCC))
+
+		if value > math.MaxInt64 {
+			return value, err
+		}
+
+		return int64(value), err
+
+	case 0xD0, 0xD1, 0xD2, 0xD3:
+		size := 1 << (b - 0xD0)
+		value, err := decoder.readUint(size)
+
+		// Sign extension
+		shift := uint(64 - 8*size)
+
+		return int64(value<<shift) >> shift, err
+
+	case 0xD9, 0xDA, 0xDB:
+		length, err := decoder.readUint(1 << (b - 0xD9))
+
+		if err != nil {
+			return nil, err
+		}
+
+		return decoder.decodeString(int(length))
+
+	case 0xDC, 0xDD:
+		length, err := decoder.readUint(2 << (b - 0xDC))
+
+		if err != nil {
+			return nil, err
+		}
+
+		return decoder.decodeArray(int(length), depth)
+
+	case 0xDE, 0xDF:
+		length, err := decoder.readUint(2 << (b - 0xDE))
+
+		if err != nil {
+			return nil, err
+		}
+
+		return decoder.decodeMap(int(length), depth)
+	}
+
+	return nil, errMessagePackMalformed
+}
+
+func (decoder *messagePackDecoder) decodeString(length int) (interface{}, error) {
+	text, err := decoder.read(length)
+
+	return string(text), err
+}
+
+func (decoder *messagePackDecoder) decodeArray(length int, depth int) (interface{}, error) {
+	// Every item takes at least one byte
+	if length > len(decoder.data)-decoder.offset {
+		return nil, errCodecTruncated
+	}
+
+	list := make([]interface{}, length)
+
+	for i := range list {
+		item, err := decoder.decode(depth + 1)
+
+		if err != nil {
+			return nil, err
+		}
+
+		list[i] = item
+	}
+
+	return list, nil
+}
+
+func (decoder *messagePackDecoder) decodeMap(length int, depth int) (interface{}, error) {
+	if length > len(decoder.data)-decoder.offset {
+		return nil, errCodecTruncated
+	}
+
+	entries := make(codecMap, length)
+
+	for i := range entries {
+		key, err := decoder.decode(depth + 1)
+
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := decoder.decode(depth + 1)
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries[i] = codecMapEntry{key, value}
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,92 @@
+package events
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestNewMessageShouldUseCurrentSchema(t *testing.T) {
+	before := time.Now()
+	m := NewDeviceMessage("abc-123", []byte("on"), "192.168.1.100", Command)
+
+	assert.Assert(t, m.SchemaVersion == MessageSchemaVersion)
+	assert.Assert(t, m.DeviceID == "abc-123")
+	assert.Assert(t, !m.Time().Before(before))
+	assert.Assert(t, m.Time().Sub(before) < time.Second)
+}
+
+func TestReplyMessagesShouldBeCorrelatedWithTheRequest(t *testing.T) {
+	request := NewDeviceMessage("abc-123", []byte("temperature"), "", Query)
+	reply := NewReplyMessage(request, []byte("21"), "192.168.1.100")
+
+	assert.Assert(t, reply.CorrelationID == request.ID)
+	assert.Assert(t, reply.DeviceID == "abc-123")
+	assert.Assert(t, reply.MessagType == Query)
+}
+
+func TestMessagesShouldSurviveJSONEncoding(t *testing.T) {
+	m := NewDeviceMessage("abc-123", []byte("{}"), "192.168.1.100", Default)
+	m.ContentType = "application/json"
+	m.SetHeader("mqtt_topic", "sensors/abc-123")
+
+	encoded, _ := json.Marshal(m)
+
+	var decoded Message
+	assert.NilError(t, json.Unmarshal(encoded, &decoded))
+	assert.DeepEqual(t, decoded, m)
+}
+
+func TestMessagesWithoutSchemaVersionShouldBeUpgraded(t *testing.T) {
+	var m Message
+
+	err := json.Unmarshal([]byte(`{"id":"1","payload":"on","message_type":"command","timestamp":1600000000}`), &m)
+
+	assert.NilError(t, err)
+	assert.Assert(t, m.SchemaVersion == MessageSchemaVersion)
+	assert.Assert(t, m.Time().Equal(time.Unix(1600000000, 0)))
+	assert.Assert(t, m.Header("mqtt_topic") == "")
+}
+
+func TestMessagesShouldExpireAfterTheirTTL(t *testing.T) {
+	m := NewMessage([]byte("valve off"), "", Command)
+	assert.Assert(t, !m.Expired())
+
+	m.SetTTL(10 * time.Millisecond)
+	assert.Assert(t, !m.Expired())
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Assert(t, m.Expired())
+
+	encoded, _ := json.Marshal(m)
+	decoded := Message{}
+	json.Unmarshal(encoded, &decoded)
+
+	assert.Assert(t, decoded.ExpiresAt == m.ExpiresAt)
+	assert.Assert(t, decoded.Expired())
+}
+
+func TestMessagePrioritiesShouldBeParsedByName(t *testing.T) {
+	for _, priority := range Priorities {
+		parsed, err := ParseMessagePriority(priority.String())
+
+		assert.NilError(t, err)
+		assert.Assert(t, parsed == priority)
+	}
+
+	parsed, _ := ParseMessagePriority("")
+	assert.Assert(t, parsed == PriorityNormal)
+
+	_, err := ParseMessagePriority("urgent")
+	assert.Assert(t, err != nil)
+
+	m := NewMessage([]byte("stop motor"), "", Command)
+	m.Priority = PriorityHigh
+	encoded, _ := json.Marshal(m)
+	decoded := Message{}
+	json.Unmarshal(encoded, &decoded)
+
+	assert.Assert(t, decoded.Priority == PriorityHigh)
+}
@@ -1,10 +1,44 @@
 package events
 
+import (
+	"fmt"
+	"strings"
+)
+
 const (
 	SystemMetricsAllocatedMemoryTopic string = "system_metrics::allocated_memory"
 	SystemMetricsNumGoRoutinesTopic   string = "system_metrics::num_go_routines"
+	SystemMetricsBusTopic             string = "system_metrics::bus"
 	ConnectionEstablishedTopic        string = "connections::established"
 	ConnectionClosedTopic             string = "connections::closed"
 	MessageReceivedTopic              string = "connections::message_received"
 	MessageSentTopic                  string = "connections::message_sent"
 )
+
+// deviceIDReservedSequences Topic wildcards and level separator, see bus.TopicLevelSeparator.
+// A device ID containing them would turn SendToDeviceTopic into a pattern matching other
+// devices topics.
+var deviceIDReservedSequences = []string{"*", "#", "::"}
+
+// ValidateDeviceID Device IDs become a level of SendToDeviceTopic, so they can not contain
+// topic wildcards nor the level separator.
+func ValidateDeviceID(deviceID string) error {
+	for _, reserved := range deviceIDReservedSequences {
+		if strings.Contains(deviceID, reserved) {
+			return fmt.Errorf("device ID %s can not contain %s", deviceID, reserved)
+		}
+	}
+
+	return nil
+}
+
+// SendToDeviceTopic Messages published on this topic are forwarded, by the connection
+// handler that owns the device connection, to the IoT device identified by deviceID.
+func SendToDeviceTopic(deviceID string) string {
+	return "devices::" + deviceID + "::send"
+}
+
+// SystemMetricsQueueDepthTopic Messages of priority waiting in the bus subscription queues.
+func SystemMetricsQueueDepthTopic(priority MessagePriority) string {
+	return "system_metrics::queue_depth::" + priority.String()
+}
@@ -0,0 +1,296 @@
+package services
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/nnset/iot-cloud-connector/events"
+)
+
+// CoAP (RFC 7252) messages encoding and decoding, only what a connections handler needs.
+
+const (
+	coapVersion = 1
+
+	coapConfirmable     byte = 0
+	coapNonConfirmable  byte = 1
+	coapAcknowledgement byte = 2
+	coapReset           byte = 3
+
+	coapCodeEmpty                    byte = 0x00
+	coapCodeGET                      byte = 0x01
+	coapCodePOST                     byte = 0x02
+	coapCodePUT                      byte = 0x03
+	coapCodeDELETE                   byte = 0x04
+	coapCodeCreated                  byte = 0x41 // 2.01
+	coapCodeDeleted                  byte = 0x42 // 2.02
+	coapCodeChanged                  byte = 0x44 // 2.04
+	coapCodeContent                  byte = 0x45 // 2.05
+	coapCodeBadRequest               byte = 0x80 // 4.00
+	coapCodeForbidden                byte = 0x83 // 4.03
+	coapCodeNotFound                 byte = 0x84 // 4.04
+	coapCodeMethodNotAllowed         byte = 0x85 // 4.05
+	coapCodeNotAcceptable            byte = 0x86 // 4.06
+	coapCodeUnsupportedContentFormat byte = 0x8F // 4.15
+	coapCodeServiceUnavailable       byte = 0xA3 // 5.03
+
+	coapOptionObserve       uint16 = 6
+	coapOptionLocationPath  uint16 = 8
+	coapOptionURIPath       uint16 = 11
+	coapOptionContentFormat uint16 = 12
+	coapOptionURIQuery      uint16 = 15
+	coapOptionAccept        uint16 = 17
+
+	coapContentFormatJSON uint16 = 50
+	coapContentFormatCBOR uint16 = 60
+
+	coapPayloadMarker byte = 0xFF
+)
+
+var errCoAPMalformedMessage = errors.New("malformed coap message")
+
+type coapOption struct {
+	number uint16
+	value  []byte
+}
+
+type coapMessage struct {
+	messageType byte
+	code        byte
+	messageID   uint16
+	token       []byte
+	options     []coapOption
+	payload     []byte
+}
+
+func parseCoAPMessage(data []byte) (*coapMessage, error) {
+	if len(data) < 4 || data[0]>>6 != coapVersion {
+		return nil, errCoAPMalformedMessage
+	}
+
+	tokenLength := int(data[0] & 0x0F)
+
+	if tokenLength > 8 || len(data) < 4+tokenLength {
+		return nil, errCoAPMalformedMessage
+	}
+
+	message := &coapMessage{
+		messageType: (data[0] >> 4) & 0x03,
+		code:        data[1],
+		messageID:   binary.BigEndian.Uint16(data[2:4]),
+		token:       append([]byte{}, data[4:4+tokenLength]...),
+	}
+
+	offset := 4 + tokenLength
+	optionNumber := 0
+
+	for offset < len(data) {
+		if data[offset] == coapPayloadMarker {
+			if offset+1 == len(data) {
+				return nil, errCoAPMalformedMessage
+			}
+
+			message.payload = append([]byte{}, data[offset+1:]...)
+
+			break
+		}
+
+		delta := int(data[offset] >> 4)
+		length := int(data[offset] & 0x0F)
+		offset++
+
+		var err error
+
+		if delta, offset, err = coapOptionExtendedValue(data, delta, offset); err != nil {
+			return nil, err
+		}
+
+		if length, offset, err = coapOptionExtendedValue(data, length, offset); err != nil {
+			return nil, err
+		}
+
+		if offset+length > len(data) {
+			return nil, errCoAPMalformedMessage
+		}
+
+		optionNumber += delta
+		message.options = append(message.options, coapOption{
+			number: uint16(optionNumber),
+			value:  append([]byte{}, data[offset:offset+length]...),
+		})
+
+		offset += length
+	}
+
+	return message, nil
+}
+
+func coapOptionExtendedValue(data []byte, value int, offset int) (int, int, error) {
+	switch value {
+	case 13:
+		if offset+1 > len(data) {
+			return 0, 0, errCoAPMalformedMessage
+		}
+
+		return int(data[offset]) + 13, offset + 1, nil
+
+	case 14:
+		if offset+2 > len(data) {
+			return 0, 0, errCoAPMalformedMessage
+		}
+
+		return int(binary.BigEndian.Uint16(data[offset:])) + 269, offset + 2, nil
+
+	case 15:
+		return 0, 0, errCoAPMalformedMessage
+	}
+
+	return value, offset, nil
+}
+
+func (message *coapMessage) encode() []byte {
+	data := []byte{
+		coapVersion<<6 | message.messageType<<4 | byte(len(message.token)),
+		message.code,
+		byte(message.messageID >> 8),
+		byte(message.messageID),
+	}
+
+	data = append(data, message.token...)
+
+	options := append([]coapOption{}, message.options...)
+	sort.SliceStable(options, func(i, j int) bool { return options[i].number < options[j].number })
+
+	previousNumber := 0
+
+	for _, option := range options {
+		delta := int(option.number) - previousNumber
+		previousNumber = int(option.number)
+
+		deltaNibble, deltaExtended := coapOptionNibble(delta)
+		lengthNibble, lengthExtended := coapOptionNibble(len(option.value))
+
+		data = append(data, deltaNibble<<4|lengthNibble)
+		data = append(data, deltaExtended...)
+		data = append(data, lengthExtended...)
+		data = append(data, option.value...)
+	}
+
+	if len(message.payload) > 0 {
+		data = append(data, coapPayloadMarker)
+		data = append(data, message.payload...)
+	}
+
+	return data
+}
+
+func coapOptionNibble(value int) (byte, []byte) {
+	switch {
+	case value < 13:
+		return byte(value), nil
+	case value < 269:
+		return 13, []byte{byte(value - 13)}
+	default:
+		extended := make([]byte, 2)
+		binary.BigEndian.PutUint16(extended, uint16(value-269))
+
+		return 14, extended
+	}
+}
+
+func (message *coapMessage) option(number uint16) ([]byte, bool) {
+	for _, option := range message.options {
+		if option.number == number {
+			return option.value, true
+		}
+	}
+
+	return nil, false
+}
+
+func (message *coapMessage) addOption(number uint16, value []byte) {
+	message.options = append(message.options, coapOption{number, value})
+}
+
+// path Uri-Path options joined with /
+func (message *coapMessage) path() string {
+	segments := []string{}
+
+	for _, option := range message.options {
+		if option.number == coapOptionURIPath {
+			segments = append(segments, string(option.value))
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// query Uri-Query options as a map
+func (message *coapMessage) query() map[string]string {
+	query := make(map[string]string)
+
+	for _, option := range message.options {
+		if option.number == coapOptionURIQuery {
+			parts := strings.SplitN(string(option.value), "=", 2)
+
+			if len(parts) == 2 {
+				query[parts[0]] = parts[1]
+			} else {
+				query[parts[0]] = ""
+			}
+		}
+	}
+
+	return query
+}
+
+// coapUint Encodes an unsigned integer option value using the minimum amount of bytes
+func coapUint(value uint32) []byte {
+	encoded := make([]byte, 4)
+	binary.BigEndian.PutUint32(encoded, value)
+
+	for len(encoded) > 0 && encoded[0] == 0 {
+		encoded = encoded[1:]
+	}
+
+	return encoded
+}
+
+// coapContentFormats Content-Format registry entries for the events package codecs
+var coapContentFormats = map[uint16]string{
+	coapContentFormatJSON: events.JSONContentType,
+	coapContentFormatCBOR: events.CBORContentType,
+}
+
+// coapCodecFor Codec for the Content-Format, or Accept, option number
+func coapCodecFor(contentFormat []byte) (events.Codec, bool) {
+	contentType, exists := coapContentFormats[uint16(coapParseUint(contentFormat))]
+
+	if !exists {
+		return nil, false
+	}
+
+	return events.CodecFor(contentType)
+}
+
+func coapContentFormatOf(codec events.Codec) (uint16, bool) {
+	for contentFormat, contentType := range coapContentFormats {
+		if contentType == codec.ContentType() {
+			return contentFormat, true
+		}
+	}
+
+	return 0, false
+}
+
+func coapParseUint(value []byte) uint32 {
+	var decoded uint32
+
+	for _, b := range value {
+		decoded = decoded<<8 | uint32(b)
+	}
+
+	return decoded
+}
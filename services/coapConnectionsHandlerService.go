@@ -0,0 +1,695 @@
+package services
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nnset/iot-cloud-connector/bus"
+	"github.com/nnset/iot-cloud-connector/events"
+)
+
+// CoAPConnectionsHandlerService CoAP (RFC 7252) over UDP server for constrained devices.
+//
+// Resources:
+//   - POST register   Registers the device, payload is the JSON expected by
+//     entities.NewConnectionFromDefaultPayload. Optional "lt" query sets the
+//     registration lifetime in seconds.
+//   - DELETE register Deregisters the device.
+//   - POST messages   Payload is published on MessageReceivedTopic.
+//   - GET commands    With Observe 0, messages published on events.SendToDeviceTopic(deviceID)
+//     are pushed to the device as confirmable notifications, with a JSON encoded
+//     events.Message as payload. With Observe 1 the device stops observing.
+//
+// Payloads are decoded according to their Content-Format option (JSON or CBOR), JSON by
+// default. The Accept option of the observe request picks the notifications encoding.
+//
+// UDP has no connections, so ConnectionEstablishedTopic is published on registration,
+// and ConnectionClosedTopic on deregistration or when the registration lifetime expires
+// without hearing from the device.
+//
+// Requests are handled in order by a worker per remote address, so a device whose
+// messages can not be published right away does not delay the others.
+type CoAPConnectionsHandlerService struct {
+	ListenAddress        string
+	RegistrationLifetime int // Seconds
+	AckTimeout           int // Milliseconds
+	MaxRetransmit        int
+	MaxMessageSize       int // Bytes
+	id                   string
+	eventBus             bus.MessageBus
+	conn                 *net.UDPConn
+	serviceIsShutdown    chan bool
+	shutdownService      chan bool
+	devices              map[string]*coapDevice // Registered devices by remote address
+	exchanges            map[string]*coapExchange
+	pendingAcks          map[uint16]chan byte
+	workers              map[string]chan *coapMessage // Requests queues by remote address
+	nextMessageID        uint16
+	mutex                sync.Mutex
+	registrationsMutex   sync.Mutex // A device is never closed while it is being opened
+	devicesWaitGroup     sync.WaitGroup
+	isShuttingDown       bool
+	isClosing            chan struct{} // Stops the workers
+}
+
+type coapDevice struct {
+	*deviceSession
+	service         *CoAPConnectionsHandlerService
+	address         *net.UDPAddr
+	lifetime        time.Duration // Guarded by service.mutex
+	expiresAt       time.Time     // Guarded by service.mutex
+	observerToken   []byte        // Guarded by service.mutex, nil when the device is not observing
+	observerCodec   events.Codec  // Guarded by service.mutex
+	observeSequence uint32        // Guarded by service.mutex
+	isClosing       chan struct{} // Aborts pending notifications retransmissions
+}
+
+// coapExchange Recently received message, used to detect duplicates, see RFC 7252 section 4.5
+type coapExchange struct {
+	receivedAt time.Time
+	response   []byte
+}
+
+const (
+	coapExchangeLifetime  = 247 * time.Second
+	coapWorkerQueueSize   = 16
+	coapWorkerIdleTimeout = 10 * time.Second
+)
+
+var (
+	errCoAPDeviceNotObserving = errors.New("device is not observing commands resource")
+	errCoAPNotificationReset  = errors.New("device reset the notification")
+	errCoAPNotificationLost   = errors.New("notification was not acknowledged")
+)
+
+// NewCoAPConnectionsHandlerService Creates a new instance of CoAPConnectionsHandlerService
+func NewCoAPConnectionsHandlerService(
+	eventBus bus.MessageBus,
+	listenAddress string,
+) *CoAPConnectionsHandlerService {
+	return &CoAPConnectionsHandlerService{
+		id:            uuid.New().String(),
+		eventBus:      eventBus,
+		ListenAddress: listenAddress,
+		devices:       make(map[string]*coapDevice),
+		exchanges:     make(map[string]*coapExchange),
+		pendingAcks:   make(map[uint16]chan byte),
+		workers:       make(map[string]chan *coapMessage),
+		isClosing:     make(chan struct{}),
+	}
+}
+
+func (service *CoAPConnectionsHandlerService) Id() string {
+	return service.id
+}
+
+func (service *CoAPConnectionsHandlerService) Init(shutdownService chan bool) error {
+	service.shutdownService = shutdownService
+	service.serviceIsShutdown = make(chan bool)
+
+	if service.RegistrationLifetime == 0 {
+		service.RegistrationLifetime = 300
+	}
+
+	if service.AckTimeout == 0 {
+		service.AckTimeout = 2000
+	}
+
+	if service.MaxRetransmit == 0 {
+		service.MaxRetransmit = 4
+	}
+
+	if service.MaxMessageSize == 0 {
+		service.MaxMessageSize = 1152
+	}
+
+	address, err := net.ResolveUDPAddr("udp", service.ListenAddress)
+
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUDP("udp", address)
+
+	if err != nil {
+		return err
+	}
+
+	service.conn = conn
+	service.nextMessageID = uint16(time.Now().UnixNano())
+
+	return nil
+}
+
+func (service *CoAPConnectionsHandlerService) Start() {
+	go service.readMessages()
+
+	expirations := time.NewTicker(time.Second)
+	defer expirations.Stop()
+
+	for {
+		select {
+		case <-expirations.C:
+			service.expireRegistrations()
+
+		case <-service.shutdownService:
+			service.mutex.Lock()
+			service.isShuttingDown = true
+			devices := service.devices
+			service.devices = make(map[string]*coapDevice)
+			service.mutex.Unlock()
+
+			service.conn.Close()
+			close(service.isClosing)
+
+			service.registrationsMutex.Lock()
+
+			for _, device := range devices {
+				service.closeDevice(device, false)
+			}
+
+			service.registrationsMutex.Unlock()
+
+			service.devicesWaitGroup.Wait()
+
+			service.serviceIsShutdown <- true
+			return
+		}
+	}
+}
+
+func (service *CoAPConnectionsHandlerService) ShutdownChannel() chan bool {
+	return service.serviceIsShutdown
+}
+
+// Addr Address the service is listening on, useful when ListenAddress port is 0
+func (service *CoAPConnectionsHandlerService) Addr() net.Addr {
+	return service.conn.LocalAddr()
+}
+
+// ActiveConnectionsCount How many devices are currently registered
+func (service *CoAPConnectionsHandlerService) ActiveConnectionsCount() int {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	return len(service.devices)
+}
+
+func (service *CoAPConnectionsHandlerService) readMessages() {
+	buffer := make([]byte, service.MaxMessageSize+1)
+
+	for {
+		n, address, err := service.conn.ReadFromUDP(buffer)
+
+		if err != nil {
+			return
+		}
+
+		if n > service.MaxMessageSize {
+			continue
+		}
+
+		message, err := parseCoAPMessage(buffer[:n])
+
+		if err != nil {
+			continue
+		}
+
+		switch message.messageType {
+		case coapAcknowledgement, coapReset:
+			service.acknowledge(message)
+		default:
+			service.dispatch(address, message)
+		}
+	}
+}
+
+// acknowledge Hands an acknowledgement or reset to the notification waiting for it.
+func (service *CoAPConnectionsHandlerService) acknowledge(message *coapMessage) {
+	service.mutex.Lock()
+	ack, pending := service.pendingAcks[message.messageID]
+	service.mutex.Unlock()
+
+	if pending {
+		select {
+		case ack <- message.messageType:
+		default:
+		}
+	}
+}
+
+// dispatch Queues message for the worker of its remote address, starting it if needed.
+// Messages are dropped while the queue is full, confirmable ones are retransmitted by
+// the device.
+func (service *CoAPConnectionsHandlerService) dispatch(address *net.UDPAddr, message *coapMessage) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	queue, exists := service.workers[address.String()]
+
+	if !exists {
+		queue = make(chan *coapMessage, coapWorkerQueueSize)
+		service.workers[address.String()] = queue
+
+		go service.work(address, queue)
+	}
+
+	select {
+	case queue <- message:
+	default:
+	}
+}
+
+// work Handles the messages queued for address, until it is idle for coapWorkerIdleTimeout
+// or the service shuts down.
+func (service *CoAPConnectionsHandlerService) work(address *net.UDPAddr, queue chan *coapMessage) {
+	for {
+		select {
+		case message := <-queue:
+			service.handleMessage(address, message)
+
+		case <-time.After(coapWorkerIdleTimeout):
+			service.mutex.Lock()
+
+			// Messages are queued holding the mutex, none can be lost once removed
+			if len(queue) == 0 {
+				delete(service.workers, address.String())
+				service.mutex.Unlock()
+
+				return
+			}
+
+			service.mutex.Unlock()
+
+		case <-service.isClosing:
+			return
+		}
+	}
+}
+
+func (service *CoAPConnectionsHandlerService) handleMessage(address *net.UDPAddr, message *coapMessage) {
+	if message.code == coapCodeEmpty {
+		// CoAP ping
+		if message.messageType == coapConfirmable {
+			service.write(address, &coapMessage{messageType: coapReset, messageID: message.messageID})
+		}
+
+		return
+	}
+
+	exchangeKey := address.String() + "/" + strconv.Itoa(int(message.messageID))
+
+	service.mutex.Lock()
+	exchange, duplicated := service.exchanges[exchangeKey]
+
+	if !duplicated {
+		exchange = &coapExchange{receivedAt: time.Now()}
+		service.exchanges[exchangeKey] = exchange
+	}
+	service.mutex.Unlock()
+
+	if duplicated {
+		if exchange.response != nil {
+			service.conn.WriteToUDP(exchange.response, address)
+		}
+
+		return
+	}
+
+	response := service.handleRequest(address, message)
+
+	if response == nil {
+		return
+	}
+
+	response.token = message.token
+
+	if message.messageType == coapConfirmable {
+		response.messageType = coapAcknowledgement
+		response.messageID = message.messageID
+	} else {
+		response.messageType = coapNonConfirmable
+		response.messageID = service.newMessageID()
+	}
+
+	encoded := response.encode()
+
+	service.mutex.Lock()
+	exchange.response = encoded
+	service.mutex.Unlock()
+
+	service.conn.WriteToUDP(encoded, address)
+}
+
+// handleRequest Returns nil when no response must be sent
+func (service *CoAPConnectionsHandlerService) handleRequest(address *net.UDPAddr, request *coapMessage) *coapMessage {
+	switch request.path() {
+	case "register":
+		switch request.code {
+		case coapCodePOST:
+			return service.register(address, request)
+		case coapCodeDELETE:
+			return service.deregister(address)
+		}
+
+		return &coapMessage{code: coapCodeMethodNotAllowed}
+
+	case "messages":
+		if request.code != coapCodePOST {
+			return &coapMessage{code: coapCodeMethodNotAllowed}
+		}
+
+		device := service.refreshRegistration(address)
+
+		if device == nil {
+			return &coapMessage{code: coapCodeForbidden}
+		}
+
+		contentType := ""
+
+		if contentFormat, exists := request.option(coapOptionContentFormat); exists {
+			codec, supported := coapCodecFor(contentFormat)
+
+			if !supported {
+				return &coapMessage{code: coapCodeUnsupportedContentFormat}
+			}
+
+			contentType = codec.ContentType()
+		}
+
+		device.MessageReceived(request.payload, contentType, nil)
+
+		if request.messageType == coapNonConfirmable {
+			return nil
+		}
+
+		return &coapMessage{code: coapCodeChanged}
+
+	case "commands":
+		if request.code != coapCodeGET {
+			return &coapMessage{code: coapCodeMethodNotAllowed}
+		}
+
+		return service.observe(address, request)
+	}
+
+	return &coapMessage{code: coapCodeNotFound}
+}
+
+func (service *CoAPConnectionsHandlerService) register(address *net.UDPAddr, request *coapMessage) *coapMessage {
+	lifetime := service.RegistrationLifetime
+
+	if lt, err := strconv.Atoi(request.query()["lt"]); err == nil && lt > 0 {
+		lifetime = lt
+	}
+
+	device := &coapDevice{
+		service:   service,
+		address:   address,
+		lifetime:  time.Duration(lifetime) * time.Second,
+		isClosing: make(chan struct{}),
+	}
+
+	device.expiresAt = time.Now().Add(device.lifetime)
+
+	var codec events.Codec = events.JSONCodec{}
+
+	if contentFormat, exists := request.option(coapOptionContentFormat); exists {
+		var supported bool
+
+		if codec, supported = coapCodecFor(contentFormat); !supported {
+			return &coapMessage{code: coapCodeUnsupportedContentFormat}
+		}
+	}
+
+	session, err := newDeviceSession(service.eventBus, device, codec, request.payload, address.String())
+
+	if err != nil {
+		return &coapMessage{code: coapCodeBadRequest, payload: []byte(err.Error())}
+	}
+
+	device.deviceSession = session
+
+	service.registrationsMutex.Lock()
+	defer service.registrationsMutex.Unlock()
+
+	service.mutex.Lock()
+
+	if service.isShuttingDown {
+		service.mutex.Unlock()
+		return &coapMessage{code: coapCodeServiceUnavailable}
+	}
+
+	replaced := []*coapDevice{}
+
+	if registered, exists := service.devices[address.String()]; exists {
+		if registered.Connection.DeviceID == session.Connection.DeviceID {
+			// Registration update, just renew its lifetime
+			registered.lifetime = device.lifetime
+			registered.expiresAt = device.expiresAt
+			service.mutex.Unlock()
+
+			return &coapMessage{code: coapCodeChanged}
+		}
+
+		replaced = append(replaced, registered)
+	}
+
+	for remoteAddress, registered := range service.devices {
+		if registered.Connection.DeviceID == session.Connection.DeviceID {
+			// Same device registering from a new address
+			replaced = append(replaced, registered)
+			delete(service.devices, remoteAddress)
+		}
+	}
+
+	service.devices[address.String()] = device
+	service.devicesWaitGroup.Add(1)
+	service.mutex.Unlock()
+
+	for _, registered := range replaced {
+		service.closeDevice(registered, true)
+	}
+
+	if err := session.Open(); err != nil {
+		service.mutex.Lock()
+		delete(service.devices, address.String())
+		service.mutex.Unlock()
+
+		service.closeDevice(device, false)
+
+		return &coapMessage{code: coapCodeServiceUnavailable}
+	}
+
+	response := &coapMessage{code: coapCodeCreated}
+	response.addOption(coapOptionLocationPath, []byte("register"))
+	response.addOption(coapOptionLocationPath, []byte(session.Connection.DeviceID))
+
+	return response
+}
+
+func (service *CoAPConnectionsHandlerService) deregister(address *net.UDPAddr) *coapMessage {
+	service.registrationsMutex.Lock()
+	defer service.registrationsMutex.Unlock()
+
+	service.mutex.Lock()
+	device, exists := service.devices[address.String()]
+	delete(service.devices, address.String())
+	service.mutex.Unlock()
+
+	if !exists {
+		return &coapMessage{code: coapCodeNotFound}
+	}
+
+	service.closeDevice(device, true)
+
+	return &coapMessage{code: coapCodeDeleted}
+}
+
+func (service *CoAPConnectionsHandlerService) observe(address *net.UDPAddr, request *coapMessage) *coapMessage {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	device, exists := service.devices[address.String()]
+
+	if !exists {
+		return &coapMessage{code: coapCodeForbidden}
+	}
+
+	device.extendRegistration()
+
+	observe, isObserveRequest := request.option(coapOptionObserve)
+	response := &coapMessage{code: coapCodeContent}
+
+	if isObserveRequest && coapParseUint(observe) == 0 {
+		device.observerCodec = events.JSONCodec{}
+
+		if accept, exists := request.option(coapOptionAccept); exists {
+			codec, supported := coapCodecFor(accept)
+
+			if !supported {
+				return &coapMessage{code: coapCodeNotAcceptable}
+			}
+
+			device.observerCodec = codec
+		}
+
+		device.observerToken = request.token
+		device.observeSequence++
+		response.addOption(coapOptionObserve, coapUint(device.observeSequence))
+	} else if isObserveRequest {
+		device.observerToken = nil
+	}
+
+	return response
+}
+
+// refreshRegistration Extends the registration lifetime, returns nil if the device is not registered
+func (service *CoAPConnectionsHandlerService) refreshRegistration(address *net.UDPAddr) *coapDevice {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	device, exists := service.devices[address.String()]
+
+	if !exists {
+		return nil
+	}
+
+	device.extendRegistration()
+
+	return device
+}
+
+func (service *CoAPConnectionsHandlerService) expireRegistrations() {
+	now := time.Now()
+	expired := []*coapDevice{}
+
+	service.mutex.Lock()
+
+	for remoteAddress, device := range service.devices {
+		if now.After(device.expiresAt) {
+			expired = append(expired, device)
+			delete(service.devices, remoteAddress)
+		}
+	}
+
+	for key, exchange := range service.exchanges {
+		if now.Sub(exchange.receivedAt) > coapExchangeLifetime {
+			delete(service.exchanges, key)
+		}
+	}
+
+	service.mutex.Unlock()
+
+	for _, device := range expired {
+		service.closeDevice(device, true)
+	}
+}
+
+// closeDevice The device must already be removed from service.devices
+func (service *CoAPConnectionsHandlerService) closeDevice(device *coapDevice, notify bool) {
+	close(device.isClosing)
+	device.Close(notify)
+
+	service.devicesWaitGroup.Done()
+}
+
+func (service *CoAPConnectionsHandlerService) newMessageID() uint16 {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	service.nextMessageID++
+
+	return service.nextMessageID
+}
+
+func (service *CoAPConnectionsHandlerService) write(address *net.UDPAddr, message *coapMessage) error {
+	_, err := service.conn.WriteToUDP(message.encode(), address)
+
+	return err
+}
+
+// extendRegistration Postpones the registration expiry to a whole lifetime from now, it is
+// never brought forward. service.mutex must be held by the caller.
+func (device *coapDevice) extendRegistration() {
+	if expiresAt := time.Now().Add(device.lifetime); device.expiresAt.Before(expiresAt) {
+		device.expiresAt = expiresAt
+	}
+}
+
+// Send deviceTransport implementation, pushes message as a confirmable notification of
+// the commands resource and waits for the device acknowledgement, retransmitting it
+// with exponential back-off as described at RFC 7252 section 4.2
+func (device *coapDevice) Send(message events.Message) error {
+	service := device.service
+	notification := &coapMessage{
+		messageType: coapConfirmable,
+		code:        coapCodeContent,
+		messageID:   service.newMessageID(),
+	}
+
+	service.mutex.Lock()
+
+	if device.observerToken == nil {
+		service.mutex.Unlock()
+		return errCoAPDeviceNotObserving
+	}
+
+	payload, err := device.observerCodec.Marshal(message)
+
+	if err != nil {
+		service.mutex.Unlock()
+		return err
+	}
+
+	contentFormat, _ := coapContentFormatOf(device.observerCodec)
+
+	device.observeSequence++
+	notification.token = device.observerToken
+	notification.payload = payload
+	notification.addOption(coapOptionObserve, coapUint(device.observeSequence))
+	notification.addOption(coapOptionContentFormat, coapUint(uint32(contentFormat)))
+
+	ack := make(chan byte, 1)
+	service.pendingAcks[notification.messageID] = ack
+	service.mutex.Unlock()
+
+	defer func() {
+		service.mutex.Lock()
+		delete(service.pendingAcks, notification.messageID)
+		service.mutex.Unlock()
+	}()
+
+	timeout := time.Duration(service.AckTimeout) * time.Millisecond
+
+	for attempt := 0; attempt <= service.MaxRetransmit; attempt++ {
+		if err := service.write(device.address, notification); err != nil {
+			return err
+		}
+
+		select {
+		case messageType := <-ack:
+			if messageType == coapReset {
+				service.mutex.Lock()
+				device.observerToken = nil
+				service.mutex.Unlock()
+
+				return errCoAPNotificationReset
+			}
+
+			return nil
+
+		case <-time.After(timeout):
+			timeout *= 2
+
+		case <-device.isClosing:
+			return errCoAPNotificationLost
+		}
+	}
+
+	return errCoAPNotificationLost
+}
@@ -0,0 +1,329 @@
+package services
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/bus"
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+// Mocks
+
+type coapTestClient struct {
+	conn          *net.UDPConn
+	nextMessageID uint16
+}
+
+func newCoAPTestClient(t *testing.T, address net.Addr) *coapTestClient {
+	conn, err := net.DialUDP("udp", nil, address.(*net.UDPAddr))
+	assert.NilError(t, err)
+
+	return &coapTestClient{conn: conn, nextMessageID: 100}
+}
+
+func (client *coapTestClient) request(t *testing.T, messageType byte, code byte, path string, payload string) *coapMessage {
+	client.nextMessageID++
+
+	request := &coapMessage{
+		messageType: messageType,
+		code:        code,
+		messageID:   client.nextMessageID,
+		token:       []byte{0xCA, 0xFE},
+		payload:     []byte(payload),
+	}
+	request.addOption(coapOptionURIPath, []byte(path))
+
+	return client.send(t, request)
+}
+
+func (client *coapTestClient) send(t *testing.T, request *coapMessage) *coapMessage {
+	client.conn.Write(request.encode())
+
+	return client.read(t)
+}
+
+func (client *coapTestClient) read(t *testing.T) *coapMessage {
+	buffer := make([]byte, 2048)
+	client.conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	n, err := client.conn.Read(buffer)
+	assert.NilError(t, err)
+
+	message, err := parseCoAPMessage(buffer[:n])
+	assert.NilError(t, err)
+
+	return message
+}
+
+func startCoAPConnectionsHandler(t *testing.T, eventBus *bus.InMemoryEventBus) (*CoAPConnectionsHandlerService, chan bool) {
+	shutdownService := make(chan bool)
+
+	service := NewCoAPConnectionsHandlerService(eventBus, "127.0.0.1:0")
+	service.AckTimeout = 100
+	service.MaxRetransmit = 1
+	assert.NilError(t, service.Init(shutdownService))
+	go service.Start()
+
+	return service, shutdownService
+}
+
+func TestCoAPMessagesShouldBeEncodedAndDecoded(t *testing.T) {
+	message := &coapMessage{
+		messageType: coapConfirmable,
+		code:        coapCodePOST,
+		messageID:   0x1234,
+		token:       []byte{1, 2, 3},
+		payload:     []byte("hello"),
+	}
+	message.addOption(coapOptionURIQuery, []byte("lt=60"))
+	message.addOption(coapOptionURIPath, []byte("register"))
+	message.addOption(300, []byte("a long option number"))
+
+	decoded, err := parseCoAPMessage(message.encode())
+	assert.NilError(t, err)
+
+	assert.Assert(t, decoded.messageType == coapConfirmable)
+	assert.Assert(t, decoded.code == coapCodePOST)
+	assert.Assert(t, decoded.messageID == 0x1234)
+	assert.DeepEqual(t, decoded.token, []byte{1, 2, 3})
+	assert.Assert(t, decoded.path() == "register")
+	assert.Assert(t, decoded.query()["lt"] == "60")
+	assert.Assert(t, string(decoded.payload) == "hello")
+
+	value, exists := decoded.option(300)
+	assert.Assert(t, exists)
+	assert.Assert(t, string(value) == "a long option number")
+
+	assert.Assert(t, coapParseUint(coapUint(70000)) == 70000)
+
+	_, err = parseCoAPMessage([]byte{0x40, 0x01})
+	assert.Assert(t, err == errCoAPMalformedMessage)
+}
+
+func TestCoAPRegistrationShouldPublishConnectionEstablished(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, shutdownService := startCoAPConnectionsHandler(t, eventBus)
+
+	established := make(chan events.Message)
+	eventBus.Subscribe(events.ConnectionEstablishedTopic, &established)
+
+	client := newCoAPTestClient(t, service.Addr())
+	defer client.conn.Close()
+
+	created := make(chan *coapMessage)
+
+	go func() {
+		created <- client.request(t, coapConfirmable, coapCodePOST, "register", "{\"device_id\": \"abc-123\"}")
+	}()
+
+	m := waitForMessage(t, established)
+	assert.Assert(t, string(m.Payload) == "{\"device_id\": \"abc-123\"}")
+	assert.Assert(t, m.OriginRemoteAddress == client.conn.LocalAddr().String())
+
+	response := <-created
+	assert.Assert(t, response.messageType == coapAcknowledgement)
+	assert.Assert(t, response.code == coapCodeCreated)
+	assert.Assert(t, response.messageID == client.nextMessageID)
+	assert.Assert(t, service.ActiveConnectionsCount() == 1)
+
+	response = client.request(t, coapConfirmable, coapCodePOST, "register", "{\"device_id\": \"abc-123\"}")
+	assert.Assert(t, response.code == coapCodeChanged)
+	assert.Assert(t, service.ActiveConnectionsCount() == 1)
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
+
+func TestCoAPMessagesFromUnregisteredDevicesShouldBeForbidden(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, shutdownService := startCoAPConnectionsHandler(t, eventBus)
+
+	client := newCoAPTestClient(t, service.Addr())
+	defer client.conn.Close()
+
+	response := client.request(t, coapConfirmable, coapCodePOST, "messages", "{\"temperature\": 21}")
+	assert.Assert(t, response.code == coapCodeForbidden)
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
+
+func TestCoAPMessagesShouldBePublishedOnMessageReceivedTopic(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, shutdownService := startCoAPConnectionsHandler(t, eventBus)
+
+	received := make(chan events.Message)
+	eventBus.Subscribe(events.MessageReceivedTopic, &received)
+
+	client := newCoAPTestClient(t, service.Addr())
+	defer client.conn.Close()
+
+	client.request(t, coapConfirmable, coapCodePOST, "register", "{\"device_id\": \"abc-123\"}")
+
+	acknowledged := make(chan *coapMessage)
+
+	go func() {
+		acknowledged <- client.request(t, coapConfirmable, coapCodePOST, "messages", "{\"temperature\": 21}")
+	}()
+
+	m := waitForMessage(t, received)
+	assert.Assert(t, string(m.Payload) == "{\"temperature\": 21}")
+
+	response := <-acknowledged
+	assert.Assert(t, response.messageType == coapAcknowledgement)
+	assert.Assert(t, response.code == coapCodeChanged)
+
+	// Retransmitted requests are acknowledged again without being processed twice
+	duplicated := &coapMessage{messageType: coapConfirmable, code: coapCodePOST, messageID: client.nextMessageID}
+	duplicated.addOption(coapOptionURIPath, []byte("messages"))
+
+	response = client.send(t, duplicated)
+	assert.Assert(t, response.code == coapCodeChanged)
+
+	select {
+	case m := <-received:
+		t.Fatalf("Duplicated message was published %v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
+
+func TestCoAPBusMessagesShouldBeNotifiedToObservingDevices(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, shutdownService := startCoAPConnectionsHandler(t, eventBus)
+
+	sent := make(chan events.Message)
+	eventBus.Subscribe(events.MessageSentTopic, &sent)
+
+	client := newCoAPTestClient(t, service.Addr())
+	defer client.conn.Close()
+
+	client.request(t, coapConfirmable, coapCodePOST, "register", "{\"device_id\": \"abc-123\"}")
+
+	observe := &coapMessage{messageType: coapConfirmable, code: coapCodeGET, messageID: 1, token: []byte{0xBE, 0xEF}}
+	observe.addOption(coapOptionURIPath, []byte("commands"))
+	observe.addOption(coapOptionObserve, coapUint(0))
+
+	response := client.send(t, observe)
+	_, isObserving := response.option(coapOptionObserve)
+	assert.Assert(t, response.code == coapCodeContent)
+	assert.Assert(t, isObserving)
+
+	go eventBus.Publish(events.SendToDeviceTopic("abc-123"), events.NewMessage([]byte("on"), "", events.Command))
+
+	notification := client.read(t)
+	assert.Assert(t, notification.messageType == coapConfirmable)
+	assert.DeepEqual(t, notification.token, []byte{0xBE, 0xEF})
+
+	var command events.Message
+	json.Unmarshal(notification.payload, &command)
+	assert.Assert(t, string(command.Payload) == "on")
+
+	client.conn.Write((&coapMessage{messageType: coapAcknowledgement, messageID: notification.messageID}).encode())
+
+	assert.Assert(t, string(waitForMessage(t, sent).Payload) == "on")
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
+
+func TestCoAPExpiredRegistrationsShouldPublishConnectionClosed(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, shutdownService := startCoAPConnectionsHandler(t, eventBus)
+
+	closed := make(chan events.Message)
+	eventBus.Subscribe(events.ConnectionClosedTopic, &closed)
+
+	client := newCoAPTestClient(t, service.Addr())
+	defer client.conn.Close()
+
+	request := &coapMessage{messageType: coapConfirmable, code: coapCodePOST, messageID: 1, payload: []byte("{\"device_id\": \"abc-123\"}")}
+	request.addOption(coapOptionURIPath, []byte("register"))
+	request.addOption(coapOptionURIQuery, []byte("lt=1"))
+
+	assert.Assert(t, client.send(t, request).code == coapCodeCreated)
+
+	select {
+	case m := <-closed:
+		assert.Assert(t, string(m.Payload) == "{\"device_id\": \"abc-123\"}")
+	case <-time.After(3 * time.Second):
+		t.Fatal("registration did not expire")
+	}
+
+	assert.Assert(t, service.ActiveConnectionsCount() == 0)
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
+
+func TestCoAPObservingShouldNotShortenTheRegistrationLifetime(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, shutdownService := startCoAPConnectionsHandler(t, eventBus)
+
+	client := newCoAPTestClient(t, service.Addr())
+	defer client.conn.Close()
+
+	request := &coapMessage{messageType: coapConfirmable, code: coapCodePOST, messageID: 1, payload: []byte("{\"device_id\": \"abc-123\"}")}
+	request.addOption(coapOptionURIPath, []byte("register"))
+	request.addOption(coapOptionURIQuery, []byte("lt=3600"))
+
+	assert.Assert(t, client.send(t, request).code == coapCodeCreated)
+	assert.Assert(t, client.request(t, coapConfirmable, coapCodeGET, "commands", "").code == coapCodeContent)
+
+	service.mutex.Lock()
+	expiresAt := service.devices[client.conn.LocalAddr().String()].expiresAt
+	service.mutex.Unlock()
+
+	// Longer than the service default RegistrationLifetime
+	assert.Assert(t, time.Until(expiresAt) > 3500*time.Second)
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
+
+func TestCoAPDevicesShouldNotWaitForOtherDevicesMessagesToBePublished(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, shutdownService := startCoAPConnectionsHandler(t, eventBus)
+
+	// Never reads, publishing on MessageReceivedTopic blocks once its queue is full
+	stalled := make(chan events.Message)
+	eventBus.SubscribeWithOptions(events.MessageReceivedTopic, &stalled, bus.SubscriptionOptions{
+		QueueSize:      1,
+		OverflowPolicy: bus.OverflowBlock,
+		BlockTimeout:   2 * time.Second,
+	})
+
+	busy := newCoAPTestClient(t, service.Addr())
+	defer busy.conn.Close()
+
+	busy.request(t, coapConfirmable, coapCodePOST, "register", "{\"device_id\": \"abc-123\"}")
+
+	for i := 0; i < 5; i++ {
+		busy.nextMessageID++
+
+		message := &coapMessage{messageType: coapNonConfirmable, code: coapCodePOST, messageID: busy.nextMessageID, payload: []byte("21")}
+		message.addOption(coapOptionURIPath, []byte("messages"))
+		busy.conn.Write(message.encode())
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	other := newCoAPTestClient(t, service.Addr())
+	defer other.conn.Close()
+
+	started := time.Now()
+	response := other.request(t, coapConfirmable, coapCodePOST, "register", "{\"device_id\": \"def-456\"}")
+
+	assert.Assert(t, response.code == coapCodeCreated)
+	assert.Assert(t, time.Since(started) < 500*time.Millisecond)
+
+	eventBus.Unsubscribe(events.MessageReceivedTopic, &stalled)
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
@@ -0,0 +1,413 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nnset/iot-cloud-connector/bus"
+	"github.com/nnset/iot-cloud-connector/events"
+)
+
+// DefaultCloudConnectorAPIService HTTP API described at docs/default-cloud-connector-api.md
+// It reads connections data from InMemoryConnectionsStorageService and talks to IoT devices
+// through a DeviceDispatcher.
+type DefaultCloudConnectorAPIService struct {
+	ListenAddress      string
+	ResponseTimeout    int // Seconds
+	id                 string
+	eventBus           bus.MessageBus
+	connectionsStorage *InMemoryConnectionsStorageService
+	server             *http.Server
+	mux                *http.ServeMux
+	serviceIsShutdown  chan bool
+	shutdownService    chan bool
+	startTime          int64
+	dispatcher         *DeviceDispatcher
+}
+
+// apiMetricsResponse Bus is only set when the event bus implements bus.BusInspector.
+type apiMetricsResponse struct {
+	Metrics map[string]interface{} `json:"metrics"`
+	Units   map[string]string      `json:"units"`
+	Bus     *bus.BusSnapshot       `json:"bus,omitempty"`
+}
+
+type apiDevicesResponse struct {
+	Devices []string `json:"devices"`
+}
+
+// apiSendToDeviceRequest TTL, in seconds, is optional. Messages not delivered to the device
+// before their TTL are discarded. Priority is optional too, high, normal or low, see
+// events.MessagePriority.
+type apiSendToDeviceRequest struct {
+	Payload  string `json:"payload"`
+	TTL      int    `json:"ttl,omitempty"`
+	Priority string `json:"priority,omitempty"`
+}
+
+type apiSendToDeviceResponse struct {
+	Response string `json:"response"`
+	Error    string `json:"error"`
+}
+
+type apiErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewDefaultCloudConnectorAPIService Creates a new instance of DefaultCloudConnectorAPIService
+func NewDefaultCloudConnectorAPIService(
+	eventBus bus.MessageBus,
+	connectionsStorage *InMemoryConnectionsStorageService,
+	listenAddress string,
+	responseTimeout int,
+) *DefaultCloudConnectorAPIService {
+	service := &DefaultCloudConnectorAPIService{
+		id:                 uuid.New().String(),
+		eventBus:           eventBus,
+		connectionsStorage: connectionsStorage,
+		ListenAddress:      listenAddress,
+		ResponseTimeout:    responseTimeout,
+		mux:                http.NewServeMux(),
+		startTime:          time.Now().Unix(),
+		dispatcher:         NewDeviceDispatcher(eventBus),
+	}
+
+	service.mux.HandleFunc("/cloud-connector/status", negotiated(service.statusHandler))
+	service.mux.HandleFunc("/devices", negotiated(service.devicesHandler))
+	service.mux.HandleFunc("/devices/", negotiated(service.deviceHandler))
+
+	return service
+}
+
+func (service *DefaultCloudConnectorAPIService) Id() string {
+	return service.id
+}
+
+func (service *DefaultCloudConnectorAPIService) Init(shutdownService chan bool) error {
+	service.shutdownService = shutdownService
+	service.serviceIsShutdown = make(chan bool)
+
+	if service.ListenAddress == "" {
+		service.ListenAddress = ":9090"
+	}
+
+	if service.ResponseTimeout == 0 {
+		service.ResponseTimeout = 5
+	}
+
+	service.server = &http.Server{
+		Addr:    service.ListenAddress,
+		Handler: service.Handler(),
+	}
+
+	return nil
+}
+
+func (service *DefaultCloudConnectorAPIService) Start() {
+	service.startTime = time.Now().Unix()
+
+	go service.server.ListenAndServe()
+
+	<-service.shutdownService
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(service.ResponseTimeout)*time.Second)
+	defer cancel()
+
+	service.server.Shutdown(ctx)
+	service.dispatcher.Close()
+
+	service.serviceIsShutdown <- true
+}
+
+func (service *DefaultCloudConnectorAPIService) ShutdownChannel() chan bool {
+	return service.serviceIsShutdown
+}
+
+// Handler Returns the http.Handler serving all API endpoints, useful when mounting
+// the API on your own http.Server.
+func (service *DefaultCloudConnectorAPIService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Access-Control-Request-Method")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		service.mux.ServeHTTP(w, r)
+	})
+}
+
+// negotiated Rejects requests whose Accept header no codec satisfies, before handler
+// encodes its response body with writeResponse.
+func negotiated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, acceptable := events.NegotiateCodec(r.Header.Get("Accept")); !acceptable {
+			w.Header().Set("Content-Type", events.JSONContentType)
+			w.WriteHeader(http.StatusNotAcceptable)
+			json.NewEncoder(w).Encode(apiErrorResponse{"Not acceptable, supported: " + strings.Join(events.ContentTypes(), ", ")})
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// Handle Mounts an extra handler on the API, i.e. ServerSentEventsStatusService
+// at /cloud-connector/status/stream. Its responses are not encoded with the API codecs,
+// so the Accept header is left for handler to check.
+func (service *DefaultCloudConnectorAPIService) Handle(pattern string, handler http.Handler) {
+	service.mux.Handle(pattern, handler)
+}
+
+// Dispatcher Returns the DeviceDispatcher used to send commands and queries to devices.
+func (service *DefaultCloudConnectorAPIService) Dispatcher() *DeviceDispatcher {
+	return service.dispatcher
+}
+
+// CommandsWaiting How many commands are currently waiting for the device response.
+func (service *DefaultCloudConnectorAPIService) CommandsWaiting() int64 {
+	return service.dispatcher.CommandsWaiting()
+}
+
+// QueriesWaiting How many queries are currently waiting for the device response.
+func (service *DefaultCloudConnectorAPIService) QueriesWaiting() int64 {
+	return service.dispatcher.QueriesWaiting()
+}
+
+// GET /cloud-connector/status
+func (service *DefaultCloudConnectorAPIService) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeResponse(w, r, http.StatusMethodNotAllowed, apiErrorResponse{"Method not allowed"})
+		return
+	}
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	uptime := time.Now().Unix() - service.startTime
+	receivedMessages := service.connectionsStorage.TotalReceivedMessages()
+	sentMessages := service.connectionsStorage.TotalSentMessages()
+
+	response := apiMetricsResponse{
+		Metrics: map[string]interface{}{
+			"server_current_state":         "started",
+			"connections":                  service.connectionsStorage.ActiveConnectionsCount(),
+			"uptime":                       uptime,
+			"received_messages":            receivedMessages,
+			"received_messages_per_second": perSecond(receivedMessages, uptime),
+			"sent_messages":                sentMessages,
+			"sent_messages_per_second":     perSecond(sentMessages, uptime),
+			"commands_waiting":             service.CommandsWaiting(),
+			"queries_waiting":              service.QueriesWaiting(),
+			"go_routines":                  runtime.NumGoroutine(),
+			"system_memory":                m.Sys / 1024 / 1024,
+			"allocated_memory":             m.Alloc / 1024 / 1024,
+			"heap_allocated_memory":        m.HeapAlloc / 1024 / 1024,
+		},
+		Units: map[string]string{
+			"server_current_state":         "",
+			"connections":                  "",
+			"uptime":                       "secs",
+			"received_messages":            "",
+			"received_messages_per_second": "",
+			"sent_messages":                "",
+			"sent_messages_per_second":     "",
+			"commands_waiting":             "",
+			"queries_waiting":              "",
+			"go_routines":                  "",
+			"system_memory":                "Mb",
+			"allocated_memory":             "Mb",
+			"heap_allocated_memory":        "Mb",
+		},
+	}
+
+	if inspector, ok := service.eventBus.(bus.BusInspector); ok {
+		snapshot := inspector.Inspect()
+		response.Bus = &snapshot
+	}
+
+	writeResponse(w, r, http.StatusOK, response)
+}
+
+// GET /devices
+func (service *DefaultCloudConnectorAPIService) devicesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeResponse(w, r, http.StatusMethodNotAllowed, apiErrorResponse{"Method not allowed"})
+		return
+	}
+
+	devices := []string{}
+
+	for deviceID := range service.connectionsStorage.ActiveConnections() {
+		devices = append(devices, deviceID)
+	}
+
+	writeResponse(w, r, http.StatusOK, apiDevicesResponse{devices})
+}
+
+// GET /devices/:deviceID/show
+// POST /devices/command/:deviceID
+// POST /devices/query/:deviceID
+func (service *DefaultCloudConnectorAPIService) deviceHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/devices/"), "/"), "/")
+
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case parts[1] == "show" && r.Method == http.MethodGet:
+		service.showDevice(w, r, parts[0])
+	case parts[0] == "command" && r.Method == http.MethodPost:
+		service.sendToDevice(w, r, parts[1], events.Command)
+	case parts[0] == "query" && r.Method == http.MethodPost:
+		service.sendToDevice(w, r, parts[1], events.Query)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (service *DefaultCloudConnectorAPIService) showDevice(w http.ResponseWriter, r *http.Request, deviceID string) {
+	connection, exists := service.connectionsStorage.ActiveConnections()[deviceID]
+
+	if !exists {
+		writeResponse(w, r, http.StatusNotFound, apiErrorResponse{"Device not found"})
+		return
+	}
+
+	uptime, _ := connection.Uptime()
+
+	writeResponse(w, r, http.StatusOK, apiMetricsResponse{
+		Metrics: map[string]interface{}{
+			"uptime":                       uptime,
+			"received_messages":            connection.ReceivedMessages,
+			"received_messages_per_second": perSecond(connection.ReceivedMessages, uptime),
+			"sent_messages":                connection.SentMessages,
+			"sent_messages_per_second":     perSecond(connection.SentMessages, uptime),
+		},
+		Units: map[string]string{
+			"uptime":                       "secs",
+			"received_messages":            "",
+			"received_messages_per_second": "",
+			"sent_messages":                "",
+			"sent_messages_per_second":     "",
+		},
+	})
+}
+
+func (service *DefaultCloudConnectorAPIService) sendToDevice(
+	w http.ResponseWriter,
+	r *http.Request,
+	deviceID string,
+	messageType events.MessageType,
+) {
+	connection, exists := service.connectionsStorage.ActiveConnections()[deviceID]
+
+	if !exists {
+		writeResponse(w, r, http.StatusNotFound, apiSendToDeviceResponse{"", "Device not found"})
+		return
+	}
+
+	var codec events.Codec = events.JSONCodec{}
+
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		var supported bool
+
+		if codec, supported = events.CodecFor(contentType); !supported {
+			writeResponse(w, r, http.StatusUnsupportedMediaType, apiSendToDeviceResponse{"", "Unsupported content type"})
+			return
+		}
+	}
+
+	var request apiSendToDeviceRequest
+	body, err := io.ReadAll(r.Body)
+
+	if err == nil {
+		err = codec.Unmarshal(body, &request)
+	}
+
+	var priority events.MessagePriority
+
+	if err == nil {
+		priority, err = events.ParseMessagePriority(request.Priority)
+	}
+
+	if err != nil || request.TTL < 0 {
+		writeResponse(w, r, http.StatusBadRequest, apiSendToDeviceResponse{"", "Invalid request body"})
+		return
+	}
+
+	message := events.NewMessage([]byte(request.Payload), connection.RemoteAddress, messageType)
+	message.Priority = priority
+
+	if request.TTL > 0 {
+		message.SetTTL(time.Duration(request.TTL) * time.Second)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(service.ResponseTimeout)*time.Second)
+	defer cancel()
+
+	response, err := service.dispatcher.Dispatch(ctx, connection.DeviceID, message)
+
+	if r.Context().Err() != nil {
+		// The client went away, nobody is waiting for the answer and the device is not to blame
+		return
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeResponse(w, r, http.StatusRequestTimeout, apiSendToDeviceResponse{"", "Device " + string(messageType) + " timeout"})
+		return
+	}
+
+	if err != nil {
+		// The device could not be reached, i.e. it is disconnecting, or the API is shutting down
+		writeResponse(w, r, http.StatusServiceUnavailable, apiSendToDeviceResponse{"", "Device unavailable"})
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, apiSendToDeviceResponse{string(response.Payload), ""})
+}
+
+// writeResponse Encodes body with the codec negotiated from the request Accept header,
+// negotiated already rejected requests without an acceptable codec.
+func writeResponse(w http.ResponseWriter, r *http.Request, statusCode int, body interface{}) {
+	codec, acceptable := events.NegotiateCodec(r.Header.Get("Accept"))
+
+	if !acceptable {
+		codec = events.JSONCodec{}
+	}
+
+	encoded, err := codec.Marshal(body)
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if codec.ContentType() == events.JSONContentType {
+		encoded = append(encoded, '\n')
+	}
+
+	w.Header().Set("Content-Type", codec.ContentType())
+	w.WriteHeader(statusCode)
+	w.Write(encoded)
+}
+
+func perSecond(total uint, seconds int64) uint {
+	if seconds <= 0 {
+		return total
+	}
+
+	return total / uint(seconds)
+}
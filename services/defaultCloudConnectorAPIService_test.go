@@ -0,0 +1,317 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/bus"
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+func newAPIServiceWithOneConnectedDevice(t *testing.T) (*DefaultCloudConnectorAPIService, *bus.InMemoryEventBus, chan bool) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	storage, _ := NewInMemoryConnectionsStorageService(eventBus)
+	shutdownStorage := make(chan bool)
+
+	storage.Init(shutdownStorage)
+	go storage.Start()
+
+	time.Sleep(20 * time.Millisecond)
+
+	eventBus.Publish(
+		events.ConnectionEstablishedTopic,
+		events.NewMessage([]byte("{\"device_id\": \"abc-123\"}"), "192.168.1.100", events.Default),
+	)
+
+	time.Sleep(20 * time.Millisecond)
+
+	return NewDefaultCloudConnectorAPIService(eventBus, storage, "", 1), eventBus, shutdownStorage
+}
+
+func TestAPIStatusShouldReturnMetricsAndUnits(t *testing.T) {
+	service, _, shutdownStorage := newAPIServiceWithOneConnectedDevice(t)
+	defer func() { shutdownStorage <- true }()
+
+	recorder := httptest.NewRecorder()
+	service.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/cloud-connector/status", nil))
+
+	assert.Assert(t, recorder.Code == http.StatusOK)
+
+	var body apiMetricsResponse
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+
+	assert.Assert(t, body.Metrics["connections"] == float64(1))
+	assert.Assert(t, body.Units["uptime"] == "secs")
+	assert.Assert(t, recorder.Header().Get("Access-Control-Allow-Origin") == "*")
+
+	// The connections storage subscribed to the connections topics
+	assert.Assert(t, body.Bus != nil)
+	assert.Assert(t, body.Bus.TotalSubscriptions > 0)
+	assert.Assert(t, len(body.Bus.Topics) > 0)
+}
+
+func TestAPIDevicesShouldListConnectedDevices(t *testing.T) {
+	service, _, shutdownStorage := newAPIServiceWithOneConnectedDevice(t)
+	defer func() { shutdownStorage <- true }()
+
+	recorder := httptest.NewRecorder()
+	service.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/devices", nil))
+
+	var body apiDevicesResponse
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+
+	assert.Assert(t, recorder.Code == http.StatusOK)
+	assert.DeepEqual(t, body.Devices, []string{"abc-123"})
+}
+
+func TestAPIShowDeviceShouldReturnNotFoundForUnknownDevices(t *testing.T) {
+	service, _, shutdownStorage := newAPIServiceWithOneConnectedDevice(t)
+	defer func() { shutdownStorage <- true }()
+
+	recorder := httptest.NewRecorder()
+	service.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/devices/unknown/show", nil))
+
+	assert.Assert(t, recorder.Code == http.StatusNotFound)
+	assert.Assert(t, strings.Contains(recorder.Body.String(), "Device not found"))
+
+	recorder = httptest.NewRecorder()
+	service.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/devices/abc-123/show", nil))
+
+	assert.Assert(t, recorder.Code == http.StatusOK)
+}
+
+func TestAPICommandShouldTimeoutWhenDeviceDoesNotRespond(t *testing.T) {
+	service, eventBus, shutdownStorage := newAPIServiceWithOneConnectedDevice(t)
+	defer func() { shutdownStorage <- true }()
+
+	// The device receives the command but never replies
+	deviceChannel := make(chan events.Message, 1)
+	eventBus.Subscribe(events.SendToDeviceTopic("abc-123"), &deviceChannel)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/devices/command/abc-123", strings.NewReader("{\"payload\": \"on\"}"))
+	service.Handler().ServeHTTP(recorder, request)
+
+	assert.Assert(t, recorder.Code == http.StatusRequestTimeout)
+	assert.Assert(t, strings.Contains(recorder.Body.String(), "Device command timeout"))
+	assert.Assert(t, service.CommandsWaiting() == 0)
+}
+
+func TestAPICommandShouldFailWhenDeviceCanNotBeReached(t *testing.T) {
+	service, _, shutdownStorage := newAPIServiceWithOneConnectedDevice(t)
+	defer func() { shutdownStorage <- true }()
+
+	// Nobody serves the device topic
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/devices/command/abc-123", strings.NewReader("{\"payload\": \"on\"}"))
+	service.Handler().ServeHTTP(recorder, request)
+
+	assert.Assert(t, recorder.Code == http.StatusServiceUnavailable)
+	assert.Assert(t, strings.Contains(recorder.Body.String(), "Device unavailable"))
+	assert.Assert(t, service.CommandsWaiting() == 0)
+}
+
+func TestAPICommandShouldNotAnswerClientsThatWentAway(t *testing.T) {
+	service, eventBus, shutdownStorage := newAPIServiceWithOneConnectedDevice(t)
+	defer func() { shutdownStorage <- true }()
+
+	deviceChannel := make(chan events.Message, 1)
+	eventBus.Subscribe(events.SendToDeviceTopic("abc-123"), &deviceChannel)
+
+	ctx, disconnect := context.WithCancel(context.Background())
+
+	go func() {
+		<-deviceChannel
+		disconnect()
+	}()
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/devices/command/abc-123", strings.NewReader("{\"payload\": \"on\"}"))
+	service.Handler().ServeHTTP(recorder, request.WithContext(ctx))
+
+	assert.Assert(t, !recorder.Flushed)
+	assert.Assert(t, recorder.Body.Len() == 0)
+	assert.Assert(t, service.CommandsWaiting() == 0)
+}
+
+func TestAPIQueryShouldReturnDeviceResponse(t *testing.T) {
+	service, eventBus, shutdownStorage := newAPIServiceWithOneConnectedDevice(t)
+	defer func() { shutdownStorage <- true }()
+
+	deviceChannel := make(chan events.Message)
+	eventBus.Subscribe(events.SendToDeviceTopic("abc-123"), &deviceChannel)
+
+	go func() {
+		query := <-deviceChannel
+		eventBus.Publish(
+			events.MessageReceivedTopic,
+			events.NewReplyMessage(query, []byte("answer to "+string(query.Payload)), "192.168.1.100"),
+		)
+	}()
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/devices/query/abc-123", strings.NewReader("{\"payload\": \"temperature\"}"))
+	service.Handler().ServeHTTP(recorder, request)
+
+	var body apiSendToDeviceResponse
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+
+	assert.Assert(t, recorder.Code == http.StatusOK)
+	assert.Assert(t, body.Response == "answer to temperature")
+}
+
+func TestAPIShouldNegotiateTheResponseCodec(t *testing.T) {
+	service, _, shutdownStorage := newAPIServiceWithOneConnectedDevice(t)
+	defer func() { shutdownStorage <- true }()
+
+	request := httptest.NewRequest(http.MethodGet, "/devices", nil)
+	request.Header.Set("Accept", "application/msgpack")
+
+	recorder := httptest.NewRecorder()
+	service.Handler().ServeHTTP(recorder, request)
+
+	var body apiDevicesResponse
+	assert.NilError(t, events.MessagePackCodec{}.Unmarshal(recorder.Body.Bytes(), &body))
+
+	assert.Assert(t, recorder.Header().Get("Content-Type") == events.MessagePackContentType)
+	assert.DeepEqual(t, body.Devices, []string{"abc-123"})
+
+	request = httptest.NewRequest(http.MethodGet, "/devices", nil)
+	request.Header.Set("Accept", "text/html")
+
+	recorder = httptest.NewRecorder()
+	service.Handler().ServeHTTP(recorder, request)
+
+	assert.Assert(t, recorder.Code == http.StatusNotAcceptable)
+}
+
+func TestAPIShouldNotNegotiateCodecsForMountedHandlers(t *testing.T) {
+	service, eventBus, shutdownStorage := newAPIServiceWithOneConnectedDevice(t)
+	defer func() { shutdownStorage <- true }()
+
+	shutdownStream := make(chan bool)
+	stream := NewServerSentEventsStatusService(eventBus, "")
+	stream.Init(shutdownStream)
+	go stream.Start()
+
+	service.Handle("/cloud-connector/status/stream", stream)
+
+	server := httptest.NewServer(service.Handler())
+	defer server.Close()
+
+	// What browsers EventSource sends
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/cloud-connector/status/stream", nil)
+	request.Header.Set("Accept", "text/event-stream")
+
+	response, err := http.DefaultClient.Do(request)
+	assert.NilError(t, err)
+	defer response.Body.Close()
+
+	assert.Assert(t, response.StatusCode == http.StatusOK)
+	assert.Assert(t, response.Header.Get("Content-Type") == "text/event-stream")
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Assert(t, stream.ConnectedClients() == 1)
+
+	shutdownStream <- true
+	<-stream.ShutdownChannel()
+}
+
+func TestAPIShouldDecodeRequestsWithTheirContentTypeCodec(t *testing.T) {
+	service, eventBus, shutdownStorage := newAPIServiceWithOneConnectedDevice(t)
+	defer func() { shutdownStorage <- true }()
+
+	deviceChannel := make(chan events.Message)
+	eventBus.Subscribe(events.SendToDeviceTopic("abc-123"), &deviceChannel)
+
+	go func() {
+		command := <-deviceChannel
+		eventBus.Publish(events.MessageReceivedTopic, events.NewReplyMessage(command, command.Payload, "192.168.1.100"))
+	}()
+
+	body, _ := events.CBORCodec{}.Marshal(apiSendToDeviceRequest{Payload: "\xff\x00binary"})
+
+	request := httptest.NewRequest(http.MethodPost, "/devices/command/abc-123", strings.NewReader(string(body)))
+	request.Header.Set("Content-Type", events.CBORContentType)
+	request.Header.Set("Accept", events.CBORContentType)
+
+	recorder := httptest.NewRecorder()
+	service.Handler().ServeHTTP(recorder, request)
+
+	var response apiSendToDeviceResponse
+	assert.NilError(t, events.CBORCodec{}.Unmarshal(recorder.Body.Bytes(), &response))
+
+	assert.Assert(t, recorder.Code == http.StatusOK)
+	assert.Assert(t, response.Response == "\xff\x00binary")
+
+	request = httptest.NewRequest(http.MethodPost, "/devices/command/abc-123", strings.NewReader("on"))
+	request.Header.Set("Content-Type", "text/plain")
+
+	recorder = httptest.NewRecorder()
+	service.Handler().ServeHTTP(recorder, request)
+
+	assert.Assert(t, recorder.Code == http.StatusUnsupportedMediaType)
+}
+
+func TestAPICommandsShouldExpireAfterTheirTTL(t *testing.T) {
+	service, eventBus, shutdownStorage := newAPIServiceWithOneConnectedDevice(t)
+	defer func() { shutdownStorage <- true }()
+
+	deviceChannel := make(chan events.Message)
+	eventBus.Subscribe(events.SendToDeviceTopic("abc-123"), &deviceChannel)
+
+	go func() {
+		command := <-deviceChannel
+
+		assert.Assert(t, command.ExpiresAt > time.Now().UnixNano())
+		assert.Assert(t, command.ExpiresAt <= time.Now().Add(30*time.Second).UnixNano())
+
+		eventBus.Publish(events.MessageReceivedTopic, events.NewReplyMessage(command, []byte("closed"), "192.168.1.100"))
+	}()
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/devices/command/abc-123", strings.NewReader("{\"payload\": \"valve off\", \"ttl\": 30}"))
+	service.Handler().ServeHTTP(recorder, request)
+
+	assert.Assert(t, recorder.Code == http.StatusOK)
+
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest(http.MethodPost, "/devices/command/abc-123", strings.NewReader("{\"payload\": \"valve off\", \"ttl\": -1}"))
+	service.Handler().ServeHTTP(recorder, request)
+
+	assert.Assert(t, recorder.Code == http.StatusBadRequest)
+}
+
+func TestAPICommandsShouldCarryTheirPriority(t *testing.T) {
+	service, eventBus, shutdownStorage := newAPIServiceWithOneConnectedDevice(t)
+	defer func() { shutdownStorage <- true }()
+
+	deviceChannel := make(chan events.Message)
+	eventBus.Subscribe(events.SendToDeviceTopic("abc-123"), &deviceChannel)
+
+	go func() {
+		command := <-deviceChannel
+
+		assert.Assert(t, command.Priority == events.PriorityHigh)
+
+		eventBus.Publish(events.MessageReceivedTopic, events.NewReplyMessage(command, []byte("stopped"), "192.168.1.100"))
+	}()
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/devices/command/abc-123", strings.NewReader("{\"payload\": \"stop motor\", \"priority\": \"high\"}"))
+	service.Handler().ServeHTTP(recorder, request)
+
+	assert.Assert(t, recorder.Code == http.StatusOK)
+
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest(http.MethodPost, "/devices/command/abc-123", strings.NewReader("{\"payload\": \"stop motor\", \"priority\": \"urgent\"}"))
+	service.Handler().ServeHTTP(recorder, request)
+
+	assert.Assert(t, recorder.Code == http.StatusBadRequest)
+}
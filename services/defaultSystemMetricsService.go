@@ -1,6 +1,7 @@
 package services
 
 import (
+	"encoding/json"
 	"runtime"
 	"strconv"
 	"time"
@@ -76,13 +77,27 @@ func (service *DefaultSystemMetricsService) publishMetrics() {
 	service.publishMetric(
 		events.SystemMetricsAllocatedMemoryTopic, strconv.Itoa(service.allocatedMemory()),
 	)
+
+	if inspector, ok := service.eventBus.(bus.BusQueueInspector); ok {
+		for priority, queued := range inspector.QueuedByPriority() {
+			service.publishMetric(events.SystemMetricsQueueDepthTopic(priority), strconv.Itoa(queued))
+		}
+	}
+
+	if inspector, ok := service.eventBus.(bus.BusInspector); ok {
+		if snapshot, err := json.Marshal(inspector.Inspect()); err == nil {
+			service.publishMetric(events.SystemMetricsBusTopic, string(snapshot))
+		}
+	}
 }
 
+// publishMetric Metrics are only published when they change, they are retained so
+// subscribers joining later get the current value straight away.
 func (service *DefaultSystemMetricsService) publishMetric(topic string, currentValue string) {
 	previousValue, exists := service.metricsLastPublishedValue[topic]
 
 	if !exists || previousValue != currentValue {
-		service.eventBus.Publish(topic, events.NewMessage(currentValue, "localhost", events.Default))
+		bus.PublishRetained(service.eventBus, topic, events.NewMessage([]byte(currentValue), "localhost", events.Default))
 		service.metricsLastPublishedValue[topic] = currentValue
 	}
 }
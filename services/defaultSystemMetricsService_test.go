@@ -1,6 +1,7 @@
 package services
 
 import (
+	"encoding/json"
 	"strconv"
 	"testing"
 	"time"
@@ -47,7 +48,7 @@ func TestStaringDefaultSystemMetricsServiceShouldPublishOnEventBus(t *testing.T)
 
 	select {
 	case message := <-topicChannel:
-		_, err := strconv.ParseInt(message.Payload, 10, 64)
+		_, err := strconv.ParseInt(string(message.Payload), 10, 64)
 
 		assert.Assert(t, err == nil)
 		assert.Assert(t, message.MessagType == events.Default)
@@ -56,3 +57,79 @@ func TestStaringDefaultSystemMetricsServiceShouldPublishOnEventBus(t *testing.T)
 		assert.Assert(t, false)
 	}
 }
+
+func TestMetricsShouldBeRetainedForLateSubscribers(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+
+	service := NewDefaultSystemMetricsService(eventBus, 1)
+	service.publishMetric(events.SystemMetricsAllocatedMemoryTopic, "4")
+
+	// Same value again, it is not published but the retained one is still there
+	service.publishMetric(events.SystemMetricsAllocatedMemoryTopic, "4")
+
+	topicChannel := make(chan events.Message)
+	eventBus.Subscribe("system_metrics::*", &topicChannel)
+
+	select {
+	case message := <-topicChannel:
+		assert.Assert(t, string(message.Payload) == "4")
+	case <-time.After(time.Second):
+		assert.Assert(t, false)
+	}
+}
+
+func TestMetricsShouldIncludeQueueDepthPerPriority(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service := NewDefaultSystemMetricsService(eventBus, 1)
+
+	// Nobody reads from it, so messages stay queued
+	slow := make(chan events.Message)
+	eventBus.Subscribe("commands", &slow)
+
+	for _, priority := range []events.MessagePriority{events.PriorityHigh, events.PriorityHigh, events.PriorityLow} {
+		m := events.NewMessage(nil, "", events.Command)
+		m.Priority = priority
+		eventBus.Publish("commands", m)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	service.publishMetrics()
+
+	// The delivery goroutine took one of the high priority messages, waiting for slow
+	expected := map[events.MessagePriority]string{events.PriorityHigh: "1", events.PriorityNormal: "0", events.PriorityLow: "1"}
+
+	for priority, depth := range expected {
+		depths := make(chan events.Message, 1)
+		eventBus.Subscribe(events.SystemMetricsQueueDepthTopic(priority), &depths)
+
+		select {
+		case m := <-depths:
+			assert.Assert(t, string(m.Payload) == depth, priority.String())
+		case <-time.After(time.Second):
+			assert.Assert(t, false, priority.String())
+		}
+	}
+}
+
+func TestMetricsShouldIncludeTheBusSnapshot(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service := NewDefaultSystemMetricsService(eventBus, 1)
+
+	eventBus.Publish("nobody::listens", events.NewMessage(nil, "", events.Default))
+	service.publishMetrics()
+
+	snapshots := make(chan events.Message, 1)
+	eventBus.Subscribe(events.SystemMetricsBusTopic, &snapshots)
+
+	select {
+	case m := <-snapshots:
+		var snapshot bus.BusSnapshot
+
+		assert.NilError(t, json.Unmarshal(m.Payload, &snapshot))
+		assert.Assert(t, snapshot.DeadLetters == 1)
+		assert.Assert(t, len(snapshot.Topics) > 0)
+
+	case <-time.After(time.Second):
+		assert.Assert(t, false)
+	}
+}
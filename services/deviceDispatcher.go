@@ -0,0 +1,196 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nnset/iot-cloud-connector/bus"
+	"github.com/nnset/iot-cloud-connector/events"
+)
+
+var (
+	// ErrDispatcherIsClosed Returned by DeviceDispatcher.Dispatch once the dispatcher is closed.
+	ErrDispatcherIsClosed = errors.New("dispatcher is closed")
+	// ErrDeviceUnreachable Returned, wrapping the bus error, by DeviceDispatcher.Dispatch when
+	// the request can not be published, i.e. no connections handler serves the device.
+	ErrDeviceUnreachable = errors.New("device is unreachable")
+)
+
+// DeviceDispatcher Sends queries and commands to IoT devices and blocks until the device
+// replies or the context is done.
+//
+// Requests are published on events.SendToDeviceTopic(deviceID), a reply is any message
+// published on MessageReceivedTopic whose CorrelationID is the request ID, see
+// events.NewReplyMessage. Connections handlers read the correlation ID from the
+// "correlation_id" field of JSON payloads sent by devices.
+type DeviceDispatcher struct {
+	eventBus        bus.MessageBus
+	replies         chan events.Message
+	pending         map[string]*pendingRequest // By request ID
+	mutex           sync.Mutex
+	isSubscribed    bool
+	isClosed        bool
+	stopRouting     chan struct{}
+	routingStopped  chan struct{}
+	commandsWaiting int64
+	queriesWaiting  int64
+}
+
+type pendingRequest struct {
+	deviceID string
+	reply    chan events.Message
+}
+
+// NewDeviceDispatcher Creates a new instance of DeviceDispatcher. It subscribes to
+// MessageReceivedTopic on the first dispatched message, call Close to unsubscribe.
+func NewDeviceDispatcher(eventBus bus.MessageBus) *DeviceDispatcher {
+	return &DeviceDispatcher{
+		eventBus:       eventBus,
+		replies:        make(chan events.Message),
+		pending:        make(map[string]*pendingRequest),
+		stopRouting:    make(chan struct{}),
+		routingStopped: make(chan struct{}),
+	}
+}
+
+// Command Sends a command to the device and waits for its reply.
+func (dispatcher *DeviceDispatcher) Command(ctx context.Context, deviceID string, payload []byte) (events.Message, error) {
+	return dispatcher.Dispatch(ctx, deviceID, events.NewDeviceMessage(deviceID, payload, "", events.Command))
+}
+
+// Query Sends a query to the device and waits for its reply.
+func (dispatcher *DeviceDispatcher) Query(ctx context.Context, deviceID string, payload []byte) (events.Message, error) {
+	return dispatcher.Dispatch(ctx, deviceID, events.NewDeviceMessage(deviceID, payload, "", events.Query))
+}
+
+// Dispatch Sends request to the device and blocks until a reply correlated with request.ID
+// arrives. When ctx is done its error is returned, usually context.DeadlineExceeded.
+// request DeviceID and ReplyTo are set by Dispatch.
+func (dispatcher *DeviceDispatcher) Dispatch(
+	ctx context.Context,
+	deviceID string,
+	request events.Message,
+) (events.Message, error) {
+	request.DeviceID = deviceID
+	request.ReplyTo = events.MessageReceivedTopic
+	reply := make(chan events.Message, 1)
+
+	if err := dispatcher.addPending(request.ID, &pendingRequest{deviceID, reply}); err != nil {
+		return events.Message{}, err
+	}
+
+	defer dispatcher.removePending(request.ID)
+
+	waiting := dispatcher.waitingCounter(request.MessagType)
+
+	atomic.AddInt64(waiting, 1)
+	defer atomic.AddInt64(waiting, -1)
+
+	if err := dispatcher.eventBus.Publish(events.SendToDeviceTopic(deviceID), request); err != nil {
+		return events.Message{}, fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+	}
+
+	select {
+	case m := <-reply:
+		return m, nil
+	case <-ctx.Done():
+		return events.Message{}, ctx.Err()
+	}
+}
+
+// CommandsWaiting How many commands are currently waiting for the device reply.
+func (dispatcher *DeviceDispatcher) CommandsWaiting() int64 {
+	return atomic.LoadInt64(&dispatcher.commandsWaiting)
+}
+
+// QueriesWaiting How many queries are currently waiting for the device reply.
+func (dispatcher *DeviceDispatcher) QueriesWaiting() int64 {
+	return atomic.LoadInt64(&dispatcher.queriesWaiting)
+}
+
+// Close Unsubscribes from the event bus, further calls to Dispatch return ErrDispatcherIsClosed
+// and requests still waiting will only return when their context is done.
+func (dispatcher *DeviceDispatcher) Close() {
+	dispatcher.mutex.Lock()
+	wasSubscribed := dispatcher.isSubscribed && !dispatcher.isClosed
+	dispatcher.isClosed = true
+	dispatcher.mutex.Unlock()
+
+	if !wasSubscribed {
+		return
+	}
+
+	close(dispatcher.stopRouting)
+	<-dispatcher.routingStopped
+
+	unsubscribeAndDrain(dispatcher.eventBus, events.MessageReceivedTopic, &dispatcher.replies)
+}
+
+func (dispatcher *DeviceDispatcher) addPending(requestID string, request *pendingRequest) error {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+
+	if dispatcher.isClosed {
+		return ErrDispatcherIsClosed
+	}
+
+	if !dispatcher.isSubscribed {
+		if err := dispatcher.eventBus.Subscribe(events.MessageReceivedTopic, &dispatcher.replies); err != nil {
+			return err
+		}
+
+		dispatcher.isSubscribed = true
+		go dispatcher.routeReplies()
+	}
+
+	dispatcher.pending[requestID] = request
+
+	return nil
+}
+
+func (dispatcher *DeviceDispatcher) removePending(requestID string) {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+
+	delete(dispatcher.pending, requestID)
+}
+
+func (dispatcher *DeviceDispatcher) routeReplies() {
+	defer close(dispatcher.routingStopped)
+
+	for {
+		select {
+		case m := <-dispatcher.replies:
+			if m.CorrelationID == "" {
+				continue
+			}
+
+			dispatcher.mutex.Lock()
+			request, exists := dispatcher.pending[m.CorrelationID]
+			dispatcher.mutex.Unlock()
+
+			// Replies from a different device are ignored
+			if exists && (m.DeviceID == "" || m.DeviceID == request.deviceID) {
+				// Buffered, only the first reply is kept
+				select {
+				case request.reply <- m:
+				default:
+				}
+			}
+
+		case <-dispatcher.stopRouting:
+			return
+		}
+	}
+}
+
+func (dispatcher *DeviceDispatcher) waitingCounter(messageType events.MessageType) *int64 {
+	if messageType == events.Query {
+		return &dispatcher.queriesWaiting
+	}
+
+	return &dispatcher.commandsWaiting
+}
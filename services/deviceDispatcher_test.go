@@ -0,0 +1,98 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/bus"
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+func TestDispatcherShouldReturnTheCorrelatedReply(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	dispatcher := NewDeviceDispatcher(eventBus)
+	defer dispatcher.Close()
+
+	deviceChannel := make(chan events.Message)
+	eventBus.Subscribe(events.SendToDeviceTopic("abc-123"), &deviceChannel)
+
+	go func() {
+		query := <-deviceChannel
+
+		// Replies to other requests must be ignored
+		eventBus.Publish(events.MessageReceivedTopic, events.NewMessage([]byte("not a reply"), "", events.Query))
+		eventBus.Publish(events.MessageReceivedTopic, events.NewReplyMessage(query, []byte("21"), ""))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	reply, err := dispatcher.Query(ctx, "abc-123", []byte("temperature"))
+
+	assert.NilError(t, err)
+	assert.Assert(t, string(reply.Payload) == "21")
+	assert.Assert(t, dispatcher.QueriesWaiting() == 0)
+}
+
+func TestDispatcherShouldCountRequestsWaitingForReplies(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	dispatcher := NewDeviceDispatcher(eventBus)
+	defer dispatcher.Close()
+
+	deviceChannel := make(chan events.Message)
+	eventBus.Subscribe(events.SendToDeviceTopic("abc-123"), &deviceChannel)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	result := make(chan error)
+
+	go func() {
+		_, err := dispatcher.Command(ctx, "abc-123", []byte("on"))
+		result <- err
+	}()
+
+	<-deviceChannel
+
+	assert.Assert(t, dispatcher.CommandsWaiting() == 1)
+	assert.Assert(t, dispatcher.QueriesWaiting() == 0)
+
+	assert.Assert(t, <-result == context.DeadlineExceeded)
+	assert.Assert(t, dispatcher.CommandsWaiting() == 0)
+}
+
+func TestDispatcherShouldFailOnceClosed(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	dispatcher := NewDeviceDispatcher(eventBus)
+	dispatcher.Close()
+
+	_, err := dispatcher.Command(context.Background(), "abc-123", []byte("on"))
+
+	assert.Assert(t, err == ErrDispatcherIsClosed)
+}
+
+func TestDispatcherOverANetworkedBusShouldFailWhenTheDeviceIsUnreachable(t *testing.T) {
+	local, _ := bus.NewInMemoryEventBus()
+	server := bus.NewTCPBusServer(local, "127.0.0.1:0")
+	assert.NilError(t, server.Start())
+	defer server.Close()
+
+	eventBus, err := bus.NewTCPBusClient(server.Addr().String())
+	assert.NilError(t, err)
+	defer eventBus.Close()
+
+	dispatcher := NewDeviceDispatcher(eventBus)
+	defer dispatcher.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// No connections handler serves the device in any process
+	_, err = dispatcher.Query(ctx, "abc-123", []byte("temperature"))
+
+	assert.Assert(t, errors.Is(err, ErrDeviceUnreachable))
+	assert.NilError(t, ctx.Err())
+}
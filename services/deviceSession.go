@@ -0,0 +1,287 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/nnset/iot-cloud-connector/bus"
+	"github.com/nnset/iot-cloud-connector/entities"
+	"github.com/nnset/iot-cloud-connector/events"
+)
+
+var (
+	errDeviceAlreadyConnected = errors.New("device already connected")
+	errServiceIsShuttingDown  = errors.New("service is shutting down")
+)
+
+// deviceTransport Is how a connections handler delivers a message to an IoT device,
+// regardless of the protocol being used (WebSocket, TCP, ...)
+type deviceTransport interface {
+	Send(message events.Message) error
+}
+
+// deviceSession Glue between a device connection and the event bus, shared by all
+// connections handlers:
+//   - Publishes ConnectionEstablishedTopic when opened and ConnectionClosedTopic when closed.
+//   - Publishes every message received from the device on MessageReceivedTopic.
+//   - Forwards messages published on SendToDeviceTopic to the device and publishes
+//     them on MessageSentTopic once delivered.
+type deviceSession struct {
+	Connection          *entities.Connection
+	eventBus            bus.MessageBus
+	transport           deviceTransport
+	codec               events.Codec
+	registrationPayload []byte
+	closedPayload       []byte
+	sendToDevice        chan events.Message
+	stopForwarding      chan struct{}
+	forwardingIsStopped chan struct{}
+	isOpen              bool
+	closeOnce           sync.Once
+}
+
+// newDeviceSession codec is the one negotiated with the device, registrationPayload is
+// decoded with it by entities.NewConnectionFromMessage. A nil codec means nothing was
+// negotiated: registration is JSON and received payloads content type is unknown.
+// Nothing is published until Open is called.
+func newDeviceSession(
+	eventBus bus.MessageBus,
+	transport deviceTransport,
+	codec events.Codec,
+	registrationPayload []byte,
+	remoteAddress string,
+) (*deviceSession, error) {
+	registration := events.NewMessage(registrationPayload, remoteAddress, events.Default)
+	registration.ContentType = events.JSONContentType
+
+	if codec != nil {
+		registration.ContentType = codec.ContentType()
+	}
+
+	connection, err := entities.NewConnectionFromMessage(registration)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &deviceSession{
+		Connection:          connection,
+		eventBus:            eventBus,
+		transport:           transport,
+		codec:               codec,
+		registrationPayload: registrationPayload,
+		closedPayload:       registrationPayload,
+		sendToDevice:        make(chan events.Message),
+		stopForwarding:      make(chan struct{}),
+		forwardingIsStopped: make(chan struct{}),
+	}, nil
+}
+
+// Open Starts forwarding messages to the device and publishes ConnectionEstablishedTopic
+func (session *deviceSession) Open() error {
+	err := session.eventBus.Subscribe(
+		events.SendToDeviceTopic(session.Connection.DeviceID), &session.sendToDevice,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	session.isOpen = true
+	go session.forwardMessagesToDevice()
+
+	session.eventBus.Publish(
+		events.ConnectionEstablishedTopic,
+		session.newRegistrationMessage(session.registrationPayload),
+	)
+
+	return nil
+}
+
+// MessageReceived Publishes a message sent by the device. contentType is only needed when
+// the protocol carries it per message, by default it is the one of the negotiated codec.
+// headers are protocol specific metadata and may be nil.
+func (session *deviceSession) MessageReceived(
+	payload []byte,
+	contentType string,
+	headers map[string]string,
+) events.Message {
+	if contentType == "" && session.codec != nil {
+		contentType = session.codec.ContentType()
+	} else if contentType == "" && json.Valid(payload) {
+		contentType = events.JSONContentType
+	}
+
+	metadata := messageMetadataFromPayload(payload, contentType)
+
+	message := session.newMessage(payload, metadata.messageType)
+	message.CorrelationID = metadata.correlationID
+	message.ContentType = contentType
+
+	if metadata.sequence != "" {
+		message.SetHeader(events.SequenceHeader, metadata.sequence)
+	}
+
+	for key, value := range headers {
+		message.SetHeader(key, value)
+	}
+
+	session.eventBus.Publish(events.MessageReceivedTopic, message)
+
+	return message
+}
+
+// Close Stops forwarding messages to the device. ConnectionClosedTopic is only published
+// if notify is true, connections handlers skip it when the whole Cloud Connector is
+// shutting down, since its subscribers may already be gone.
+func (session *deviceSession) Close(notify bool) {
+	session.closeOnce.Do(func() {
+		if !session.isOpen {
+			return
+		}
+
+		close(session.stopForwarding)
+		<-session.forwardingIsStopped
+
+		unsubscribeAndDrain(
+			session.eventBus, events.SendToDeviceTopic(session.Connection.DeviceID), &session.sendToDevice,
+		)
+
+		if notify {
+			session.eventBus.Publish(
+				events.ConnectionClosedTopic,
+				session.newRegistrationMessage(session.closedPayload),
+			)
+		}
+	})
+}
+
+// SetClosedPayload Overrides the payload published on ConnectionClosedTopic, by default the
+// registration payload. It must still be accepted by entities.NewConnectionFromMessage
+func (session *deviceSession) SetClosedPayload(payload []byte) {
+	session.closedPayload = payload
+}
+
+func (session *deviceSession) newMessage(payload []byte, messageType events.MessageType) events.Message {
+	return events.NewDeviceMessage(
+		session.Connection.DeviceID, payload, session.Connection.RemoteAddress, messageType,
+	)
+}
+
+// newRegistrationMessage For ConnectionEstablishedTopic and ConnectionClosedTopic
+func (session *deviceSession) newRegistrationMessage(payload []byte) events.Message {
+	message := session.newMessage(payload, events.Default)
+	message.ContentType = events.JSONContentType
+
+	if session.codec != nil {
+		message.ContentType = session.codec.ContentType()
+	}
+
+	return message
+}
+
+func (session *deviceSession) forwardMessagesToDevice() {
+	defer close(session.forwardingIsStopped)
+
+	for {
+		select {
+		case m := <-session.sendToDevice:
+			if err := session.transport.Send(m); err != nil {
+				continue
+			}
+
+			// For sent messages OriginRemoteAddress is the device the message was delivered to
+			m.OriginRemoteAddress = session.Connection.RemoteAddress
+			m.DeviceID = session.Connection.DeviceID
+
+			session.eventBus.Publish(events.MessageSentTopic, m)
+
+		case <-session.stopForwarding:
+			return
+		}
+	}
+}
+
+// unsubscribeAndDrain Publishers may be blocked sending to channel while we try to
+// unsubscribe it, so keep reading from it until the bus has released it.
+func unsubscribeAndDrain(eventBus bus.MessageBus, topic string, channel *chan events.Message) {
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		eventBus.Unsubscribe(topic, channel)
+	}()
+
+	for {
+		select {
+		case <-*channel:
+		case <-done:
+			return
+		}
+	}
+}
+
+type deviceMessageMetadata struct {
+	messageType   events.MessageType
+	correlationID string
+	sequence      string
+}
+
+// messageMetadataFromPayload Devices may flag a message as a reply to a query or command
+// sending an object with a "message_type" field, and the "correlation_id" of the message
+// being answered, encoded as contentType. Any other message type is events.Default.
+// Devices retransmitting messages may also number them with a "sequence" field, a string
+// or an integer, so duplicates can be detected (see bus.DeduplicationInterceptor).
+func messageMetadataFromPayload(payload []byte, contentType string) deviceMessageMetadata {
+	var decoded struct {
+		MessageType   events.MessageType `json:"message_type"`
+		CorrelationID string             `json:"correlation_id"`
+		Sequence      interface{}        `json:"sequence"`
+	}
+
+	metadata := deviceMessageMetadata{messageType: events.Default}
+	codec, exists := events.CodecFor(contentType)
+
+	if !exists || unmarshalKeepingNumbers(codec, payload, &decoded) != nil {
+		return metadata
+	}
+
+	switch decoded.MessageType {
+	case events.Query, events.Command:
+		metadata.messageType = decoded.MessageType
+	}
+
+	metadata.correlationID = decoded.CorrelationID
+
+	switch sequence := decoded.Sequence.(type) {
+	case string:
+		metadata.sequence = sequence
+	case json.Number:
+		metadata.sequence = sequence.String()
+	case float64:
+		metadata.sequence = strconv.FormatFloat(sequence, 'f', -1, 64)
+	case int64:
+		metadata.sequence = strconv.FormatInt(sequence, 10)
+	case uint64:
+		metadata.sequence = strconv.FormatUint(sequence, 10)
+	}
+
+	return metadata
+}
+
+// unmarshalKeepingNumbers Same as codec.Unmarshal, but JSON numbers decoded into an
+// interface{} are a json.Number, float64 would round integers above 2^53.
+func unmarshalKeepingNumbers(codec events.Codec, data []byte, v interface{}) error {
+	if codec.ContentType() != events.JSONContentType {
+		return codec.Unmarshal(data, v)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	return decoder.Decode(v)
+}
@@ -15,7 +15,8 @@ import (
 // This Storage will listen to eventBus ConnectionEstablished and
 // ConnectionClosed messages in order to keep track of all active connections,
 // without keeping any historical data, regardless a couple of global counters:
-// totalSentMessages and totalReceivedMessages
+// totalSentMessages and totalReceivedMessages, updated from MessageSent and
+// MessageReceived messages.
 type InMemoryConnectionsStorageService struct {
 	id                            string
 	eventBus                      bus.MessageBus
@@ -28,6 +29,8 @@ type InMemoryConnectionsStorageService struct {
 	activeConnectionsCount        uint
 	connectionsEstablishedChannel chan events.Message
 	connectionsClosedChannel      chan events.Message
+	messagesReceivedChannel       chan events.Message
+	messagesSentChannel           chan events.Message
 	gracefullShutdownWaitGroup    sync.WaitGroup
 }
 
@@ -42,6 +45,8 @@ func NewInMemoryConnectionsStorageService(
 		dataMutex:                     sync.Mutex{},
 		connectionsEstablishedChannel: make(chan events.Message),
 		connectionsClosedChannel:      make(chan events.Message),
+		messagesReceivedChannel:       make(chan events.Message),
+		messagesSentChannel:           make(chan events.Message),
 		gracefullShutdownWaitGroup:    sync.WaitGroup{},
 	}, nil
 }
@@ -56,6 +61,8 @@ func (service *InMemoryConnectionsStorageService) Init(shutdownService chan bool
 
 	service.eventBus.Subscribe(events.ConnectionEstablishedTopic, &service.connectionsEstablishedChannel)
 	service.eventBus.Subscribe(events.ConnectionClosedTopic, &service.connectionsClosedChannel)
+	service.eventBus.Subscribe(events.MessageReceivedTopic, &service.messagesReceivedChannel)
+	service.eventBus.Subscribe(events.MessageSentTopic, &service.messagesSentChannel)
 
 	return nil
 }
@@ -69,11 +76,17 @@ func (service *InMemoryConnectionsStorageService) Start() {
 	shutdownClosedConnections := make(chan bool)
 	go service.handleClosedConnections(shutdownClosedConnections)
 
+	service.gracefullShutdownWaitGroup.Add(1)
+	shutdownMessagesCounters := make(chan bool)
+	go service.handleMessagesCounters(shutdownMessagesCounters)
+
 	<-service.shutdownService
 	// TODO add Timeout here
 	shutdownEstablishedConnections <- true
 	// TODO add Timeout here
 	shutdownClosedConnections <- true
+	// TODO add Timeout here
+	shutdownMessagesCounters <- true
 
 	service.serviceIsShutdown <- true
 }
@@ -104,11 +117,27 @@ func (service *InMemoryConnectionsStorageService) handleClosedConnections(shutdo
 	}
 }
 
+func (service *InMemoryConnectionsStorageService) handleMessagesCounters(shutdownChannel chan bool) {
+	for {
+		select {
+		case m := <-service.messagesReceivedChannel:
+			service.messageReceived(m)
+
+		case m := <-service.messagesSentChannel:
+			service.messageSent(m)
+
+		case <-shutdownChannel:
+			service.gracefullShutdownWaitGroup.Done()
+			return
+		}
+	}
+}
+
 func (service *InMemoryConnectionsStorageService) addConnection(message events.Message) error {
 	service.dataMutex.Lock()
 	defer service.dataMutex.Unlock()
 
-	connection, err := entities.NewConnectionFromDefaultPayload(message.Payload, message.OriginRemoteAddress)
+	connection, err := entities.NewConnectionFromMessage(message)
 
 	if err != nil {
 		return err
@@ -131,7 +160,7 @@ func (service *InMemoryConnectionsStorageService) removeConnection(message event
 	service.dataMutex.Lock()
 	defer service.dataMutex.Unlock()
 
-	connection, err := entities.NewConnectionFromDefaultPayload(message.Payload, message.OriginRemoteAddress)
+	connection, err := entities.NewConnectionFromMessage(message)
 
 	if err != nil {
 		return err
@@ -150,23 +179,71 @@ func (service *InMemoryConnectionsStorageService) removeConnection(message event
 	return nil
 }
 
+func (service *InMemoryConnectionsStorageService) messageReceived(message events.Message) {
+	service.dataMutex.Lock()
+	defer service.dataMutex.Unlock()
+
+	service.totalReceivedMessages++
+
+	if connection := service.findConnection(message); connection != nil {
+		connection.MessageReceived()
+	}
+}
+
+func (service *InMemoryConnectionsStorageService) messageSent(message events.Message) {
+	service.dataMutex.Lock()
+	defer service.dataMutex.Unlock()
+
+	service.totalSentMessages++
+
+	if connection := service.findConnection(message); connection != nil {
+		connection.MessageSent()
+	}
+}
+
+// findConnection By message DeviceID, or by its remote address for messages without
+// it. dataMutex must be locked by the caller
+func (service *InMemoryConnectionsStorageService) findConnection(message events.Message) *entities.Connection {
+	if message.DeviceID != "" {
+		return service.activeConnections[message.DeviceID]
+	}
+
+	for _, connection := range service.activeConnections {
+		if connection.RemoteAddress == message.OriginRemoteAddress {
+			return connection
+		}
+	}
+
+	return nil
+}
+
 func (service *InMemoryConnectionsStorageService) ShutdownChannel() chan bool {
 	return service.serviceIsShutdown
 }
 
 func (service *InMemoryConnectionsStorageService) TotalSentMessages() uint {
+	service.dataMutex.Lock()
+	defer service.dataMutex.Unlock()
+
 	return service.totalSentMessages
 }
 
 func (service *InMemoryConnectionsStorageService) TotalReceivedMessages() uint {
+	service.dataMutex.Lock()
+	defer service.dataMutex.Unlock()
+
 	return service.totalReceivedMessages
 }
 
 func (service *InMemoryConnectionsStorageService) ActiveConnectionsCount() uint {
+	service.dataMutex.Lock()
+	defer service.dataMutex.Unlock()
+
 	return service.activeConnectionsCount
 }
 
-// ActiveConnections Returns a copy of the currently active connections map
+// ActiveConnections Returns a copy of the currently active connections map, connections
+// are copied too, so their counters may be read while new messages are counted.
 func (service *InMemoryConnectionsStorageService) ActiveConnections() map[string]*entities.Connection {
 	service.dataMutex.Lock()
 	defer service.dataMutex.Unlock()
@@ -174,7 +251,8 @@ func (service *InMemoryConnectionsStorageService) ActiveConnections() map[string
 	cloned := make(map[string]*entities.Connection)
 
 	for k, v := range service.activeConnections {
-		cloned[k] = v
+		connection := *v
+		cloned[k] = &connection
 	}
 
 	return cloned
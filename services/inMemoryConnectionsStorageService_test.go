@@ -36,7 +36,7 @@ func TestEstablishedConnectionsShouldBeCounted(t *testing.T) {
 
 	assert.Assert(t, service.ActiveConnectionsCount() == 0)
 
-	m := events.NewMessage("{\"device_id\": \"abc-123\"}", "192.168.1.100", events.Default)
+	m := events.NewMessage([]byte("{\"device_id\": \"abc-123\"}"), "192.168.1.100", events.Default)
 
 	eventBus.Publish(events.ConnectionEstablishedTopic, m)
 
@@ -61,7 +61,7 @@ func TestClosedConnectionsShouldBeDiscounted(t *testing.T) {
 
 	assert.Assert(t, service.ActiveConnectionsCount() == 0)
 
-	m := events.NewMessage("{\"device_id\": \"abc-123\"}", "192.168.1.100", events.Default)
+	m := events.NewMessage([]byte("{\"device_id\": \"abc-123\"}"), "192.168.1.100", events.Default)
 
 	eventBus.Publish(events.ConnectionEstablishedTopic, m)
 
@@ -96,7 +96,7 @@ func TestEstablishingMultipleConnectionsShouldBeThreadSafe(t *testing.T) {
 	go func() {
 		for i := 0; i < 10; i++ {
 			payload := fmt.Sprintf("{\"device_id\": \"%s\"}", uuid.New().String())
-			m := events.NewMessage(payload, "192.168.1.100", events.Default)
+			m := events.NewMessage([]byte(payload), "192.168.1.100", events.Default)
 
 			eventBus.Publish(events.ConnectionEstablishedTopic, m)
 		}
@@ -107,7 +107,7 @@ func TestEstablishingMultipleConnectionsShouldBeThreadSafe(t *testing.T) {
 	go func() {
 		for i := 0; i < 10; i++ {
 			payload := fmt.Sprintf("{\"device_id\": \"%s\"}", uuid.New().String())
-			m := events.NewMessage(payload, "192.168.1.100", events.Default)
+			m := events.NewMessage([]byte(payload), "192.168.1.100", events.Default)
 
 			eventBus.Publish(events.ConnectionEstablishedTopic, m)
 		}
@@ -118,7 +118,7 @@ func TestEstablishingMultipleConnectionsShouldBeThreadSafe(t *testing.T) {
 	go func() {
 		for i := 0; i < 40; i++ {
 			payload := fmt.Sprintf("{\"device_id\": \"%s\"}", uuid.New().String())
-			m := events.NewMessage(payload, "192.168.1.100", events.Default)
+			m := events.NewMessage([]byte(payload), "192.168.1.100", events.Default)
 
 			eventBus.Publish(events.ConnectionEstablishedTopic, m)
 		}
@@ -136,6 +136,9 @@ func TestEstablishingMultipleConnectionsShouldBeThreadSafe(t *testing.T) {
 
 	select {
 	case <-c:
+		// Publishing only queues messages, give the service time to process them
+		time.Sleep(50 * time.Millisecond)
+
 		assert.Assert(t, service.ActiveConnectionsCount() == 60)
 		assert.Assert(t, len(service.ActiveConnections()) == 60)
 		shutdownService <- true
@@ -144,3 +147,36 @@ func TestEstablishingMultipleConnectionsShouldBeThreadSafe(t *testing.T) {
 		assert.Assert(t, false)
 	}
 }
+
+func TestExchangedMessagesShouldBeCounted(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+
+	service, _ := NewInMemoryConnectionsStorageService(eventBus)
+
+	shutdownService := make(chan bool)
+
+	service.Init(shutdownService)
+
+	go service.Start()
+
+	time.Sleep(200 * time.Millisecond)
+
+	eventBus.Publish(
+		events.ConnectionEstablishedTopic,
+		events.NewMessage([]byte("{\"device_id\": \"abc-123\"}"), "192.168.1.100", events.Default),
+	)
+
+	time.Sleep(20 * time.Millisecond)
+
+	eventBus.Publish(events.MessageReceivedTopic, events.NewMessage([]byte("hello"), "192.168.1.100", events.Default))
+	eventBus.Publish(events.MessageReceivedTopic, events.NewMessage([]byte("hello"), "192.168.1.100", events.Default))
+	eventBus.Publish(events.MessageSentTopic, events.NewMessage([]byte("hi"), "192.168.1.100", events.Default))
+
+	time.Sleep(20 * time.Millisecond)
+
+	assert.Assert(t, service.TotalReceivedMessages() == 2)
+	assert.Assert(t, service.TotalSentMessages() == 1)
+	assert.Assert(t, service.ActiveConnections()["abc-123"].ReceivedMessages == 2)
+	assert.Assert(t, service.ActiveConnections()["abc-123"].SentMessages == 1)
+	shutdownService <- true
+}
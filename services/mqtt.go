@@ -0,0 +1,432 @@
+package services
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// MQTT 3.1.1 control packets encoding and decoding, see
+// http://docs.oasis-open.org/mqtt/mqtt/v3.1.1/os/mqtt-v3.1.1-os.html
+
+const (
+	mqttConnect     byte = 1
+	mqttConnack     byte = 2
+	mqttPublish     byte = 3
+	mqttPuback      byte = 4
+	mqttPubrec      byte = 5
+	mqttPubrel      byte = 6
+	mqttPubcomp     byte = 7
+	mqttSubscribe   byte = 8
+	mqttSuback      byte = 9
+	mqttUnsubscribe byte = 10
+	mqttUnsuback    byte = 11
+	mqttPingreq     byte = 12
+	mqttPingresp    byte = 13
+	mqttDisconnect  byte = 14
+
+	mqttConnackAccepted             byte = 0
+	mqttConnackUnacceptableProtocol byte = 1
+	mqttConnackIdentifierRejected   byte = 2
+	mqttConnackBadCredentials       byte = 4
+	mqttConnackNotAuthorized        byte = 5
+	mqttSubackFailure               byte = 0x80
+	mqttProtocolLevel               byte = 4
+	mqttMaxQoS                      byte = 1
+	mqttConnectFlagCleanSession     byte = 0x02
+	mqttConnectFlagWill             byte = 0x04
+	mqttConnectFlagWillRetain       byte = 0x20
+	mqttConnectFlagPassword         byte = 0x40
+	mqttConnectFlagUsername         byte = 0x80
+	mqttConnectFlagReserved         byte = 0x01
+	mqttPublishFlagRetain           byte = 0x01
+	mqttPublishFlagDup              byte = 0x08
+)
+
+var errMQTTMalformedPacket = errors.New("malformed mqtt packet")
+
+type mqttPacket struct {
+	packetType byte
+	flags      byte
+	body       []byte
+}
+
+type mqttConnectPacket struct {
+	protocolName  string
+	protocolLevel byte
+	cleanSession  bool
+	keepAlive     uint16
+	clientID      string
+	will          *mqttPublishPacket
+	username      string
+	password      []byte
+}
+
+type mqttPublishPacket struct {
+	topic    string
+	packetID uint16
+	qos      byte
+	retain   bool
+	dup      bool
+	payload  []byte
+}
+
+type mqttSubscription struct {
+	filter string
+	qos    byte
+}
+
+func readMQTTPacket(reader *bufio.Reader, maxPacketSize int) (*mqttPacket, error) {
+	header, err := reader.ReadByte()
+
+	if err != nil {
+		return nil, err
+	}
+
+	remainingLength := 0
+	multiplier := 1
+
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errMQTTMalformedPacket
+		}
+
+		b, err := reader.ReadByte()
+
+		if err != nil {
+			return nil, err
+		}
+
+		remainingLength += int(b&0x7F) * multiplier
+		multiplier *= 128
+
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	if remainingLength > maxPacketSize {
+		return nil, errors.New("mqtt packet too big")
+	}
+
+	body := make([]byte, remainingLength)
+
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+
+	return &mqttPacket{packetType: header >> 4, flags: header & 0x0F, body: body}, nil
+}
+
+func (packet mqttPacket) encode() []byte {
+	encoded := []byte{packet.packetType<<4 | packet.flags}
+	length := len(packet.body)
+
+	for {
+		b := byte(length % 128)
+		length /= 128
+
+		if length > 0 {
+			b |= 0x80
+		}
+
+		encoded = append(encoded, b)
+
+		if length == 0 {
+			break
+		}
+	}
+
+	return append(encoded, packet.body...)
+}
+
+// mqttReader Reads MQTT data types from a packet body
+type mqttReader struct {
+	body   []byte
+	offset int
+	err    error
+}
+
+func (r *mqttReader) byte() byte {
+	if r.err != nil || r.offset+1 > len(r.body) {
+		r.err = errMQTTMalformedPacket
+		return 0
+	}
+
+	r.offset++
+
+	return r.body[r.offset-1]
+}
+
+func (r *mqttReader) uint16() uint16 {
+	if r.err != nil || r.offset+2 > len(r.body) {
+		r.err = errMQTTMalformedPacket
+		return 0
+	}
+
+	r.offset += 2
+
+	return binary.BigEndian.Uint16(r.body[r.offset-2:])
+}
+
+func (r *mqttReader) bytes() []byte {
+	length := int(r.uint16())
+
+	if r.err != nil || r.offset+length > len(r.body) {
+		r.err = errMQTTMalformedPacket
+		return nil
+	}
+
+	r.offset += length
+
+	return r.body[r.offset-length : r.offset]
+}
+
+func (r *mqttReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *mqttReader) remaining() []byte {
+	return r.body[r.offset:]
+}
+
+func (r *mqttReader) done() bool {
+	return r.offset >= len(r.body)
+}
+
+func appendMQTTString(body []byte, s string) []byte {
+	body = append(body, byte(len(s)>>8), byte(len(s)))
+
+	return append(body, s...)
+}
+
+func appendMQTTUint16(body []byte, value uint16) []byte {
+	return append(body, byte(value>>8), byte(value))
+}
+
+func parseMQTTConnect(packet *mqttPacket) (*mqttConnectPacket, error) {
+	r := &mqttReader{body: packet.body}
+	connect := &mqttConnectPacket{}
+
+	connect.protocolName = r.string()
+	connect.protocolLevel = r.byte()
+	flags := r.byte()
+	connect.keepAlive = r.uint16()
+
+	if r.err != nil || flags&mqttConnectFlagReserved != 0 {
+		return nil, errMQTTMalformedPacket
+	}
+
+	connect.cleanSession = flags&mqttConnectFlagCleanSession != 0
+	connect.clientID = r.string()
+
+	if flags&mqttConnectFlagWill != 0 {
+		connect.will = &mqttPublishPacket{
+			qos:    (flags >> 3) & 0x03,
+			retain: flags&mqttConnectFlagWillRetain != 0,
+		}
+		connect.will.topic = r.string()
+		connect.will.payload = r.bytes()
+
+		if connect.will.qos > 2 || !validMQTTTopicName(connect.will.topic) {
+			return nil, errMQTTMalformedPacket
+		}
+	}
+
+	if flags&mqttConnectFlagUsername != 0 {
+		connect.username = r.string()
+	}
+
+	if flags&mqttConnectFlagPassword != 0 {
+		connect.password = r.bytes()
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return connect, nil
+}
+
+func (connect *mqttConnectPacket) encode() mqttPacket {
+	var flags byte
+	body := appendMQTTString(nil, connect.protocolName)
+	body = append(body, connect.protocolLevel, 0)
+	body = appendMQTTUint16(body, connect.keepAlive)
+	body = appendMQTTString(body, connect.clientID)
+
+	if connect.cleanSession {
+		flags |= mqttConnectFlagCleanSession
+	}
+
+	if connect.will != nil {
+		flags |= mqttConnectFlagWill | connect.will.qos<<3
+
+		if connect.will.retain {
+			flags |= mqttConnectFlagWillRetain
+		}
+
+		body = appendMQTTString(body, connect.will.topic)
+		body = appendMQTTString(body, string(connect.will.payload))
+	}
+
+	if connect.username != "" {
+		flags |= mqttConnectFlagUsername
+		body = appendMQTTString(body, connect.username)
+	}
+
+	if connect.password != nil {
+		flags |= mqttConnectFlagPassword
+		body = appendMQTTString(body, string(connect.password))
+	}
+
+	body[len(connect.protocolName)+3] = flags
+
+	return mqttPacket{packetType: mqttConnect, body: body}
+}
+
+func parseMQTTPublish(packet *mqttPacket) (*mqttPublishPacket, error) {
+	r := &mqttReader{body: packet.body}
+	publish := &mqttPublishPacket{
+		qos:    (packet.flags >> 1) & 0x03,
+		retain: packet.flags&mqttPublishFlagRetain != 0,
+		dup:    packet.flags&mqttPublishFlagDup != 0,
+	}
+
+	publish.topic = r.string()
+
+	if publish.qos > 0 {
+		publish.packetID = r.uint16()
+	}
+
+	if r.err != nil || publish.qos > 2 || !validMQTTTopicName(publish.topic) {
+		return nil, errMQTTMalformedPacket
+	}
+
+	publish.payload = append([]byte{}, r.remaining()...)
+
+	return publish, nil
+}
+
+func (publish *mqttPublishPacket) encode() mqttPacket {
+	flags := publish.qos << 1
+
+	if publish.retain {
+		flags |= mqttPublishFlagRetain
+	}
+
+	if publish.dup {
+		flags |= mqttPublishFlagDup
+	}
+
+	body := appendMQTTString(nil, publish.topic)
+
+	if publish.qos > 0 {
+		body = appendMQTTUint16(body, publish.packetID)
+	}
+
+	return mqttPacket{packetType: mqttPublish, flags: flags, body: append(body, publish.payload...)}
+}
+
+func parseMQTTSubscribe(packet *mqttPacket) (uint16, []mqttSubscription, error) {
+	r := &mqttReader{body: packet.body}
+	packetID := r.uint16()
+	subscriptions := []mqttSubscription{}
+
+	for r.err == nil && !r.done() {
+		filter := r.string()
+		qos := r.byte()
+
+		if qos > 2 {
+			return 0, nil, errMQTTMalformedPacket
+		}
+
+		subscriptions = append(subscriptions, mqttSubscription{filter, qos})
+	}
+
+	if r.err != nil || packet.flags != 0x02 || len(subscriptions) == 0 {
+		return 0, nil, errMQTTMalformedPacket
+	}
+
+	return packetID, subscriptions, nil
+}
+
+func parseMQTTUnsubscribe(packet *mqttPacket) (uint16, []string, error) {
+	r := &mqttReader{body: packet.body}
+	packetID := r.uint16()
+	filters := []string{}
+
+	for r.err == nil && !r.done() {
+		filters = append(filters, r.string())
+	}
+
+	if r.err != nil || packet.flags != 0x02 || len(filters) == 0 {
+		return 0, nil, errMQTTMalformedPacket
+	}
+
+	return packetID, filters, nil
+}
+
+func parseMQTTPacketID(packet *mqttPacket) (uint16, error) {
+	r := &mqttReader{body: packet.body}
+	packetID := r.uint16()
+
+	return packetID, r.err
+}
+
+func newMQTTPacketWithID(packetType byte, flags byte, packetID uint16) mqttPacket {
+	return mqttPacket{packetType: packetType, flags: flags, body: appendMQTTUint16(nil, packetID)}
+}
+
+func validMQTTTopicName(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#\x00")
+}
+
+func validMQTTTopicFilter(filter string) bool {
+	if filter == "" || strings.Contains(filter, "\x00") {
+		return false
+	}
+
+	levels := strings.Split(filter, "/")
+
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// mqttTopicMatches Checks topic against a subscription filter with + and # wildcards.
+// Wildcards at the first level do not match topics starting with $
+func mqttTopicMatches(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+
+		if i >= len(topicLevels) {
+			return false
+		}
+
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,731 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nnset/iot-cloud-connector/bus"
+	"github.com/nnset/iot-cloud-connector/events"
+)
+
+// MQTTTopicHeader events.Message header holding the topic a device published the message on.
+const MQTTTopicHeader = "mqtt_topic"
+
+// MQTTBrokerService Embedded MQTT 3.1.1 broker acting as a connections handler.
+//
+//   - CONNECT client ID is the device ID (entities.Connection.DeviceID).
+//   - Every PUBLISH from a device is published on MessageReceivedTopic, with its topic
+//     in the MQTTTopicHeader header, and also routed to any MQTT client subscribed
+//     to its topic, as any MQTT broker would do.
+//   - Messages published on events.SendToDeviceTopic(deviceID) are sent as a PUBLISH,
+//     with a JSON encoded events.Message as payload, on the device's topic
+//     (DeviceTopicPrefix + deviceID), devices must subscribe to it.
+//   - When a device disconnects without sending DISCONNECT its last will is published,
+//     and ConnectionClosedTopic payload carries it under the "last_will" field.
+//   - Devices may only publish, and subscribe, to their own topics, see Authorize.
+//   - A CONNECT with the client ID of a connected device takes over its session only
+//     when Authenticate is set, otherwise it is rejected.
+//
+// Supports QoS 0 and 1 for outgoing messages (QoS 2 subscriptions are granted QoS 1),
+// QoS 0, 1 and 2 for incoming messages, retained messages and keepalive. QoS 1 messages
+// not acknowledged within RetryInterval are sent again. Sessions are always clean,
+// persistent sessions are not supported.
+type MQTTBrokerService struct {
+	ListenAddress     string
+	DeviceTopicPrefix string
+	ConnectTimeout    int // Seconds
+	WriteTimeout      int // Seconds
+	RetryInterval     int // Seconds
+	MaxPacketSize     int // Bytes
+	Authenticate      MQTTAuthenticator
+	Authorize         MQTTAuthorizer
+	id                string
+	eventBus          bus.MessageBus
+	listener          net.Listener
+	serviceIsShutdown chan bool
+	shutdownService   chan bool
+	clients           map[string]*mqttClient
+	retained          map[string]*mqttPublishPacket
+	brokerMutex       sync.Mutex
+	clientsWaitGroup  sync.WaitGroup
+	isShuttingDown    bool
+}
+
+// MQTTAuthenticator Checks the credentials of a CONNECT, clientID is the device ID.
+type MQTTAuthenticator func(clientID, username string, password []byte) bool
+
+// MQTTAccess What a device wants to do with a topic, see MQTTAuthorizer.
+type MQTTAccess int
+
+const (
+	MQTTPublishAccess MQTTAccess = iota
+	MQTTSubscribeAccess
+)
+
+// MQTTAuthorizer Checks if deviceID may publish on topic, or subscribe to it, in which
+// case topic is a filter that may contain wildcards. Last wills need publish access.
+// By default devices may only use their device topic (see DeviceTopic) and the topics
+// below it, i.e. devices/abc-123 and devices/abc-123/temperature.
+type MQTTAuthorizer func(deviceID, topic string, access MQTTAccess) bool
+
+type mqttClient struct {
+	*deviceSession
+	broker             *MQTTBrokerService
+	conn               net.Conn
+	writeMutex         sync.Mutex
+	subscriptions      map[string]byte // Guarded by brokerMutex
+	nextPacketID       uint16
+	inflight           map[uint16]*mqttInflightPublish
+	receivedQoS2       map[uint16]bool
+	inflightMutex      sync.Mutex
+	will               *mqttPublishPacket
+	disconnectedByPeer bool
+	disconnected       chan struct{}
+}
+
+// mqttInflightPublish A QoS 1 PUBLISH waiting for its PUBACK.
+type mqttInflightPublish struct {
+	publish *mqttPublishPacket
+	sentAt  time.Time
+}
+
+type mqttRegistrationPayload struct {
+	DeviceID  string              `json:"device_id"`
+	UserAgent string              `json:"user_agent"`
+	LastWill  *mqttLastWillFields `json:"last_will,omitempty"`
+}
+
+type mqttLastWillFields struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	QoS     byte   `json:"qos"`
+	Retain  bool   `json:"retain"`
+}
+
+var (
+	errMQTTDeviceNotSubscribed = errors.New("device is not subscribed to its topic")
+	errMQTTNotAuthorized       = errors.New("device is not authorized to publish on this topic")
+	errMQTTTooManyInflight     = errors.New("every packet ID is waiting for its acknowledgement")
+)
+
+// NewMQTTBrokerService Creates a new instance of MQTTBrokerService
+func NewMQTTBrokerService(
+	eventBus bus.MessageBus,
+	listenAddress string,
+) *MQTTBrokerService {
+	return &MQTTBrokerService{
+		id:            uuid.New().String(),
+		eventBus:      eventBus,
+		ListenAddress: listenAddress,
+		clients:       make(map[string]*mqttClient),
+		retained:      make(map[string]*mqttPublishPacket),
+	}
+}
+
+func (service *MQTTBrokerService) Id() string {
+	return service.id
+}
+
+func (service *MQTTBrokerService) Init(shutdownService chan bool) error {
+	service.shutdownService = shutdownService
+	service.serviceIsShutdown = make(chan bool)
+
+	if service.DeviceTopicPrefix == "" {
+		service.DeviceTopicPrefix = "devices/"
+	}
+
+	if service.ConnectTimeout == 0 {
+		service.ConnectTimeout = 5
+	}
+
+	if service.WriteTimeout == 0 {
+		service.WriteTimeout = 10
+	}
+
+	if service.RetryInterval == 0 {
+		service.RetryInterval = 20
+	}
+
+	if service.Authorize == nil {
+		service.Authorize = service.authorizeDeviceTopics
+	}
+
+	if service.MaxPacketSize == 0 {
+		service.MaxPacketSize = 256 * 1024
+	}
+
+	listener, err := net.Listen("tcp", service.ListenAddress)
+
+	if err != nil {
+		return err
+	}
+
+	service.listener = listener
+
+	return nil
+}
+
+func (service *MQTTBrokerService) Start() {
+	go service.acceptConnections()
+
+	<-service.shutdownService
+
+	service.brokerMutex.Lock()
+	service.isShuttingDown = true
+	service.listener.Close()
+
+	for _, client := range service.clients {
+		client.conn.Close()
+	}
+	service.brokerMutex.Unlock()
+
+	service.clientsWaitGroup.Wait()
+
+	service.serviceIsShutdown <- true
+}
+
+func (service *MQTTBrokerService) ShutdownChannel() chan bool {
+	return service.serviceIsShutdown
+}
+
+// Addr Address the broker is listening on, useful when ListenAddress port is 0
+func (service *MQTTBrokerService) Addr() net.Addr {
+	return service.listener.Addr()
+}
+
+// DeviceTopic MQTT topic where messages published on events.SendToDeviceTopic(deviceID)
+// are delivered.
+func (service *MQTTBrokerService) DeviceTopic(deviceID string) string {
+	return service.DeviceTopicPrefix + deviceID
+}
+
+// authorizeDeviceTopics Default MQTTAuthorizer, devices own their device topic and the
+// topics below it.
+func (service *MQTTBrokerService) authorizeDeviceTopics(deviceID, topic string, access MQTTAccess) bool {
+	deviceTopic := service.DeviceTopic(deviceID)
+
+	return topic == deviceTopic || strings.HasPrefix(topic, deviceTopic+"/")
+}
+
+// ActiveConnectionsCount How many devices are currently connected to the broker
+func (service *MQTTBrokerService) ActiveConnectionsCount() int {
+	service.brokerMutex.Lock()
+	defer service.brokerMutex.Unlock()
+
+	return len(service.clients)
+}
+
+func (service *MQTTBrokerService) acceptConnections() {
+	for {
+		conn, err := service.listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		go service.handleConnection(conn)
+	}
+}
+
+func (service *MQTTBrokerService) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(time.Duration(service.ConnectTimeout) * time.Second))
+
+	packet, err := readMQTTPacket(reader, service.MaxPacketSize)
+
+	if err != nil || packet.packetType != mqttConnect {
+		return
+	}
+
+	connect, err := parseMQTTConnect(packet)
+
+	if err != nil {
+		return
+	}
+
+	client, returnCode := service.connectClient(conn, connect)
+
+	if returnCode != mqttConnackAccepted {
+		service.writeConnack(conn, returnCode)
+		return
+	}
+
+	defer service.disconnectClient(client)
+
+	if err := client.write(mqttPacket{packetType: mqttConnack, body: []byte{0, mqttConnackAccepted}}); err != nil {
+		return
+	}
+
+	go client.retransmitInflight()
+
+	for {
+		if connect.keepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(time.Duration(connect.keepAlive) * 1500 * time.Millisecond))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+
+		packet, err := readMQTTPacket(reader, service.MaxPacketSize)
+
+		if err != nil {
+			return
+		}
+
+		if packet.packetType == mqttDisconnect {
+			client.disconnectedByPeer = true
+			return
+		}
+
+		if err := client.handlePacket(packet); err != nil {
+			return
+		}
+	}
+}
+
+func (service *MQTTBrokerService) writeConnack(conn net.Conn, returnCode byte) {
+	conn.SetWriteDeadline(time.Now().Add(time.Duration(service.WriteTimeout) * time.Second))
+	conn.Write(mqttPacket{packetType: mqttConnack, body: []byte{0, returnCode}}.encode())
+}
+
+func (service *MQTTBrokerService) connectClient(conn net.Conn, connect *mqttConnectPacket) (*mqttClient, byte) {
+	if connect.protocolName != "MQTT" || connect.protocolLevel != mqttProtocolLevel {
+		return nil, mqttConnackUnacceptableProtocol
+	}
+
+	// Client IDs are a level of the device topic, they can not add levels nor wildcards
+	if connect.clientID == "" || strings.ContainsAny(connect.clientID, "/+#") {
+		return nil, mqttConnackIdentifierRejected
+	}
+
+	if service.Authenticate != nil && !service.Authenticate(connect.clientID, connect.username, connect.password) {
+		return nil, mqttConnackBadCredentials
+	}
+
+	if connect.will != nil && !service.Authorize(connect.clientID, connect.will.topic, MQTTPublishAccess) {
+		return nil, mqttConnackNotAuthorized
+	}
+
+	registration, _ := json.Marshal(mqttRegistrationPayload{
+		DeviceID:  connect.clientID,
+		UserAgent: "MQTT 3.1.1",
+	})
+
+	client := &mqttClient{
+		broker:        service,
+		conn:          conn,
+		subscriptions: make(map[string]byte),
+		inflight:      make(map[uint16]*mqttInflightPublish),
+		receivedQoS2:  make(map[uint16]bool),
+		will:          connect.will,
+		disconnected:  make(chan struct{}),
+	}
+
+	session, err := newDeviceSession(service.eventBus, client, nil, registration, conn.RemoteAddr().String())
+
+	if err != nil {
+		return nil, mqttConnackIdentifierRejected
+	}
+
+	client.deviceSession = session
+
+	service.brokerMutex.Lock()
+
+	if service.isShuttingDown {
+		service.brokerMutex.Unlock()
+		return nil, mqttConnackIdentifierRejected
+	}
+
+	previous, alreadyConnected := service.clients[connect.clientID]
+
+	// Without credentials anybody could take over a device session
+	if alreadyConnected && service.Authenticate == nil {
+		service.brokerMutex.Unlock()
+		return nil, mqttConnackIdentifierRejected
+	}
+
+	service.clients[connect.clientID] = client
+	service.clientsWaitGroup.Add(1)
+
+	service.brokerMutex.Unlock()
+
+	if alreadyConnected {
+		// MQTT 3.1.1 section 3.1.4, the existing client is disconnected
+		previous.conn.Close()
+		<-previous.disconnected
+	}
+
+	if err := session.Open(); err != nil {
+		service.disconnectClient(client)
+		return nil, mqttConnackIdentifierRejected
+	}
+
+	return client, mqttConnackAccepted
+}
+
+func (service *MQTTBrokerService) disconnectClient(client *mqttClient) {
+	service.brokerMutex.Lock()
+
+	if service.clients[client.Connection.DeviceID] == client {
+		delete(service.clients, client.Connection.DeviceID)
+	}
+
+	notify := !service.isShuttingDown
+	service.brokerMutex.Unlock()
+
+	client.conn.Close()
+
+	if !client.disconnectedByPeer && client.will != nil {
+		service.publishLastWill(client)
+	}
+
+	client.Close(notify)
+	close(client.disconnected)
+
+	service.clientsWaitGroup.Done()
+}
+
+func (service *MQTTBrokerService) publishLastWill(client *mqttClient) {
+	closedPayload, _ := json.Marshal(mqttRegistrationPayload{
+		DeviceID:  client.Connection.DeviceID,
+		UserAgent: "MQTT 3.1.1",
+		LastWill: &mqttLastWillFields{
+			Topic:   client.will.topic,
+			Payload: string(client.will.payload),
+			QoS:     client.will.qos,
+			Retain:  client.will.retain,
+		},
+	})
+
+	client.SetClosedPayload(closedPayload)
+
+	service.route(client.will)
+}
+
+// route Delivers publish to every subscribed MQTT client, storing it first if it is retained.
+func (service *MQTTBrokerService) route(publish *mqttPublishPacket) {
+	service.brokerMutex.Lock()
+
+	if publish.retain {
+		if len(publish.payload) == 0 {
+			delete(service.retained, publish.topic)
+		} else {
+			service.retained[publish.topic] = publish
+		}
+	}
+
+	type delivery struct {
+		client *mqttClient
+		qos    byte
+	}
+
+	deliveries := []delivery{}
+
+	for _, client := range service.clients {
+		if qos, subscribed := client.grantedQoS(publish.topic); subscribed {
+			deliveries = append(deliveries, delivery{client, minQoS(qos, publish.qos)})
+		}
+	}
+
+	service.brokerMutex.Unlock()
+
+	for _, d := range deliveries {
+		d.client.deliver(publish.topic, publish.payload, d.qos, false)
+	}
+}
+
+// Send deviceTransport implementation, delivers a bus message to the device's topic
+func (client *mqttClient) Send(message events.Message) error {
+	payload, err := json.Marshal(message)
+
+	if err != nil {
+		return err
+	}
+
+	topic := client.broker.DeviceTopic(client.Connection.DeviceID)
+
+	client.broker.brokerMutex.Lock()
+	qos, subscribed := client.grantedQoS(topic)
+	client.broker.brokerMutex.Unlock()
+
+	if !subscribed {
+		return errMQTTDeviceNotSubscribed
+	}
+
+	return client.deliver(topic, payload, qos, false)
+}
+
+// grantedQoS Highest QoS among the client's subscriptions matching topic, brokerMutex
+// must be locked by the caller.
+func (client *mqttClient) grantedQoS(topic string) (byte, bool) {
+	granted, subscribed := byte(0), false
+
+	for filter, qos := range client.subscriptions {
+		if mqttTopicMatches(filter, topic) {
+			subscribed = true
+			granted = maxQoS(granted, qos)
+		}
+	}
+
+	return granted, subscribed
+}
+
+func (client *mqttClient) deliver(topic string, payload []byte, qos byte, retain bool) error {
+	publish := &mqttPublishPacket{topic: topic, qos: qos, retain: retain, payload: payload}
+
+	if qos == 0 {
+		return client.write(publish.encode())
+	}
+
+	client.inflightMutex.Lock()
+
+	if len(client.inflight) >= math.MaxUint16 {
+		client.inflightMutex.Unlock()
+		return errMQTTTooManyInflight
+	}
+
+	// Packet IDs still waiting for their PUBACK are skipped
+	for {
+		client.nextPacketID++
+
+		if _, inUse := client.inflight[client.nextPacketID]; client.nextPacketID != 0 && !inUse {
+			break
+		}
+	}
+
+	publish.packetID = client.nextPacketID
+	client.inflight[publish.packetID] = &mqttInflightPublish{publish: publish, sentAt: time.Now()}
+
+	// Encoded while locked, retransmitInflight may flag it as DUP
+	packet := publish.encode()
+
+	client.inflightMutex.Unlock()
+
+	return client.write(packet)
+}
+
+// retransmitInflight Sends again, flagged as DUP, the QoS 1 messages not acknowledged
+// within RetryInterval, until the client disconnects.
+func (client *mqttClient) retransmitInflight() {
+	interval := time.Duration(client.broker.RetryInterval) * time.Second
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			unacknowledged := []mqttPublishPacket{}
+
+			client.inflightMutex.Lock()
+
+			for _, inflight := range client.inflight {
+				if now.Sub(inflight.sentAt) >= interval {
+					inflight.sentAt = now
+					inflight.publish.dup = true
+					unacknowledged = append(unacknowledged, *inflight.publish)
+				}
+			}
+
+			client.inflightMutex.Unlock()
+
+			for i := range unacknowledged {
+				if err := client.write(unacknowledged[i].encode()); err != nil {
+					return
+				}
+			}
+
+		case <-client.disconnected:
+			return
+		}
+	}
+}
+
+func (client *mqttClient) write(packet mqttPacket) error {
+	client.writeMutex.Lock()
+	defer client.writeMutex.Unlock()
+
+	client.conn.SetWriteDeadline(time.Now().Add(time.Duration(client.broker.WriteTimeout) * time.Second))
+
+	_, err := client.conn.Write(packet.encode())
+
+	return err
+}
+
+// InflightMessages How many QoS 1 messages are waiting for the client's PUBACK
+func (client *mqttClient) InflightMessages() int {
+	client.inflightMutex.Lock()
+	defer client.inflightMutex.Unlock()
+
+	return len(client.inflight)
+}
+
+func (client *mqttClient) handlePacket(packet *mqttPacket) error {
+	switch packet.packetType {
+	case mqttPublish:
+		return client.handlePublish(packet)
+
+	case mqttPuback:
+		packetID, err := parseMQTTPacketID(packet)
+
+		client.inflightMutex.Lock()
+		delete(client.inflight, packetID)
+		client.inflightMutex.Unlock()
+
+		return err
+
+	case mqttPubrel:
+		packetID, err := parseMQTTPacketID(packet)
+
+		if err != nil {
+			return err
+		}
+
+		client.inflightMutex.Lock()
+		delete(client.receivedQoS2, packetID)
+		client.inflightMutex.Unlock()
+
+		return client.write(newMQTTPacketWithID(mqttPubcomp, 0, packetID))
+
+	case mqttSubscribe:
+		return client.handleSubscribe(packet)
+
+	case mqttUnsubscribe:
+		return client.handleUnsubscribe(packet)
+
+	case mqttPingreq:
+		return client.write(mqttPacket{packetType: mqttPingresp})
+	}
+
+	return errMQTTMalformedPacket
+}
+
+func (client *mqttClient) handlePublish(packet *mqttPacket) error {
+	publish, err := parseMQTTPublish(packet)
+
+	if err != nil {
+		return err
+	}
+
+	// MQTT 3.1.1 section 3.3.5, there is no negative acknowledgement, the connection is closed
+	if !client.broker.Authorize(client.Connection.DeviceID, publish.topic, MQTTPublishAccess) {
+		return errMQTTNotAuthorized
+	}
+
+	if publish.qos == 2 {
+		client.inflightMutex.Lock()
+		alreadyReceived := client.receivedQoS2[publish.packetID]
+		client.receivedQoS2[publish.packetID] = true
+		client.inflightMutex.Unlock()
+
+		if !alreadyReceived {
+			client.publish(publish)
+		}
+
+		return client.write(newMQTTPacketWithID(mqttPubrec, 0, publish.packetID))
+	}
+
+	client.publish(publish)
+
+	if publish.qos == 1 {
+		return client.write(newMQTTPacketWithID(mqttPuback, 0, publish.packetID))
+	}
+
+	return nil
+}
+
+func (client *mqttClient) publish(publish *mqttPublishPacket) {
+	client.MessageReceived(publish.payload, "", map[string]string{MQTTTopicHeader: publish.topic})
+	client.broker.route(publish)
+}
+
+func (client *mqttClient) handleSubscribe(packet *mqttPacket) error {
+	packetID, subscriptions, err := parseMQTTSubscribe(packet)
+
+	if err != nil {
+		return err
+	}
+
+	returnCodes := []byte{}
+	retained := []*mqttPublishPacket{}
+	retainedQoS := []byte{}
+
+	client.broker.brokerMutex.Lock()
+
+	for _, subscription := range subscriptions {
+		if !validMQTTTopicFilter(subscription.filter) ||
+			!client.broker.Authorize(client.Connection.DeviceID, subscription.filter, MQTTSubscribeAccess) {
+			returnCodes = append(returnCodes, mqttSubackFailure)
+			continue
+		}
+
+		qos := minQoS(subscription.qos, mqttMaxQoS)
+		client.subscriptions[subscription.filter] = qos
+		returnCodes = append(returnCodes, qos)
+
+		for topic, publish := range client.broker.retained {
+			if mqttTopicMatches(subscription.filter, topic) {
+				retained = append(retained, publish)
+				retainedQoS = append(retainedQoS, minQoS(qos, publish.qos))
+			}
+		}
+	}
+
+	client.broker.brokerMutex.Unlock()
+
+	suback := mqttPacket{packetType: mqttSuback, body: append(appendMQTTUint16(nil, packetID), returnCodes...)}
+
+	if err := client.write(suback); err != nil {
+		return err
+	}
+
+	for i, publish := range retained {
+		if err := client.deliver(publish.topic, publish.payload, retainedQoS[i], true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (client *mqttClient) handleUnsubscribe(packet *mqttPacket) error {
+	packetID, filters, err := parseMQTTUnsubscribe(packet)
+
+	if err != nil {
+		return err
+	}
+
+	client.broker.brokerMutex.Lock()
+
+	for _, filter := range filters {
+		delete(client.subscriptions, filter)
+	}
+
+	client.broker.brokerMutex.Unlock()
+
+	return client.write(newMQTTPacketWithID(mqttUnsuback, 0, packetID))
+}
+
+func minQoS(a, b byte) byte {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func maxQoS(a, b byte) byte {
+	if a > b {
+		return a
+	}
+
+	return b
+}
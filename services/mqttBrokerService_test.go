@@ -0,0 +1,411 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/bus"
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+// Mocks
+
+type mqttTestClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func connectMQTTTestClient(t *testing.T, address string, connect *mqttConnectPacket) (*mqttTestClient, byte) {
+	conn, err := net.Dial("tcp", address)
+	assert.NilError(t, err)
+
+	client := &mqttTestClient{conn, bufio.NewReader(conn)}
+	client.write(connect.encode())
+
+	connack := client.read(t)
+	assert.Assert(t, connack.packetType == mqttConnack)
+
+	return client, connack.body[1]
+}
+
+func newMQTTTestConnect(clientID string) *mqttConnectPacket {
+	return &mqttConnectPacket{
+		protocolName:  "MQTT",
+		protocolLevel: mqttProtocolLevel,
+		cleanSession:  true,
+		keepAlive:     60,
+		clientID:      clientID,
+	}
+}
+
+func (client *mqttTestClient) write(packet mqttPacket) {
+	client.conn.Write(packet.encode())
+}
+
+func (client *mqttTestClient) read(t *testing.T) *mqttPacket {
+	client.conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	packet, err := readMQTTPacket(client.reader, 1024*1024)
+	assert.NilError(t, err)
+
+	return packet
+}
+
+func (client *mqttTestClient) subscribe(t *testing.T, filter string, qos byte) byte {
+	body := appendMQTTString(appendMQTTUint16(nil, 1), filter)
+	client.write(mqttPacket{packetType: mqttSubscribe, flags: 0x02, body: append(body, qos)})
+
+	suback := client.read(t)
+	assert.Assert(t, suback.packetType == mqttSuback)
+
+	return suback.body[2]
+}
+
+func startMQTTBroker(t *testing.T, eventBus *bus.InMemoryEventBus, configure ...func(*MQTTBrokerService)) (*MQTTBrokerService, chan bool) {
+	shutdownService := make(chan bool)
+
+	service := NewMQTTBrokerService(eventBus, "127.0.0.1:0")
+
+	for _, c := range configure {
+		c(service)
+	}
+
+	assert.NilError(t, service.Init(shutdownService))
+	go service.Start()
+
+	return service, shutdownService
+}
+
+func TestMQTTTopicFiltersShouldMatchTopics(t *testing.T) {
+	assert.Assert(t, mqttTopicMatches("sensors/+/temperature", "sensors/abc/temperature"))
+	assert.Assert(t, mqttTopicMatches("sensors/#", "sensors/abc/temperature"))
+	assert.Assert(t, mqttTopicMatches("sensors/#", "sensors"))
+	assert.Assert(t, mqttTopicMatches("#", "sensors"))
+	assert.Assert(t, !mqttTopicMatches("sensors/+", "sensors/abc/temperature"))
+	assert.Assert(t, !mqttTopicMatches("#", "$SYS/uptime"))
+	assert.Assert(t, !validMQTTTopicFilter("sensors/#/temperature"))
+	assert.Assert(t, !validMQTTTopicFilter("sensors/a+"))
+}
+
+func TestMQTTConnectShouldPublishConnectionEstablished(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, shutdownService := startMQTTBroker(t, eventBus)
+
+	established := make(chan events.Message)
+	eventBus.Subscribe(events.ConnectionEstablishedTopic, &established)
+
+	connected := make(chan byte)
+
+	go func() {
+		client, returnCode := connectMQTTTestClient(t, service.Addr().String(), newMQTTTestConnect("abc-123"))
+		defer client.conn.Close()
+
+		connected <- returnCode
+		<-service.ShutdownChannel()
+	}()
+
+	m := waitForMessage(t, established)
+	assert.Assert(t, strings.Contains(string(m.Payload), "\"device_id\":\"abc-123\""))
+
+	assert.Assert(t, <-connected == mqttConnackAccepted)
+	assert.Assert(t, service.ActiveConnectionsCount() == 1)
+
+	shutdownService <- true
+}
+
+func TestMQTTConnectWithUnknownProtocolLevelShouldBeRejected(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, shutdownService := startMQTTBroker(t, eventBus)
+
+	connect := newMQTTTestConnect("abc-123")
+	connect.protocolLevel = 3
+
+	client, returnCode := connectMQTTTestClient(t, service.Addr().String(), connect)
+	defer client.conn.Close()
+
+	assert.Assert(t, returnCode == mqttConnackUnacceptableProtocol)
+	assert.Assert(t, service.ActiveConnectionsCount() == 0)
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
+
+func TestMQTTPublishShouldBePublishedOnMessageReceivedTopic(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, shutdownService := startMQTTBroker(t, eventBus)
+
+	received := make(chan events.Message)
+	eventBus.Subscribe(events.MessageReceivedTopic, &received)
+
+	client, _ := connectMQTTTestClient(t, service.Addr().String(), newMQTTTestConnect("abc-123"))
+	defer client.conn.Close()
+
+	publish := &mqttPublishPacket{topic: "devices/abc-123/temperature", qos: 1, packetID: 7, payload: []byte("{\"temperature\": 21}")}
+	client.write(publish.encode())
+
+	m := waitForMessage(t, received)
+	assert.Assert(t, string(m.Payload) == "{\"temperature\": 21}")
+	assert.Assert(t, m.DeviceID == "abc-123")
+	assert.Assert(t, m.ContentType == "application/json")
+	assert.Assert(t, m.Header(MQTTTopicHeader) == "devices/abc-123/temperature")
+
+	puback := client.read(t)
+	assert.Assert(t, puback.packetType == mqttPuback)
+	assert.DeepEqual(t, puback.body, []byte{0, 7})
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
+
+func TestMQTTBusMessagesShouldBeDeliveredOnTheDeviceTopic(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, shutdownService := startMQTTBroker(t, eventBus)
+
+	sent := make(chan events.Message)
+	eventBus.Subscribe(events.MessageSentTopic, &sent)
+
+	client, _ := connectMQTTTestClient(t, service.Addr().String(), newMQTTTestConnect("abc-123"))
+	defer client.conn.Close()
+
+	assert.Assert(t, client.subscribe(t, service.DeviceTopic("abc-123"), 2) == 1)
+
+	go eventBus.Publish(events.SendToDeviceTopic("abc-123"), events.NewMessage([]byte("on"), "", events.Command))
+
+	packet := client.read(t)
+	publish, err := parseMQTTPublish(packet)
+	assert.NilError(t, err)
+
+	var command events.Message
+	json.Unmarshal(publish.payload, &command)
+
+	assert.Assert(t, publish.topic == "devices/abc-123")
+	assert.Assert(t, publish.qos == 1)
+	assert.Assert(t, string(command.Payload) == "on")
+	assert.Assert(t, string(waitForMessage(t, sent).Payload) == "on")
+
+	client.write(newMQTTPacketWithID(mqttPuback, 0, publish.packetID))
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
+
+// dashboardMQTTAuthorizer Lets the dashboard device subscribe to every device topic
+func dashboardMQTTAuthorizer(service *MQTTBrokerService) {
+	service.Authorize = func(deviceID, topic string, access MQTTAccess) bool {
+		if deviceID == "dashboard" && access == MQTTSubscribeAccess {
+			return strings.HasPrefix(topic, "devices/")
+		}
+
+		return service.authorizeDeviceTopics(deviceID, topic, access)
+	}
+}
+
+func TestMQTTRetainedMessagesShouldBeDeliveredToNewSubscribers(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, shutdownService := startMQTTBroker(t, eventBus, dashboardMQTTAuthorizer)
+
+	publisher, _ := connectMQTTTestClient(t, service.Addr().String(), newMQTTTestConnect("abc-123"))
+	defer publisher.conn.Close()
+
+	publish := &mqttPublishPacket{topic: "devices/abc-123/temperature", retain: true, payload: []byte("21")}
+	publisher.write(publish.encode())
+
+	time.Sleep(20 * time.Millisecond)
+
+	subscriber, _ := connectMQTTTestClient(t, service.Addr().String(), newMQTTTestConnect("dashboard"))
+	defer subscriber.conn.Close()
+
+	subscriber.subscribe(t, "devices/#", 0)
+
+	retained, err := parseMQTTPublish(subscriber.read(t))
+	assert.NilError(t, err)
+
+	assert.Assert(t, retained.retain)
+	assert.Assert(t, retained.topic == "devices/abc-123/temperature")
+	assert.Assert(t, string(retained.payload) == "21")
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
+
+func TestMQTTLastWillShouldBePublishedWhenDeviceDisconnectsUngracefully(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, shutdownService := startMQTTBroker(t, eventBus, dashboardMQTTAuthorizer)
+
+	closed := make(chan events.Message)
+	eventBus.Subscribe(events.ConnectionClosedTopic, &closed)
+
+	subscriber, _ := connectMQTTTestClient(t, service.Addr().String(), newMQTTTestConnect("dashboard"))
+	defer subscriber.conn.Close()
+
+	subscriber.subscribe(t, "devices/+/status", 0)
+
+	connect := newMQTTTestConnect("abc-123")
+	connect.will = &mqttPublishPacket{topic: "devices/abc-123/status", payload: []byte("offline")}
+
+	device, _ := connectMQTTTestClient(t, service.Addr().String(), connect)
+	device.conn.Close()
+
+	will, err := parseMQTTPublish(subscriber.read(t))
+	assert.NilError(t, err)
+	assert.Assert(t, string(will.payload) == "offline")
+
+	m := waitForMessage(t, closed)
+	assert.Assert(t, strings.Contains(string(m.Payload), "\"device_id\":\"abc-123\""))
+	assert.Assert(t, strings.Contains(string(m.Payload), "\"payload\":\"offline\""))
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
+
+func TestMQTTClientsNotHonouringKeepAliveShouldBeDisconnected(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, shutdownService := startMQTTBroker(t, eventBus)
+
+	connect := newMQTTTestConnect("abc-123")
+	connect.keepAlive = 1
+
+	client, _ := connectMQTTTestClient(t, service.Addr().String(), connect)
+	defer client.conn.Close()
+
+	client.write(mqttPacket{packetType: mqttPingreq})
+	assert.Assert(t, client.read(t).packetType == mqttPingresp)
+
+	time.Sleep(2 * time.Second)
+
+	assert.Assert(t, service.ActiveConnectionsCount() == 0)
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
+
+func TestMQTTDevicesShouldOnlyUseTheirOwnTopics(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, shutdownService := startMQTTBroker(t, eventBus)
+
+	client, _ := connectMQTTTestClient(t, service.Addr().String(), newMQTTTestConnect("abc-123"))
+	defer client.conn.Close()
+
+	assert.Assert(t, client.subscribe(t, "#", 1) == mqttSubackFailure)
+	assert.Assert(t, client.subscribe(t, "devices/+", 1) == mqttSubackFailure)
+	assert.Assert(t, client.subscribe(t, "devices/def-456", 1) == mqttSubackFailure)
+	assert.Assert(t, client.subscribe(t, "devices/abc-123/#", 1) == 1)
+
+	wildcard, returnCode := connectMQTTTestClient(t, service.Addr().String(), newMQTTTestConnect("+"))
+	defer wildcard.conn.Close()
+	assert.Assert(t, returnCode == mqttConnackIdentifierRejected)
+
+	connect := newMQTTTestConnect("def-456")
+	connect.will = &mqttPublishPacket{topic: "devices/abc-123", payload: []byte("offline")}
+
+	impostor, returnCode := connectMQTTTestClient(t, service.Addr().String(), connect)
+	defer impostor.conn.Close()
+	assert.Assert(t, returnCode == mqttConnackNotAuthorized)
+
+	// No negative acknowledgement in MQTT 3.1.1, the connection is closed
+	client.write((&mqttPublishPacket{topic: "devices/def-456", payload: []byte("off")}).encode())
+
+	client.conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := readMQTTPacket(client.reader, 1024)
+	assert.Assert(t, err != nil)
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Assert(t, service.ActiveConnectionsCount() == 0)
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
+
+func TestMQTTSessionTakeoverShouldRequireAuthentication(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, shutdownService := startMQTTBroker(t, eventBus)
+
+	device, _ := connectMQTTTestClient(t, service.Addr().String(), newMQTTTestConnect("abc-123"))
+	defer device.conn.Close()
+
+	impostor, returnCode := connectMQTTTestClient(t, service.Addr().String(), newMQTTTestConnect("abc-123"))
+	defer impostor.conn.Close()
+
+	assert.Assert(t, returnCode == mqttConnackIdentifierRejected)
+
+	device.write(mqttPacket{packetType: mqttPingreq})
+	assert.Assert(t, device.read(t).packetType == mqttPingresp)
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+
+	service, shutdownService = startMQTTBroker(t, eventBus, func(service *MQTTBrokerService) {
+		service.Authenticate = func(clientID, username string, password []byte) bool {
+			return username == clientID && string(password) == "secret"
+		}
+	})
+
+	connect := newMQTTTestConnect("abc-123")
+	connect.username = "abc-123"
+	connect.password = []byte("secret")
+
+	device, returnCode = connectMQTTTestClient(t, service.Addr().String(), connect)
+	defer device.conn.Close()
+	assert.Assert(t, returnCode == mqttConnackAccepted)
+
+	connect.password = []byte("guess")
+	impostor, returnCode = connectMQTTTestClient(t, service.Addr().String(), connect)
+	defer impostor.conn.Close()
+	assert.Assert(t, returnCode == mqttConnackBadCredentials)
+
+	connect.password = []byte("secret")
+	reconnected, returnCode := connectMQTTTestClient(t, service.Addr().String(), connect)
+	defer reconnected.conn.Close()
+	assert.Assert(t, returnCode == mqttConnackAccepted)
+
+	// The previous connection was taken over
+	device.conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := readMQTTPacket(device.reader, 1024)
+	assert.Assert(t, err != nil)
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
+
+func TestMQTTUnacknowledgedMessagesShouldBeSentAgain(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, shutdownService := startMQTTBroker(t, eventBus, func(service *MQTTBrokerService) {
+		service.RetryInterval = 1
+	})
+
+	client, _ := connectMQTTTestClient(t, service.Addr().String(), newMQTTTestConnect("abc-123"))
+	defer client.conn.Close()
+
+	client.subscribe(t, service.DeviceTopic("abc-123"), 1)
+
+	go eventBus.Publish(events.SendToDeviceTopic("abc-123"), events.NewMessage([]byte("on"), "", events.Command))
+
+	first, err := parseMQTTPublish(client.read(t))
+	assert.NilError(t, err)
+	assert.Assert(t, !first.dup)
+
+	client.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	packet, err := readMQTTPacket(client.reader, 1024*1024)
+	assert.NilError(t, err)
+
+	retransmitted, err := parseMQTTPublish(packet)
+	assert.NilError(t, err)
+	assert.Assert(t, retransmitted.dup)
+	assert.Assert(t, retransmitted.packetID == first.packetID)
+	assert.DeepEqual(t, retransmitted.payload, first.payload)
+
+	client.write(newMQTTPacketWithID(mqttPuback, 0, first.packetID))
+
+	// Acknowledged, it is not sent again
+	client.conn.SetReadDeadline(time.Now().Add(1500 * time.Millisecond))
+	_, err = readMQTTPacket(client.reader, 1024*1024)
+	assert.Assert(t, err != nil)
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
@@ -0,0 +1,305 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nnset/iot-cloud-connector/bus"
+	"github.com/nnset/iot-cloud-connector/events"
+)
+
+// ServerSentEventsStatusService Streams Cloud Connector status changes to browsers
+// using Server Sent Events, see /cloud-connector/status/stream at docs/default-cloud-connector-api.md
+//
+// The service holds a single subscription per topic on the eventBus and fans out every
+// message to all connected clients. Each client has its own buffer, a client that can not
+// keep up is disconnected, so it may reconnect and resume using the Last-Event-ID header,
+// as long as the missed events are still in the history window.
+//
+// If ListenAddress is empty no HTTP server is started, mount the service on your own
+// server instead (i.e. DefaultCloudConnectorAPIService.Handle).
+type ServerSentEventsStatusService struct {
+	ListenAddress     string
+	ClientBufferSize  int
+	HistorySize       int
+	HeartbeatInterval int // Seconds
+	id                string
+	eventBus          bus.MessageBus
+	server            *http.Server
+	serviceIsShutdown chan bool
+	shutdownService   chan bool
+	serviceIsStopping chan struct{}
+	topicsChannels    map[string]*chan events.Message
+	clients           map[*serverSentEventsClient]bool
+	history           []serverSentEvent
+	lastEventID       uint64
+	clientsMutex      sync.Mutex
+}
+
+type serverSentEvent struct {
+	id   uint64
+	name string
+	data string
+}
+
+type serverSentEventsClient struct {
+	events chan serverSentEvent
+}
+
+type systemStatusEventData struct {
+	Metric string `json:"metric"`
+	Value  string `json:"value"`
+}
+
+// systemStatusMetrics Maps metric topics to the metric name used by /cloud-connector/status
+var systemStatusMetrics = map[string]string{
+	events.SystemMetricsNumGoRoutinesTopic:   "go_routines",
+	events.SystemMetricsAllocatedMemoryTopic: "allocated_memory",
+}
+
+// connectionsEventNames Maps connection topics to the event name sent to clients
+var connectionsEventNames = map[string]string{
+	events.ConnectionEstablishedTopic: "connection_established",
+	events.ConnectionClosedTopic:      "connection_closed",
+}
+
+// NewServerSentEventsStatusService Creates a new instance of ServerSentEventsStatusService
+func NewServerSentEventsStatusService(
+	eventBus bus.MessageBus,
+	listenAddress string,
+) *ServerSentEventsStatusService {
+	return &ServerSentEventsStatusService{
+		id:             uuid.New().String(),
+		eventBus:       eventBus,
+		ListenAddress:  listenAddress,
+		topicsChannels: make(map[string]*chan events.Message),
+		clients:        make(map[*serverSentEventsClient]bool),
+	}
+}
+
+func (service *ServerSentEventsStatusService) Id() string {
+	return service.id
+}
+
+func (service *ServerSentEventsStatusService) Init(shutdownService chan bool) error {
+	service.shutdownService = shutdownService
+	service.serviceIsShutdown = make(chan bool)
+	service.serviceIsStopping = make(chan struct{})
+
+	if service.ClientBufferSize == 0 {
+		service.ClientBufferSize = 64
+	}
+
+	if service.HistorySize == 0 {
+		service.HistorySize = 100
+	}
+
+	if service.HeartbeatInterval == 0 {
+		service.HeartbeatInterval = 15
+	}
+
+	for topic := range systemStatusMetrics {
+		service.subscribe(topic)
+	}
+
+	for topic := range connectionsEventNames {
+		service.subscribe(topic)
+	}
+
+	if service.ListenAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/cloud-connector/status/stream", service)
+
+		service.server = &http.Server{Addr: service.ListenAddress, Handler: mux}
+	}
+
+	return nil
+}
+
+func (service *ServerSentEventsStatusService) Start() {
+	if service.server != nil {
+		go service.server.ListenAndServe()
+	}
+
+	wg := sync.WaitGroup{}
+
+	for topic, channel := range service.topicsChannels {
+		wg.Add(1)
+
+		go func(topic string, channel *chan events.Message) {
+			defer wg.Done()
+
+			for {
+				select {
+				case m := <-*channel:
+					service.broadcast(topic, m)
+				case <-service.serviceIsStopping:
+					return
+				}
+			}
+		}(topic, channel)
+	}
+
+	<-service.shutdownService
+
+	close(service.serviceIsStopping)
+	wg.Wait()
+
+	for topic, channel := range service.topicsChannels {
+		unsubscribeAndDrain(service.eventBus, topic, channel)
+	}
+
+	if service.server != nil {
+		service.server.Close()
+	}
+
+	service.serviceIsShutdown <- true
+}
+
+func (service *ServerSentEventsStatusService) ShutdownChannel() chan bool {
+	return service.serviceIsShutdown
+}
+
+// ConnectedClients How many clients are currently listening to the stream
+func (service *ServerSentEventsStatusService) ConnectedClients() int {
+	service.clientsMutex.Lock()
+	defer service.clientsMutex.Unlock()
+
+	return len(service.clients)
+}
+
+// ServeHTTP GET /cloud-connector/status/stream
+func (service *ServerSentEventsStatusService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	client, missedEvents := service.addClient(r.Header.Get("Last-Event-ID"))
+	defer service.removeClient(client)
+
+	for _, event := range missedEvents {
+		writeServerSentEvent(w, event)
+	}
+
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(time.Duration(service.HeartbeatInterval) * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, open := <-client.events:
+			if !open {
+				return
+			}
+
+			writeServerSentEvent(w, event)
+			flusher.Flush()
+
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return
+
+		case <-service.serviceIsStopping:
+			return
+		}
+	}
+}
+
+func (service *ServerSentEventsStatusService) subscribe(topic string) {
+	channel := make(chan events.Message)
+
+	service.topicsChannels[topic] = &channel
+	service.eventBus.Subscribe(topic, &channel)
+}
+
+// addClient Registers a new client and returns the events it missed since lastEventID.
+// Both things happen while holding the lock, so no event is lost between them.
+func (service *ServerSentEventsStatusService) addClient(lastEventID string) (*serverSentEventsClient, []serverSentEvent) {
+	service.clientsMutex.Lock()
+	defer service.clientsMutex.Unlock()
+
+	client := &serverSentEventsClient{events: make(chan serverSentEvent, service.ClientBufferSize)}
+	service.clients[client] = true
+
+	missedEvents := []serverSentEvent{}
+
+	if id, err := strconv.ParseUint(lastEventID, 10, 64); err == nil {
+		for _, event := range service.history {
+			if event.id > id {
+				missedEvents = append(missedEvents, event)
+			}
+		}
+	}
+
+	return client, missedEvents
+}
+
+func (service *ServerSentEventsStatusService) removeClient(client *serverSentEventsClient) {
+	service.clientsMutex.Lock()
+	defer service.clientsMutex.Unlock()
+
+	delete(service.clients, client)
+}
+
+func (service *ServerSentEventsStatusService) broadcast(topic string, message events.Message) {
+	event, err := service.toServerSentEvent(topic, message)
+
+	if err != nil {
+		return
+	}
+
+	service.clientsMutex.Lock()
+	defer service.clientsMutex.Unlock()
+
+	service.lastEventID++
+	event.id = service.lastEventID
+
+	service.history = append(service.history, event)
+
+	if len(service.history) > service.HistorySize {
+		service.history = service.history[len(service.history)-service.HistorySize:]
+	}
+
+	for client := range service.clients {
+		select {
+		case client.events <- event:
+		default:
+			// Slow client, disconnect it so it can resume using Last-Event-ID
+			close(client.events)
+			delete(service.clients, client)
+		}
+	}
+}
+
+func (service *ServerSentEventsStatusService) toServerSentEvent(topic string, message events.Message) (serverSentEvent, error) {
+	if metric, ok := systemStatusMetrics[topic]; ok {
+		data, err := json.Marshal(systemStatusEventData{metric, string(message.Payload)})
+
+		return serverSentEvent{name: "system_status", data: string(data)}, err
+	}
+
+	data, err := json.Marshal(message)
+
+	return serverSentEvent{name: connectionsEventNames[topic], data: string(data)}, err
+}
+
+func writeServerSentEvent(w http.ResponseWriter, event serverSentEvent) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.id, event.name, event.data)
+}
@@ -0,0 +1,135 @@
+package services
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/bus"
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+func readServerSentEvent(t *testing.T, reader *bufio.Reader) map[string]string {
+	event := make(map[string]string)
+
+	for {
+		line, err := reader.ReadString('\n')
+		assert.NilError(t, err)
+
+		line = strings.TrimSuffix(line, "\n")
+
+		if line == "" {
+			return event
+		}
+
+		if parts := strings.SplitN(line, ": ", 2); len(parts) == 2 {
+			event[parts[0]] = parts[1]
+		}
+	}
+}
+
+func TestServerSentEventsStatusServiceShouldStreamSystemMetrics(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	shutdownService := make(chan bool)
+
+	service := NewServerSentEventsStatusService(eventBus, "")
+	service.Init(shutdownService)
+	go service.Start()
+
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	assert.NilError(t, err)
+	defer response.Body.Close()
+
+	assert.Assert(t, response.Header.Get("Content-Type") == "text/event-stream")
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Assert(t, service.ConnectedClients() == 1)
+
+	eventBus.Publish(events.SystemMetricsNumGoRoutinesTopic, events.NewMessage([]byte("17"), "localhost", events.Default))
+
+	event := readServerSentEvent(t, bufio.NewReader(response.Body))
+
+	assert.Assert(t, event["id"] == "1")
+	assert.Assert(t, event["event"] == "system_status")
+	assert.Assert(t, event["data"] == "{\"metric\":\"go_routines\",\"value\":\"17\"}")
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
+
+func TestServerSentEventsStatusServiceShouldResumeFromLastEventID(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	shutdownService := make(chan bool)
+
+	service := NewServerSentEventsStatusService(eventBus, "")
+	service.Init(shutdownService)
+	go service.Start()
+
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	listener, err := http.Get(server.URL)
+	assert.NilError(t, err)
+	defer listener.Body.Close()
+
+	time.Sleep(20 * time.Millisecond)
+
+	// Each topic has its own subscription queue, wait for every event so ids follow publishing order
+	listenerEvents := bufio.NewReader(listener.Body)
+
+	eventBus.Publish(events.SystemMetricsNumGoRoutinesTopic, events.NewMessage([]byte("17"), "localhost", events.Default))
+	assert.Assert(t, readServerSentEvent(t, listenerEvents)["id"] == "1")
+
+	eventBus.Publish(events.SystemMetricsAllocatedMemoryTopic, events.NewMessage([]byte("4"), "localhost", events.Default))
+	assert.Assert(t, readServerSentEvent(t, listenerEvents)["id"] == "2")
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	request.Header.Set("Last-Event-ID", "1")
+
+	response, err := http.DefaultClient.Do(request)
+	assert.NilError(t, err)
+	defer response.Body.Close()
+
+	event := readServerSentEvent(t, bufio.NewReader(response.Body))
+
+	assert.Assert(t, event["id"] == "2")
+	assert.Assert(t, event["data"] == "{\"metric\":\"allocated_memory\",\"value\":\"4\"}")
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
+
+func TestServerSentEventsStatusServiceShouldForgetClientsThatWentAway(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	shutdownService := make(chan bool)
+
+	service := NewServerSentEventsStatusService(eventBus, "")
+	service.Init(shutdownService)
+	go service.Start()
+
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	assert.NilError(t, err)
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Assert(t, service.ConnectedClients() == 1)
+
+	response.Body.Close()
+
+	time.Sleep(500 * time.Millisecond)
+	assert.Assert(t, service.ConnectedClients() == 0)
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+
+	assert.Assert(t, eventBus.TotalSubscriptions == 0)
+}
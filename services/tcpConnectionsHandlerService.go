@@ -0,0 +1,253 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nnset/iot-cloud-connector/bus"
+	"github.com/nnset/iot-cloud-connector/events"
+)
+
+// TCPConnectionsHandlerService Accepts IoT devices connections over plain TCP, for
+// devices that can not afford WebSocket or TLS stacks.
+//
+// Each line is a JSON frame. The first frame is the handshake, a JSON payload as expected
+// by entities.NewConnectionFromDefaultPayload, i.e. {"device_id": "abc-123"}. Any other
+// frame is published on MessageReceivedTopic, and every message published on
+// events.SendToDeviceTopic(deviceID) is written to the device as a JSON encoded
+// events.Message followed by a new line.
+type TCPConnectionsHandlerService struct {
+	ListenAddress     string
+	HandshakeTimeout  int // Seconds
+	ReadTimeout       int // Seconds, devices must send at least one frame within this time
+	WriteTimeout      int // Seconds
+	MaxFrameSize      int // Bytes
+	id                string
+	eventBus          bus.MessageBus
+	listener          net.Listener
+	serviceIsShutdown chan bool
+	shutdownService   chan bool
+	sessions          map[string]*tcpDeviceSession
+	sessionsMutex     sync.Mutex
+	sessionsWaitGroup sync.WaitGroup
+	isShuttingDown    bool
+}
+
+type tcpDeviceSession struct {
+	*deviceSession
+	conn net.Conn
+}
+
+// tcpTransport deviceTransport implementation
+type tcpTransport struct {
+	conn         net.Conn
+	writeTimeout time.Duration
+	writeMutex   sync.Mutex
+}
+
+func (transport *tcpTransport) Send(message events.Message) error {
+	frame, err := json.Marshal(message)
+
+	if err != nil {
+		return err
+	}
+
+	transport.writeMutex.Lock()
+	defer transport.writeMutex.Unlock()
+
+	transport.conn.SetWriteDeadline(time.Now().Add(transport.writeTimeout))
+
+	_, err = transport.conn.Write(append(frame, '\n'))
+
+	return err
+}
+
+// NewTCPConnectionsHandlerService Creates a new instance of TCPConnectionsHandlerService
+func NewTCPConnectionsHandlerService(
+	eventBus bus.MessageBus,
+	listenAddress string,
+) *TCPConnectionsHandlerService {
+	return &TCPConnectionsHandlerService{
+		id:            uuid.New().String(),
+		eventBus:      eventBus,
+		ListenAddress: listenAddress,
+		sessions:      make(map[string]*tcpDeviceSession),
+	}
+}
+
+func (service *TCPConnectionsHandlerService) Id() string {
+	return service.id
+}
+
+func (service *TCPConnectionsHandlerService) Init(shutdownService chan bool) error {
+	service.shutdownService = shutdownService
+	service.serviceIsShutdown = make(chan bool)
+
+	if service.HandshakeTimeout == 0 {
+		service.HandshakeTimeout = 5
+	}
+
+	if service.ReadTimeout == 0 {
+		service.ReadTimeout = 60
+	}
+
+	if service.WriteTimeout == 0 {
+		service.WriteTimeout = 10
+	}
+
+	if service.MaxFrameSize == 0 {
+		service.MaxFrameSize = 4 * 1024
+	}
+
+	listener, err := net.Listen("tcp", service.ListenAddress)
+
+	if err != nil {
+		return err
+	}
+
+	service.listener = listener
+
+	return nil
+}
+
+func (service *TCPConnectionsHandlerService) Start() {
+	go service.acceptConnections()
+
+	<-service.shutdownService
+
+	service.sessionsMutex.Lock()
+	service.isShuttingDown = true
+	service.listener.Close()
+
+	for _, session := range service.sessions {
+		session.conn.Close()
+	}
+	service.sessionsMutex.Unlock()
+
+	service.sessionsWaitGroup.Wait()
+
+	service.serviceIsShutdown <- true
+}
+
+func (service *TCPConnectionsHandlerService) ShutdownChannel() chan bool {
+	return service.serviceIsShutdown
+}
+
+// Addr Address the service is listening on, useful when ListenAddress port is 0
+func (service *TCPConnectionsHandlerService) Addr() net.Addr {
+	return service.listener.Addr()
+}
+
+// ActiveConnectionsCount How many devices are currently connected to this handler
+func (service *TCPConnectionsHandlerService) ActiveConnectionsCount() int {
+	service.sessionsMutex.Lock()
+	defer service.sessionsMutex.Unlock()
+
+	return len(service.sessions)
+}
+
+func (service *TCPConnectionsHandlerService) acceptConnections() {
+	for {
+		conn, err := service.listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		go service.handleConnection(conn)
+	}
+}
+
+func (service *TCPConnectionsHandlerService) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	// Scanner's max token size is the larger of its initial buffer capacity and MaxFrameSize
+	scanner.Buffer(make([]byte, 0, service.MaxFrameSize), service.MaxFrameSize)
+
+	conn.SetReadDeadline(time.Now().Add(time.Duration(service.HandshakeTimeout) * time.Second))
+
+	if !scanner.Scan() {
+		return
+	}
+
+	session, err := service.openSession(conn, append([]byte{}, scanner.Bytes()...))
+
+	if err != nil {
+		return
+	}
+
+	defer service.closeSession(session)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Duration(service.ReadTimeout) * time.Second))
+
+		if !scanner.Scan() {
+			// EOF, timeout or frame bigger than MaxFrameSize
+			return
+		}
+
+		frame := scanner.Bytes()
+
+		if len(frame) == 0 || !json.Valid(frame) {
+			continue
+		}
+
+		// Scanner reuses its buffer
+		session.MessageReceived(append([]byte{}, frame...), "", nil)
+	}
+}
+
+func (service *TCPConnectionsHandlerService) openSession(conn net.Conn, registrationPayload []byte) (*tcpDeviceSession, error) {
+	transport := &tcpTransport{conn: conn, writeTimeout: time.Duration(service.WriteTimeout) * time.Second}
+
+	// Newline delimited frames leave no room to negotiate binary codecs
+	deviceSession, err := newDeviceSession(
+		service.eventBus, transport, events.JSONCodec{}, registrationPayload, conn.RemoteAddr().String(),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	service.sessionsMutex.Lock()
+
+	if service.isShuttingDown {
+		service.sessionsMutex.Unlock()
+		return nil, errServiceIsShuttingDown
+	}
+
+	if _, alreadyConnected := service.sessions[deviceSession.Connection.DeviceID]; alreadyConnected {
+		service.sessionsMutex.Unlock()
+		return nil, errDeviceAlreadyConnected
+	}
+
+	session := &tcpDeviceSession{deviceSession, conn}
+	service.sessions[deviceSession.Connection.DeviceID] = session
+	service.sessionsWaitGroup.Add(1)
+
+	service.sessionsMutex.Unlock()
+
+	if err := deviceSession.Open(); err != nil {
+		service.closeSession(session)
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func (service *TCPConnectionsHandlerService) closeSession(session *tcpDeviceSession) {
+	service.sessionsMutex.Lock()
+	delete(service.sessions, session.Connection.DeviceID)
+	notify := !service.isShuttingDown
+	service.sessionsMutex.Unlock()
+
+	session.Close(notify)
+	session.conn.Close()
+
+	service.sessionsWaitGroup.Done()
+}
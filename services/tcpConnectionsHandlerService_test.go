@@ -0,0 +1,128 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/bus"
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+func startTCPConnectionsHandler(t *testing.T, eventBus *bus.InMemoryEventBus) (*TCPConnectionsHandlerService, chan bool) {
+	shutdownService := make(chan bool)
+
+	service := NewTCPConnectionsHandlerService(eventBus, "127.0.0.1:0")
+	service.MaxFrameSize = 64
+	assert.NilError(t, service.Init(shutdownService))
+	go service.Start()
+
+	return service, shutdownService
+}
+
+func TestTCPHandshakeShouldPublishConnectionEstablished(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, shutdownService := startTCPConnectionsHandler(t, eventBus)
+
+	established := make(chan events.Message)
+	eventBus.Subscribe(events.ConnectionEstablishedTopic, &established)
+
+	conn, err := net.Dial("tcp", service.Addr().String())
+	assert.NilError(t, err)
+	defer conn.Close()
+
+	conn.Write([]byte("{\"device_id\": \"abc-123\"}\n"))
+
+	m := waitForMessage(t, established)
+
+	assert.Assert(t, string(m.Payload) == "{\"device_id\": \"abc-123\"}")
+	assert.Assert(t, m.OriginRemoteAddress == conn.LocalAddr().String())
+	assert.Assert(t, service.ActiveConnectionsCount() == 1)
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
+
+func TestTCPFramesShouldBeExchangedThroughTheBus(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, shutdownService := startTCPConnectionsHandler(t, eventBus)
+
+	received := make(chan events.Message)
+	closed := make(chan events.Message)
+	eventBus.Subscribe(events.MessageReceivedTopic, &received)
+	eventBus.Subscribe(events.ConnectionClosedTopic, &closed)
+
+	conn, err := net.Dial("tcp", service.Addr().String())
+	assert.NilError(t, err)
+
+	conn.Write([]byte("{\"device_id\": \"abc-123\"}\nnot json\n{\"temperature\": 21}\n"))
+
+	m := waitForMessage(t, received)
+	assert.Assert(t, string(m.Payload) == "{\"temperature\": 21}")
+	assert.Assert(t, m.OriginRemoteAddress == conn.LocalAddr().String())
+
+	go eventBus.Publish(events.SendToDeviceTopic("abc-123"), events.NewMessage([]byte("on"), "", events.Command))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.NilError(t, err)
+
+	var command events.Message
+	json.Unmarshal([]byte(line), &command)
+	assert.Assert(t, string(command.Payload) == "on")
+
+	conn.Close()
+
+	assert.Assert(t, string(waitForMessage(t, closed).Payload) == "{\"device_id\": \"abc-123\"}")
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
+
+func TestTCPFramesBiggerThanMaxFrameSizeShouldCloseTheConnection(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, shutdownService := startTCPConnectionsHandler(t, eventBus)
+
+	conn, err := net.Dial("tcp", service.Addr().String())
+	assert.NilError(t, err)
+
+	conn.Write([]byte("{\"device_id\": \"abc-123\"}\n"))
+	conn.Write([]byte("{\"data\": \"" + strings.Repeat("x", 100) + "\"}\n"))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+
+	assert.Assert(t, err != nil)
+	assert.Assert(t, service.ActiveConnectionsCount() == 0)
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
+
+func TestTCPFramesSequenceShouldBeSetAsHeader(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, shutdownService := startTCPConnectionsHandler(t, eventBus)
+
+	received := make(chan events.Message)
+	eventBus.Subscribe(events.MessageReceivedTopic, &received)
+
+	conn, err := net.Dial("tcp", service.Addr().String())
+	assert.NilError(t, err)
+	defer conn.Close()
+
+	conn.Write([]byte("{\"device_id\": \"abc-123\"}\n{\"sequence\": 42}\n{\"sequence\": 9007199254740993}\n"))
+
+	m := waitForMessage(t, received)
+	assert.Assert(t, m.Header(events.SequenceHeader) == "42")
+
+	// Above 2^53, float64 would round it
+	m = waitForMessage(t, received)
+	assert.Assert(t, m.Header(events.SequenceHeader) == "9007199254740993")
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
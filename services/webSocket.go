@@ -0,0 +1,338 @@
+package services
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal RFC 6455 server side implementation, just what a connections handler needs:
+// handshake, masked client frames, fragmentation, ping/pong and close.
+
+const (
+	webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	webSocketContinuationFrame = 0x0
+	webSocketTextFrame         = 0x1
+	webSocketBinaryFrame       = 0x2
+	webSocketCloseFrame        = 0x8
+	webSocketPingFrame         = 0x9
+	webSocketPongFrame         = 0xA
+
+	webSocketCloseNormal           = 1000
+	webSocketCloseGoingAway        = 1001
+	webSocketClosePolicyViolation  = 1008
+	webSocketCloseMessageTooBig    = 1009
+	webSocketCloseProtocolError    = 1002
+	webSocketMaxControlPayloadSize = 125
+)
+
+var errWebSocketClosed = errors.New("websocket connection closed")
+
+type webSocketConn struct {
+	conn           net.Conn
+	reader         *bufio.Reader
+	writeMutex     sync.Mutex
+	maxMessageSize int64
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+}
+
+// upgradeToWebSocket Performs the opening handshake and hijacks the HTTP connection.
+// subprotocol, if not empty, must be one of the subprotocols requested by the client.
+func upgradeToWebSocket(
+	w http.ResponseWriter,
+	r *http.Request,
+	maxMessageSize int64,
+	subprotocol string,
+) (*webSocketConn, error) {
+	if r.Method != http.MethodGet ||
+		!headerContainsToken(r.Header, "Connection", "upgrade") ||
+		!headerContainsToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Not a websocket handshake", http.StatusBadRequest)
+		return nil, errors.New("not a websocket handshake")
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported websocket version")
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+
+	if !ok {
+		http.Error(w, "Websocket unsupported", http.StatusInternalServerError)
+		return nil, errors.New("http.ResponseWriter does not implement http.Hijacker")
+	}
+
+	conn, buffer, err := hijacker.Hijack()
+
+	if err != nil {
+		return nil, err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAcceptKey(key) + "\r\n"
+
+	if subprotocol != "" {
+		response += "Sec-WebSocket-Protocol: " + subprotocol + "\r\n"
+	}
+
+	response += "\r\n"
+
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &webSocketConn{
+		conn:           conn,
+		reader:         buffer.Reader,
+		maxMessageSize: maxMessageSize,
+		writeTimeout:   10 * time.Second,
+	}, nil
+}
+
+func webSocketAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + webSocketGUID))
+
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, t := range headerTokens(header, name) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// headerTokens Comma separated values of all the name headers, in order.
+func headerTokens(header http.Header, name string) []string {
+	tokens := []string{}
+
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tokens = append(tokens, t)
+			}
+		}
+	}
+
+	return tokens
+}
+
+// ReadMessage Blocks until a complete text or binary message is received. Control
+// frames are handled internally.
+func (ws *webSocketConn) ReadMessage() (int, []byte, error) {
+	var message []byte
+	messageOpcode := -1
+
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case webSocketPingFrame:
+			if err := ws.writeFrame(webSocketPongFrame, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+
+		case webSocketPongFrame:
+			continue
+
+		case webSocketCloseFrame:
+			ws.writeFrame(webSocketCloseFrame, payload)
+			return 0, nil, errWebSocketClosed
+
+		case webSocketTextFrame, webSocketBinaryFrame:
+			if messageOpcode != -1 {
+				ws.Close(webSocketCloseProtocolError, "expected continuation frame")
+				return 0, nil, errors.New("expected continuation frame")
+			}
+			messageOpcode = opcode
+
+		case webSocketContinuationFrame:
+			if messageOpcode == -1 {
+				ws.Close(webSocketCloseProtocolError, "unexpected continuation frame")
+				return 0, nil, errors.New("unexpected continuation frame")
+			}
+
+		default:
+			ws.Close(webSocketCloseProtocolError, "unknown opcode")
+			return 0, nil, errors.New("unknown opcode")
+		}
+
+		if int64(len(message)+len(payload)) > ws.maxMessageSize {
+			ws.Close(webSocketCloseMessageTooBig, "message too big")
+			return 0, nil, errors.New("message too big")
+		}
+
+		message = append(message, payload...)
+
+		if fin {
+			return messageOpcode, message, nil
+		}
+	}
+}
+
+func (ws *webSocketConn) readFrame() (bool, int, []byte, error) {
+	if ws.readTimeout > 0 {
+		ws.conn.SetReadDeadline(time.Now().Add(ws.readTimeout))
+	}
+
+	header := make([]byte, 2)
+
+	if _, err := io.ReadFull(ws.reader, header); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := int(header[0] & 0x0F)
+	masked := header[1]&0x80 != 0
+	length := int64(header[1] & 0x7F)
+
+	if !masked {
+		ws.Close(webSocketCloseProtocolError, "client frames must be masked")
+		return false, 0, nil, errors.New("client frames must be masked")
+	}
+
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+
+		if _, err := io.ReadFull(ws.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+
+		length = int64(binary.BigEndian.Uint16(extended))
+
+	case 127:
+		extended := make([]byte, 8)
+
+		if _, err := io.ReadFull(ws.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+
+		length = int64(binary.BigEndian.Uint64(extended))
+	}
+
+	if opcode >= webSocketCloseFrame && (length > webSocketMaxControlPayloadSize || !fin) {
+		ws.Close(webSocketCloseProtocolError, "invalid control frame")
+		return false, 0, nil, errors.New("invalid control frame")
+	}
+
+	if length < 0 || length > ws.maxMessageSize {
+		ws.Close(webSocketCloseMessageTooBig, "message too big")
+		return false, 0, nil, errors.New("message too big")
+	}
+
+	mask := make([]byte, 4)
+
+	if _, err := io.ReadFull(ws.reader, mask); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// WriteText Sends a text message to the client.
+func (ws *webSocketConn) WriteText(payload []byte) error {
+	return ws.writeFrame(webSocketTextFrame, payload)
+}
+
+// WriteBinary Sends a binary message to the client.
+func (ws *webSocketConn) WriteBinary(payload []byte) error {
+	return ws.writeFrame(webSocketBinaryFrame, payload)
+}
+
+// Ping Sends a ping control frame to the client.
+func (ws *webSocketConn) Ping() error {
+	return ws.writeFrame(webSocketPingFrame, nil)
+}
+
+func (ws *webSocketConn) writeFrame(opcode int, payload []byte) error {
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+
+	frame := []byte{0x80 | byte(opcode)}
+	length := len(payload)
+
+	switch {
+	case length <= 125:
+		frame = append(frame, byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+
+	ws.conn.SetWriteDeadline(time.Now().Add(ws.writeTimeout))
+
+	_, err := ws.conn.Write(append(frame, payload...))
+
+	return err
+}
+
+// SetReadTimeout Every frame must be received within timeout, zero means no timeout.
+func (ws *webSocketConn) SetReadTimeout(timeout time.Duration) {
+	ws.readTimeout = timeout
+}
+
+// RemoteAddr See net.Conn
+func (ws *webSocketConn) RemoteAddr() net.Addr {
+	return ws.conn.RemoteAddr()
+}
+
+// Close Sends a close frame with the given status code and reason and closes the
+// underlying connection.
+func (ws *webSocketConn) Close(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+
+	if len(payload) > webSocketMaxControlPayloadSize {
+		payload = payload[:webSocketMaxControlPayloadSize]
+	}
+
+	ws.writeFrame(webSocketCloseFrame, payload)
+
+	return ws.conn.Close()
+}
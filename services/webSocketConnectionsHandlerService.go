@@ -0,0 +1,285 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nnset/iot-cloud-connector/bus"
+	"github.com/nnset/iot-cloud-connector/events"
+)
+
+// WebSocketConnectionsHandlerService Accepts IoT devices connections over WebSocket.
+//
+// The first message a device sends is the handshake, a payload as expected by
+// entities.NewConnectionFromMessage, i.e. {"device_id": "abc-123"}. After that every
+// message received is published on MessageReceivedTopic, and every message published on
+// events.SendToDeviceTopic(deviceID) is sent to the device as an encoded events.Message.
+//
+// Devices pick the codec requesting its name (json, cbor, msgpack) as WebSocket subprotocol,
+// the first supported one is used. Without subprotocol messages are sent as JSON and the
+// content type of received payloads is only set when they are valid JSON. Binary codecs
+// messages are sent as binary frames.
+//
+// If ListenAddress is empty no HTTP server is started, mount the service on your own
+// server instead.
+type WebSocketConnectionsHandlerService struct {
+	ListenAddress     string
+	Path              string
+	HandshakeTimeout  int // Seconds
+	PingInterval      int // Seconds
+	MaxMessageSize    int64
+	id                string
+	eventBus          bus.MessageBus
+	server            *http.Server
+	serviceIsShutdown chan bool
+	shutdownService   chan bool
+	sessions          map[string]*webSocketDeviceSession
+	sessionsMutex     sync.Mutex
+	sessionsWaitGroup sync.WaitGroup
+	isShuttingDown    bool
+}
+
+type webSocketDeviceSession struct {
+	*deviceSession
+	ws *webSocketConn
+}
+
+// webSocketTransport deviceTransport implementation
+type webSocketTransport struct {
+	ws    *webSocketConn
+	codec events.Codec // nil if no subprotocol was negotiated
+}
+
+func (transport *webSocketTransport) Send(message events.Message) error {
+	if transport.codec == nil {
+		frame, err := json.Marshal(message)
+
+		if err != nil {
+			return err
+		}
+
+		return transport.ws.WriteText(frame)
+	}
+
+	frame, err := transport.codec.Marshal(message)
+
+	if err != nil {
+		return err
+	}
+
+	if transport.codec.ContentType() == events.JSONContentType {
+		return transport.ws.WriteText(frame)
+	}
+
+	return transport.ws.WriteBinary(frame)
+}
+
+// NewWebSocketConnectionsHandlerService Creates a new instance of WebSocketConnectionsHandlerService
+func NewWebSocketConnectionsHandlerService(
+	eventBus bus.MessageBus,
+	listenAddress string,
+) *WebSocketConnectionsHandlerService {
+	return &WebSocketConnectionsHandlerService{
+		id:            uuid.New().String(),
+		eventBus:      eventBus,
+		ListenAddress: listenAddress,
+		sessions:      make(map[string]*webSocketDeviceSession),
+	}
+}
+
+func (service *WebSocketConnectionsHandlerService) Id() string {
+	return service.id
+}
+
+func (service *WebSocketConnectionsHandlerService) Init(shutdownService chan bool) error {
+	service.shutdownService = shutdownService
+	service.serviceIsShutdown = make(chan bool)
+
+	if service.Path == "" {
+		service.Path = "/ws"
+	}
+
+	if service.HandshakeTimeout == 0 {
+		service.HandshakeTimeout = 5
+	}
+
+	if service.PingInterval == 0 {
+		service.PingInterval = 30
+	}
+
+	if service.MaxMessageSize == 0 {
+		service.MaxMessageSize = 64 * 1024
+	}
+
+	if service.ListenAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle(service.Path, service)
+
+		service.server = &http.Server{Addr: service.ListenAddress, Handler: mux}
+	}
+
+	return nil
+}
+
+func (service *WebSocketConnectionsHandlerService) Start() {
+	if service.server != nil {
+		go service.server.ListenAndServe()
+	}
+
+	<-service.shutdownService
+
+	if service.server != nil {
+		service.server.Close()
+	}
+
+	service.sessionsMutex.Lock()
+	service.isShuttingDown = true
+
+	for _, session := range service.sessions {
+		session.ws.Close(webSocketCloseGoingAway, "server shutdown")
+	}
+	service.sessionsMutex.Unlock()
+
+	service.sessionsWaitGroup.Wait()
+
+	service.serviceIsShutdown <- true
+}
+
+func (service *WebSocketConnectionsHandlerService) ShutdownChannel() chan bool {
+	return service.serviceIsShutdown
+}
+
+// ActiveConnectionsCount How many devices are currently connected to this handler
+func (service *WebSocketConnectionsHandlerService) ActiveConnectionsCount() int {
+	service.sessionsMutex.Lock()
+	defer service.sessionsMutex.Unlock()
+
+	return len(service.sessions)
+}
+
+// ServeHTTP Upgrades the request to a WebSocket connection and handles it until the
+// device disconnects.
+func (service *WebSocketConnectionsHandlerService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var codec events.Codec
+	subprotocol := ""
+
+	for _, requested := range headerTokens(r.Header, "Sec-WebSocket-Protocol") {
+		if negotiated, exists := events.CodecByName(requested); exists {
+			codec = negotiated
+			subprotocol = requested
+			break
+		}
+	}
+
+	ws, err := upgradeToWebSocket(w, r, service.MaxMessageSize, subprotocol)
+
+	if err != nil {
+		return
+	}
+
+	ws.SetReadTimeout(time.Duration(service.HandshakeTimeout) * time.Second)
+
+	_, registrationPayload, err := ws.ReadMessage()
+
+	if err != nil {
+		ws.Close(webSocketClosePolicyViolation, "handshake expected")
+		return
+	}
+
+	session, err := service.openSession(ws, codec, registrationPayload, r.RemoteAddr)
+
+	if err != nil {
+		ws.Close(webSocketClosePolicyViolation, err.Error())
+		return
+	}
+
+	defer service.closeSession(session)
+
+	ws.SetReadTimeout(2 * time.Duration(service.PingInterval) * time.Second)
+
+	stopPinging := make(chan struct{})
+	defer close(stopPinging)
+
+	go service.keepAlive(ws, stopPinging)
+
+	for {
+		_, payload, err := ws.ReadMessage()
+
+		if err != nil {
+			return
+		}
+
+		session.MessageReceived(payload, "", nil)
+	}
+}
+
+func (service *WebSocketConnectionsHandlerService) openSession(
+	ws *webSocketConn,
+	codec events.Codec,
+	registrationPayload []byte,
+	remoteAddress string,
+) (*webSocketDeviceSession, error) {
+	deviceSession, err := newDeviceSession(
+		service.eventBus, &webSocketTransport{ws, codec}, codec, registrationPayload, remoteAddress,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	service.sessionsMutex.Lock()
+
+	if service.isShuttingDown {
+		service.sessionsMutex.Unlock()
+		return nil, errServiceIsShuttingDown
+	}
+
+	if _, alreadyConnected := service.sessions[deviceSession.Connection.DeviceID]; alreadyConnected {
+		service.sessionsMutex.Unlock()
+		return nil, errDeviceAlreadyConnected
+	}
+
+	session := &webSocketDeviceSession{deviceSession, ws}
+	service.sessions[deviceSession.Connection.DeviceID] = session
+	service.sessionsWaitGroup.Add(1)
+
+	service.sessionsMutex.Unlock()
+
+	if err := deviceSession.Open(); err != nil {
+		service.closeSession(session)
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func (service *WebSocketConnectionsHandlerService) closeSession(session *webSocketDeviceSession) {
+	service.sessionsMutex.Lock()
+	delete(service.sessions, session.Connection.DeviceID)
+	notify := !service.isShuttingDown
+	service.sessionsMutex.Unlock()
+
+	session.Close(notify)
+	session.ws.Close(webSocketCloseNormal, "")
+
+	service.sessionsWaitGroup.Done()
+}
+
+func (service *WebSocketConnectionsHandlerService) keepAlive(ws *webSocketConn, stop chan struct{}) {
+	ticker := time.NewTicker(time.Duration(service.PingInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if ws.Ping() != nil {
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
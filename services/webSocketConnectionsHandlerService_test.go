@@ -0,0 +1,243 @@
+package services
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nnset/iot-cloud-connector/bus"
+	"github.com/nnset/iot-cloud-connector/events"
+	"gotest.tools/assert"
+)
+
+// Mocks
+
+type webSocketTestClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, serverURL string, subprotocols ...string) *webSocketTestClient {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(serverURL, "http://"))
+	assert.NilError(t, err)
+
+	key := make([]byte, 16)
+	rand.Read(key)
+
+	request, _ := http.NewRequest(http.MethodGet, serverURL, nil)
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	request.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+
+	if len(subprotocols) > 0 {
+		request.Header.Set("Sec-WebSocket-Protocol", strings.Join(subprotocols, ", "))
+	}
+
+	request.Write(conn)
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	assert.NilError(t, err)
+	assert.Assert(t, response.StatusCode == http.StatusSwitchingProtocols)
+	assert.Assert(t, response.Header.Get("Sec-WebSocket-Accept") == webSocketAcceptKey(request.Header.Get("Sec-WebSocket-Key")))
+
+	return &webSocketTestClient{conn, reader}
+}
+
+func (client *webSocketTestClient) writeText(payload string) {
+	client.writeFrame(webSocketTextFrame, []byte(payload))
+}
+
+func (client *webSocketTestClient) writeFrame(opcode byte, payload []byte) {
+	frame := []byte{0x80 | opcode}
+
+	if len(payload) <= 125 {
+		frame = append(frame, 0x80|byte(len(payload)))
+	} else {
+		frame = append(frame, 0x80|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	}
+
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+
+	client.conn.Write(frame)
+}
+
+func (client *webSocketTestClient) readFrame(t *testing.T) (int, []byte) {
+	client.conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	header := make([]byte, 2)
+	_, err := io.ReadFull(client.reader, header)
+	assert.NilError(t, err)
+
+	length := int(header[1] & 0x7F)
+
+	if length == 126 {
+		extended := make([]byte, 2)
+		io.ReadFull(client.reader, extended)
+		length = int(binary.BigEndian.Uint16(extended))
+	}
+
+	payload := make([]byte, length)
+	io.ReadFull(client.reader, payload)
+
+	return int(header[0] & 0x0F), payload
+}
+
+func startWebSocketConnectionsHandler(eventBus *bus.InMemoryEventBus) (*WebSocketConnectionsHandlerService, *httptest.Server, chan bool) {
+	shutdownService := make(chan bool)
+
+	service := NewWebSocketConnectionsHandlerService(eventBus, "")
+	service.Init(shutdownService)
+	go service.Start()
+
+	return service, httptest.NewServer(service), shutdownService
+}
+
+func waitForMessage(t *testing.T, channel chan events.Message) events.Message {
+	select {
+	case m := <-channel:
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("message was not received")
+	}
+
+	return events.Message{}
+}
+
+func TestWebSocketHandshakeShouldPublishConnectionEstablished(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, server, shutdownService := startWebSocketConnectionsHandler(eventBus)
+	defer server.Close()
+
+	established := make(chan events.Message)
+	eventBus.Subscribe(events.ConnectionEstablishedTopic, &established)
+
+	client := dialWebSocket(t, server.URL)
+	client.writeText("{\"device_id\": \"abc-123\"}")
+
+	m := waitForMessage(t, established)
+
+	assert.Assert(t, string(m.Payload) == "{\"device_id\": \"abc-123\"}")
+	assert.Assert(t, service.ActiveConnectionsCount() == 1)
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+
+	assert.Assert(t, service.ActiveConnectionsCount() == 0)
+}
+
+func TestWebSocketInvalidHandshakeShouldCloseTheConnection(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, server, shutdownService := startWebSocketConnectionsHandler(eventBus)
+	defer server.Close()
+
+	client := dialWebSocket(t, server.URL)
+	client.writeText("{\"dummy\": \"hello\"}")
+
+	opcode, payload := client.readFrame(t)
+
+	assert.Assert(t, opcode == webSocketCloseFrame)
+	assert.Assert(t, binary.BigEndian.Uint16(payload) == webSocketClosePolicyViolation)
+	assert.Assert(t, service.ActiveConnectionsCount() == 0)
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
+
+func TestWebSocketMessagesShouldBeExchangedThroughTheBus(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, server, shutdownService := startWebSocketConnectionsHandler(eventBus)
+	defer server.Close()
+
+	received := make(chan events.Message)
+	sent := make(chan events.Message)
+	closed := make(chan events.Message)
+	eventBus.Subscribe(events.MessageReceivedTopic, &received)
+	eventBus.Subscribe(events.MessageSentTopic, &sent)
+	eventBus.Subscribe(events.ConnectionClosedTopic, &closed)
+
+	client := dialWebSocket(t, server.URL)
+	client.writeText("{\"device_id\": \"abc-123\"}")
+
+	time.Sleep(20 * time.Millisecond)
+
+	client.writeText("{\"temperature\": 21}")
+
+	m := waitForMessage(t, received)
+	assert.Assert(t, string(m.Payload) == "{\"temperature\": 21}")
+	assert.Assert(t, m.MessagType == events.Default)
+
+	go eventBus.Publish(events.SendToDeviceTopic("abc-123"), events.NewMessage([]byte("on"), "", events.Command))
+
+	_, frame := client.readFrame(t)
+
+	var command events.Message
+	json.Unmarshal(frame, &command)
+
+	assert.Assert(t, string(command.Payload) == "on")
+	assert.Assert(t, command.MessagType == events.Command)
+	assert.Assert(t, string(waitForMessage(t, sent).Payload) == "on")
+
+	client.conn.Close()
+
+	assert.Assert(t, string(waitForMessage(t, closed).Payload) == "{\"device_id\": \"abc-123\"}")
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}
+
+func TestWebSocketSubprotocolShouldSelectTheCodec(t *testing.T) {
+	eventBus, _ := bus.NewInMemoryEventBus()
+	service, server, shutdownService := startWebSocketConnectionsHandler(eventBus)
+	defer server.Close()
+
+	established := make(chan events.Message)
+	received := make(chan events.Message)
+	eventBus.Subscribe(events.ConnectionEstablishedTopic, &established)
+	eventBus.Subscribe(events.MessageReceivedTopic, &received)
+
+	client := dialWebSocket(t, server.URL, "mqtt", "cbor", "json")
+
+	registration, _ := events.CBORCodec{}.Marshal(map[string]string{"device_id": "abc-123"})
+	client.writeFrame(webSocketBinaryFrame, registration)
+
+	m := waitForMessage(t, established)
+	assert.Assert(t, m.DeviceID == "abc-123")
+	assert.Assert(t, m.ContentType == events.CBORContentType)
+
+	reading, _ := events.CBORCodec{}.Marshal(map[string]float64{"temperature": 21.5})
+	client.writeFrame(webSocketBinaryFrame, reading)
+
+	m = waitForMessage(t, received)
+	assert.DeepEqual(t, m.Payload, reading)
+	assert.Assert(t, m.ContentType == events.CBORContentType)
+
+	go eventBus.Publish(events.SendToDeviceTopic("abc-123"), events.NewMessage([]byte("on"), "", events.Command))
+
+	opcode, frame := client.readFrame(t)
+
+	var command events.Message
+	assert.NilError(t, events.CBORCodec{}.Unmarshal(frame, &command))
+
+	assert.Assert(t, opcode == webSocketBinaryFrame)
+	assert.Assert(t, string(command.Payload) == "on")
+
+	shutdownService <- true
+	<-service.ShutdownChannel()
+}